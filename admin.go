@@ -0,0 +1,233 @@
+package infrared
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	adminPathServers = "/servers"
+	adminPathHealth  = "/health"
+
+	// adminMaxBodySize is the largest proxy config that can be registered in bytes
+	adminMaxBodySize = 1 << 20
+	adminTimeout     = 10 * time.Second
+	adminIdleTimeout = time.Minute
+)
+
+// ErrAdminTokenRequired is returned when the admin API is enabled without a token
+var ErrAdminTokenRequired = errors.New("admin API requires a token")
+
+// AdminServer is an HTTP API to register and remove proxies of a gateway at runtime.
+//
+//	GET    /servers       lists all proxies with their number of players
+//	POST   /servers       registers a proxy from a proxy config in the body
+//	DELETE /servers/{uid} closes the proxy with uid
+//	GET    /health        reports if the gateway is running
+type AdminServer struct {
+	Gateway *Gateway
+
+	// Token has to be sent as bearer token with every request to /servers.
+	// Requests to /servers are refused if it is empty.
+	Token string
+}
+
+// AdminProxy is a proxy as listed by the AdminServer
+type AdminProxy struct {
+	UID         string   `json:"uid"`
+	DomainNames []string `json:"domainNames"`
+	ListenTo    string   `json:"listenTo"`
+	ProxyTo     string   `json:"proxyTo"`
+	Players     int      `json:"players"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+type adminHealth struct {
+	Status string `json:"status"`
+}
+
+func (admin *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == adminPathHealth:
+		admin.handleHealth(w, r)
+	case r.URL.Path == adminPathServers, strings.HasPrefix(r.URL.Path, adminPathServers+"/"):
+		if !admin.authorized(r) {
+			writeAdminJSON(w, http.StatusUnauthorized, adminError{Error: "unauthorized"})
+			return
+		}
+		admin.handleServers(w, r)
+	default:
+		writeAdminJSON(w, http.StatusNotFound, adminError{Error: "not found"})
+	}
+}
+
+func (admin *AdminServer) authorized(r *http.Request) bool {
+	if admin.Token == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(admin.Token)) == 1
+}
+
+func (admin *AdminServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	admin.Gateway.mu.Lock()
+	closed := admin.Gateway.closed
+	admin.Gateway.mu.Unlock()
+
+	if closed {
+		writeAdminJSON(w, http.StatusServiceUnavailable, adminHealth{Status: "closed"})
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, adminHealth{Status: "ok"})
+}
+
+func (admin *AdminServer) handleServers(w http.ResponseWriter, r *http.Request) {
+	uid := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, adminPathServers), "/")
+	if uid != "" {
+		if r.Method != http.MethodDelete {
+			writeMethodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		admin.deleteServer(w, uid)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, admin.Gateway.adminProxies())
+	case http.MethodPost:
+		admin.postServer(w, r)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (admin *AdminServer) postServer(w http.ResponseWriter, r *http.Request) {
+	cfg := DefaultProxyConfig()
+	r.Body = http.MaxBytesReader(w, r.Body, adminMaxBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{Error: "invalid proxy config: " + err.Error()})
+		return
+	}
+	if cfg.ProxyTo == "" && len(cfg.Servers) == 0 {
+		writeAdminJSON(w, http.StatusBadRequest, adminError{Error: "invalid proxy config: proxyTo or servers is required"})
+		return
+	}
+
+	proxy := &Proxy{Config: &cfg}
+	if err := admin.Gateway.RegisterProxyIfAbsent(proxy); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrProxyExists) {
+			status = http.StatusConflict
+		}
+		writeAdminJSON(w, status, adminError{Error: err.Error()})
+		return
+	}
+
+	log.Println("Registered proxy with UID", proxy.UID(), "through the admin API")
+	writeAdminJSON(w, http.StatusCreated, newAdminProxy(proxy))
+}
+
+func (admin *AdminServer) deleteServer(w http.ResponseWriter, uid string) {
+	if _, ok := admin.Gateway.proxies.Load(uid); !ok {
+		writeAdminJSON(w, http.StatusNotFound, adminError{Error: "proxy " + uid + " not found"})
+		return
+	}
+
+	admin.Gateway.CloseProxy(uid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminProxies returns every registered proxy once, sorted by UID
+func (gateway *Gateway) adminProxies() []AdminProxy {
+	seen := map[*Proxy]bool{}
+	proxies := []AdminProxy{}
+	gateway.proxies.Range(func(k, v interface{}) bool {
+		proxy := v.(*Proxy)
+		if !seen[proxy] {
+			seen[proxy] = true
+			proxies = append(proxies, newAdminProxy(proxy))
+		}
+		return true
+	})
+
+	sort.Slice(proxies, func(i, j int) bool {
+		return proxies[i].UID < proxies[j].UID
+	})
+	return proxies
+}
+
+func newAdminProxy(proxy *Proxy) AdminProxy {
+	return AdminProxy{
+		UID:         proxy.UID(),
+		DomainNames: proxy.DomainNames(),
+		ListenTo:    proxy.ListenTo(),
+		ProxyTo:     proxy.ProxyTo(),
+		Players:     proxy.PlayerCount(),
+	}
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeAdminJSON(w, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+}
+
+func writeAdminJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("[w] Failed to write admin API response; error:", err)
+	}
+}
+
+// EnableAdminAPI serves the AdminServer of the gateway on bind.
+// The token has to be sent as bearer token with every request to /servers;
+// it fails with ErrAdminTokenRequired if token is empty.
+func (gateway *Gateway) EnableAdminAPI(bind, token string) error {
+	if token == "" {
+		return ErrAdminTokenRequired
+	}
+
+	gateway.wg.Add(1)
+
+	go func() {
+		defer gateway.wg.Done()
+
+		admin := &AdminServer{
+			Gateway: gateway,
+			Token:   token,
+		}
+		srv := &http.Server{
+			Addr:              bind,
+			Handler:           admin,
+			ReadHeaderTimeout: adminTimeout,
+			ReadTimeout:       adminTimeout,
+			WriteTimeout:      adminTimeout,
+			IdleTimeout:       adminIdleTimeout,
+		}
+		if err := srv.ListenAndServe(); err != nil {
+			log.Println("[x] Admin API exited; error:", err)
+		}
+	}()
+
+	log.Println("Enabling admin API on", bind)
+	return nil
+}
@@ -0,0 +1,286 @@
+package infrared
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAdminServer(t *testing.T) {
+	portEnd := 634
+	gateway := &Gateway{}
+	defer gateway.Close()
+	admin := &AdminServer{Gateway: gateway, Token: "secret"}
+
+	proxyUID := proxyUID("infrared", gatewayAddr(portEnd))
+	proxyCfg, err := json.Marshal(map[string]interface{}{
+		"domainName": "infrared",
+		"listenTo":   gatewayAddr(portEnd),
+		"proxyTo":    serverAddr(portEnd),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The requests share the gateway and run in order
+	tt := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		token          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Health",
+			method:         http.MethodGet,
+			path:           "/health",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"status":"ok"}`,
+		},
+		{
+			name:           "Unauthorized",
+			method:         http.MethodGet,
+			path:           "/servers",
+			token:          "wrong",
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   `{"error":"unauthorized"}`,
+		},
+		{
+			name:           "ListEmpty",
+			method:         http.MethodGet,
+			path:           "/servers",
+			token:          "secret",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `[]`,
+		},
+		{
+			name:           "RegisterInvalidJSON",
+			method:         http.MethodPost,
+			path:           "/servers",
+			body:           `{`,
+			token:          "secret",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "RegisterWithoutProxyTo",
+			method:         http.MethodPost,
+			path:           "/servers",
+			body:           `{"domainName":"infrared"}`,
+			token:          "secret",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"error":"invalid proxy config: proxyTo or servers is required"}`,
+		},
+		{
+			name:           "Register",
+			method:         http.MethodPost,
+			path:           "/servers",
+			body:           string(proxyCfg),
+			token:          "secret",
+			expectedStatus: http.StatusCreated,
+			expectedBody:   `{"uid":"` + proxyUID + `","domainNames":["infrared"],"listenTo":"` + gatewayAddr(portEnd) + `","proxyTo":"` + serverAddr(portEnd) + `","players":0}`,
+		},
+		{
+			name:           "RegisterTwice",
+			method:         http.MethodPost,
+			path:           "/servers",
+			body:           string(proxyCfg),
+			token:          "secret",
+			expectedStatus: http.StatusConflict,
+			expectedBody:   `{"error":"proxy already exists: ` + proxyUID + `"}`,
+		},
+		{
+			name:           "List",
+			method:         http.MethodGet,
+			path:           "/servers",
+			token:          "secret",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `[{"uid":"` + proxyUID + `","domainNames":["infrared"],"listenTo":"` + gatewayAddr(portEnd) + `","proxyTo":"` + serverAddr(portEnd) + `","players":0}]`,
+		},
+		{
+			name:           "MethodNotAllowed",
+			method:         http.MethodPut,
+			path:           "/servers",
+			token:          "secret",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "Deregister",
+			method:         http.MethodDelete,
+			path:           "/servers/" + proxyUID,
+			token:          "secret",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "DeregisterTwice",
+			method:         http.MethodDelete,
+			path:           "/servers/" + proxyUID,
+			token:          "secret",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `{"error":"proxy ` + proxyUID + ` not found"}`,
+		},
+		{
+			name:           "ListAfterDeregister",
+			method:         http.MethodGet,
+			path:           "/servers",
+			token:          "secret",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `[]`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, r)
+
+			if w.Code != tc.expectedStatus {
+				t.Errorf("got: %d; want: %d", w.Code, tc.expectedStatus)
+			}
+			if body := strings.TrimSpace(w.Body.String()); tc.expectedBody != "" && body != tc.expectedBody {
+				t.Errorf("got: %v; want: %v", body, tc.expectedBody)
+			}
+		})
+	}
+}
+
+func TestAdminServer_HealthAfterClose(t *testing.T) {
+	gateway := &Gateway{}
+	gateway.Close()
+	admin := &AdminServer{Gateway: gateway}
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got: %d; want: %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != `{"status":"closed"}` {
+		t.Errorf("got: %v; want: %v", body, `{"status":"closed"}`)
+	}
+}
+
+func TestAdminServer_ConcurrentRegister(t *testing.T) {
+	portEnd := 660
+	gateway := &Gateway{}
+	defer gateway.Close()
+	admin := &AdminServer{Gateway: gateway, Token: "secret"}
+
+	proxyCfg := `{"domainName":"infrared","listenTo":"` + gatewayAddr(portEnd) + `","proxyTo":"` + serverAddr(portEnd) + `"}`
+
+	// Only one of the requests for the same proxy may register it
+	requests := 16
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/servers", strings.NewReader(proxyCfg))
+			r.Header.Set("Authorization", "Bearer secret")
+			admin.ServeHTTP(w, r)
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Errorf("got: %d; want: %d or %d", code, http.StatusCreated, http.StatusConflict)
+		}
+	}
+	if created != 1 {
+		t.Errorf("got: %d created; want: %d", created, 1)
+	}
+}
+
+func TestAdminServer_Authorization(t *testing.T) {
+	tt := []struct {
+		name           string
+		token          string
+		authorization  string
+		expectedStatus int
+	}{
+		{
+			name:           "BearerToken",
+			token:          "secret",
+			authorization:  "Bearer secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "TokenWithoutScheme",
+			token:          "secret",
+			authorization:  "secret",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "WrongToken",
+			token:          "secret",
+			authorization:  "Bearer secreT",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "NoTokenConfigured",
+			authorization:  "Bearer ",
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			admin := &AdminServer{Gateway: &Gateway{}, Token: tc.token}
+			r := httptest.NewRequest(http.MethodGet, "/servers", nil)
+			r.Header.Set("Authorization", tc.authorization)
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, r)
+
+			if w.Code != tc.expectedStatus {
+				t.Errorf("got: %d; want: %d", w.Code, tc.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestAdminServer_BodyTooLarge(t *testing.T) {
+	gateway := &Gateway{}
+	defer gateway.Close()
+	admin := &AdminServer{Gateway: gateway, Token: "secret"}
+
+	body := `{"domainName":"` + strings.Repeat("a", adminMaxBodySize) + `","proxyTo":"localhost:25565"}`
+	r := httptest.NewRequest(http.MethodPost, "/servers", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got: %d; want: %d", w.Code, http.StatusBadRequest)
+	}
+	if proxies := gateway.adminProxies(); len(proxies) != 0 {
+		t.Errorf("got: %v; want: no proxies", proxies)
+	}
+}
+
+func TestGateway_EnableAdminAPI_RequiresToken(t *testing.T) {
+	gateway := &Gateway{}
+	defer gateway.Close()
+
+	if err := gateway.EnableAdminAPI("localhost:0", ""); !errors.Is(err, ErrAdminTokenRequired) {
+		t.Errorf("got: %v; want: %v", err, ErrAdminTokenRequired)
+	}
+}
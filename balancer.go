@@ -0,0 +1,97 @@
+package infrared
+
+import "sync"
+
+// Strategies to pick one of the servers of a proxy
+const (
+	// BalancingRoundRobin lets the servers take turns by weight
+	BalancingRoundRobin = "roundRobin"
+	// BalancingLeastConnections picks the server with the fewest players per weight
+	BalancingLeastConnections = "leastConnections"
+)
+
+// WeightedRoundRobin distributes addresses proportionally to their weights.
+// It uses the smooth weighted round-robin algorithm known from Nginx so that
+// servers with a high weight are interleaved with the others instead of being
+// picked in bursts. It is safe for concurrent use.
+type WeightedRoundRobin struct {
+	mu      sync.Mutex
+	servers []*weightedServer
+}
+
+type weightedServer struct {
+	addr    string
+	weight  int
+	current int
+}
+
+// Add adds addr with the given weight or updates the weight if addr was already added.
+// Weights smaller than one are treated as one.
+func (wrr *WeightedRoundRobin) Add(addr string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+
+	for _, server := range wrr.servers {
+		if server.addr == addr {
+			server.weight = weight
+			return
+		}
+	}
+
+	wrr.servers = append(wrr.servers, &weightedServer{
+		addr:   addr,
+		weight: weight,
+	})
+}
+
+// Remove removes addr
+func (wrr *WeightedRoundRobin) Remove(addr string) {
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+
+	for i, server := range wrr.servers {
+		if server.addr == addr {
+			wrr.servers = append(wrr.servers[:i], wrr.servers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Next returns the next address or false if no address was added
+func (wrr *WeightedRoundRobin) Next() (string, bool) {
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+
+	var best *weightedServer
+	total := 0
+	for _, server := range wrr.servers {
+		server.current += server.weight
+		total += server.weight
+		if best == nil || server.current > best.current {
+			best = server
+		}
+	}
+
+	if best == nil {
+		return "", false
+	}
+
+	best.current -= total
+	return best.addr, true
+}
+
+// Weights returns the added addresses with their weights
+func (wrr *WeightedRoundRobin) Weights() map[string]int {
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+
+	weights := make(map[string]int, len(wrr.servers))
+	for _, server := range wrr.servers {
+		weights[server.addr] = server.weight
+	}
+	return weights
+}
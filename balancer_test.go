@@ -0,0 +1,100 @@
+package infrared
+
+import (
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestWeightedRoundRobin_Next(t *testing.T) {
+	tt := []struct {
+		name    string
+		weights map[string]int
+		remove  string
+	}{
+		{
+			name:    "EqualWeights",
+			weights: map[string]int{"a:25565": 1, "b:25565": 1},
+		},
+		{
+			name:    "UnequalWeights",
+			weights: map[string]int{"a:25565": 5, "b:25565": 3, "c:25565": 2},
+		},
+		{
+			name:    "Removed",
+			weights: map[string]int{"a:25565": 5, "b:25565": 3, "c:25565": 2},
+			remove:  "b:25565",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var wrr WeightedRoundRobin
+			for addr, weight := range tc.weights {
+				wrr.Add(addr, weight)
+			}
+
+			totalWeight := 0
+			for addr, weight := range tc.weights {
+				if addr != tc.remove {
+					totalWeight += weight
+				}
+			}
+			wrr.Remove(tc.remove)
+
+			calls := 1000
+			counts := map[string]int{}
+			for i := 0; i < calls; i++ {
+				addr, ok := wrr.Next()
+				if !ok {
+					t.Fatal("got no address")
+				}
+				counts[addr]++
+			}
+
+			if counts[tc.remove] > 0 {
+				t.Errorf("got: %d calls to removed %s; want: 0", counts[tc.remove], tc.remove)
+			}
+
+			for addr, weight := range tc.weights {
+				if addr == tc.remove {
+					continue
+				}
+				want := float64(weight) / float64(totalWeight)
+				got := float64(counts[addr]) / float64(calls)
+				if math.Abs(got-want) > 0.02 {
+					t.Errorf("%s got: %.3f; want: %.3f", addr, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWeightedRoundRobin_Empty(t *testing.T) {
+	var wrr WeightedRoundRobin
+	if addr, ok := wrr.Next(); ok {
+		t.Errorf("got: %v; want: no address", addr)
+	}
+}
+
+func TestWeightedRoundRobin_Concurrent(t *testing.T) {
+	var wrr WeightedRoundRobin
+	wrr.Add("a:25565", 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			wrr.Add("b:25565", 2)
+			wrr.Remove("b:25565")
+		}()
+		go func() {
+			defer wg.Done()
+			if _, ok := wrr.Next(); !ok {
+				t.Error("got no address")
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,84 @@
+package infrared
+
+import (
+	"strings"
+	"sync"
+)
+
+// BanStore decides which players are not allowed to log in.
+// UUIDs are 32 hex digits without dashes.
+type BanStore interface {
+	// Banned returns the reason of the ban if the player with name or uuid is banned
+	Banned(name, uuid string) (reason string, banned bool)
+}
+
+// MemoryBanStore is a BanStore that keeps its bans in memory.
+// Names are case insensitive like Minecraft usernames.
+type MemoryBanStore struct {
+	mu    sync.RWMutex
+	names map[string]string
+	uuids map[string]string
+}
+
+func NewMemoryBanStore() *MemoryBanStore {
+	return &MemoryBanStore{
+		names: map[string]string{},
+		uuids: map[string]string{},
+	}
+}
+
+// BanName bans the player with name. The reason is sent as disconnect message
+// and supports the same placeholders as the disconnect message of a proxy.
+func (store *MemoryBanStore) BanName(name, reason string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.names[strings.ToLower(name)] = reason
+}
+
+// BanUUID bans the player with uuid. Dashes in uuid are ignored.
+func (store *MemoryBanStore) BanUUID(uuid, reason string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.uuids[normalizeUUID(uuid)] = reason
+}
+
+func (store *MemoryBanStore) UnbanName(name string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.names, strings.ToLower(name))
+}
+
+func (store *MemoryBanStore) UnbanUUID(uuid string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.uuids, normalizeUUID(uuid))
+}
+
+func (store *MemoryBanStore) Banned(name, uuid string) (string, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if reason, ok := store.names[strings.ToLower(name)]; ok {
+		return reason, true
+	}
+
+	reason, ok := store.uuids[normalizeUUID(uuid)]
+	return reason, ok
+}
+
+func normalizeUUID(uuid string) string {
+	return strings.ToLower(strings.Replace(uuid, "-", "", -1))
+}
+
+// banReason peeks the login start of conn and returns the reason if the player is banned.
+// The login start only holds the name of the player, so the player is looked up
+// with the UUID an offline mode server would assign.
+func banReason(conn Conn, bans BanStore) (string, bool, error) {
+	loginStart, err := peekLoginStart(conn)
+	if err != nil {
+		return "", false, err
+	}
+
+	reason, banned := bans.Banned(string(loginStart.Name), loginStart.OfflineUUID())
+	return reason, banned, nil
+}
@@ -0,0 +1,75 @@
+package infrared
+
+import (
+	"testing"
+
+	"github.com/haveachin/infrared/protocol/login"
+)
+
+func TestMemoryBanStore_Banned(t *testing.T) {
+	store := NewMemoryBanStore()
+	store.BanName("Notch", "griefing")
+	store.BanUUID("069a79f4-44e9-4726-a5be-fca90e38aaf5", "cheating")
+
+	tt := []struct {
+		name       string
+		playerName string
+		uuid       string
+		reason     string
+		banned     bool
+	}{
+		{
+			name:       "Name",
+			playerName: "Notch",
+			reason:     "griefing",
+			banned:     true,
+		},
+		{
+			name:       "NameIgnoresCase",
+			playerName: "nOTCH",
+			reason:     "griefing",
+			banned:     true,
+		},
+		{
+			name:       "UUIDWithoutDashes",
+			playerName: "Steve",
+			uuid:       "069a79f444e94726a5befca90e38aaf5",
+			reason:     "cheating",
+			banned:     true,
+		},
+		{
+			name:       "NotBanned",
+			playerName: "Alex",
+			uuid:       login.ServerLoginStart{Name: "Alex"}.OfflineUUID(),
+			banned:     false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			reason, banned := store.Banned(tc.playerName, tc.uuid)
+			if banned != tc.banned {
+				t.Errorf("got: %v; want: %v", banned, tc.banned)
+			}
+			if reason != tc.reason {
+				t.Errorf("got: %v; want: %v", reason, tc.reason)
+			}
+		})
+	}
+}
+
+func TestMemoryBanStore_Unban(t *testing.T) {
+	store := NewMemoryBanStore()
+	store.BanName("Notch", "griefing")
+	store.BanUUID("069a79f444e94726a5befca90e38aaf5", "griefing")
+
+	store.UnbanName("notch")
+	if _, banned := store.Banned("Notch", ""); banned {
+		t.Error("name is still banned after unban")
+	}
+
+	store.UnbanUUID("069a79f4-44e9-4726-a5be-fca90e38aaf5")
+	if _, banned := store.Banned("", "069a79f444e94726a5befca90e38aaf5"); banned {
+		t.Error("uuid is still banned after unban")
+	}
+}
@@ -3,10 +3,14 @@ package callback
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 )
 
+// retryDelay is the delay before the first retry; it doubles with every retry
+var retryDelay = 500 * time.Millisecond
+
 // HTTPClient represents an interface for the Logger to log events with.
 type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
@@ -33,6 +37,10 @@ type Logger struct {
 
 	URL    string
 	Events []string
+	// Timeout limits every request if it is greater than zero
+	Timeout time.Duration
+	// Retries is the number of times a failed request is retried
+	Retries int
 }
 
 func (logger Logger) isValid() bool {
@@ -53,9 +61,10 @@ func (logger Logger) hasEvent(event Event) bool {
 
 // LogEvent posts the given event to an http endpoint if the Logger
 // holds a valid URL and the Logger.Events contains given event's type.
+// Requests that fail or are not answered with a 2xx status are retried.
 func (logger Logger) LogEvent(event Event) (*EventLog, error) {
 	if logger.client == nil {
-		logger.client = http.DefaultClient
+		logger.client = &http.Client{Timeout: logger.Timeout}
 	}
 
 	if !logger.isValid() {
@@ -72,15 +81,36 @@ func (logger Logger) LogEvent(event Event) (*EventLog, error) {
 		return nil, err
 	}
 
+	delay := retryDelay
+	for retry := 0; ; retry++ {
+		err = logger.post(bb)
+		if err == nil {
+			return &eventLog, nil
+		}
+		if retry >= logger.Retries {
+			return nil, err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (logger Logger) post(bb []byte) error {
 	request, err := http.NewRequest(http.MethodPost, logger.URL, bytes.NewReader(bb))
 	if err != nil {
-		return nil, err
+		return err
 	}
+	request.Header.Set("Content-Type", "application/json")
 
-	_, err = logger.client.Do(request)
+	response, err := logger.client.Do(request)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer response.Body.Close()
 
-	return &eventLog, nil
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("callback server responded with status %s", response.Status)
+	}
+	return nil
 }
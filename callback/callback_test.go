@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestLogger_IsValid(t *testing.T) {
@@ -101,7 +104,7 @@ func (mock *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
 		mock.Error(err)
 	}
 
-	return nil, nil
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
 }
 
 func TestLogger_LogEvent(t *testing.T) {
@@ -157,3 +160,63 @@ func TestLogger_LogEvent(t *testing.T) {
 		}
 	}
 }
+
+func TestLogger_LogEventRetries(t *testing.T) {
+	retryDelay = time.Millisecond
+
+	tt := []struct {
+		name         string
+		retries      int
+		failures     int
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{
+			name:         "NoFailures",
+			retries:      2,
+			failures:     0,
+			wantAttempts: 1,
+		},
+		{
+			name:         "SucceedsOnRetry",
+			retries:      2,
+			failures:     2,
+			wantAttempts: 3,
+		},
+		{
+			name:         "RetriesExhausted",
+			retries:      1,
+			failures:     2,
+			wantAttempts: 2,
+			wantErr:      true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) <= int32(tc.failures) {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}))
+			defer server.Close()
+
+			logger := Logger{
+				URL:     server.URL,
+				Events:  []string{EventTypeError},
+				Timeout: time.Second,
+				Retries: tc.retries,
+			}
+
+			_, err := logger.LogEvent(ErrorEvent{Error: "my error message"})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got: %v; want error: %v", err, tc.wantErr)
+			}
+
+			if got := atomic.LoadInt32(&attempts); got != tc.wantAttempts {
+				t.Errorf("got: %d attempts; want: %d", got, tc.wantAttempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package infrared
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haveachin/infrared/protocol"
+)
+
+// captureMagic starts every capture and carries the version of the format in its last byte.
+// After it, every packet is written as
+//   - the time it was captured as big-endian Unix nanoseconds (8 bytes)
+//   - its CaptureDirection (1 byte), with capturePiped set for piped data
+//   - the length of its raw bytes as big-endian uint32 (4 bytes)
+//   - its raw bytes, which are the uncompressed packet with its length prefix or the piped data
+var captureMagic = []byte("IRCAP\x01")
+
+// capturePiped marks the direction of records that hold piped data instead of a packet
+const capturePiped = 0x80
+
+// maxCapturedPacketLength is the largest record ReadCapture accepts.
+// A packet and its length prefix are never longer and piped data is captured in smaller chunks.
+const maxCapturedPacketLength = protocol.MaxPacketLength + 5
+
+// captureQueueLength is the number of records a capture can fall behind before it stops
+const captureQueueLength = 256
+
+// DefaultCaptureMaxBytes is the size that a capture file stops at if no other size is configured
+const DefaultCaptureMaxBytes = 64 << 20
+
+// ErrInvalidCapture is returned by ReadCapture for data that isn't a capture
+var ErrInvalidCapture = errors.New("invalid capture")
+
+// CaptureDirection tells if a captured packet was read or written by the connection
+type CaptureDirection byte
+
+const (
+	// CaptureInbound packets were read from the connection
+	CaptureInbound CaptureDirection = iota + 1
+	// CaptureOutbound packets were written to the connection
+	CaptureOutbound
+)
+
+func (d CaptureDirection) String() string {
+	switch d {
+	case CaptureInbound:
+		return "inbound"
+	case CaptureOutbound:
+		return "outbound"
+	default:
+		return fmt.Sprintf("CaptureDirection(%d)", byte(d))
+	}
+}
+
+// CapturedPacket is a packet of a capture
+type CapturedPacket struct {
+	Time      time.Time
+	Direction CaptureDirection
+	// Piped data was relayed after the login as it was sent over the connection,
+	// so it may be compressed or split in the middle of a packet
+	Piped bool
+	// Data is the uncompressed packet with its length prefix as protocol.Packet.Marshal returns it
+	// or the piped data
+	Data []byte
+}
+
+// Packet unmarshals the raw bytes of the captured packet
+func (cp CapturedPacket) Packet() (protocol.Packet, error) {
+	if cp.Piped {
+		return protocol.Packet{}, errors.New("piped data is not a packet")
+	}
+	return protocol.ReadPacket(bytes.NewReader(cp.Data))
+}
+
+// CapturingConn is a Conn that writes every packet it reads or writes to a capture.
+// Packets are captured after decompression, so a capture can be replayed without compression.
+// Peeked packets are captured once they are read. Data piped after the login is captured
+// through Tap. Records are written to the capture in the background, so a slow capture
+// never slows down the connection; the capture stops instead if it falls too far behind.
+type CapturingConn struct {
+	Conn
+
+	mu      sync.Mutex
+	records chan []byte
+	closed  bool
+	err     error
+
+	once sync.Once
+	done chan struct{}
+}
+
+// NewCapturingConn wraps c and writes the start of the capture to w.
+// A failed write to w stops the capture but leaves the connection working.
+func NewCapturingConn(c Conn, w io.Writer) (*CapturingConn, error) {
+	if _, err := w.Write(captureMagic); err != nil {
+		return nil, err
+	}
+
+	cc := &CapturingConn{
+		Conn:    c,
+		records: make(chan []byte, captureQueueLength),
+		done:    make(chan struct{}),
+	}
+	go cc.run(w)
+	return cc, nil
+}
+
+func (c *CapturingConn) run(w io.Writer) {
+	defer close(c.done)
+	for record := range c.records {
+		if c.Err() != nil {
+			continue
+		}
+		if _, err := w.Write(record); err != nil {
+			c.mu.Lock()
+			c.stop(err)
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *CapturingConn) ReadPacket() (protocol.Packet, error) {
+	pk, err := c.Conn.ReadPacket()
+	if err != nil {
+		return pk, err
+	}
+	c.capturePacket(CaptureInbound, pk)
+	return pk, nil
+}
+
+func (c *CapturingConn) WritePacket(pk protocol.Packet) error {
+	if err := c.Conn.WritePacket(pk); err != nil {
+		return err
+	}
+	c.capturePacket(CaptureOutbound, pk)
+	return nil
+}
+
+// Tap captures the data piped through the connection when it is passed to PipeContextWithTap.
+// The connection has to be c1 of the pipe, so data from it is inbound.
+func (c *CapturingConn) Tap(direction Direction, data []byte) {
+	captureDirection := CaptureOutbound
+	if direction == DirectionServerBound {
+		captureDirection = CaptureInbound
+	}
+	c.capture(CapturedPacket{
+		Direction: captureDirection,
+		Piped:     true,
+		Data:      data,
+	})
+}
+
+// Close closes the connection and waits until the queued records are written to the capture
+func (c *CapturingConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		close(c.records)
+		c.mu.Unlock()
+	})
+	<-c.done
+	return err
+}
+
+// Err returns the error that stopped the capture if there is one
+func (c *CapturingConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *CapturingConn) capturePacket(direction CaptureDirection, pk protocol.Packet) {
+	data, err := pk.Marshal()
+	if err != nil {
+		c.mu.Lock()
+		c.stop(err)
+		c.mu.Unlock()
+		return
+	}
+
+	c.capture(CapturedPacket{
+		Direction: direction,
+		Data:      data,
+	})
+}
+
+// capture queues the record of cp with the current time
+func (c *CapturingConn) capture(cp CapturedPacket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || c.err != nil {
+		return
+	}
+
+	cp.Time = time.Now()
+	record, err := appendCapturedPacket(nil, cp)
+	if err != nil {
+		c.stop(err)
+		return
+	}
+
+	select {
+	case c.records <- record:
+	default:
+		c.stop(errors.New("capture fell behind"))
+	}
+}
+
+// stop ends the capture with err unless it already ended; c.mu has to be held
+func (c *CapturingConn) stop(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	log.Printf("[w] Stopped capturing packets of %s; error: %s", c.RemoteAddr(), err)
+}
+
+// appendCapturedPacket appends the record of cp to bb
+func appendCapturedPacket(bb []byte, cp CapturedPacket) ([]byte, error) {
+	if len(cp.Data) > maxCapturedPacketLength {
+		return bb, fmt.Errorf("captured packet is %d bytes long; at most %d are allowed", len(cp.Data), maxCapturedPacketLength)
+	}
+
+	var header [13]byte
+	binary.BigEndian.PutUint64(header[:8], uint64(cp.Time.UnixNano()))
+	header[8] = byte(cp.Direction)
+	if cp.Piped {
+		header[8] |= capturePiped
+	}
+	binary.BigEndian.PutUint32(header[9:], uint32(len(cp.Data)))
+	bb = append(bb, header[:]...)
+	return append(bb, cp.Data...), nil
+}
+
+// ReadCapture reads every packet of a capture written by a CapturingConn until r ends
+func ReadCapture(r io.Reader) ([]CapturedPacket, error) {
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, fmt.Errorf("%w: reading the start failed: %v", ErrInvalidCapture, err)
+	}
+	if !bytes.Equal(magic, captureMagic) {
+		return nil, fmt.Errorf("%w: unknown start %q", ErrInvalidCapture, magic)
+	}
+
+	var packets []CapturedPacket
+	var header [13]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return packets, nil
+			}
+			return packets, fmt.Errorf("%w: reading packet %d failed: %v", ErrInvalidCapture, len(packets), err)
+		}
+
+		piped := header[8]&capturePiped != 0
+		direction := CaptureDirection(header[8] &^ capturePiped)
+		if direction != CaptureInbound && direction != CaptureOutbound {
+			return packets, fmt.Errorf("%w: packet %d has unknown direction %d", ErrInvalidCapture, len(packets), header[8])
+		}
+
+		length := binary.BigEndian.Uint32(header[9:])
+		if length > maxCapturedPacketLength {
+			return packets, fmt.Errorf("%w: packet %d is %d bytes long", ErrInvalidCapture, len(packets), length)
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return packets, fmt.Errorf("%w: reading packet %d failed: %v", ErrInvalidCapture, len(packets), err)
+		}
+
+		packets = append(packets, CapturedPacket{
+			Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[:8]))),
+			Direction: direction,
+			Piped:     piped,
+			Data:      data,
+		})
+	}
+}
+
+// captureTap captures piped data to c before it hands it to tap if set.
+// A panicking tap stops receiving data like it does without a capture, but the capture goes on.
+func captureTap(c *CapturingConn, tap Tap) Tap {
+	if tap == nil {
+		return c.Tap
+	}
+
+	panicked := false
+	return func(direction Direction, data []byte) {
+		c.Tap(direction, data)
+		if panicked {
+			return
+		}
+
+		defer func() {
+			if r := recover(); r != nil {
+				panicked = true
+				log.Printf("[w] Tap panicked and stops receiving data; error: %v", r)
+			}
+		}()
+		tap(direction, data)
+	}
+}
+
+// captureFile is a CapturingConn that writes to a file of its own
+type captureFile struct {
+	*CapturingConn
+	f *os.File
+}
+
+// createCaptureFile captures c to a new file in dir that is named after the time and remoteAddr.
+// The capture stops once the file would grow beyond maxBytes.
+func createCaptureFile(c Conn, dir string, remoteAddr net.Addr, maxBytes int64) (*captureFile, error) {
+	name := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(remoteAddr.String())
+	f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%d-%s.cap", time.Now().UnixNano(), name)))
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := NewCapturingConn(c, &limitedWriter{w: f, n: maxBytes})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &captureFile{CapturingConn: cc, f: f}, nil
+}
+
+// limitedWriter writes to w until n bytes are left and fails for every write that doesn't fit
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (lw *limitedWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > lw.n {
+		return 0, errors.New("capture reached its maximum size")
+	}
+	n, err := lw.w.Write(b)
+	lw.n -= int64(n)
+	return n, err
+}
+
+// Close closes the connection and the file once the capture is written
+func (c *captureFile) Close() error {
+	err := c.CapturingConn.Close()
+	if closeErr := c.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
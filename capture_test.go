@@ -0,0 +1,453 @@
+package infrared
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared/protocol"
+	"github.com/haveachin/infrared/protocol/login"
+)
+
+func TestCapturingConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := wrapConn(c1)
+	defer client.Close()
+
+	var buf bytes.Buffer
+	server, err := NewCapturingConn(wrapConn(c2), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := statusHandshakePort(652)
+	loginStart := login.ServerLoginStart{Name: "Steve"}.Marshal()
+	disconnect := login.ClientBoundDisconnect{Reason: `{"text":"Bye"}`}.Marshal()
+
+	marshal := func(pk protocol.Packet) []byte {
+		bb, err := pk.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bb
+	}
+	expected := []CapturedPacket{
+		{Direction: CaptureInbound, Data: marshal(handshake)},
+		{Direction: CaptureInbound, Data: marshal(loginStart)},
+		{Direction: CaptureOutbound, Data: marshal(disconnect)},
+		{Direction: CaptureInbound, Piped: true, Data: []byte("to the server")},
+		{Direction: CaptureOutbound, Piped: true, Data: []byte("to the client")},
+	}
+
+	go func() {
+		client.WritePacket(handshake)
+		client.WritePacket(loginStart)
+		client.ReadPacket()
+	}()
+
+	before := time.Now()
+	// Peeked packets are only captured once they are read
+	if _, err := server.PeekPacket(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := server.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.WritePacket(disconnect); err != nil {
+		t.Fatal(err)
+	}
+	server.Tap(DirectionServerBound, []byte("to the server"))
+	server.Tap(DirectionClientBound, []byte("to the client"))
+	after := time.Now()
+
+	// Close waits until everything is written to the capture
+	server.Close()
+	// Data tapped after Close is not captured
+	server.Tap(DirectionServerBound, []byte("too late"))
+
+	packets, err := ReadCapture(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != len(expected) {
+		t.Fatalf("got: %v; want: %v", len(packets), len(expected))
+	}
+
+	for i, cp := range packets {
+		if cp.Direction != expected[i].Direction || cp.Piped != expected[i].Piped || !bytes.Equal(cp.Data, expected[i].Data) {
+			t.Errorf("packet %d: got: %v; want: %v", i, cp, expected[i])
+		}
+
+		if cp.Time.Before(before) || cp.Time.After(after) {
+			t.Errorf("packet %d time: got: %v; want: between %v and %v", i, cp.Time, before, after)
+		}
+		if i > 0 && cp.Time.Before(packets[i-1].Time) {
+			t.Errorf("packet %d time: got: %v; want: not before %v", i, cp.Time, packets[i-1].Time)
+		}
+	}
+
+	if pk, err := packets[1].Packet(); err != nil || !reflect.DeepEqual(pk, loginStart) {
+		t.Errorf("got: %v, %v; want: %v, nil", pk, err, loginStart)
+	}
+	if _, err := packets[3].Packet(); err == nil {
+		t.Error("piped data: got: nil; want: error")
+	}
+
+	if err := server.Err(); err != nil {
+		t.Errorf("got: %v; want: nil", err)
+	}
+}
+
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errors.New("disk full")
+	}
+	w.n--
+	return len(b), nil
+}
+
+func TestCapturingConn_WriteFails(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := wrapConn(c1)
+	defer client.Close()
+
+	server, err := NewCapturingConn(wrapConn(c2), &failingWriter{n: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	go func() {
+		client.WritePacket(statusHandshakePort(652))
+		client.WritePacket(statusHandshakePort(652))
+	}()
+
+	// The connection keeps working after the capture stopped
+	for i := 0; i < 2; i++ {
+		if _, err := server.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.Close()
+	if err := server.Err(); err == nil {
+		t.Error("got: nil; want: error")
+	}
+}
+
+// blockingWriter blocks every write after the first n until unblock is closed
+type blockingWriter struct {
+	n       int
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	if w.n == 0 {
+		<-w.unblock
+	} else {
+		w.n--
+	}
+	return len(b), nil
+}
+
+func TestCapturingConn_SlowCapture(t *testing.T) {
+	_, c := net.Pipe()
+	w := &blockingWriter{n: 1, unblock: make(chan struct{})}
+	server, err := NewCapturingConn(wrapConn(c), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < captureQueueLength*2; i++ {
+			server.Tap(DirectionServerBound, []byte("data"))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was blocked by the capture")
+	}
+	if err := server.Err(); err == nil {
+		t.Error("got: nil; want: error")
+	}
+
+	close(w.unblock)
+	server.Close()
+}
+
+func TestReadCapture(t *testing.T) {
+	packets := []CapturedPacket{
+		{
+			Time:      time.Unix(1700000000, 123456789),
+			Direction: CaptureInbound,
+			Data:      []byte{0x01, 0x00},
+		},
+		{
+			Time:      time.Unix(1700000001, 0),
+			Direction: CaptureOutbound,
+			Data:      []byte{0x03, 0x00, 0xf2, 0x05},
+		},
+		{
+			Time:      time.Unix(1700000002, 0),
+			Direction: CaptureInbound,
+			Piped:     true,
+			Data:      []byte("piped"),
+		},
+	}
+
+	bb := append([]byte{}, captureMagic...)
+	for _, cp := range packets {
+		var err error
+		bb, err = appendCapturedPacket(bb, cp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := []struct {
+		name            string
+		data            []byte
+		expectedPackets []CapturedPacket
+		expectedErr     error
+	}{
+		{
+			name:            "Packets",
+			data:            bb,
+			expectedPackets: packets,
+		},
+		{
+			name: "Empty",
+			data: captureMagic,
+		},
+		{
+			name:        "NoCapture",
+			data:        []byte("not a capture"),
+			expectedErr: ErrInvalidCapture,
+		},
+		{
+			name:        "Nothing",
+			expectedErr: ErrInvalidCapture,
+		},
+		{
+			name:            "TruncatedHeader",
+			data:            bb[:len(bb)-10],
+			expectedPackets: packets[:2],
+			expectedErr:     ErrInvalidCapture,
+		},
+		{
+			name:            "TruncatedData",
+			data:            bb[:len(bb)-1],
+			expectedPackets: packets[:2],
+			expectedErr:     ErrInvalidCapture,
+		},
+		{
+			name:        "UnknownDirection",
+			data:        append(append([]byte{}, captureMagic...), 0, 0, 0, 0, 0, 0, 0, 0, 7, 0, 0, 0, 0),
+			expectedErr: ErrInvalidCapture,
+		},
+		{
+			name:        "TooLong",
+			data:        append(append([]byte{}, captureMagic...), 0, 0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff),
+			expectedErr: ErrInvalidCapture,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			packets, err := ReadCapture(bytes.NewReader(tc.data))
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("got: %v; want: %v", err, tc.expectedErr)
+			}
+
+			if len(packets) != len(tc.expectedPackets) {
+				t.Fatalf("got: %v; want: %v", len(packets), len(tc.expectedPackets))
+			}
+			for i, cp := range packets {
+				expected := tc.expectedPackets[i]
+				if !cp.Time.Equal(expected.Time) || cp.Direction != expected.Direction || cp.Piped != expected.Piped || !bytes.Equal(cp.Data, expected.Data) {
+					t.Errorf("packet %d: got: %v; want: %v", i, cp, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestProxy_CaptureDir(t *testing.T) {
+	portEnd := 659
+	hsPk := loginHandshakePort(portEnd)
+	handshake, err := hsPk.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginStartPk := login.ServerLoginStart{Name: "Steve"}.Marshal()
+	loginStart, err := loginStartPk.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := append(append(handshake, loginStart...), "hello"...)
+
+	received := make(chan []byte, 1)
+	l := serveMirrorTarget(t, serverAddr(portEnd), sent, []byte("world"), received)
+	defer l.Close()
+
+	dir := t.TempDir()
+	config := createBasicProxyConfig(serverDomain, gatewayAddr(portEnd), serverAddr(portEnd))
+	config.CaptureDir = dir
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe([]*Proxy{{Config: config}}); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	conn, err := net.Dial("tcp", gatewayAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't make a connection with gateway: %v", err)
+	}
+	if _, err := conn.Write(sent); err != nil {
+		t.Fatal(err)
+	}
+	answer := make([]byte, len("world"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	expected := []CapturedPacket{
+		{Direction: CaptureInbound, Data: handshake},
+		{Direction: CaptureInbound, Data: loginStart},
+		{Direction: CaptureInbound, Piped: true, Data: []byte("hello")},
+		{Direction: CaptureOutbound, Piped: true, Data: []byte("world")},
+	}
+
+	// The capture is complete once the proxy is done with the connection
+	var packets []CapturedPacket
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.cap"))
+		if len(files) == 1 {
+			if bb, err := os.ReadFile(files[0]); err == nil {
+				packets, _ = ReadCapture(bytes.NewReader(bb))
+			}
+		}
+		if len(packets) >= len(expected) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(packets) != len(expected) {
+		t.Fatalf("got: %v; want: %v", packets, expected)
+	}
+	for i, cp := range packets {
+		if cp.Direction != expected[i].Direction || cp.Piped != expected[i].Piped || !bytes.Equal(cp.Data, expected[i].Data) {
+			t.Errorf("packet %d: got: %v; want: %v", i, cp, expected[i])
+		}
+	}
+}
+
+func TestProxy_CaptureDirSkipsStatus(t *testing.T) {
+	portEnd := 665
+	dir := t.TempDir()
+	config := createBasicProxyConfig(serverDomain, gatewayAddr(portEnd), serverAddr(portEnd))
+	config.CaptureDir = dir
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe([]*Proxy{{Config: config}}); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	if _, err := statusDial(statusDialConfig{
+		pk:          statusHandshakePort(portEnd),
+		gatewayAddr: gatewayAddr(portEnd),
+	}); err != nil {
+		t.Fatalf("%s: %v", err.Message, err.Error)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.cap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("got: %v; want: no captures", files)
+	}
+}
+
+func TestCreateCaptureFile_MaxBytes(t *testing.T) {
+	_, c := net.Pipe()
+	dir := t.TempDir()
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 25565}
+	capture, err := createCaptureFile(wrapConn(c), dir, remoteAddr, int64(len(captureMagic)+64))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	capture.Tap(DirectionServerBound, []byte("fits"))
+	capture.Tap(DirectionServerBound, bytes.Repeat([]byte("x"), 64))
+	capture.Close()
+
+	if err := capture.Err(); err == nil {
+		t.Error("got: nil; want: error")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.cap"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got: %v, %v; want: one capture", files, err)
+	}
+	bb, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, err := ReadCapture(bytes.NewReader(bb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 1 || string(packets[0].Data) != "fits" {
+		t.Errorf("got: %v; want: only the data that fits", packets)
+	}
+}
+
+func TestCaptureTap_PanickingTap(t *testing.T) {
+	_, c := net.Pipe()
+	var buf bytes.Buffer
+	capture, err := NewCapturingConn(wrapConn(c), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	tap := captureTap(capture, func(direction Direction, data []byte) {
+		calls++
+		panic("tap failed")
+	})
+	tap(DirectionServerBound, []byte("first"))
+	tap(DirectionClientBound, []byte("second"))
+	capture.Close()
+
+	if calls != 1 {
+		t.Errorf("got: %d calls; want: 1", calls)
+	}
+
+	packets, err := ReadCapture(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 2 {
+		t.Errorf("got: %v; want: both chunks to be captured", packets)
+	}
+}
@@ -0,0 +1,123 @@
+package infrared
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by a CircuitBreaker that does not allow calls
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is the state of a CircuitBreaker
+type CircuitState int
+
+const (
+	// CircuitClosed allows every call
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects every call until the recovery timeout passed
+	CircuitOpen
+	// CircuitHalfOpen allows a single probe call that decides if the circuit closes or opens again
+	CircuitHalfOpen
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitStats is a snapshot of a CircuitBreaker
+type CircuitStats struct {
+	State CircuitState
+	// Failures is the number of consecutive failed calls
+	Failures int
+}
+
+// CircuitBreaker stops calls to a struggling server so that it is bypassed instead of
+// being attempted over and over. It opens after FailureThreshold consecutive failures,
+// allows one probe after RecoveryTimeout and closes again if the probe succeeds.
+// Every call that Allow permits has to be reported with Report.
+type CircuitBreaker struct {
+	FailureThreshold int
+	RecoveryTimeout  time.Duration
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// Allow returns ErrCircuitOpen if the circuit is open or its probe is in progress
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.RecoveryTimeout {
+			return ErrCircuitOpen
+		}
+		cb.state = CircuitHalfOpen
+		cb.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if cb.probing {
+			return ErrCircuitOpen
+		}
+		cb.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Report records the result of a call that was allowed.
+// Canceled calls say nothing about the server and only end a probe.
+func (cb *CircuitBreaker) Report(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	probe := cb.state == CircuitHalfOpen
+	cb.probing = false
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return
+	case err == nil:
+		cb.state = CircuitClosed
+		cb.failures = 0
+	case probe:
+		cb.failures++
+		cb.open()
+	default:
+		cb.failures++
+		if cb.state == CircuitClosed && cb.failures >= cb.FailureThreshold {
+			cb.open()
+		}
+	}
+}
+
+func (cb *CircuitBreaker) open() {
+	cb.state = CircuitOpen
+	cb.openedAt = time.Now()
+}
+
+// Stats returns the current state and number of consecutive failures
+func (cb *CircuitBreaker) Stats() CircuitStats {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return CircuitStats{
+		State:    cb.state,
+		Failures: cb.failures,
+	}
+}
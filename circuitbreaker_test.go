@@ -0,0 +1,107 @@
+package infrared
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	recoveryTimeout := 50 * time.Millisecond
+	cb := &CircuitBreaker{
+		FailureThreshold: 2,
+		RecoveryTimeout:  recoveryTimeout,
+	}
+	errDial := errors.New("dial failed")
+
+	// The steps share the circuit breaker and run in order
+	tt := []struct {
+		name          string
+		wait          time.Duration
+		expectedAllow error
+		report        error
+		expectedStats CircuitStats
+	}{
+		{
+			name:          "ClosedFailure",
+			report:        errDial,
+			expectedStats: CircuitStats{State: CircuitClosed, Failures: 1},
+		},
+		{
+			name:          "ClosedSuccessResetsFailures",
+			expectedStats: CircuitStats{State: CircuitClosed},
+		},
+		{
+			name:          "ClosedFailureAgain",
+			report:        errDial,
+			expectedStats: CircuitStats{State: CircuitClosed, Failures: 1},
+		},
+		{
+			name:          "ClosedToOpen",
+			report:        errDial,
+			expectedStats: CircuitStats{State: CircuitOpen, Failures: 2},
+		},
+		{
+			name:          "OpenRejects",
+			expectedAllow: ErrCircuitOpen,
+			expectedStats: CircuitStats{State: CircuitOpen, Failures: 2},
+		},
+		{
+			name:          "OpenToHalfOpenToOpen",
+			wait:          recoveryTimeout,
+			report:        errDial,
+			expectedStats: CircuitStats{State: CircuitOpen, Failures: 3},
+		},
+		{
+			name:          "OpenRejectsAfterFailedProbe",
+			expectedAllow: ErrCircuitOpen,
+			expectedStats: CircuitStats{State: CircuitOpen, Failures: 3},
+		},
+		{
+			name:          "CanceledProbe",
+			wait:          recoveryTimeout,
+			report:        context.Canceled,
+			expectedStats: CircuitStats{State: CircuitHalfOpen, Failures: 3},
+		},
+		{
+			name:          "HalfOpenToClosed",
+			expectedStats: CircuitStats{State: CircuitClosed},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			time.Sleep(tc.wait)
+
+			if err := cb.Allow(); err != tc.expectedAllow {
+				t.Fatalf("got: %v; want: %v", err, tc.expectedAllow)
+			}
+			if tc.expectedAllow == nil {
+				cb.Report(tc.report)
+			}
+
+			if stats := cb.Stats(); stats != tc.expectedStats {
+				t.Errorf("got: %v; want: %v", stats, tc.expectedStats)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker_SingleProbe(t *testing.T) {
+	cb := &CircuitBreaker{FailureThreshold: 1}
+	if err := cb.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	cb.Report(errors.New("dial failed"))
+
+	if err := cb.Allow(); err != nil {
+		t.Fatalf("probe: got: %v; want: %v", err, nil)
+	}
+	if stats := cb.Stats(); stats.State != CircuitHalfOpen {
+		t.Errorf("got: %v; want: %v", stats.State, CircuitHalfOpen)
+	}
+	if err := cb.Allow(); err != ErrCircuitOpen {
+		t.Errorf("second probe: got: %v; want: %v", err, ErrCircuitOpen)
+	}
+}
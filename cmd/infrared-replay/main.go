@@ -0,0 +1,146 @@
+// Command infrared-replay replays a packet capture of an infrared.CapturingConn against a server.
+// Without a server address it prints the packets of the capture instead.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/haveachin/infrared"
+	"github.com/haveachin/infrared/protocol"
+)
+
+const (
+	clfCapturePath = "capture"
+	clfAddr        = "addr"
+	clfSend        = "send"
+	clfSpeed       = "speed"
+	clfTimeout     = "timeout"
+)
+
+var (
+	capturePath = ""
+	addr        = ""
+	send        = infrared.CaptureInbound.String()
+	speed       = 1.0
+	timeout     = 5000
+)
+
+func init() {
+	flag.StringVar(&capturePath, clfCapturePath, capturePath, "path of the capture to replay")
+	flag.StringVar(&addr, clfAddr, addr, "address of the server to replay the capture against; prints the capture if empty")
+	flag.StringVar(&send, clfSend, send, "direction of the captured packets that are sent to the server; inbound for captures of client connections and outbound for captures of server connections")
+	flag.Float64Var(&speed, clfSpeed, speed, "speed of the replay relative to the capture; 0 sends every packet right away")
+	flag.IntVar(&timeout, clfTimeout, timeout, "time in milliseconds to wait for packets of the server after the last packet is sent")
+	flag.Parse()
+}
+
+func main() {
+	if capturePath == "" {
+		log.Fatalf("[x] -%s is required", clfCapturePath)
+	}
+
+	f, err := os.Open(capturePath)
+	if err != nil {
+		log.Fatalf("[x] Failed opening capture %s; error: %s", capturePath, err)
+	}
+	packets, err := infrared.ReadCapture(bufio.NewReader(f))
+	f.Close()
+	if err != nil {
+		log.Fatalf("[x] Failed reading capture %s; error: %s", capturePath, err)
+	}
+
+	if addr == "" {
+		printCapture(packets)
+		return
+	}
+
+	var direction infrared.CaptureDirection
+	switch send {
+	case infrared.CaptureInbound.String():
+		direction = infrared.CaptureInbound
+	case infrared.CaptureOutbound.String():
+		direction = infrared.CaptureOutbound
+	default:
+		log.Fatalf("[x] -%s has to be %s or %s", clfSend, infrared.CaptureInbound, infrared.CaptureOutbound)
+	}
+
+	if err := replay(packets, direction); err != nil {
+		log.Fatalf("[x] Failed replaying capture against %s; error: %s", addr, err)
+	}
+}
+
+func printCapture(packets []infrared.CapturedPacket) {
+	for i, cp := range packets {
+		if cp.Piped {
+			fmt.Printf("%s %-8s #%d piped %d bytes: %x\n", cp.Time.Format(time.RFC3339Nano), cp.Direction, i, len(cp.Data), cp.Data)
+			continue
+		}
+
+		pk, err := cp.Packet()
+		if err != nil {
+			fmt.Printf("%s %-8s invalid packet: %s\n", cp.Time.Format(time.RFC3339Nano), cp.Direction, err)
+			continue
+		}
+		fmt.Printf("%s %-8s #%d id 0x%02x with %d bytes: %x\n", cp.Time.Format(time.RFC3339Nano), cp.Direction, i, pk.ID, len(pk.Data), pk.Data)
+	}
+}
+
+// replay sends the packets and piped data of direction to the server and logs every packet it answers with.
+// The server has to answer without compression and encryption, since replayed packets are never compressed or encrypted.
+func replay(packets []infrared.CapturedPacket, direction infrared.CaptureDirection) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	received := make(chan int)
+	go func() {
+		n := 0
+		defer func() { received <- n }()
+		r := bufio.NewReader(conn)
+		for {
+			pk, err := protocol.ReadPacket(r)
+			if err != nil {
+				log.Printf("[i] Stopped reading packets of the server; error: %s", err)
+				return
+			}
+			n++
+			log.Printf("[i] Received packet 0x%02x with %d bytes", pk.ID, len(pk.Data))
+		}
+	}()
+
+	sent := 0
+	var last time.Time
+	for _, cp := range packets {
+		if cp.Direction != direction {
+			continue
+		}
+
+		if speed > 0 && !last.IsZero() {
+			time.Sleep(time.Duration(float64(cp.Time.Sub(last)) / speed))
+		}
+		last = cp.Time
+
+		if _, err := conn.Write(cp.Data); err != nil {
+			return err
+		}
+		sent++
+		log.Printf("[i] Sent packet %d of %d bytes", sent, len(cp.Data))
+	}
+
+	select {
+	case n := <-received:
+		log.Printf("[i] Sent %d packets and received %d", sent, n)
+	case <-time.After(time.Millisecond * time.Duration(timeout)):
+		conn.Close()
+		log.Printf("[i] Sent %d packets and received %d", sent, <-received)
+	}
+	return nil
+}
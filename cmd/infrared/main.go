@@ -1,18 +1,56 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/haveachin/infrared"
+	"github.com/haveachin/infrared/discovery/consul"
 )
 
 const (
 	envPrefix               = "INFRARED_"
 	envConfigPath           = envPrefix + "CONFIG_PATH"
 	envReceiveProxyProtocol = envPrefix + "RECEIVE_PROXY_PROTOCOL"
+	envHandshakeTimeout     = envPrefix + "HANDSHAKE_TIMEOUT"
+	envTLSCertPath          = envPrefix + "TLS_CERT_PATH"
+	envTLSKeyPath           = envPrefix + "TLS_KEY_PATH"
+	envRateLimit            = envPrefix + "RATE_LIMIT"
+	envRateLimitBurst       = envPrefix + "RATE_LIMIT_BURST"
+	envRateLimitMessage     = envPrefix + "RATE_LIMIT_MESSAGE"
+	envNoProxyMessage       = envPrefix + "NO_PROXY_MESSAGE"
+	envAllowCIDRs           = envPrefix + "ALLOW_CIDRS"
+	envDenyCIDRs            = envPrefix + "DENY_CIDRS"
+	envShutdownTimeout      = envPrefix + "SHUTDOWN_TIMEOUT"
+	envConnLog              = envPrefix + "CONN_LOG"
+	envConfigPollInterval   = envPrefix + "CONFIG_POLL_INTERVAL"
+	envTCPNoDelay           = envPrefix + "TCP_NO_DELAY"
+	envTCPKeepAlive         = envPrefix + "TCP_KEEP_ALIVE"
+	envMaxPacketLength      = envPrefix + "MAX_PACKET_LENGTH"
+	envAdminBind            = envPrefix + "ADMIN_BIND"
+	envAdminToken           = envPrefix + "ADMIN_TOKEN"
+	envRealIPPublicKeyPath  = envPrefix + "REAL_IP_PUBLIC_KEY_PATH"
+	envRealIPMaxAge         = envPrefix + "REAL_IP_MAX_AGE"
+	envMinReadRate          = envPrefix + "MIN_READ_RATE"
+	envMinReadRateWindow    = envPrefix + "MIN_READ_RATE_WINDOW"
+	envTrustedProxyCIDRs    = envPrefix + "TRUSTED_PROXY_CIDRS"
+	envUnixSocketMode       = envPrefix + "UNIX_SOCKET_MODE"
+	envMaxConnections       = envPrefix + "MAX_CONNECTIONS"
+	envMaxConnectionsMsg    = envPrefix + "MAX_CONNECTIONS_MESSAGE"
+	envNumAcceptWorkers     = envPrefix + "NUM_ACCEPT_WORKERS"
+	envConsulAddress        = envPrefix + "CONSUL_ADDRESS"
+	envConsulToken          = envPrefix + "CONSUL_TOKEN"
+	envConsulDatacenter     = envPrefix + "CONSUL_DATACENTER"
+	envConsulService        = envPrefix + "CONSUL_SERVICE"
 )
 
 const (
@@ -20,6 +58,36 @@ const (
 	clfReceiveProxyProtocol = "receive-proxy-protocol"
     clfPrometheusEnabled    = "enable-prometheus"
     clfPrometheusBind       = "prometheus-bind"
+	clfHandshakeTimeout     = "handshake-timeout"
+	clfTLSCertPath          = "tls-cert-path"
+	clfTLSKeyPath           = "tls-key-path"
+	clfRateLimit            = "rate-limit"
+	clfRateLimitBurst       = "rate-limit-burst"
+	clfRateLimitMessage     = "rate-limit-message"
+	clfNoProxyMessage       = "no-proxy-message"
+	clfAllowCIDRs           = "allow-cidrs"
+	clfDenyCIDRs            = "deny-cidrs"
+	clfShutdownTimeout      = "shutdown-timeout"
+	clfConnLog              = "conn-log"
+	clfConfigPollInterval   = "config-poll-interval"
+	clfTCPNoDelay           = "tcp-no-delay"
+	clfTCPKeepAlive         = "tcp-keep-alive"
+	clfMaxPacketLength      = "max-packet-length"
+	clfAdminBind            = "admin-bind"
+	clfAdminToken           = "admin-token"
+	clfRealIPPublicKeyPath  = "real-ip-public-key-path"
+	clfRealIPMaxAge         = "real-ip-max-age"
+	clfMinReadRate          = "min-read-rate"
+	clfMinReadRateWindow    = "min-read-rate-window"
+	clfTrustedProxyCIDRs    = "trusted-proxy-cidrs"
+	clfUnixSocketMode       = "unix-socket-mode"
+	clfMaxConnections       = "max-connections"
+	clfMaxConnectionsMsg    = "max-connections-message"
+	clfNumAcceptWorkers     = "num-accept-workers"
+	clfConsulAddress        = "consul-address"
+	clfConsulToken          = "consul-token"
+	clfConsulDatacenter     = "consul-datacenter"
+	clfConsulService        = "consul-service"
 )
 
 var (
@@ -27,6 +95,36 @@ var (
 	receiveProxyProtocol = false
     prometheusEnabled    = false
     prometheusBind       = ":9100"
+	handshakeTimeout     = 5000
+	tlsCertPath          = ""
+	tlsKeyPath           = ""
+	rateLimit            = 0.0
+	rateLimitBurst       = 5
+	rateLimitMessage     = ""
+	noProxyMessage       = "No server found for {{domain}}"
+	allowCIDRs           = ""
+	denyCIDRs            = ""
+	shutdownTimeout      = 30000
+	connLog              = false
+	configPollInterval   = 0
+	tcpNoDelay           = false
+	tcpKeepAlive         = 0
+	maxPacketLength      = 0
+	adminBind            = ""
+	adminToken           = ""
+	realIPPublicKeyPath  = ""
+	realIPMaxAge         = 30000
+	minReadRate          = 0
+	minReadRateWindow    = 5000
+	trustedProxyCIDRs    = ""
+	unixSocketMode       = ""
+	maxConnections       = 0
+	maxConnectionsMsg    = ""
+	numAcceptWorkers     = 1
+	consulAddress        = ""
+	consulToken          = ""
+	consulDatacenter     = ""
+	consulService        = "minecraft"
 )
 
 func envBool(name string, value bool) bool {
@@ -43,6 +141,34 @@ func envBool(name string, value bool) bool {
 	return envBool
 }
 
+func envInt(name string, value int) int {
+	envString := os.Getenv(name)
+	if envString == "" {
+		return value
+	}
+
+	envInt, err := strconv.Atoi(envString)
+	if err != nil {
+		return value
+	}
+
+	return envInt
+}
+
+func envFloat(name string, value float64) float64 {
+	envString := os.Getenv(name)
+	if envString == "" {
+		return value
+	}
+
+	envFloat, err := strconv.ParseFloat(envString, 64)
+	if err != nil {
+		return value
+	}
+
+	return envFloat
+}
+
 func envString(name string, value string) string {
 	envString := os.Getenv(name)
 	if envString == "" {
@@ -55,6 +181,36 @@ func envString(name string, value string) string {
 func initEnv() {
 	configPath = envString(envConfigPath, configPath)
 	receiveProxyProtocol = envBool(envReceiveProxyProtocol, receiveProxyProtocol)
+	handshakeTimeout = envInt(envHandshakeTimeout, handshakeTimeout)
+	tlsCertPath = envString(envTLSCertPath, tlsCertPath)
+	tlsKeyPath = envString(envTLSKeyPath, tlsKeyPath)
+	rateLimit = envFloat(envRateLimit, rateLimit)
+	rateLimitBurst = envInt(envRateLimitBurst, rateLimitBurst)
+	rateLimitMessage = envString(envRateLimitMessage, rateLimitMessage)
+	noProxyMessage = envString(envNoProxyMessage, noProxyMessage)
+	allowCIDRs = envString(envAllowCIDRs, allowCIDRs)
+	denyCIDRs = envString(envDenyCIDRs, denyCIDRs)
+	shutdownTimeout = envInt(envShutdownTimeout, shutdownTimeout)
+	connLog = envBool(envConnLog, connLog)
+	configPollInterval = envInt(envConfigPollInterval, configPollInterval)
+	tcpNoDelay = envBool(envTCPNoDelay, tcpNoDelay)
+	tcpKeepAlive = envInt(envTCPKeepAlive, tcpKeepAlive)
+	maxPacketLength = envInt(envMaxPacketLength, maxPacketLength)
+	adminBind = envString(envAdminBind, adminBind)
+	adminToken = envString(envAdminToken, adminToken)
+	realIPPublicKeyPath = envString(envRealIPPublicKeyPath, realIPPublicKeyPath)
+	realIPMaxAge = envInt(envRealIPMaxAge, realIPMaxAge)
+	minReadRate = envInt(envMinReadRate, minReadRate)
+	minReadRateWindow = envInt(envMinReadRateWindow, minReadRateWindow)
+	trustedProxyCIDRs = envString(envTrustedProxyCIDRs, trustedProxyCIDRs)
+	unixSocketMode = envString(envUnixSocketMode, unixSocketMode)
+	maxConnections = envInt(envMaxConnections, maxConnections)
+	maxConnectionsMsg = envString(envMaxConnectionsMsg, maxConnectionsMsg)
+	numAcceptWorkers = envInt(envNumAcceptWorkers, numAcceptWorkers)
+	consulAddress = envString(envConsulAddress, consulAddress)
+	consulToken = envString(envConsulToken, consulToken)
+	consulDatacenter = envString(envConsulDatacenter, consulDatacenter)
+	consulService = envString(envConsulService, consulService)
 }
 
 func initFlags() {
@@ -62,6 +218,36 @@ func initFlags() {
 	flag.BoolVar(&receiveProxyProtocol, clfReceiveProxyProtocol, receiveProxyProtocol, "should accept proxy protocol")
     flag.BoolVar(&prometheusEnabled, clfPrometheusEnabled, prometheusEnabled, "should run prometheus client exposing metrics")
     flag.StringVar(&prometheusBind, clfPrometheusBind, prometheusBind, "bind address and/or port for prometheus")
+	flag.IntVar(&handshakeTimeout, clfHandshakeTimeout, handshakeTimeout, "time in milliseconds a client has to send its handshake")
+	flag.StringVar(&tlsCertPath, clfTLSCertPath, tlsCertPath, "path of the TLS certificate")
+	flag.StringVar(&tlsKeyPath, clfTLSKeyPath, tlsKeyPath, "path of the TLS private key")
+	flag.Float64Var(&rateLimit, clfRateLimit, rateLimit, "connections per second per IP; 0 disables rate limiting")
+	flag.IntVar(&rateLimitBurst, clfRateLimitBurst, rateLimitBurst, "connections per IP that are allowed in a burst")
+	flag.StringVar(&rateLimitMessage, clfRateLimitMessage, rateLimitMessage, "disconnect message for rate limited logins")
+	flag.StringVar(&noProxyMessage, clfNoProxyMessage, noProxyMessage, "disconnect message for logins to domains without a proxy")
+	flag.StringVar(&allowCIDRs, clfAllowCIDRs, allowCIDRs, "comma separated CIDRs that are allowed to connect")
+	flag.StringVar(&denyCIDRs, clfDenyCIDRs, denyCIDRs, "comma separated CIDRs that are not allowed to connect")
+	flag.IntVar(&shutdownTimeout, clfShutdownTimeout, shutdownTimeout, "time in milliseconds to wait for connections to close on shutdown")
+	flag.BoolVar(&connLog, clfConnLog, connLog, "should log the lifecycle of every connection as JSON to stdout")
+	flag.IntVar(&configPollInterval, clfConfigPollInterval, configPollInterval, "time in milliseconds between polls of the config path; 0 watches it with file system events")
+	flag.BoolVar(&tcpNoDelay, clfTCPNoDelay, tcpNoDelay, "should disable Nagle's algorithm on client connections")
+	flag.IntVar(&tcpKeepAlive, clfTCPKeepAlive, tcpKeepAlive, "period in milliseconds of TCP keep-alives on client connections; 0 leaves the system default")
+	flag.IntVar(&maxPacketLength, clfMaxPacketLength, maxPacketLength, "largest packet length in bytes that is read from clients; 0 allows the protocol maximum")
+	flag.StringVar(&adminBind, clfAdminBind, adminBind, "bind address and/or port for the admin API; empty disables it")
+	flag.StringVar(&adminToken, clfAdminToken, adminToken, "bearer token that requests to the admin API have to send; required to enable it")
+	flag.StringVar(&realIPPublicKeyPath, clfRealIPPublicKeyPath, realIPPublicKeyPath, "path of the public key that RealIP handshakes are signed with")
+	flag.IntVar(&realIPMaxAge, clfRealIPMaxAge, realIPMaxAge, "time in milliseconds that the timestamp of a RealIP handshake may be off")
+	flag.IntVar(&minReadRate, clfMinReadRate, minReadRate, "bytes a client has to send in every window until its handshake is done; 0 disables it")
+	flag.IntVar(&minReadRateWindow, clfMinReadRateWindow, minReadRateWindow, "time in milliseconds of the windows of the minimum read rate")
+	flag.StringVar(&trustedProxyCIDRs, clfTrustedProxyCIDRs, trustedProxyCIDRs, "comma separated CIDRs whose PROXY protocol headers are trusted; empty trusts everyone")
+	flag.StringVar(&unixSocketMode, clfUnixSocketMode, unixSocketMode, "octal file mode of the Unix domain sockets proxies listen to; empty keeps the default")
+	flag.IntVar(&maxConnections, clfMaxConnections, maxConnections, "connections the gateway handles at once; 0 disables the limit")
+	flag.StringVar(&maxConnectionsMsg, clfMaxConnectionsMsg, maxConnectionsMsg, "disconnect message for logins beyond the max connections")
+	flag.IntVar(&numAcceptWorkers, clfNumAcceptWorkers, numAcceptWorkers, "sockets with SO_REUSEPORT that every listener accepts connections on in parallel; Linux only")
+	flag.StringVar(&consulAddress, clfConsulAddress, consulAddress, "address of the Consul HTTP API to discover servers with; empty disables it")
+	flag.StringVar(&consulToken, clfConsulToken, consulToken, "ACL token for the Consul HTTP API")
+	flag.StringVar(&consulDatacenter, clfConsulDatacenter, consulDatacenter, "Consul datacenter to discover servers in; empty uses the one of the agent")
+	flag.StringVar(&consulService, clfConsulService, consulService, "name of the Consul service whose instances tagged infrared are registered")
 	flag.Parse()
 }
 
@@ -73,7 +259,14 @@ func init() {
 func main() {
 	log.Println("Loading proxy configs")
 
-	cfgs, err := infrared.LoadProxyConfigsFromPath(configPath, false)
+	outCfgs := make(chan *infrared.ProxyConfig)
+	var cfgs []*infrared.ProxyConfig
+	var err error
+	if configPollInterval > 0 {
+		cfgs, _, err = infrared.PollProxyConfigFolder(configPath, time.Millisecond*time.Duration(configPollInterval), outCfgs)
+	} else {
+		cfgs, err = infrared.LoadProxyConfigsFromPath(configPath, false)
+	}
 	if err != nil {
 		log.Printf("Failed loading proxy configs from %s; error: %s", configPath, err)
 		return
@@ -86,15 +279,109 @@ func main() {
 		})
 	}
 
-	outCfgs := make(chan *infrared.ProxyConfig)
-	go func() {
-		if err := infrared.WatchProxyConfigFolder(configPath, outCfgs); err != nil {
-			log.Println("Failed watching config folder; error:", err)
-			log.Println("SYSTEM FAILURE: CONFIG WATCHER FAILED")
+	if configPollInterval <= 0 {
+		go func() {
+			if err := infrared.WatchProxyConfigFolder(configPath, outCfgs); err != nil {
+				log.Println("Failed watching config folder; error:", err)
+				log.Println("SYSTEM FAILURE: CONFIG WATCHER FAILED")
+			}
+		}()
+	}
+
+	gateway := infrared.Gateway{
+		ReceiveProxyProtocol: receiveProxyProtocol,
+		HandshakeTimeout:     time.Millisecond * time.Duration(handshakeTimeout),
+		NoProxyMessage:       noProxyMessage,
+		MaxPacketLength:      maxPacketLength,
+		NumAcceptWorkers:     numAcceptWorkers,
+		MinReadRate: infrared.MinReadRate{
+			Bytes:  minReadRate,
+			Window: time.Millisecond * time.Duration(minReadRateWindow),
+		},
+		TCPOptions: infrared.TCPOptions{
+			NoDelay:         tcpNoDelay,
+			KeepAlivePeriod: time.Millisecond * time.Duration(tcpKeepAlive),
+		},
+	}
+
+	if connLog {
+		gateway.ConnLogger = infrared.NewJSONLogger(os.Stdout)
+	}
+
+	if rateLimit > 0 {
+		gateway.RateLimiter = infrared.NewIPRateLimiter(rateLimit, rateLimitBurst)
+		gateway.RateLimitMessage = rateLimitMessage
+	}
+
+	if maxConnections > 0 {
+		gateway.MaxConnections = maxConnections
+		gateway.MaxConnectionsMessage = maxConnectionsMsg
+	}
+
+	if allowCIDRs != "" || denyCIDRs != "" {
+		ipFilter, err := infrared.NewIPFilter(strings.Split(allowCIDRs, ","), strings.Split(denyCIDRs, ","))
+		if err != nil {
+			log.Printf("Failed parsing CIDRs; error: %s", err)
+			return
 		}
-	}()
+		gateway.IPFilter = ipFilter
+	}
+
+	if trustedProxyCIDRs != "" {
+		trustedProxies, err := infrared.NewIPFilter(strings.Split(trustedProxyCIDRs, ","), nil)
+		if err != nil {
+			log.Printf("Failed parsing trusted proxy CIDRs; error: %s", err)
+			return
+		}
+		gateway.TrustedProxies = trustedProxies
+	}
+
+	if tlsCertPath != "" && tlsKeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCertPath, tlsKeyPath)
+		if err != nil {
+			log.Printf("Failed loading TLS key pair; error: %s", err)
+			return
+		}
+		gateway.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+
+	if unixSocketMode != "" {
+		mode, err := strconv.ParseUint(unixSocketMode, 8, 32)
+		if err != nil {
+			log.Printf("Failed parsing Unix socket mode; error: %s", err)
+			return
+		}
+		gateway.UnixSocketMode = os.FileMode(mode)
+	}
+
+	if realIPPublicKeyPath != "" {
+		bb, err := ioutil.ReadFile(realIPPublicKeyPath)
+		if err != nil {
+			log.Printf("Failed reading RealIP public key; error: %s", err)
+			return
+		}
+		key, err := infrared.ParseRealIPPublicKey(bb)
+		if err != nil {
+			log.Printf("Failed parsing RealIP public key; error: %s", err)
+			return
+		}
+		gateway.RealIPPublicKey = key
+		gateway.RealIPMaxAge = time.Millisecond * time.Duration(realIPMaxAge)
+	}
+
+	if prometheusEnabled {
+		gateway.EnablePrometheus(prometheusBind)
+	}
+
+	if adminBind != "" {
+		if err := gateway.EnableAdminAPI(adminBind, adminToken); err != nil {
+			log.Printf("Failed enabling the admin API; error: %s", err)
+			return
+		}
+	}
 
-	gateway := infrared.Gateway{}
 	go func() {
 		for {
 			cfg, ok := <-outCfgs
@@ -109,10 +396,35 @@ func main() {
 		}
 	}()
 
-	if prometheusEnabled {
-		gateway.EnablePrometheus(prometheusBind)
+	if consulAddress != "" {
+		store := &consul.ConsulServerStore{
+			Gateway:    &gateway,
+			Address:    consulAddress,
+			Token:      consulToken,
+			Datacenter: consulDatacenter,
+			Service:    consulService,
+		}
+		go func() {
+			if err := store.Watch(context.Background()); err != nil {
+				log.Println("Failed watching Consul; error:", err)
+			}
+		}()
 	}
 
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		log.Println("Shutting down Infrared")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(shutdownTimeout))
+		defer cancel()
+		if err := gateway.Shutdown(ctx); err != nil {
+			log.Println("Failed to drain all connections; error:", err)
+		}
+		os.Exit(0)
+	}()
+
 	log.Println("Starting Infrared")
 	if err := gateway.ListenAndServe(proxies); err != nil {
 		log.Fatal("Gateway exited; error: ", err)
@@ -1,22 +1,26 @@
 package infrared
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"image/png"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/haveachin/infrared/process"
 	"github.com/haveachin/infrared/protocol"
 	"github.com/haveachin/infrared/protocol/status"
+	"sigs.k8s.io/yaml"
 )
 
 // ProxyConfig is a data representation of a Proxy configuration
@@ -27,20 +31,55 @@ type ProxyConfig struct {
 	removeCallback func()
 	changeCallback func()
 	dialer         *Dialer
+	balancer       *WeightedRoundRobin
 	process        process.Process
-
-	DomainName        string               `json:"domainName"`
-	ListenTo          string               `json:"listenTo"`
-	ProxyTo           string               `json:"proxyTo"`
-	ProxyBind         string               `json:"proxyBind"`
-	ProxyProtocol     bool                 `json:"proxyProtocol"`
-	RealIP            bool                 `json:"realIp"`
-	Timeout           int                  `json:"timeout"`
-	DisconnectMessage string               `json:"disconnectMessage"`
-	Docker            DockerConfig         `json:"docker"`
-	OnlineStatus      StatusConfig         `json:"onlineStatus"`
-	OfflineStatus     StatusConfig         `json:"offlineStatus"`
-	CallbackServer    CallbackServerConfig `json:"callbackServer"`
+	// maintenance overrides Maintenance while it isn't maintenanceFromConfig; accessed atomically
+	maintenance int32
+
+	DomainName         string               `json:"domainName"`
+	DomainNames        []string             `json:"domainNames"`
+	ListenTo           string               `json:"listenTo"`
+	ProxyTo            string               `json:"proxyTo"`
+	Servers            []ServerConfig       `json:"servers"`
+	Balancing          string               `json:"balancing"`
+	StickySessionTTL   int                  `json:"stickySessionTTL"`
+	Canary             CanaryConfig         `json:"canary"`
+	VersionRoutes      []VersionRouteConfig `json:"versionRoutes"`
+	FallbackTo         []string             `json:"fallbackTo"`
+	MirrorTo           string               `json:"mirrorTo"`
+	CaptureDir         string               `json:"captureDir"`
+	CaptureMaxBytes    int                  `json:"captureMaxBytes"`
+	DialRetries        int                  `json:"dialRetries"`
+	DialRetryDelay     int                  `json:"dialRetryDelay"`
+	DialRetryMaxDelay  int                  `json:"dialRetryMaxDelay"`
+	HealthCheck        HealthCheckConfig    `json:"healthCheck"`
+	CircuitBreaker     CircuitBreakerConfig `json:"circuitBreaker"`
+	ProxyBind          string               `json:"proxyBind"`
+	ProxyProtocol      bool                 `json:"proxyProtocol"`
+	RealIP             bool                 `json:"realIp"`
+	BungeeCord         bool                 `json:"bungeeCord"`
+	VelocitySecret     string               `json:"velocitySecret"`
+	RewriteHost        string               `json:"rewriteHost"`
+	RewritePort        int                  `json:"rewritePort"`
+	Timeout            int                  `json:"timeout"`
+	DialTimeout        int                  `json:"dialTimeout"`
+	StatusCacheTTL     int                  `json:"statusCacheTTL"`
+	PipeBufferSize     int                  `json:"pipeBufferSize"`
+	IdleTimeout        int                  `json:"idleTimeout"`
+	IngressBytesPerSec int                  `json:"ingressBytesPerSec"`
+	EgressBytesPerSec  int                  `json:"egressBytesPerSec"`
+	DisconnectMessage  string               `json:"disconnectMessage"`
+	MaxPlayers         int                  `json:"maxPlayers"`
+	FullMessage        string               `json:"fullMessage"`
+	Maintenance        bool                 `json:"maintenance"`
+	MaintenanceMessage string               `json:"maintenanceMessage"`
+	Docker             DockerConfig         `json:"docker"`
+	OnlineStatus       StatusConfig         `json:"onlineStatus"`
+	OfflineStatus      StatusConfig         `json:"offlineStatus"`
+	StatusOverride     StatusConfig         `json:"statusOverride"`
+	StatusPatch        StatusPatchConfig    `json:"statusPatch"`
+	AggregatePlayers   bool                 `json:"aggregatePlayers"`
+	CallbackServer     CallbackServerConfig `json:"callbackServer"`
 }
 
 func (cfg *ProxyConfig) Dialer() (*Dialer, error) {
@@ -48,17 +87,107 @@ func (cfg *ProxyConfig) Dialer() (*Dialer, error) {
 		return cfg.dialer, nil
 	}
 
+	timeout := cfg.Timeout
+	if cfg.DialTimeout > 0 {
+		timeout = cfg.DialTimeout
+	}
+
 	cfg.dialer = &Dialer{
 		Dialer: net.Dialer{
-			Timeout: time.Millisecond * time.Duration(cfg.Timeout),
+			Timeout: time.Millisecond * time.Duration(timeout),
 			LocalAddr: &net.TCPAddr{
 				IP: net.ParseIP(cfg.ProxyBind),
 			},
 		},
+		SRV: defaultSRVCache,
 	}
 	return cfg.dialer, nil
 }
 
+// Balancer returns the load balancer of the configured servers
+// or nil if no servers are configured
+func (cfg *ProxyConfig) Balancer() *WeightedRoundRobin {
+	if cfg.balancer != nil || len(cfg.Servers) == 0 {
+		return cfg.balancer
+	}
+
+	cfg.balancer = &WeightedRoundRobin{}
+	for _, server := range cfg.Servers {
+		cfg.balancer.Add(server.Address, server.Weight)
+	}
+	return cfg.balancer
+}
+
+type ServerConfig struct {
+	Address     string `json:"address"`
+	Weight      int    `json:"weight"`
+	MaxPlayers  int    `json:"maxPlayers"`
+	RewriteHost string `json:"rewriteHost"`
+	RewritePort int    `json:"rewritePort"`
+}
+
+func (cfg *ProxyConfig) serverMaxPlayers(addr string) int {
+	for _, server := range cfg.Servers {
+		if server.Address == addr {
+			return server.MaxPlayers
+		}
+	}
+	return 0
+}
+
+// serverRewrite returns the host and port that the handshake for the server with addr
+// is rewritten to. The values of the server take precedence over the ones of the proxy.
+func (cfg *ProxyConfig) serverRewrite(addr string) (string, int) {
+	host, port := cfg.RewriteHost, cfg.RewritePort
+	for _, server := range cfg.Servers {
+		if server.Address != addr {
+			continue
+		}
+		if server.RewriteHost != "" {
+			host = server.RewriteHost
+		}
+		if server.RewritePort > 0 {
+			port = server.RewritePort
+		}
+		break
+	}
+	return host, port
+}
+
+type HealthCheckConfig struct {
+	Interval           int `json:"interval"`
+	Timeout            int `json:"timeout"`
+	UnhealthyThreshold int `json:"unhealthyThreshold"`
+	HealthyThreshold   int `json:"healthyThreshold"`
+}
+
+// CanaryConfig sends a fraction of the new connections to a canary server
+type CanaryConfig struct {
+	ProxyTo  string  `json:"proxyTo"`
+	Fraction float64 `json:"fraction"`
+}
+
+// VersionRouteConfig sends clients with a protocol version from MinProtocol
+// to MaxProtocol to the server at ProxyTo. A MaxProtocol of zero has no upper bound.
+type VersionRouteConfig struct {
+	MinProtocol int    `json:"minProtocol"`
+	MaxProtocol int    `json:"maxProtocol"`
+	ProxyTo     string `json:"proxyTo"`
+}
+
+// Matches reports if protocolVersion is in the range of the route
+func (route VersionRouteConfig) Matches(protocolVersion int) bool {
+	if protocolVersion < route.MinProtocol {
+		return false
+	}
+	return route.MaxProtocol == 0 || protocolVersion <= route.MaxProtocol
+}
+
+type CircuitBreakerConfig struct {
+	FailureThreshold int `json:"failureThreshold"`
+	RecoveryTimeout  int `json:"recoveryTimeout"`
+}
+
 type DockerConfig struct {
 	DNSServer     string `json:"dnsServer"`
 	ContainerName string `json:"containerName"`
@@ -95,6 +224,7 @@ type StatusConfig struct {
 	PlayersOnline  int            `json:"playersOnline"`
 	PlayerSamples  []PlayerSample `json:"playerSamples"`
 	IconPath       string         `json:"iconPath"`
+	Favicon        string         `json:"favicon"`
 	MOTD           string         `json:"motd"`
 }
 
@@ -127,11 +257,13 @@ func (cfg StatusConfig) StatusResponsePacket() (protocol.Packet, error) {
 	}
 
 	if cfg.IconPath != "" {
-		img64, err := loadImageAndEncodeToBase64String(cfg.IconPath)
+		favicon, err := LoadFavicon(cfg.IconPath)
 		if err != nil {
 			return protocol.Packet{}, err
 		}
-		responseJSON.Favicon = fmt.Sprintf("data:image/png;base64,%s", img64)
+		responseJSON.Favicon = favicon
+	} else if cfg.Favicon != "" {
+		responseJSON.Favicon = faviconPrefix + strings.TrimPrefix(cfg.Favicon, faviconPrefix)
 	}
 
 	bb, err := json.Marshal(responseJSON)
@@ -147,47 +279,211 @@ func (cfg StatusConfig) StatusResponsePacket() (protocol.Packet, error) {
 	return packet, nil
 }
 
-func loadImageAndEncodeToBase64String(path string) (string, error) {
-	if path == "" {
-		return "", nil
+// StatusPatchConfig changes single fields of the status response of the server.
+// Fields with their zero value keep what the server sent.
+type StatusPatchConfig struct {
+	VersionName    string `json:"versionName"`
+	ProtocolNumber int    `json:"protocolNumber"`
+	MaxPlayers     int    `json:"maxPlayers"`
+	PlayersOnline  int    `json:"playersOnline"`
+	IconPath       string `json:"iconPath"`
+	MOTD           string `json:"motd"`
+}
+
+func (cfg StatusPatchConfig) IsZero() bool {
+	return cfg == StatusPatchConfig{}
+}
+
+// Apply returns responsePk with the fields of cfg applied.
+// All other fields of the response, like mod info, are kept as they are.
+func (cfg StatusPatchConfig) Apply(responsePk protocol.Packet) (protocol.Packet, error) {
+	response, err := status.UnmarshalClientBoundResponse(responsePk)
+	if err != nil {
+		return protocol.Packet{}, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(response.JSONResponse), &fields); err != nil {
+		return protocol.Packet{}, err
+	}
+
+	version := map[string]interface{}{}
+	if cfg.VersionName != "" {
+		version["name"] = cfg.VersionName
+	}
+	if cfg.ProtocolNumber != 0 {
+		version["protocol"] = cfg.ProtocolNumber
+	}
+	if err := patchJSONObject(fields, "version", version); err != nil {
+		return protocol.Packet{}, err
+	}
+
+	players := map[string]interface{}{}
+	if cfg.MaxPlayers != 0 {
+		players["max"] = cfg.MaxPlayers
+	}
+	if cfg.PlayersOnline != 0 {
+		players["online"] = cfg.PlayersOnline
+	}
+	if err := patchJSONObject(fields, "players", players); err != nil {
+		return protocol.Packet{}, err
+	}
+
+	if cfg.MOTD != "" {
+		if fields["description"], err = json.Marshal(status.DescriptionJSON{Text: cfg.MOTD}); err != nil {
+			return protocol.Packet{}, err
+		}
+	}
+
+	if cfg.IconPath != "" {
+		favicon, err := LoadFavicon(cfg.IconPath)
+		if err != nil {
+			return protocol.Packet{}, err
+		}
+		if fields["favicon"], err = json.Marshal(favicon); err != nil {
+			return protocol.Packet{}, err
+		}
+	}
+
+	bb, err := json.Marshal(fields)
+	if err != nil {
+		return protocol.Packet{}, err
+	}
+
+	return status.ClientBoundResponse{
+		JSONResponse: protocol.String(bb),
+	}.Marshal(), nil
+}
+
+// patchJSONObject sets the values of patch in the JSON object fields[key]
+// and keeps all other values of the object. If fields[key] is null or not an object,
+// it is replaced by a new object with the values of patch.
+func patchJSONObject(fields map[string]json.RawMessage, key string, patch map[string]interface{}) error {
+	if len(patch) == 0 {
+		return nil
+	}
+
+	var object map[string]json.RawMessage
+	if raw, ok := fields[key]; ok {
+		if err := json.Unmarshal(raw, &object); err != nil {
+			object = nil
+		}
+	}
+	if object == nil {
+		object = map[string]json.RawMessage{}
+	}
+
+	for k, v := range patch {
+		bb, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		object[k] = bb
 	}
 
-	imgFile, err := os.Open(path)
+	bb, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	fields[key] = bb
+	return nil
+}
+
+const (
+	faviconSize   = 64
+	faviconPrefix = "data:image/png;base64,"
+)
+
+// favicons caches the favicons that LoadFavicon loaded
+var favicons = faviconCache{entries: map[string]faviconEntry{}}
+
+type faviconCache struct {
+	mu      sync.Mutex
+	entries map[string]faviconEntry
+}
+
+type faviconEntry struct {
+	modTime time.Time
+	size    int64
+	favicon string
+}
+
+// LoadFavicon loads the PNG at path and encodes it as the data URI that the
+// status response expects as favicon. The image has to be 64x64 pixels.
+// The favicon is cached and only loaded again if the file changed.
+func LoadFavicon(path string) (string, error) {
+	info, err := os.Stat(path)
 	if err != nil {
 		return "", err
 	}
-	defer imgFile.Close()
 
-	fileInfo, err := imgFile.Stat()
+	favicons.mu.Lock()
+	entry, ok := favicons.entries[path]
+	favicons.mu.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.favicon, nil
+	}
+
+	favicon, err := loadFavicon(path)
 	if err != nil {
 		return "", err
 	}
 
-	buffer := make([]byte, fileInfo.Size())
-	fileReader := bufio.NewReader(imgFile)
-	_, err = fileReader.Read(buffer)
+	favicons.mu.Lock()
+	favicons.entries[path] = faviconEntry{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		favicon: favicon,
+	}
+	favicons.mu.Unlock()
+	return favicon, nil
+}
+
+func loadFavicon(path string) (string, error) {
+	bb, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	img, err := png.DecodeConfig(bytes.NewReader(bb))
 	if err != nil {
-		return "", nil
+		return "", fmt.Errorf("favicon %s is not a valid PNG: %w", path, err)
+	}
+
+	if img.Width != faviconSize || img.Height != faviconSize {
+		return "", fmt.Errorf("favicon %s is %dx%d pixels; must be %dx%d", path, img.Width, img.Height, faviconSize, faviconSize)
 	}
 
-	return base64.StdEncoding.EncodeToString(buffer), nil
+	return faviconPrefix + base64.StdEncoding.EncodeToString(bb), nil
 }
 
 type CallbackServerConfig struct {
-	URL    string   `json:"url"`
-	Events []string `json:"events"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Timeout int      `json:"timeout"`
+	Retries int      `json:"retries"`
 }
 
 func DefaultProxyConfig() ProxyConfig {
 	return ProxyConfig{
-		DomainName:        "localhost",
-		ListenTo:          ":25565",
-		Timeout:           1000,
-		DisconnectMessage: "Sorry {{username}}, but the server is offline.",
+		DomainName:         "localhost",
+		ListenTo:           ":25565",
+		Timeout:            1000,
+		DisconnectMessage:  "Sorry {{username}}, but the server is offline.",
+		FullMessage:        "Sorry {{username}}, but the server is full.",
+		MaintenanceMessage: "Sorry {{username}}, but the server is under maintenance.",
+		HealthCheck: HealthCheckConfig{
+			Timeout:            1000,
+			UnhealthyThreshold: 3,
+			HealthyThreshold:   2,
+		},
 		Docker: DockerConfig{
 			DNSServer: "127.0.0.11",
 			Timeout:   300000,
 		},
+		CallbackServer: CallbackServerConfig{
+			Timeout: 5000,
+		},
 		OfflineStatus: StatusConfig{
 			VersionName:    "Infrared 1.17",
 			ProtocolNumber: 755,
@@ -310,7 +606,9 @@ func (cfg *ProxyConfig) watch(path string, interval time.Duration) {
 				return
 			}
 			if event.Op&fsnotify.Remove == fsnotify.Remove {
-				cfg.removeCallback()
+				if cfg.removeCallback != nil {
+					cfg.removeCallback()
+				}
 				return
 			}
 			if event.Op&fsnotify.Write == fsnotify.Write {
@@ -326,16 +624,51 @@ func (cfg *ProxyConfig) watch(path string, interval time.Duration) {
 }
 
 func (cfg *ProxyConfig) onConfigWrite(event fsnotify.Event) {
-	log.Println("Updating", event.Name)
-	if err := cfg.LoadFromPath(event.Name); err != nil {
-		log.Printf("Failed update on %s; error %s", event.Name, err)
+	cfg.reload(event.Name)
+}
+
+// reload loads the changed config file at path and notifies the gateway
+func (cfg *ProxyConfig) reload(path string) {
+	log.Println("Updating", path)
+	if err := cfg.LoadFromPath(path); err != nil {
+		log.Printf("Failed update on %s; error %s", path, err)
 		return
 	}
 	cfg.OnlineStatus.cachedPacket = nil
 	cfg.OfflineStatus.cachedPacket = nil
+	cfg.StatusOverride.cachedPacket = nil
 	cfg.dialer = nil
+	cfg.balancer = nil
 	cfg.process = nil
-	cfg.changeCallback()
+	atomic.StoreInt32(&cfg.maintenance, maintenanceFromConfig)
+	if cfg.changeCallback != nil {
+		cfg.changeCallback()
+	}
+}
+
+// SetServerAddrs replaces the servers of cfg with addrs of equal weight and notifies its proxy.
+// Unlike registering a new proxy, the proxy keeps its listener and state.
+func (cfg *ProxyConfig) SetServerAddrs(addrs []string) {
+	cfg.Lock()
+	cfg.ProxyTo = ""
+	cfg.Servers = nil
+	if len(addrs) > 0 {
+		cfg.ProxyTo = addrs[0]
+	}
+	if len(addrs) > 1 {
+		for _, addr := range addrs {
+			cfg.Servers = append(cfg.Servers, ServerConfig{
+				Address: addr,
+				Weight:  1,
+			})
+		}
+	}
+	cfg.balancer = nil
+	cfg.Unlock()
+
+	if cfg.changeCallback != nil {
+		cfg.changeCallback()
+	}
 }
 
 // LoadFromPath loads the ProxyConfig from a file
@@ -358,6 +691,12 @@ func (cfg *ProxyConfig) LoadFromPath(path string) error {
 		return err
 	}
 
+	if isYAMLFile(path) {
+		if bb, err = yamlToJSON(bb); err != nil {
+			return fmt.Errorf("invalid config %s: %w", path, err)
+		}
+	}
+
 	var loadedCfg map[string]interface{}
 	if err := json.Unmarshal(bb, &loadedCfg); err != nil {
 		log.Println(string(bb))
@@ -376,6 +715,21 @@ func (cfg *ProxyConfig) LoadFromPath(path string) error {
 	return json.Unmarshal(bb, cfg)
 }
 
+func isYAMLFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yml" || ext == ".yaml"
+}
+
+// yamlToJSON converts a YAML config to JSON. Unlike JSON configs,
+// YAML configs with unknown fields are rejected.
+func yamlToJSON(bb []byte) ([]byte, error) {
+	var cfg ProxyConfig
+	if err := yaml.UnmarshalStrict(bb, &cfg); err != nil {
+		return nil, err
+	}
+	return yaml.YAMLToJSON(bb)
+}
+
 func WatchProxyConfigFolder(path string, out chan *ProxyConfig) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -0,0 +1,408 @@
+package infrared
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared/protocol"
+	"github.com/haveachin/infrared/protocol/status"
+)
+
+func writePNG(t *testing.T, path string, width, height int) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadFavicon(t *testing.T) {
+	dir := t.TempDir()
+
+	validPath := filepath.Join(dir, "valid.png")
+	writePNG(t, validPath, 64, 64)
+	wrongSizePath := filepath.Join(dir, "wrong-size.png")
+	writePNG(t, wrongSizePath, 128, 64)
+	notPNGPath := filepath.Join(dir, "icon.txt")
+	if err := ioutil.WriteFile(notPNGPath, []byte("not a png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{
+			name: "Valid",
+			path: validPath,
+		},
+		{
+			name:    "WrongSize",
+			path:    wrongSizePath,
+			wantErr: true,
+		},
+		{
+			name:    "NotPNG",
+			path:    notPNGPath,
+			wantErr: true,
+		},
+		{
+			name:    "Missing",
+			path:    filepath.Join(dir, "missing.png"),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			favicon, err := LoadFavicon(tc.path)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got: %q; want an error", favicon)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.HasPrefix(favicon, "data:image/png;base64,") {
+				t.Fatalf("got: %q; want data URI prefix", favicon)
+			}
+
+			bb, err := ioutil.ReadFile(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "data:image/png;base64," + base64.StdEncoding.EncodeToString(bb); favicon != want {
+				t.Errorf("got: %v; want: %v", favicon, want)
+			}
+		})
+	}
+}
+
+func TestLoadFavicon_Cache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "icon.png")
+	writePNG(t, path, 64, 64)
+
+	favicon, err := LoadFavicon(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the file but keep its size and modification time
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, make([]byte, info.Size()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err := LoadFavicon(path)
+	if err != nil {
+		t.Fatalf("got: %v; want the cached favicon", err)
+	}
+	if cached != favicon {
+		t.Errorf("got: %v; want: %v", cached, favicon)
+	}
+
+	// A changed file is loaded again
+	modTime := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if favicon, err := LoadFavicon(path); err == nil {
+		t.Errorf("got: %q; want an error for the changed file", favicon)
+	}
+}
+
+func TestProxyConfig_LoadFromPath_YAML(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"lobby.yml": `
+domainName: lobby.example.com
+listenTo: ":25565"
+proxyTo: lobby:25565
+timeout: 500
+statusOverride:
+  protocolNumber: 755
+  motd: Lobby
+`,
+		"survival.yaml": `
+domainName: survival.example.com
+listenTo: ":25565"
+servers:
+  - address: survival-1:25565
+    weight: 2
+  - address: survival-2:25565
+velocitySecret: secret
+`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var lobby, survival ProxyConfig
+	if err := lobby.LoadFromPath(filepath.Join(dir, "lobby.yml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := survival.LoadFromPath(filepath.Join(dir, "survival.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	if lobby.DomainName != "lobby.example.com" || lobby.ProxyTo != "lobby:25565" || lobby.Timeout != 500 {
+		t.Errorf("got: %v; want lobby config", lobby.DomainName)
+	}
+	if lobby.StatusOverride.ProtocolNumber != 755 || lobby.StatusOverride.MOTD != "Lobby" {
+		t.Errorf("got: %v; want: status override", lobby.StatusOverride)
+	}
+
+	expectedServers := []ServerConfig{
+		{Address: "survival-1:25565", Weight: 2},
+		{Address: "survival-2:25565"},
+	}
+	if len(survival.Servers) != len(expectedServers) {
+		t.Fatalf("got: %v; want: %v", survival.Servers, expectedServers)
+	}
+	for i, server := range survival.Servers {
+		if server != expectedServers[i] {
+			t.Errorf("got: %v; want: %v", server, expectedServers[i])
+		}
+	}
+	if survival.VelocitySecret != "secret" {
+		t.Errorf("got: %v; want: %v", survival.VelocitySecret, "secret")
+	}
+	// Fields that are not set fall back to the defaults like in JSON configs
+	if survival.Timeout != DefaultProxyConfig().Timeout {
+		t.Errorf("got: %v; want: %v", survival.Timeout, DefaultProxyConfig().Timeout)
+	}
+}
+
+func TestProxyConfig_LoadFromPath_YAMLUnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yml")
+	content := "domainName: mc.example.com\nproxyTo: mc:25565\nbackend: mc:25566\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg ProxyConfig
+	if err := cfg.LoadFromPath(path); err == nil || !strings.Contains(err.Error(), "backend") {
+		t.Errorf("got: %v; want: unknown field error", err)
+	}
+}
+
+func TestStatusPatchConfig_Apply(t *testing.T) {
+	iconPath := filepath.Join(t.TempDir(), "icon.png")
+	writePNG(t, iconPath, faviconSize, faviconSize)
+	favicon, err := LoadFavicon(iconPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverJSON := `{
+		"version": {"name": "Paper 1.17", "protocol": 755},
+		"players": {"max": 20, "online": 3, "sample": [{"name": "Steve", "id": "00000000-0000-0000-0000-000000000001"}]},
+		"description": {"extra": [{"text": "Hello", "bold": true}], "text": ""},
+		"favicon": "data:image/png;base64,AAAA",
+		"modinfo": {"type": "FML", "modList": []}
+	}`
+
+	tt := []struct {
+		name  string
+		patch StatusPatchConfig
+		// changed holds the expected changes to serverJSON
+		changed map[string]interface{}
+	}{
+		{
+			name: "VersionName",
+			patch: StatusPatchConfig{
+				VersionName: "Infrared",
+			},
+			changed: map[string]interface{}{
+				"version": map[string]interface{}{"name": "Infrared", "protocol": 755.0},
+			},
+		},
+		{
+			name: "Players",
+			patch: StatusPatchConfig{
+				MaxPlayers: 100,
+			},
+			changed: map[string]interface{}{
+				"players": map[string]interface{}{
+					"max":    100.0,
+					"online": 3.0,
+					"sample": []interface{}{
+						map[string]interface{}{"name": "Steve", "id": "00000000-0000-0000-0000-000000000001"},
+					},
+				},
+			},
+		},
+		{
+			name: "MOTDAndIcon",
+			patch: StatusPatchConfig{
+				MOTD:     "Lobby",
+				IconPath: iconPath,
+			},
+			changed: map[string]interface{}{
+				"description": map[string]interface{}{"text": "Lobby"},
+				"favicon":     favicon,
+			},
+		},
+		{
+			name: "MOTDAndVersionKeepPlayers",
+			patch: StatusPatchConfig{
+				VersionName: "Infrared",
+				MOTD:        "Lobby",
+			},
+			changed: map[string]interface{}{
+				"version":     map[string]interface{}{"name": "Infrared", "protocol": 755.0},
+				"description": map[string]interface{}{"text": "Lobby"},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			pk := status.ClientBoundResponse{JSONResponse: protocol.String(serverJSON)}.Marshal()
+			patchedPk, err := tc.patch.Apply(pk)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := status.UnmarshalClientBoundResponse(patchedPk)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got, want map[string]interface{}
+			if err := json.Unmarshal([]byte(response.JSONResponse), &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(serverJSON), &want); err != nil {
+				t.Fatal(err)
+			}
+			for key, value := range tc.changed {
+				want[key] = value
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got: %v; want: %v", got, want)
+			}
+		})
+	}
+}
+
+func TestStatusPatchConfig_ApplyInvalidObjects(t *testing.T) {
+	patch := StatusPatchConfig{
+		VersionName: "Infrared",
+		MaxPlayers:  100,
+	}
+
+	tt := []struct {
+		name       string
+		serverJSON string
+	}{
+		{
+			name:       "Null",
+			serverJSON: `{"version": null, "players": null}`,
+		},
+		{
+			name:       "NotObjects",
+			serverJSON: `{"version": "1.17", "players": 20}`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			pk := status.ClientBoundResponse{JSONResponse: protocol.String(tc.serverJSON)}.Marshal()
+			patchedPk, err := patch.Apply(pk)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := status.UnmarshalClientBoundResponse(patchedPk)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got map[string]interface{}
+			if err := json.Unmarshal([]byte(response.JSONResponse), &got); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]interface{}{
+				"version": map[string]interface{}{"name": "Infrared"},
+				"players": map[string]interface{}{"max": 100.0},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got: %v; want: %v", got, want)
+			}
+		})
+	}
+}
+
+func TestVersionRouteConfig_Matches(t *testing.T) {
+	tt := []struct {
+		name            string
+		route           VersionRouteConfig
+		protocolVersion int
+		expected        bool
+	}{
+		{
+			name:            "InRange",
+			route:           VersionRouteConfig{MinProtocol: 47, MaxProtocol: 340},
+			protocolVersion: 107,
+			expected:        true,
+		},
+		{
+			name:            "BelowRange",
+			route:           VersionRouteConfig{MinProtocol: 47, MaxProtocol: 340},
+			protocolVersion: 46,
+			expected:        false,
+		},
+		{
+			name:            "AboveRange",
+			route:           VersionRouteConfig{MinProtocol: 47, MaxProtocol: 340},
+			protocolVersion: 341,
+			expected:        false,
+		},
+		{
+			name:            "NoUpperBound",
+			route:           VersionRouteConfig{MinProtocol: 735},
+			protocolVersion: 763,
+			expected:        true,
+		},
+		{
+			name:            "NoBounds",
+			protocolVersion: 0,
+			expected:        true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.route.Matches(tc.protocolVersion); got != tc.expected {
+				t.Errorf("got: %v; want: %v", got, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package infrared
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+type polledConfig struct {
+	cfg      *ProxyConfig
+	checksum [sha256.Size]byte
+}
+
+// PollProxyConfigFolder loads all proxy configs in path and then polls the folder every interval.
+// It is an alternative to watching with fsnotify, which does not work on every file system.
+// Configs of new files are sent to out, changed files are reloaded and removed files close their proxy.
+// Connections of closed proxies are not dropped, they end when the player leaves.
+// The returned stop function stops the polling and closes out.
+func PollProxyConfigFolder(path string, interval time.Duration, out chan *ProxyConfig) ([]*ProxyConfig, func(), error) {
+	configs := map[string]*polledConfig{}
+	filePaths, err := ReadFilePaths(path, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cfgs []*ProxyConfig
+	for _, filePath := range filePaths {
+		polled, err := loadPolledConfig(filePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		configs[filePath] = polled
+		cfgs = append(cfgs, polled.cfg)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer close(out)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				pollConfigs(path, configs, out, done)
+			}
+		}
+	}()
+
+	stop := func() {
+		close(done)
+		<-stopped
+	}
+	return cfgs, stop, nil
+}
+
+func pollConfigs(path string, configs map[string]*polledConfig, out chan *ProxyConfig, done chan struct{}) {
+	filePaths, err := ReadFilePaths(path, false)
+	if err != nil {
+		log.Printf("Failed polling %s; error %s", path, err)
+		return
+	}
+
+	found := map[string]bool{}
+	for _, filePath := range filePaths {
+		found[filePath] = true
+
+		polled, ok := configs[filePath]
+		if !ok {
+			polled, err := loadPolledConfig(filePath)
+			if err != nil {
+				log.Printf("Failed loading %s; error %s", filePath, err)
+				continue
+			}
+			configs[filePath] = polled
+			select {
+			case out <- polled.cfg:
+			case <-done:
+				return
+			}
+			continue
+		}
+
+		bb, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			log.Printf("Failed reading %s; error %s", filePath, err)
+			continue
+		}
+
+		if checksum := sha256.Sum256(bb); checksum != polled.checksum {
+			polled.checksum = checksum
+			polled.cfg.reload(filePath)
+		}
+	}
+
+	for filePath, polled := range configs {
+		if found[filePath] {
+			continue
+		}
+
+		log.Println("Removing", filePath)
+		delete(configs, filePath)
+		if polled.cfg.removeCallback != nil {
+			polled.cfg.removeCallback()
+		}
+	}
+}
+
+func loadPolledConfig(path string) (*polledConfig, error) {
+	log.Println("Loading", path)
+
+	bb, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg ProxyConfig
+	if err := cfg.LoadFromPath(path); err != nil {
+		return nil, err
+	}
+
+	return &polledConfig{
+		cfg:      &cfg,
+		checksum: sha256.Sum256(bb),
+	}, nil
+}
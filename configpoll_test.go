@@ -0,0 +1,139 @@
+package infrared
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared/protocol/login"
+)
+
+func writeProxyConfig(t *testing.T, path string, cfg *ProxyConfig) {
+	bb, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, bb, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitForProxyUIDs(t *testing.T, gateway *Gateway, expected ...string) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := map[string]bool{}
+		for _, uid := range gateway.ProxyUIDs() {
+			got[uid] = true
+		}
+
+		ok := len(got) == len(expected)
+		for _, uid := range expected {
+			ok = ok && got[uid]
+		}
+		if ok {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("got: %v; want: %v", gateway.ProxyUIDs(), expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPollProxyConfigFolder(t *testing.T) {
+	portEnd := 615
+	server, err := Listen(serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer server.Close()
+
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Skip the handshake and login start
+		for i := 0; i < 2; i++ {
+			if _, err := conn.ReadPacket(); err != nil {
+				return
+			}
+		}
+		io.Copy(conn, conn)
+	}()
+
+	dir := t.TempDir()
+	lobbyPath := filepath.Join(dir, "lobby.json")
+	lobbyCfg := proxyConfigWithPortEnd(portEnd)
+	writeProxyConfig(t, lobbyPath, lobbyCfg)
+
+	out := make(chan *ProxyConfig)
+	cfgs, stop, err := PollProxyConfigFolder(dir, 10*time.Millisecond, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configsToProxies(cfgs)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	go func() {
+		for cfg := range out {
+			gateway.RegisterProxy(&Proxy{Config: cfg})
+		}
+	}()
+
+	// Keep a player connected while the configs change
+	conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't make a connection with gateway: %v", err)
+	}
+	defer conn.Close()
+	if err := sendHandshake(conn, loginHandshakePort(portEnd)); err != nil {
+		t.Fatalf("%s: %v", err.Message, err.Error)
+	}
+	if err := conn.WritePacket(login.ServerLoginStart{Name: "Steve"}.Marshal()); err != nil {
+		t.Fatalf("Can't write login start packet: %v", err)
+	}
+
+	lobbyUID := proxyUID(serverDomain, gatewayAddr(portEnd))
+	survivalUID := proxyUID("survival."+serverDomain, gatewayAddr(portEnd))
+
+	survivalPath := filepath.Join(dir, "survival.json")
+	survivalCfg := proxyConfigWithPortEnd(portEnd)
+	survivalCfg.DomainName = "survival." + serverDomain
+	writeProxyConfig(t, survivalPath, survivalCfg)
+	waitForProxyUIDs(t, &gateway, lobbyUID, survivalUID)
+
+	lobbyCfg.DomainNames = []string{"hub." + serverDomain}
+	writeProxyConfig(t, lobbyPath, lobbyCfg)
+	hubUID := proxyUID("hub."+serverDomain, gatewayAddr(portEnd))
+	waitForProxyUIDs(t, &gateway, lobbyUID, hubUID, survivalUID)
+
+	if err := os.Remove(survivalPath); err != nil {
+		t.Fatal(err)
+	}
+	waitForProxyUIDs(t, &gateway, lobbyUID, hubUID)
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("Connection was dropped: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Errorf("got: %v; want: %v", string(got), "ping")
+	}
+}
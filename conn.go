@@ -2,10 +2,17 @@ package infrared
 
 import (
 	"bufio"
+	"context"
 	"crypto/cipher"
+	"crypto/tls"
+	"fmt"
 	"github.com/haveachin/infrared/protocol"
+	"github.com/haveachin/infrared/protocol/handshaking"
 	"io"
 	"net"
+	"os"
+	"sync/atomic"
+	"time"
 )
 
 type PacketWriter interface {
@@ -21,27 +28,183 @@ type PacketPeeker interface {
 }
 
 type conn struct {
+	// bytesRead and bytesWritten are accessed atomically and come first
+	// to be 64-bit aligned on 32-bit platforms
+	bytesRead    int64
+	bytesWritten int64
+
 	net.Conn
 
 	r *bufio.Reader
 	w io.Writer
+
+	// compressionThreshold is accessed atomically and negative while compression is disabled,
+	// since pipes enable compression for both directions while the other one is reading
+	compressionThreshold int32
+	// maxPacketLength limits the length of read packets below protocol.MaxPacketLength if positive
+	maxPacketLength int
+	// packetPool is the pool ReadPooledPacket reads into if set
+	packetPool *protocol.PacketPool
 }
 
 type Listener struct {
 	net.Listener
+
+	// IPFilter closes every accepted connection that does not pass the filter if set
+	IPFilter *IPFilter
+
+	// TCPOptions are applied to every accepted connection
+	TCPOptions TCPOptions
+
+	// MaxPacketLength is the largest packet length accepted connections read if positive.
+	// Longer packets fail before anything is allocated for them.
+	MaxPacketLength int
+
+	// MinReadRate disconnects accepted connections that send too slowly
+	// until their read deadline is cleared if enabled
+	MinReadRate MinReadRate
+
+	// PacketPool is the pool accepted connections read packets into when they are piped packet by packet if set
+	PacketPool *protocol.PacketPool
+
+	// Logger receives a record for every connection that is closed right after it was accepted if set
+	Logger Logger
+}
+
+// TCPOptions tunes the socket of a TCP connection.
+// The zero value leaves the defaults of the operating system and Go untouched.
+type TCPOptions struct {
+	// NoDelay disables Nagle's algorithm so that small packets are sent without delay
+	NoDelay bool
+	// KeepAlivePeriod enables TCP keep-alives with this period if it is greater than zero.
+	// Keep-alives detect peers that vanished without closing the connection.
+	KeepAlivePeriod time.Duration
+}
+
+// Apply applies the options to c if it is a *net.TCPConn and does nothing otherwise
+func (opts TCPOptions) Apply(c net.Conn) error {
+	tcpConn, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if opts.NoDelay {
+		if err := tcpConn.SetNoDelay(true); err != nil {
+			return err
+		}
+	}
+
+	if opts.KeepAlivePeriod > 0 {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tcpConn.SetKeepAlivePeriod(opts.KeepAlivePeriod); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func Listen(addr string) (Listener, error) {
-	l, err := net.Listen("tcp", addr)
+	return ListenNetwork("tcp", addr)
+}
+
+// ListenNetwork creates a Listener on addr of network, which is "tcp", "tcp4", "tcp6" or "unix".
+// Connections are handled the same way for every network.
+func ListenNetwork(network, addr string) (Listener, error) {
+	l, err := net.Listen(network, addr)
 	return Listener{Listener: l}, err
 }
 
-func (l Listener) Accept() (Conn, error) {
-	conn, err := l.Listener.Accept()
+// UnixAddrPrefix marks listen addresses of proxies that are paths of Unix domain sockets
+const UnixAddrPrefix = "unix:"
+
+// ListenUnix creates a Listener on a Unix domain socket at path.
+// The file mode of the socket is set to mode unless it is zero.
+// A socket that is left at path by a process that did not shut down cleanly is removed first.
+func ListenUnix(path string, mode os.FileMode) (Listener, error) {
+	if err := removeStaleUnixSocket(path); err != nil {
+		return Listener{}, err
+	}
+
+	l, err := net.Listen("unix", path)
 	if err != nil {
-		return nil, err
+		return Listener{}, err
 	}
-	return wrapConn(conn), nil
+
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return Listener{}, err
+		}
+	}
+	return Listener{Listener: l}, nil
+}
+
+// removeStaleUnixSocket removes the socket at path if nothing listens on it anymore.
+// Sockets in use and files that aren't sockets are left alone.
+func removeStaleUnixSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	c, err := net.Dial("unix", path)
+	if err == nil {
+		c.Close()
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ListenTLS creates a Listener that terminates TLS on every accepted connection
+// before it is handed over as a Minecraft connection
+func ListenTLS(addr string, config *tls.Config) (Listener, error) {
+	l, err := tls.Listen("tcp", addr, config)
+	return Listener{Listener: l}, err
+}
+
+func (l Listener) Accept() (Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.IPFilter != nil && !l.IPFilter.AllowedAddr(conn.RemoteAddr()) {
+			loggerOrNoop(l.Logger).Debug("ip filter denied connection", "remote_addr", conn.RemoteAddr().String())
+			hardClose(conn)
+			continue
+		}
+
+		// Only fails if the connection is already broken
+		if err := l.TCPOptions.Apply(conn); err != nil {
+			loggerOrNoop(l.Logger).Debug("failed to apply tcp options", "remote_addr", conn.RemoteAddr().String(), "error", err)
+			hardClose(conn)
+			continue
+		}
+
+		if l.MinReadRate.enabled() {
+			conn = newReadRateConn(conn, l.MinReadRate)
+		}
+
+		c := wrapConn(conn)
+		c.maxPacketLength = l.MaxPacketLength
+		c.packetPool = l.PacketPool
+		return c, nil
+	}
+}
+
+// hardClose closes conn without sending any data and resets TCP connections
+func hardClose(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+	_ = conn.Close()
 }
 
 // Conn is a minecraft Connection
@@ -52,29 +215,122 @@ type Conn interface {
 	PacketPeeker
 
 	Reader() *bufio.Reader
+	EnableCompression(threshold int)
+
+	// BytesRead returns the number of bytes read from the underlying connection
+	BytesRead() int64
+	// BytesWritten returns the number of bytes written to the underlying connection
+	BytesWritten() int64
 }
 
 // wrapConn warp an net.Conn to infared.conn
 func wrapConn(c net.Conn) *conn {
-	return &conn{
+	wrapped := &conn{
 		Conn: c,
-		r:    bufio.NewReader(c),
-		w:    c,
+
+		compressionThreshold: -1,
 	}
+	wrapped.r = bufio.NewReader(countingReader{wrapped})
+	wrapped.w = countingWriter{wrapped}
+	return wrapped
+}
+
+// countingReader reads from the underlying connection of c and counts the bytes
+type countingReader struct {
+	c *conn
+}
+
+func (r countingReader) Read(b []byte) (int, error) {
+	n, err := r.c.Conn.Read(b)
+	atomic.AddInt64(&r.c.bytesRead, int64(n))
+	return n, err
+}
+
+// countingWriter writes to the underlying connection of c and counts the bytes
+type countingWriter struct {
+	c *conn
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	n, err := w.c.Conn.Write(b)
+	atomic.AddInt64(&w.c.bytesWritten, int64(n))
+	return n, err
 }
 
 type Dialer struct {
 	net.Dialer
+
+	// SRV resolves addresses without a port if set
+	SRV *SRVCache
+
+	// TCPOptions are applied to every dialed connection
+	TCPOptions TCPOptions
+
+	// PacketPool is the pool dialed connections read packets into when they are piped packet by packet if set
+	PacketPool *protocol.PacketPool
 }
 
 // Dial create a Minecraft connection
 func (d Dialer) Dial(addr string) (Conn, error) {
-	conn, err := d.Dialer.Dial("tcp", addr)
+	return d.DialContext(context.Background(), addr)
+}
+
+// DialContext creates a Minecraft connection and aborts if ctx is done before it is established
+func (d Dialer) DialContext(ctx context.Context, addr string) (Conn, error) {
+	if d.SRV != nil {
+		resolveCtx := ctx
+		if d.Timeout > 0 {
+			var cancel context.CancelFunc
+			resolveCtx, cancel = context.WithTimeout(ctx, d.Timeout)
+			defer cancel()
+		}
+		addr = d.SRV.Resolve(resolveCtx, addr)
+	}
+
+	conn, err := d.Dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
 
-	return wrapConn(conn), nil
+	if err := d.TCPOptions.Apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := wrapConn(conn)
+	c.packetPool = d.PacketPool
+	return c, nil
+}
+
+// DialServer dials req.ServerAddr so that a Dialer can be used as ServerDialer
+func (d Dialer) DialServer(ctx context.Context, req DialRequest) (Conn, error) {
+	return d.DialContext(ctx, req.ServerAddr)
+}
+
+// DialRequest describes a server connection that a proxy needs
+type DialRequest struct {
+	// ServerAddr is the address of the server to dial
+	ServerAddr string
+	// ClientAddr is the address of the client the connection is for.
+	// It is nil for connections the proxy makes on its own, like requesting the status of a server.
+	ClientAddr net.Addr
+	// Handshake is the handshake the client sent; zero if ClientAddr is nil
+	Handshake handshaking.ServerBoundHandshake
+	// Username is the name the client logs in with; empty for status requests
+	Username string
+}
+
+// ServerDialer dials the server connections of a proxy
+type ServerDialer interface {
+	DialServer(ctx context.Context, req DialRequest) (Conn, error)
+}
+
+// ServerDialerFunc adapts a function to a ServerDialer
+type ServerDialerFunc func(ctx context.Context, req DialRequest) (Conn, error)
+
+// DialServer calls fn(ctx, req)
+func (fn ServerDialerFunc) DialServer(ctx context.Context, req DialRequest) (Conn, error) {
+	return fn(ctx, req)
 }
 
 func (c *conn) Read(b []byte) (int, error) {
@@ -87,17 +343,93 @@ func (c *conn) Write(b []byte) (int, error) {
 
 // ReadPacket read a Packet from Conn.
 func (c *conn) ReadPacket() (protocol.Packet, error) {
+	c.waitForPacket()
+	if err := c.checkPacketLength(); err != nil {
+		return protocol.Packet{}, err
+	}
+	if threshold := c.threshold(); threshold >= 0 {
+		return protocol.ReadCompressedPacket(c.r, threshold)
+	}
 	return protocol.ReadPacket(c.r)
 }
 
 // PeekPacket peeks a Packet from Conn.
 func (c *conn) PeekPacket() (protocol.Packet, error) {
+	c.waitForPacket()
+	if err := c.checkPacketLength(); err != nil {
+		return protocol.Packet{}, err
+	}
+	if threshold := c.threshold(); threshold >= 0 {
+		return protocol.PeekCompressedPacket(c.r, threshold)
+	}
 	return protocol.PeekPacket(c.r)
 }
 
+// ReadPooledPacket works like ReadPacket but reads into a packet of the PacketPool of c if it has one.
+// The packet has to be handed back with ReleasePacket once it is no longer used.
+func (c *conn) ReadPooledPacket() (*protocol.Packet, error) {
+	if c.packetPool == nil {
+		pk, err := c.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		return &pk, nil
+	}
+
+	c.waitForPacket()
+	if err := c.checkPacketLength(); err != nil {
+		return nil, err
+	}
+	if threshold := c.threshold(); threshold >= 0 {
+		pk, err := protocol.ReadCompressedPacket(c.r, threshold)
+		if err != nil {
+			return nil, err
+		}
+		return &pk, nil
+	}
+	return c.packetPool.ReadPacket(c.r)
+}
+
+// ReleasePacket puts a packet of ReadPooledPacket back into the PacketPool of c
+func (c *conn) ReleasePacket(pk *protocol.Packet) {
+	if c.packetPool != nil {
+		c.packetPool.Put(pk)
+	}
+}
+
+// waitForPacket blocks until the next packet starts to arrive, so that the compression threshold
+// is only checked afterwards; a pipe can enable compression while a read is blocked.
+// Errors are left to the read of the packet.
+func (c *conn) waitForPacket() {
+	_, _ = c.r.Peek(1)
+}
+
+// checkPacketLength peeks the length of the next packet and fails if it exceeds maxPacketLength
+func (c *conn) checkPacketLength() error {
+	if c.maxPacketLength <= 0 {
+		return nil
+	}
+
+	length, err := protocol.PeekPacketLength(c.r)
+	if err != nil {
+		return err
+	}
+
+	if length > c.maxPacketLength {
+		return fmt.Errorf("%w: length of %d bytes exceeds the limit of %d", protocol.ErrPacketTooLong, length, c.maxPacketLength)
+	}
+	return nil
+}
+
 //WritePacket write a Packet to Conn.
 func (c *conn) WritePacket(p protocol.Packet) error {
-	pk, err := p.Marshal()
+	var pk []byte
+	var err error
+	if threshold := c.threshold(); threshold >= 0 {
+		pk, err = p.MarshalCompressed(threshold)
+	} else {
+		pk, err = p.Marshal()
+	}
 	if err != nil {
 		return err
 	}
@@ -109,14 +441,39 @@ func (c *conn) WritePacket(p protocol.Packet) error {
 func (c *conn) SetCipher(ecoStream, decoStream cipher.Stream) {
 	c.r = bufio.NewReader(cipher.StreamReader{
 		S: decoStream,
-		R: c.Conn,
+		R: countingReader{c},
 	})
 	c.w = cipher.StreamWriter{
 		S: ecoStream,
-		W: c.Conn,
+		W: countingWriter{c},
 	}
 }
 
+// EnableCompression compresses every packet of this Conn that is at least threshold bytes long
+// and decompresses incoming packets like after a Set Compression packet.
+// A negative threshold disables compression again.
+func (c *conn) EnableCompression(threshold int) {
+	atomic.StoreInt32(&c.compressionThreshold, int32(threshold))
+}
+
+func (c *conn) threshold() int {
+	return int(atomic.LoadInt32(&c.compressionThreshold))
+}
+
+// isPlain reports if c reads and writes the bytes of its connection as they are, without a cipher
+func (c *conn) isPlain() bool {
+	_, ok := c.w.(countingWriter)
+	return ok
+}
+
 func (c *conn) Reader() *bufio.Reader {
 	return c.r
 }
+
+func (c *conn) BytesRead() int64 {
+	return atomic.LoadInt64(&c.bytesRead)
+}
+
+func (c *conn) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.bytesWritten)
+}
@@ -0,0 +1,149 @@
+package infrared
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/haveachin/infrared/protocol/status"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "infrared.sock")
+	l, err := ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("got: %v; want: %v", mode, os.FileMode(0600))
+	}
+
+	go func() {
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		wrapConn(c).WritePacket(statusHandshakePort(643))
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	pk, err := c.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := statusHandshakePort(643); pk.ID != want.ID || string(pk.Data) != string(want.Data) {
+		t.Errorf("got: %v; want: %v", pk, want)
+	}
+}
+
+func TestListenUnix_AddressInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "infrared.sock")
+	l, err := ListenUnix(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err := ListenUnix(path, 0); err == nil {
+		t.Error("got: nil; want: error for a socket path that is in use")
+	}
+}
+
+func TestListenUnix_StaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "infrared.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave the socket file behind like a crashed process does
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := ListenUnix(path, 0)
+	if err != nil {
+		t.Fatalf("got: %v; want: stale socket to be replaced", err)
+	}
+	l.Close()
+}
+
+func TestListenUnix_RegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "infrared.sock")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err := ListenUnix(path, 0); err == nil {
+		l.Close()
+		t.Error("got: nil; want: error for a path that is a regular file")
+	}
+	if bb, err := os.ReadFile(path); err != nil || string(bb) != "data" {
+		t.Errorf("got: %q, %v; want: the regular file to be kept", bb, err)
+	}
+}
+
+func TestGateway_ListenUnix(t *testing.T) {
+	portEnd := 643
+	path := filepath.Join(t.TempDir(), "infrared.sock")
+
+	config := createBasicProxyConfig(serverDomain, UnixAddrPrefix+path, serverAddr(portEnd))
+	config.OfflineStatus = offlineStatus
+
+	gateway := Gateway{UnixSocketMode: 0660}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0660 {
+		t.Errorf("got: %v; want: %v", mode, os.FileMode(0660))
+	}
+
+	netConn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Can't connect to the gateway socket: %v", err)
+	}
+	conn := wrapConn(netConn)
+	defer conn.Close()
+
+	if err := sendHandshake(conn, statusHandshakePort(portEnd)); err != nil {
+		t.Fatalf("%s: %v", err.Message, err.Error)
+	}
+	if err := conn.WritePacket(status.ServerBoundRequest{}.Marshal()); err != nil {
+		t.Fatalf("Can't write status request packet: %v", err)
+	}
+
+	pk, err := conn.ReadPacket()
+	if err != nil {
+		t.Fatalf("Can't read status response packet: %v", err)
+	}
+	response, err := status.UnmarshalClientBoundResponse(pk)
+	if err != nil {
+		t.Fatalf("Can't unmarshal status response packet: %v", err)
+	}
+
+	res := status.ResponseJSON{}
+	if err := json.Unmarshal([]byte(response.JSONResponse), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Version.Name != offlineStatus.VersionName {
+		t.Errorf("got: %v; want: %v", res.Version.Name, offlineStatus.VersionName)
+	}
+}
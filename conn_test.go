@@ -0,0 +1,514 @@
+package infrared
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared/protocol"
+	"github.com/haveachin/infrared/protocol/login"
+)
+
+func TestConn_WritePacket(t *testing.T) {
+	tt := []struct {
+		name   string
+		packet protocol.Packet
+	}{
+		{
+			name:   "EmptyPacket",
+			packet: protocol.Packet{ID: 0x00},
+		},
+		{
+			name: "PacketWithData",
+			packet: protocol.Packet{
+				ID:   0x01,
+				Data: []byte{0x0d, 0x48, 0x65, 0x6c, 0x6c, 0x6f},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+
+			want, err := tc.packet.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- wrapConn(c1).WritePacket(tc.packet)
+			}()
+
+			got := make([]byte, len(want))
+			if _, err := c2.Read(got); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Errorf("got: %v; want: %v", got, want)
+			}
+		})
+	}
+}
+
+func TestConn_ByteCounters(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client, server := wrapConn(c1), wrapConn(c2)
+	defer client.Close()
+	defer server.Close()
+
+	pk := protocol.Packet{ID: 0x01, Data: []byte{0x0d, 0x48, 0x65, 0x6c, 0x6c, 0x6f}}
+	bb, err := pk.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := []byte("raw data")
+
+	// Both directions run at the same time like the two directions of a pipe
+	errCh := make(chan error, 4)
+	go func() {
+		if err := client.WritePacket(pk); err != nil {
+			errCh <- err
+			return
+		}
+		_, err := client.Write(raw)
+		errCh <- err
+	}()
+	go func() {
+		_, err := server.Write(raw)
+		errCh <- err
+	}()
+	go func() {
+		if _, err := server.ReadPacket(); err != nil {
+			errCh <- err
+			return
+		}
+		_, err := io.ReadFull(server, make([]byte, len(raw)))
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.ReadFull(client, make([]byte, len(raw)))
+		errCh <- err
+	}()
+
+	for i := 0; i < 4; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serverBound := int64(len(bb) + len(raw))
+	clientBound := int64(len(raw))
+	if n := client.BytesWritten(); n != serverBound {
+		t.Errorf("client written: got: %d; want: %d", n, serverBound)
+	}
+	if n := server.BytesRead(); n != serverBound {
+		t.Errorf("server read: got: %d; want: %d", n, serverBound)
+	}
+	if n := server.BytesWritten(); n != clientBound {
+		t.Errorf("server written: got: %d; want: %d", n, clientBound)
+	}
+	if n := client.BytesRead(); n != clientBound {
+		t.Errorf("client read: got: %d; want: %d", n, clientBound)
+	}
+}
+
+func TestConn_WritePacket_PropagatesError(t *testing.T) {
+	c1, c2 := net.Pipe()
+	c2.Close()
+	c1.Close()
+
+	if err := wrapConn(c1).WritePacket(protocol.Packet{ID: 0x00}); err == nil {
+		t.Error("expected write error, got nil")
+	}
+}
+
+func TestConn_ReadPacket_Deadline(t *testing.T) {
+	tt := []struct {
+		name          string
+		writeDelay    time.Duration
+		expectTimeout bool
+	}{
+		{
+			name:          "FastReader",
+			writeDelay:    0,
+			expectTimeout: false,
+		},
+		{
+			name:          "SlowReader",
+			writeDelay:    500 * time.Millisecond,
+			expectTimeout: true,
+		},
+	}
+
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+
+			go func() {
+				time.Sleep(tc.writeDelay)
+				_ = wrapConn(c1).WritePacket(protocol.Packet{ID: 0x00})
+			}()
+
+			conn := wrapConn(c2)
+			if err := conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := conn.ReadPacket()
+			netErr, isNetErr := err.(net.Error)
+			isTimeout := isNetErr && netErr.Timeout()
+			if isTimeout != tc.expectTimeout {
+				t.Errorf("got timeout: %v; want: %v; error: %v", isTimeout, tc.expectTimeout, err)
+			}
+		})
+	}
+}
+
+func TestConn_EnableCompression(t *testing.T) {
+	tt := []struct {
+		name   string
+		packet protocol.Packet
+	}{
+		{
+			name:   "BelowThreshold",
+			packet: protocol.Packet{ID: 0x01, Data: []byte{0x0d, 0x48, 0x65, 0x6c, 0x6c, 0x6f}},
+		},
+		{
+			name:   "AboveThreshold",
+			packet: protocol.Packet{ID: 0x01, Data: bytes.Repeat([]byte{0x0d}, 512)},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+
+			w, r := wrapConn(c1), wrapConn(c2)
+			w.EnableCompression(256)
+			r.EnableCompression(256)
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- w.WritePacket(tc.packet)
+			}()
+
+			pk, err := r.ReadPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+
+			if pk.ID != tc.packet.ID || !bytes.Equal(pk.Data, tc.packet.Data) {
+				t.Errorf("got: %v; want: %v", pk, tc.packet)
+			}
+		})
+	}
+}
+
+func TestConn_ReadPooledPacket(t *testing.T) {
+	tt := []struct {
+		name      string
+		pool      *protocol.PacketPool
+		threshold int
+	}{
+		{
+			name:      "WithoutPool",
+			threshold: -1,
+		},
+		{
+			name:      "Pool",
+			pool:      &protocol.PacketPool{},
+			threshold: -1,
+		},
+		{
+			name:      "PoolWithCompression",
+			pool:      &protocol.PacketPool{},
+			threshold: 256,
+		},
+	}
+
+	packets := []protocol.Packet{
+		{ID: 0x01, Data: bytes.Repeat([]byte{0x0d}, 512)},
+		{ID: 0x02, Data: []byte{0x48, 0x65, 0x6c, 0x6c, 0x6f}},
+		{ID: 0x03, Data: []byte{}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+
+			w, r := wrapConn(c1), wrapConn(c2)
+			r.packetPool = tc.pool
+			w.EnableCompression(tc.threshold)
+			r.EnableCompression(tc.threshold)
+
+			go func() {
+				for _, pk := range packets {
+					if err := w.WritePacket(pk); err != nil {
+						return
+					}
+				}
+			}()
+
+			// Released packets are reused for the following reads
+			for _, expected := range packets {
+				pk, err := r.ReadPooledPacket()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if pk.ID != expected.ID || !bytes.Equal(pk.Data, expected.Data) {
+					t.Errorf("got: %v; want: %v", pk, expected)
+				}
+				r.ReleasePacket(pk)
+			}
+		})
+	}
+}
+
+func TestConn_SetCompression(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	server, client := wrapConn(c1), wrapConn(c2)
+	packets := []protocol.Packet{
+		{ID: 0x02, Data: []byte{0x0d, 0x48, 0x65, 0x6c, 0x6c, 0x6f}},
+		{ID: 0x02, Data: bytes.Repeat([]byte{0x0d}, 512)},
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		if err := server.WritePacket(login.ClientBoundSetCompression{Threshold: 256}.Marshal()); err != nil {
+			errCh <- err
+			return
+		}
+		server.EnableCompression(256)
+
+		for _, pk := range packets {
+			if err := server.WritePacket(pk); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	pk, err := client.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setCompression, err := login.UnmarshalClientBoundSetCompression(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.EnableCompression(int(setCompression.Threshold))
+
+	for _, want := range packets {
+		pk, err := client.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pk.ID != want.ID || !bytes.Equal(pk.Data, want.Data) {
+			t.Errorf("got: %v; want: %v", pk, want)
+		}
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTCPOptions_Apply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Close()
+	}()
+
+	tcpConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+
+	pipeConn, _ := net.Pipe()
+	defer pipeConn.Close()
+
+	tt := []struct {
+		name string
+		conn net.Conn
+		opts TCPOptions
+	}{
+		{
+			name: "TCP",
+			conn: tcpConn,
+			opts: TCPOptions{NoDelay: true, KeepAlivePeriod: 15 * time.Second},
+		},
+		{
+			name: "TCPZeroValue",
+			conn: tcpConn,
+		},
+		{
+			name: "NonTCP",
+			conn: pipeConn,
+			opts: TCPOptions{NoDelay: true, KeepAlivePeriod: 15 * time.Second},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.opts.Apply(tc.conn); err != nil {
+				t.Errorf("got: %v; want: %v", err, nil)
+			}
+		})
+	}
+}
+
+func TestDialer_TCPOptions(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.TCPOptions = TCPOptions{NoDelay: true, KeepAlivePeriod: 15 * time.Second}
+	defer l.Close()
+
+	pk := protocol.Packet{ID: 0x00, Data: []byte{0x01}}
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_ = c.WritePacket(pk)
+	}()
+
+	dialer := Dialer{TCPOptions: TCPOptions{NoDelay: true, KeepAlivePeriod: 15 * time.Second}}
+	c, err := dialer.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	got, err := c.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != pk.ID || !bytes.Equal(got.Data, pk.Data) {
+		t.Errorf("got: %v; want: %v", got, pk)
+	}
+}
+
+func TestDialer_DialServer(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	pk := protocol.Packet{ID: 0x00, Data: []byte{0x01}}
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_ = c.WritePacket(pk)
+	}()
+
+	var dialer ServerDialer = Dialer{}
+	c, err := dialer.DialServer(context.Background(), DialRequest{ServerAddr: l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	got, err := c.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != pk.ID || !bytes.Equal(got.Data, pk.Data) {
+		t.Errorf("got: %v; want: %v", got, pk)
+	}
+}
+
+func TestConn_MaxPacketLength(t *testing.T) {
+	tt := []struct {
+		name   string
+		length int
+		ok     bool
+	}{
+		{
+			name:   "BelowLimit",
+			length: 16,
+			ok:     true,
+		},
+		{
+			name:   "AboveLimit",
+			length: 17,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			c := wrapConn(server)
+			c.maxPacketLength = 16
+
+			go func() {
+				_ = wrapConn(client).WritePacket(protocol.Packet{ID: 0x00, Data: make([]byte, tc.length-1)})
+			}()
+
+			_, err := c.PeekPacket()
+			if tc.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !tc.ok && !errors.Is(err, protocol.ErrPacketTooLong) {
+				t.Fatalf("got: %v; want: %v", err, protocol.ErrPacketTooLong)
+			}
+
+			_, err = c.ReadPacket()
+			if tc.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !tc.ok && !errors.Is(err, protocol.ErrPacketTooLong) {
+				t.Errorf("got: %v; want: %v", err, protocol.ErrPacketTooLong)
+			}
+		})
+	}
+}
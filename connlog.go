@@ -0,0 +1,125 @@
+package infrared
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Types of the lifecycle events of a connection
+const (
+	ConnEventConnected    = "connected"
+	ConnEventRouted       = "routed"
+	ConnEventDisconnected = "disconnected"
+	ConnEventError        = "error"
+)
+
+// ConnEvent is a lifecycle event of a connection that is handled by the gateway.
+// Fields that are not known yet when the event happens are left empty.
+type ConnEvent struct {
+	Timestamp       time.Time `json:"timestamp"`
+	Event           string    `json:"event"`
+	ConnID          string    `json:"conn_id"`
+	RemoteAddr      string    `json:"remote_addr"`
+	ServerAddr      string    `json:"server_addr"`
+	ProtocolVersion int       `json:"protocol_version"`
+	PlayerName      string    `json:"player_name"`
+	BytesIn         int64     `json:"bytes_in"`
+	BytesOut        int64     `json:"bytes_out"`
+	DurationMs      int64     `json:"duration_ms"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// ConnLogger logs the lifecycle events of connections
+type ConnLogger interface {
+	LogConn(event ConnEvent)
+}
+
+// JSONLogger writes every event as a single line of JSON to W
+type JSONLogger struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{W: w}
+}
+
+func (logger *JSONLogger) LogConn(event ConnEvent) {
+	bb, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	_, _ = logger.W.Write(append(bb, '\n'))
+}
+
+// connSession collects the details of a connection for its lifecycle events
+// and the attributes of its span. A session without a logger logs nothing.
+type connSession struct {
+	connLogger ConnLogger
+	logger     Logger
+	tracer     Tracer
+	span       Span
+	start      time.Time
+	event      ConnEvent
+}
+
+func newConnSession(logger ConnLogger, remoteAddr net.Addr) *connSession {
+	return &connSession{
+		connLogger: logger,
+		logger:     noopLogger{},
+		span:       noopSpan{},
+		start:      time.Now(),
+		event: ConnEvent{
+			ConnID:     newConnID(),
+			RemoteAddr: remoteAddr.String(),
+		},
+	}
+}
+
+// newConnID returns a random UUID that identifies a connection in logs
+func newConnID() string {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
+
+type connIDKey struct{}
+
+// ConnIDFromContext returns the ID of the connection that ctx belongs to.
+// The gateway stores the ID in the context of every connection it handles.
+func ConnIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(connIDKey{}).(string)
+	return id, ok
+}
+
+func contextWithConnID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, connIDKey{}, id)
+}
+
+// startSpan starts a child span of the connection with the tracer of the session
+func (session *connSession) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	return startSpan(ctx, session.tracer, name)
+}
+
+func (session *connSession) log(eventType string) {
+	if session == nil || session.connLogger == nil {
+		return
+	}
+
+	event := session.event
+	event.Timestamp = time.Now()
+	event.Event = eventType
+	event.DurationMs = time.Since(session.start).Milliseconds()
+	session.connLogger.LogConn(event)
+}
@@ -0,0 +1,84 @@
+package infrared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger_LogConn(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf)
+
+	logger.LogConn(ConnEvent{
+		Timestamp:       time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		Event:           ConnEventDisconnected,
+		ConnID:          "d9fa7598-d2f8-4b04-a9f7-1fc662d3142e",
+		RemoteAddr:      "127.0.0.1:50000",
+		ServerAddr:      "127.0.0.1:25565",
+		ProtocolVersion: 755,
+		PlayerName:      "Steve",
+		BytesIn:         128,
+		BytesOut:        1024,
+		DurationMs:      1500,
+	})
+	logger.LogConn(ConnEvent{Event: ConnEventError, Error: "no proxy"})
+
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("got: %d lines; want: %d", len(lines), 2)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(lines[0], &got); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"timestamp":        "2021-06-01T12:00:00Z",
+		"event":            "disconnected",
+		"conn_id":          "d9fa7598-d2f8-4b04-a9f7-1fc662d3142e",
+		"remote_addr":      "127.0.0.1:50000",
+		"server_addr":      "127.0.0.1:25565",
+		"protocol_version": 755.0,
+		"player_name":      "Steve",
+		"bytes_in":         128.0,
+		"bytes_out":        1024.0,
+		"duration_ms":      1500.0,
+	}
+	if len(got) != len(expected) {
+		t.Errorf("got: %v; want: %v", got, expected)
+	}
+	for key, value := range expected {
+		if got[key] != value {
+			t.Errorf("%s: got: %v; want: %v", key, got[key], value)
+		}
+	}
+
+	got = nil
+	if err := json.Unmarshal(lines[1], &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["error"] != "no proxy" {
+		t.Errorf("got: %v; want: %v", got["error"], "no proxy")
+	}
+}
+
+func TestConnIDFromContext(t *testing.T) {
+	if _, ok := ConnIDFromContext(context.Background()); ok {
+		t.Error("got a connection ID from a context without one")
+	}
+
+	session := newConnSession(nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000})
+	if len(session.event.ConnID) != 36 {
+		t.Errorf("got: %q; want: a UUID", session.event.ConnID)
+	}
+
+	ctx := contextWithConnID(context.Background(), session.event.ConnID)
+	if id, ok := ConnIDFromContext(ctx); !ok || id != session.event.ConnID {
+		t.Errorf("got: %v; want: %v", id, session.event.ConnID)
+	}
+}
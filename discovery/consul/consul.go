@@ -0,0 +1,304 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haveachin/infrared"
+)
+
+const (
+	// DefaultAddress is the address of the Consul HTTP API of a local agent
+	DefaultAddress = "http://127.0.0.1:8500"
+	// DefaultTag is the tag of the service instances that are registered
+	DefaultTag = "infrared"
+	// MetaDomainName is the service meta key with the domain name an instance serves
+	MetaDomainName = "infrared_domain"
+)
+
+// Health check states as Consul reports them
+const (
+	StatusPassing  = "passing"
+	StatusWarning  = "warning"
+	StatusCritical = "critical"
+)
+
+const (
+	defaultWaitTime = 5 * time.Minute
+	headerIndex     = "X-Consul-Index"
+	headerToken     = "X-Consul-Token"
+)
+
+// retryDelay is the delay before a failed query is sent again
+var retryDelay = 5 * time.Second
+
+// Gateway is where a ConsulServerStore registers the servers it discovers.
+// *infrared.Gateway implements it.
+type Gateway interface {
+	RegisterProxyIfAbsent(proxy *infrared.Proxy) error
+	CloseRegisteredProxy(proxy *infrared.Proxy)
+}
+
+// ConsulServerStore registers the instances of a Consul service as proxies of a gateway.
+// Instances need the tag and the infrared_domain service meta with the domain name they serve.
+// Instances of the same domain name share one proxy that balances between them.
+// Passing instances are added, critical ones removed and instances with warnings keep their state.
+// Proxies that are already registered, for example from a config file, are left alone.
+type ConsulServerStore struct {
+	Gateway Gateway
+
+	// Address of the Consul HTTP API; DefaultAddress if empty
+	Address string
+	// Token is sent as ACL token with every query if set
+	Token string
+	// Datacenter to query; the datacenter of the agent if empty
+	Datacenter string
+	// Service is the name of the Consul service to watch
+	Service string
+	// Tag the instances need to have; DefaultTag if empty
+	Tag string
+	// ListenTo is the address the proxies listen to; the default of infrared.DefaultProxyConfig if empty
+	ListenTo string
+	// WaitTime limits how long a blocking query waits for changes; 5 minutes if zero
+	WaitTime time.Duration
+	// Client sends the queries; http.DefaultClient if nil
+	Client *http.Client
+
+	proxies map[string]*infrared.Proxy
+	servers map[string][]string
+}
+
+type serviceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+	} `json:"Service"`
+	Checks []struct {
+		Status string `json:"Status"`
+	} `json:"Checks"`
+}
+
+// addr returns the address of the service instance; the node address is used if the service has none
+func (entry serviceEntry) addr() string {
+	host := entry.Service.Address
+	if host == "" {
+		host = entry.Node.Address
+	}
+	return net.JoinHostPort(host, strconv.Itoa(entry.Service.Port))
+}
+
+// status aggregates the checks of the instance like Consul does; the worst one wins
+func (entry serviceEntry) status() string {
+	status := StatusPassing
+	for _, check := range entry.Checks {
+		switch check.Status {
+		case StatusPassing:
+		case StatusWarning:
+			if status == StatusPassing {
+				status = StatusWarning
+			}
+		default:
+			return StatusCritical
+		}
+	}
+	return status
+}
+
+// Watch keeps the proxies of the gateway in sync with the healthy instances of the service
+// with blocking queries until ctx is done. Failed queries are retried.
+// The proxies stay registered after Watch returned. Watch must not be called concurrently.
+func (store *ConsulServerStore) Watch(ctx context.Context) error {
+	if store.Service == "" {
+		return errors.New("no service to watch")
+	}
+
+	var index uint64
+	for {
+		entries, newIndex, err := store.health(ctx, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("[w] Failed querying Consul for service %s; error: %s", store.Service, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retryDelay):
+			}
+			continue
+		}
+
+		// Consul asks clients to start over if the index goes backwards
+		if newIndex < index {
+			index = 0
+		} else {
+			index = newIndex
+		}
+		store.sync(entries)
+	}
+}
+
+func (store *ConsulServerStore) health(ctx context.Context, index uint64) ([]serviceEntry, uint64, error) {
+	addr := store.Address
+	if addr == "" {
+		addr = DefaultAddress
+	}
+	tag := store.Tag
+	if tag == "" {
+		tag = DefaultTag
+	}
+	wait := store.WaitTime
+	if wait <= 0 {
+		wait = defaultWaitTime
+	}
+
+	query := url.Values{}
+	query.Set("tag", tag)
+	query.Set("index", strconv.FormatUint(index, 10))
+	query.Set("wait", strconv.FormatInt(wait.Milliseconds(), 10)+"ms")
+	if store.Datacenter != "" {
+		query.Set("dc", store.Datacenter)
+	}
+	u := strings.TrimSuffix(addr, "/") + "/v1/health/service/" + url.PathEscape(store.Service) + "?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if store.Token != "" {
+		req.Header.Set(headerToken, store.Token)
+	}
+
+	client := store.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	newIndex, err := strconv.ParseUint(resp.Header.Get(headerIndex), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid %s header: %w", headerIndex, err)
+	}
+
+	var entries []serviceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, newIndex, nil
+}
+
+// sync registers a proxy for every domain name with healthy instances, updates the servers
+// of proxies whose instances changed and closes the proxies of domain names that are gone
+func (store *ConsulServerStore) sync(entries []serviceEntry) {
+	if store.proxies == nil {
+		store.proxies = map[string]*infrared.Proxy{}
+	}
+
+	servers := map[string][]string{}
+	for _, entry := range entries {
+		domainName := entry.Service.Meta[MetaDomainName]
+		if domainName == "" {
+			continue
+		}
+
+		addr := entry.addr()
+		switch entry.status() {
+		case StatusPassing:
+		case StatusWarning:
+			if !contains(store.servers[domainName], addr) {
+				continue
+			}
+		default:
+			continue
+		}
+		servers[domainName] = append(servers[domainName], addr)
+	}
+
+	for _, addrs := range servers {
+		sort.Strings(addrs)
+	}
+
+	for domainName, proxy := range store.proxies {
+		addrs, ok := servers[domainName]
+		if !ok {
+			log.Printf("Removing servers of %s discovered through Consul", domainName)
+			store.Gateway.CloseRegisteredProxy(proxy)
+			delete(store.proxies, domainName)
+			continue
+		}
+		if equalStrings(store.servers[domainName], addrs) {
+			continue
+		}
+		log.Printf("Updating servers of %s discovered through Consul to %s", domainName, strings.Join(addrs, ", "))
+		proxy.Config.SetServerAddrs(addrs)
+	}
+
+	for domainName, addrs := range servers {
+		if _, ok := store.proxies[domainName]; ok {
+			continue
+		}
+
+		proxy := store.newProxy(domainName, addrs)
+		log.Printf("Adding servers %s of %s discovered through Consul", strings.Join(addrs, ", "), domainName)
+		if err := store.Gateway.RegisterProxyIfAbsent(proxy); err != nil {
+			log.Printf("[w] Failed registering servers of %s; error: %s", domainName, err)
+			delete(servers, domainName)
+			continue
+		}
+		store.proxies[domainName] = proxy
+	}
+	store.servers = servers
+}
+
+func (store *ConsulServerStore) newProxy(domainName string, addrs []string) *infrared.Proxy {
+	cfg := infrared.DefaultProxyConfig()
+	cfg.DomainName = domainName
+	if store.ListenTo != "" {
+		cfg.ListenTo = store.ListenTo
+	}
+	cfg.SetServerAddrs(addrs)
+	return &infrared.Proxy{Config: &cfg}
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,337 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared"
+)
+
+type fakeGateway struct {
+	mu         sync.Mutex
+	proxies    map[string]*infrared.Proxy
+	registered []string
+}
+
+func (gateway *fakeGateway) RegisterProxyIfAbsent(proxy *infrared.Proxy) error {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	if gateway.proxies == nil {
+		gateway.proxies = map[string]*infrared.Proxy{}
+	}
+	if _, ok := gateway.proxies[proxy.UID()]; ok {
+		return infrared.ErrProxyExists
+	}
+	gateway.proxies[proxy.UID()] = proxy
+	gateway.registered = append(gateway.registered, proxy.DomainName())
+	return nil
+}
+
+func (gateway *fakeGateway) CloseRegisteredProxy(proxy *infrared.Proxy) {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	if gateway.proxies[proxy.UID()] == proxy {
+		delete(gateway.proxies, proxy.UID())
+	}
+}
+
+// servers returns the server addresses of every registered proxy by domain name
+func (gateway *fakeGateway) servers() map[string][]string {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	servers := map[string][]string{}
+	for _, proxy := range gateway.proxies {
+		if len(proxy.Config.Servers) == 0 {
+			servers[proxy.DomainName()] = []string{proxy.ProxyTo()}
+			continue
+		}
+		for _, server := range proxy.Config.Servers {
+			servers[proxy.DomainName()] = append(servers[proxy.DomainName()], server.Address)
+		}
+	}
+	return servers
+}
+
+// instance returns a service instance as the Consul health endpoint lists it
+func instance(domainName, addr string, statuses ...string) map[string]interface{} {
+	checks := []map[string]string{}
+	for _, status := range statuses {
+		checks = append(checks, map[string]string{"Status": status})
+	}
+	meta := map[string]string{}
+	if domainName != "" {
+		meta[MetaDomainName] = domainName
+	}
+	return map[string]interface{}{
+		"Node":    map[string]string{"Address": "10.0.1.1"},
+		"Service": map[string]interface{}{"Address": addr, "Port": 25565, "Meta": meta},
+		"Checks":  checks,
+	}
+}
+
+func healthJSON(t *testing.T, instances ...map[string]interface{}) []byte {
+	if instances == nil {
+		instances = []map[string]interface{}{}
+	}
+	bb, err := json.Marshal(instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bb
+}
+
+func TestConsulServerStore_Sync(t *testing.T) {
+	gateway := &fakeGateway{}
+	store := &ConsulServerStore{Gateway: gateway}
+
+	// The steps share the store and run in order
+	tt := []struct {
+		name            string
+		instances       []map[string]interface{}
+		expectedServers map[string][]string
+	}{
+		{
+			name: "AddPassing",
+			instances: []map[string]interface{}{
+				instance("a.example.com", "10.0.0.1", StatusPassing, StatusPassing),
+				instance("a.example.com", "10.0.0.2", StatusPassing, StatusCritical),
+				instance("b.example.com", "10.0.0.3", StatusPassing),
+				instance("", "10.0.0.4", StatusPassing),
+			},
+			expectedServers: map[string][]string{
+				"a.example.com": {"10.0.0.1:25565"},
+				"b.example.com": {"10.0.0.3:25565"},
+			},
+		},
+		{
+			name: "WarningKeepsState",
+			instances: []map[string]interface{}{
+				instance("a.example.com", "10.0.0.1", StatusWarning),
+				instance("a.example.com", "10.0.0.2", StatusWarning),
+				instance("b.example.com", "10.0.0.3", StatusPassing),
+			},
+			expectedServers: map[string][]string{
+				"a.example.com": {"10.0.0.1:25565"},
+				"b.example.com": {"10.0.0.3:25565"},
+			},
+		},
+		{
+			name: "RemoveCritical",
+			instances: []map[string]interface{}{
+				instance("a.example.com", "10.0.0.2", StatusPassing),
+				instance("a.example.com", "10.0.0.1", StatusPassing),
+				instance("b.example.com", "10.0.0.3", StatusCritical),
+			},
+			expectedServers: map[string][]string{
+				"a.example.com": {"10.0.0.1:25565", "10.0.0.2:25565"},
+			},
+		},
+		{
+			name: "NodeAddress",
+			instances: []map[string]interface{}{
+				instance("a.example.com", "10.0.0.1", StatusPassing),
+				instance("a.example.com", "10.0.0.2", StatusPassing),
+				instance("c.example.com", ""),
+			},
+			expectedServers: map[string][]string{
+				"a.example.com": {"10.0.0.1:25565", "10.0.0.2:25565"},
+				"c.example.com": {"10.0.1.1:25565"},
+			},
+		},
+		{
+			name:            "RemoveAll",
+			expectedServers: map[string][]string{},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var entries []serviceEntry
+			if err := json.Unmarshal(healthJSON(t, tc.instances...), &entries); err != nil {
+				t.Fatal(err)
+			}
+
+			store.sync(entries)
+
+			if servers := gateway.servers(); !reflect.DeepEqual(servers, tc.expectedServers) {
+				t.Errorf("got: %v; want: %v", servers, tc.expectedServers)
+			}
+		})
+	}
+
+	// Proxies are updated in place instead of being registered again
+	expectedRegistered := []string{"a.example.com", "b.example.com", "c.example.com"}
+	registered := gateway.registered
+	if len(registered) > 2 {
+		// a.example.com and b.example.com of the first step are registered in any order
+		if registered[0] > registered[1] {
+			registered[0], registered[1] = registered[1], registered[0]
+		}
+	}
+	if !reflect.DeepEqual(registered, expectedRegistered) {
+		t.Errorf("got: %v; want: %v", registered, expectedRegistered)
+	}
+}
+
+func TestConsulServerStore_SyncKeepsOtherProxies(t *testing.T) {
+	cfg := infrared.DefaultProxyConfig()
+	cfg.DomainName = "a.example.com"
+	cfg.ProxyTo = "10.0.9.9:25565"
+	fileProxy := &infrared.Proxy{Config: &cfg}
+
+	gateway := &fakeGateway{}
+	if err := gateway.RegisterProxyIfAbsent(fileProxy); err != nil {
+		t.Fatal(err)
+	}
+	store := &ConsulServerStore{Gateway: gateway}
+
+	for _, instances := range [][]map[string]interface{}{
+		{instance("a.example.com", "10.0.0.1", StatusPassing)},
+		{},
+	} {
+		var entries []serviceEntry
+		if err := json.Unmarshal(healthJSON(t, instances...), &entries); err != nil {
+			t.Fatal(err)
+		}
+		store.sync(entries)
+
+		// The proxy of the config file is neither replaced nor closed
+		expected := map[string][]string{"a.example.com": {"10.0.9.9:25565"}}
+		if servers := gateway.servers(); !reflect.DeepEqual(servers, expected) {
+			t.Errorf("got: %v; want: %v", servers, expected)
+		}
+	}
+}
+
+func TestConsulServerStore_SyncUpdatesInPlace(t *testing.T) {
+	gateway := &fakeGateway{}
+	store := &ConsulServerStore{Gateway: gateway}
+
+	var proxy *infrared.Proxy
+	for _, instances := range [][]map[string]interface{}{
+		{instance("a.example.com", "10.0.0.1", StatusPassing)},
+		{instance("a.example.com", "10.0.0.1", StatusPassing), instance("a.example.com", "10.0.0.2", StatusPassing)},
+		{instance("a.example.com", "10.0.0.2", StatusPassing)},
+	} {
+		var entries []serviceEntry
+		if err := json.Unmarshal(healthJSON(t, instances...), &entries); err != nil {
+			t.Fatal(err)
+		}
+		store.sync(entries)
+
+		var registered *infrared.Proxy
+		for _, p := range gateway.proxies {
+			registered = p
+		}
+		if proxy == nil {
+			proxy = registered
+		}
+		if registered != proxy {
+			t.Error("got: a new proxy; want: the servers of the proxy updated in place")
+		}
+	}
+
+	expected := map[string][]string{"a.example.com": {"10.0.0.2:25565"}}
+	if servers := gateway.servers(); !reflect.DeepEqual(servers, expected) {
+		t.Errorf("got: %v; want: %v", servers, expected)
+	}
+}
+
+func TestConsulServerStore_Watch(t *testing.T) {
+	retryDelay = 10 * time.Millisecond
+
+	blocked := make(chan struct{})
+	failed := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/minecraft" {
+			t.Errorf("got: %v; want: %v", r.URL.Path, "/v1/health/service/minecraft")
+		}
+		query := r.URL.Query()
+		if token := r.Header.Get(headerToken); token != "secret" {
+			t.Errorf("got: %v; want: %v", token, "secret")
+		}
+		if dc := query.Get("dc"); dc != "dc1" {
+			t.Errorf("got: %v; want: %v", dc, "dc1")
+		}
+		if tag := query.Get("tag"); tag != DefaultTag {
+			t.Errorf("got: %v; want: %v", tag, DefaultTag)
+		}
+		if wait := query.Get("wait"); wait != "60000ms" {
+			t.Errorf("got: %v; want: %v", wait, "60000ms")
+		}
+
+		switch query.Get("index") {
+		case "0":
+			if !failed {
+				failed = true
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(headerIndex, "5")
+			w.Write(healthJSON(t, instance("a.example.com", "10.0.0.1", StatusPassing)))
+		case "5":
+			w.Header().Set(headerIndex, "7")
+			w.Write(healthJSON(t, instance("a.example.com", "10.0.0.1", StatusCritical)))
+		default:
+			close(blocked)
+			<-r.Context().Done()
+		}
+	}))
+	defer srv.Close()
+
+	gateway := &fakeGateway{}
+	store := &ConsulServerStore{
+		Gateway:    gateway,
+		Address:    srv.URL,
+		Token:      "secret",
+		Datacenter: "dc1",
+		Service:    "minecraft",
+		WaitTime:   time.Minute,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- store.Watch(ctx)
+	}()
+
+	select {
+	case <-blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not send a blocking query")
+	}
+
+	if servers := gateway.servers(); len(servers) != 0 {
+		t.Errorf("got: %v; want: %v", servers, map[string][]string{})
+	}
+	gateway.mu.Lock()
+	registered := gateway.registered
+	gateway.mu.Unlock()
+	if !reflect.DeepEqual(registered, []string{"a.example.com"}) {
+		t.Errorf("got: %v; want: %v", registered, []string{"a.example.com"})
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got: %v; want: %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not return after its context was canceled")
+	}
+}
+
+func TestConsulServerStore_WatchWithoutService(t *testing.T) {
+	store := &ConsulServerStore{Gateway: &fakeGateway{}}
+	if err := store.Watch(context.Background()); err == nil {
+		t.Error("got: nil; want: error")
+	}
+}
@@ -1,33 +1,138 @@
 package infrared
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/haveachin/infrared/callback"
+	"github.com/haveachin/infrared/metrics"
 	"github.com/haveachin/infrared/protocol/handshaking"
+	"github.com/haveachin/infrared/protocol/login"
+	"github.com/haveachin/infrared/protocol/status"
 	"github.com/pires/go-proxyproto"
-
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-)
-
-var (
-	proxiesActive = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "infrared_proxies",
-		Help: "The total number of proxies running",
-	})
 )
 
 type Gateway struct {
-	listeners            sync.Map
-	proxies              sync.Map
-	closed               chan bool
-	wg                   sync.WaitGroup
-	receiveProxyProtocol bool
+	// mu serializes registering and closing of proxies
+	// so that listeners are opened and closed exactly once per address
+	mu        sync.Mutex
+	closed    bool
+	listeners sync.Map
+	proxies   sync.Map
+	wg        sync.WaitGroup
+	conns     sync.Map
+	connsWg   sync.WaitGroup
+	// activeConns counts the connections that hold a slot of MaxConnections; accessed atomically
+	activeConns int32
+	// rejectingConns counts the connections beyond MaxConnections that are sent
+	// the MaxConnectionsMessage; accessed atomically
+	rejectingConns int32
+
+	// regexpProxies holds the proxies with regexp domain names in registration order
+	regexpMu      sync.RWMutex
+	regexpProxies []regexpProxy
+
+	// ReceiveProxyProtocol enables parsing of PROXY protocol v1 and v2 headers
+	// sent by load balancers in front of the gateway
+	ReceiveProxyProtocol bool
+
+	// TrustedProxies limits the connections whose PROXY protocol header is read if set.
+	// Connections from addresses that do not pass the filter are handled as if they sent
+	// no header, so that clients can't spoof their address with a header of their own.
+	TrustedProxies *IPFilter
+
+	// HandshakeTimeout is the time a client has to send its handshake
+	// (including the PROXY protocol header and the login start) before
+	// the connection gets closed. A value of zero or less disables the timeout.
+	HandshakeTimeout time.Duration
+
+	// TLSConfig enables TLS termination on all listeners if set
+	TLSConfig *tls.Config
+
+	// UnixSocketMode is the file mode of the Unix domain sockets that proxies
+	// with a unix:<path> listen address listen to. Zero keeps the mode the socket is created with.
+	UnixSocketMode os.FileMode
+
+	// NumAcceptWorkers is the number of sockets with SO_REUSEPORT that every TCP listener
+	// accepts connections on in parallel if it is greater than one. Only Linux supports it;
+	// other platforms fall back to a single socket.
+	NumAcceptWorkers int
+
+	// RateLimiter limits the connections per IP if set
+	RateLimiter RateLimiter
+	// RateLimitMessage is sent to rate limited clients that request a login.
+	// If empty the connection is closed without a response.
+	RateLimitMessage string
+
+	// MaxConnections limits the number of connections the gateway handles at once if positive.
+	// Connections beyond the limit are closed right after they were accepted.
+	MaxConnections int
+	// MaxConnectionsMessage is sent to clients beyond MaxConnections that request a login.
+	// These clients have one second to send their handshake and only a few of them are
+	// answered at once; the others are closed right away.
+	// If empty the connection is closed without reading anything from it.
+	MaxConnectionsMessage string
+
+	// NoProxyMessage is sent to clients that request a login for a domain without a proxy.
+	// The placeholder {{domain}} is replaced with the requested domain.
+	// If empty the connection is closed without a response.
+	NoProxyMessage string
+
+	// BanStore rejects logins of banned players if set
+	BanStore BanStore
+
+	// RealIPPublicKey enables receiving signed RealIP handshakes like TCPShield sends them.
+	// The client address of handshakes with a valid signature replaces the remote address
+	// of the connection. Handshakes without a valid signature are rejected.
+	RealIPPublicKey *ecdsa.PublicKey
+	// RealIPMaxAge is how far the timestamp of signed RealIP data may be off from the time
+	// it is received. The zero value means DefaultRealIPMaxAge.
+	RealIPMaxAge time.Duration
+
+	// IPFilter is applied by all listeners before a connection is handled.
+	// If ReceiveProxyProtocol is enabled the client address from the PROXY protocol
+	// header is filtered instead of the address of the load balancer.
+	IPFilter *IPFilter
+
+	// TCPOptions are applied to every accepted connection.
+	// They have no effect on connections of a TLSConfig listener.
+	TCPOptions TCPOptions
+
+	// MaxPacketLength is the largest packet length that is read from clients.
+	// Connections that announce longer packets are closed. A value of zero
+	// or less allows every packet up to protocol.MaxPacketLength.
+	MaxPacketLength int
+
+	// MinReadRate disconnects clients that send their handshake and login start too slowly
+	// to hold connections open, even before the HandshakeTimeout is reached.
+	MinReadRate MinReadRate
+
+	// ConnLogger logs the lifecycle events of every connection if set
+	ConnLogger ConnLogger
+
+	// Tracer traces the handling of every connection if set
+	Tracer Tracer
+
+	// Logger receives structured records about handshakes, routing, dials and pipes if set
+	Logger Logger
+
+	// BaseContext returns the parent context of every connection if set.
+	// A connection is closed as soon as its context is done.
+	BaseContext func() context.Context
 }
 
 func (gateway *Gateway) ListenAndServe(proxies []*Proxy) error {
@@ -35,8 +140,6 @@ func (gateway *Gateway) ListenAndServe(proxies []*Proxy) error {
 		return errors.New("no proxies in gateway")
 	}
 
-	gateway.closed = make(chan bool, len(proxies))
-
 	for _, proxy := range proxies {
 		if err := gateway.RegisterProxy(proxy); err != nil {
 			gateway.Close()
@@ -48,13 +151,19 @@ func (gateway *Gateway) ListenAndServe(proxies []*Proxy) error {
 	return nil
 }
 
+// MetricsHandler serves the metrics of Infrared in the Prometheus exposition format.
+// Operators that run their own HTTP server can mount it on /metrics instead of calling EnablePrometheus.
+func MetricsHandler() http.Handler {
+	return metrics.Handler()
+}
+
 func (gateway *Gateway) EnablePrometheus(bind string) error {
 	gateway.wg.Add(1)
 
 	go func() {
 		defer gateway.wg.Done()
 
-		http.Handle("/metrics", promhttp.Handler())
+		http.Handle("/metrics", MetricsHandler())
 		http.ListenAndServe(bind, nil)
 	}()
 
@@ -66,23 +175,108 @@ func (gateway *Gateway) KeepProcessActive() {
 	gateway.wg.Wait()
 }
 
-// Close closes all listeners
+// ErrGatewayClosed is returned when a proxy is registered after the gateway was closed
+var ErrGatewayClosed = errors.New("gateway closed")
+
+// ErrProxyExists is returned by RegisterProxyIfAbsent when a proxy is already registered under one of the UIDs
+var ErrProxyExists = errors.New("proxy already exists")
+
+// Close closes all listeners and stops all health checks.
+// Proxies that are registered afterwards are rejected with ErrGatewayClosed,
+// so that a config change during a Shutdown does not open a new listener.
 func (gateway *Gateway) Close() {
+	gateway.mu.Lock()
+	gateway.closed = true
+	gateway.mu.Unlock()
+
 	gateway.listeners.Range(func(k, v interface{}) bool {
-		gateway.closed <- true
 		_ = v.(Listener).Close()
-		return false
+		return true
+	})
+	gateway.proxies.Range(func(k, v interface{}) bool {
+		v.(*Proxy).stopHealthCheck()
+		return true
 	})
 }
 
+// Shutdown closes all listeners and waits for all active connections to close.
+// If ctx is done before that, the remaining connections are closed forcefully
+// and the context's error is returned.
+func (gateway *Gateway) Shutdown(ctx context.Context) error {
+	gateway.Close()
+
+	done := make(chan struct{})
+	go func() {
+		gateway.connsWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	gateway.conns.Range(func(k, v interface{}) bool {
+		_ = k.(Conn).Close()
+		return true
+	})
+	<-done
+	return ctx.Err()
+}
+
+// ProxyUIDs returns a snapshot of the UIDs of all registered proxies.
+// A proxy with several domain names has one UID per domain name.
+func (gateway *Gateway) ProxyUIDs() []string {
+	var uids []string
+	gateway.proxies.Range(func(k, v interface{}) bool {
+		uids = append(uids, k.(string))
+		return true
+	})
+	return uids
+}
+
 func (gateway *Gateway) CloseProxy(proxyUID string) {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+
+	gateway.closeProxy(proxyUID)
+}
+
+// CloseRegisteredProxy closes proxy if it is still registered under its UID.
+// Unlike CloseProxy it never closes another proxy that replaced it.
+func (gateway *Gateway) CloseRegisteredProxy(proxy *Proxy) {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+
+	proxyUID := proxy.UID()
+	if v, ok := gateway.proxies.Load(proxyUID); !ok || v.(*Proxy) != proxy {
+		return
+	}
+	gateway.closeProxy(proxyUID)
+}
+
+func (gateway *Gateway) closeProxy(proxyUID string) {
 	log.Println("Closing proxy with UID", proxyUID)
 	v, ok := gateway.proxies.LoadAndDelete(proxyUID)
 	if !ok {
 		return
 	}
-	proxiesActive.Dec()
+	metrics.ProxiesActive.Dec()
 	proxy := v.(*Proxy)
+	proxy.stopHealthCheck()
+
+	// Remove the UIDs of the other domain names of the proxy
+	gateway.proxies.Range(func(k, v interface{}) bool {
+		if v.(*Proxy) == proxy {
+			gateway.proxies.Delete(k)
+		}
+		return true
+	})
+
+	gateway.regexpMu.Lock()
+	gateway.regexpProxies = removeRegexpProxy(gateway.regexpProxies, proxy)
+	gateway.regexpMu.Unlock()
 
 	closeListener := true
 	gateway.proxies.Range(func(k, v interface{}) bool {
@@ -98,7 +292,7 @@ func (gateway *Gateway) CloseProxy(proxyUID string) {
 		return
 	}
 
-	v, ok = gateway.listeners.Load(proxy.ListenTo())
+	v, ok = gateway.listeners.LoadAndDelete(proxy.ListenTo())
 	if !ok {
 		return
 	}
@@ -106,18 +300,52 @@ func (gateway *Gateway) CloseProxy(proxyUID string) {
 }
 
 func (gateway *Gateway) RegisterProxy(proxy *Proxy) error {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+
+	return gateway.registerProxy(proxy)
+}
+
+// RegisterProxyIfAbsent registers proxy unless a proxy is already registered under one of its UIDs.
+// The check and the registration happen atomically, so concurrent calls never replace each other.
+func (gateway *Gateway) RegisterProxyIfAbsent(proxy *Proxy) error {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+
+	for _, uid := range proxy.UIDs() {
+		if _, ok := gateway.proxies.Load(uid); ok {
+			return fmt.Errorf("%w: %s", ErrProxyExists, uid)
+		}
+	}
+	return gateway.registerProxy(proxy)
+}
+
+func (gateway *Gateway) registerProxy(proxy *Proxy) error {
+	if gateway.closed {
+		return ErrGatewayClosed
+	}
+
 	// Register new Proxy
 	proxyUID := proxy.UID()
 	log.Println("Registering proxy with UID", proxyUID)
-	gateway.proxies.Store(proxyUID, proxy)
-	proxiesActive.Inc()
+	_, loaded := gateway.proxies.Load(proxyUID)
+	proxyUIDs := proxy.UIDs()
+	if err := gateway.storeProxy(proxy); err != nil {
+		return err
+	}
+	if !loaded {
+		metrics.ProxiesActive.Inc()
+	}
+	proxy.startHealthCheck()
 
 	proxy.Config.removeCallback = func() {
 		gateway.CloseProxy(proxyUID)
 	}
 
 	proxy.Config.changeCallback = func() {
-		if proxyUID == proxy.UID() {
+		proxy.InvalidateStatusCache()
+		if equalStrings(proxyUIDs, proxy.UIDs()) {
+			proxy.startHealthCheck()
 			return
 		}
 		gateway.CloseProxy(proxyUID)
@@ -126,7 +354,7 @@ func (gateway *Gateway) RegisterProxy(proxy *Proxy) error {
 		}
 	}
 
-	playersConnected.WithLabelValues(proxy.DomainName())
+	metrics.PlayersConnected.WithLabelValues(proxy.DomainName())
 
 	// Check if a gate is already listening to the Proxy address
 	addr := proxy.ListenTo()
@@ -135,7 +363,7 @@ func (gateway *Gateway) RegisterProxy(proxy *Proxy) error {
 	}
 
 	log.Println("Creating listener on", addr)
-	listener, err := Listen(addr)
+	listener, err := gateway.listen(addr)
 	if err != nil {
 		return err
 	}
@@ -150,70 +378,604 @@ func (gateway *Gateway) RegisterProxy(proxy *Proxy) error {
 	return nil
 }
 
+// regexpProxy is a proxy with a domain name that is a regular expression
+type regexpProxy struct {
+	re *regexp.Regexp
+	// prefix is the literal every match of an anchored re starts with.
+	// It rules out most domains without running re.
+	prefix string
+	addr   string
+	proxy  *Proxy
+}
+
+func newRegexpProxy(pattern, addr string, proxy *Proxy) (regexpProxy, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return regexpProxy{}, err
+	}
+
+	rp := regexpProxy{re: re, addr: addr, proxy: proxy}
+	if strings.HasPrefix(pattern, "^") {
+		rp.prefix, _ = re.LiteralPrefix()
+	}
+	return rp, nil
+}
+
+func (rp regexpProxy) match(domain string) bool {
+	return strings.HasPrefix(domain, rp.prefix) && rp.re.MatchString(domain)
+}
+
+// storeProxy stores proxy under all of its UIDs and registers its regexp domain names
+func (gateway *Gateway) storeProxy(proxy *Proxy) error {
+	addr := proxy.ListenTo()
+	var regexps []regexpProxy
+	for _, domainName := range proxy.DomainNames() {
+		if !strings.HasPrefix(domainName, regexpDomainPrefix) {
+			continue
+		}
+		rp, err := newRegexpProxy(strings.TrimPrefix(domainName, regexpDomainPrefix), addr, proxy)
+		if err != nil {
+			return fmt.Errorf("invalid domain name %q: %w", domainName, err)
+		}
+		regexps = append(regexps, rp)
+	}
+
+	for _, uid := range proxy.UIDs() {
+		gateway.proxies.Store(uid, proxy)
+	}
+
+	gateway.regexpMu.Lock()
+	defer gateway.regexpMu.Unlock()
+	gateway.regexpProxies = append(removeRegexpProxy(gateway.regexpProxies, proxy), regexps...)
+	return nil
+}
+
+func removeRegexpProxy(regexps []regexpProxy, proxy *Proxy) []regexpProxy {
+	var kept []regexpProxy
+	for _, rp := range regexps {
+		if rp.proxy != proxy {
+			kept = append(kept, rp)
+		}
+	}
+	return kept
+}
+
+func (gateway *Gateway) listen(addr string) (Listener, error) {
+	var listener Listener
+	var err error
+	if path := strings.TrimPrefix(addr, UnixAddrPrefix); path != addr {
+		listener, err = ListenUnix(path, gateway.UnixSocketMode)
+		if err == nil && gateway.TLSConfig != nil {
+			listener.Listener = tls.NewListener(listener.Listener, gateway.TLSConfig)
+		}
+	} else if gateway.NumAcceptWorkers > 1 {
+		// TLS is set up per socket by acceptors
+		var l *ReusePortListener
+		if l, err = ListenReusePort("tcp", addr, gateway.NumAcceptWorkers); err == nil {
+			listener.Listener = l
+		}
+	} else if gateway.TLSConfig != nil {
+		listener, err = ListenTLS(addr, gateway.TLSConfig)
+	} else {
+		listener, err = Listen(addr)
+	}
+	if !gateway.ReceiveProxyProtocol {
+		listener.IPFilter = gateway.IPFilter
+	}
+	listener.TCPOptions = gateway.TCPOptions
+	listener.MaxPacketLength = gateway.MaxPacketLength
+	listener.MinReadRate = gateway.MinReadRate
+	listener.Logger = gateway.Logger
+	return listener, err
+}
+
 func (gateway *Gateway) listenAndServe(listener Listener, addr string) error {
 	defer gateway.wg.Done()
 
+	acceptors := gateway.acceptors(listener)
+	var wg sync.WaitGroup
+	for _, acceptor := range acceptors[1:] {
+		wg.Add(1)
+		go func(acceptor Listener) {
+			defer wg.Done()
+			gateway.acceptAndServe(acceptor, addr)
+		}(acceptor)
+	}
+	gateway.acceptAndServe(acceptors[0], addr)
+	wg.Wait()
+
+	log.Println("Closing listener on", addr)
+	gateway.deleteListener(addr, listener)
+	return nil
+}
+
+// acceptors returns a Listener for every socket of listener.
+// A ReusePortListener gets one per socket, so that every socket is served by its own loop.
+func (gateway *Gateway) acceptors(listener Listener) []Listener {
+	l, ok := listener.Listener.(*ReusePortListener)
+	if !ok {
+		return []Listener{listener}
+	}
+
+	acceptors := make([]Listener, 0, l.NumSockets())
+	for _, socket := range l.Sockets() {
+		acceptor := listener
+		acceptor.Listener = socket
+		if gateway.TLSConfig != nil {
+			acceptor.Listener = tls.NewListener(socket, gateway.TLSConfig)
+		}
+		acceptors = append(acceptors, acceptor)
+	}
+	return acceptors
+}
+
+// acceptAndServe serves every connection that listener accepts until it is closed
+func (gateway *Gateway) acceptAndServe(listener Listener, addr string) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			// TODO: Refactor this; it feels hacky
-			if err.Error() == "use of closed network connection" {
-				log.Println("Closing listener on", addr)
-				gateway.listeners.Delete(addr)
-				return nil
+			if errors.Is(err, net.ErrClosed) {
+				return
 			}
 
 			continue
 		}
 
+		gateway.conns.Store(conn, struct{}{})
+		gateway.connsWg.Add(1)
 		go func() {
-			log.Printf("[>] Incoming %s on listener %s", conn.RemoteAddr(), addr)
-			defer conn.Close()
-			if err := gateway.serve(conn, addr); err != nil {
-				log.Printf("[x] %s closed connection with %s; error: %s", conn.RemoteAddr(), addr, err)
+			session := newConnSession(gateway.ConnLogger, conn.RemoteAddr())
+			connID := session.event.ConnID
+			log.Printf("[>] Incoming %s on listener %s with connection ID %s", conn.RemoteAddr(), addr, connID)
+			ctx, cancel := context.WithCancel(contextWithConnID(gateway.baseContext(), connID))
+			ctx, span := startSpan(ctx, gateway.Tracer, SpanConnection)
+			session.tracer = gateway.Tracer
+			session.logger = loggerOrNoop(gateway.Logger)
+			session.span = span
+			defer func() {
+				span.End()
+				cancel()
+				conn.Close()
+				gateway.conns.Delete(conn)
+				gateway.connsWg.Done()
+			}()
+			go func() {
+				<-ctx.Done()
+				conn.Close()
+			}()
+			session.log(ConnEventConnected)
+			defer session.log(ConnEventDisconnected)
+			if err := gateway.serve(ctx, conn, addr, session); err != nil {
+				session.event.Error = err.Error()
+				session.log(ConnEventError)
+				span.RecordError(err)
+				log.Printf("[x] %s closed connection %s with %s; error: %s", conn.RemoteAddr(), connID, addr, err)
 				return
 			}
-			log.Printf("[x] %s closed connection with %s", conn.RemoteAddr(), addr)
+			log.Printf("[x] %s closed connection %s with %s", conn.RemoteAddr(), connID, addr)
 		}()
 	}
 }
 
-func (gateway *Gateway) serve(conn Conn, addr string) error {
+func (gateway *Gateway) realIPMaxAge() time.Duration {
+	if gateway.RealIPMaxAge <= 0 {
+		return DefaultRealIPMaxAge
+	}
+	return gateway.RealIPMaxAge
+}
+
+func (gateway *Gateway) baseContext() context.Context {
+	if gateway.BaseContext == nil {
+		return context.Background()
+	}
+	return gateway.BaseContext()
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteListener removes listener from the gateway unless
+// it was already replaced by a new listener on the same address
+func (gateway *Gateway) deleteListener(addr string, listener Listener) {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+
+	if v, ok := gateway.listeners.Load(addr); ok && v.(Listener) == listener {
+		gateway.listeners.Delete(addr)
+	}
+}
+
+const (
+	// maxRejectingConns is the number of connections beyond MaxConnections
+	// that are sent the MaxConnectionsMessage at once
+	maxRejectingConns = 16
+	// rejectTimeout is the time a connection beyond MaxConnections has
+	// to send its handshake and read the MaxConnectionsMessage
+	rejectTimeout = time.Second
+)
+
+// acquireConn takes a slot of MaxConnections and reports if one was free.
+// Every successful call has to be followed by a call to releaseConn.
+func (gateway *Gateway) acquireConn() bool {
+	if gateway.MaxConnections <= 0 {
+		return true
+	}
+	if atomic.AddInt32(&gateway.activeConns, 1) > int32(gateway.MaxConnections) {
+		atomic.AddInt32(&gateway.activeConns, -1)
+		return false
+	}
+	return true
+}
+
+func (gateway *Gateway) releaseConn() {
+	if gateway.MaxConnections > 0 {
+		atomic.AddInt32(&gateway.activeConns, -1)
+	}
+}
+
+// acquireRejectingConn takes one of the maxRejectingConns slots and reports if one was free.
+// Every successful call has to be followed by a call to releaseRejectingConn.
+func (gateway *Gateway) acquireRejectingConn() bool {
+	if atomic.AddInt32(&gateway.rejectingConns, 1) > maxRejectingConns {
+		atomic.AddInt32(&gateway.rejectingConns, -1)
+		return false
+	}
+	return true
+}
+
+func (gateway *Gateway) releaseRejectingConn() {
+	atomic.AddInt32(&gateway.rejectingConns, -1)
+}
+
+func (gateway *Gateway) serve(ctx context.Context, conn Conn, addr string, session *connSession) error {
+	acceptedAt := time.Now()
+	full := !gateway.acquireConn()
+	if !full {
+		defer gateway.releaseConn()
+	} else if gateway.MaxConnectionsMessage == "" || !gateway.acquireRejectingConn() {
+		metrics.ConnectionsTotal.WithLabelValues("", metrics.ResultMaxConnections).Inc()
+		return errors.New("max connections reached")
+	} else {
+		defer gateway.releaseRejectingConn()
+	}
+
+	if full {
+		// Connections without a slot must not stay open for long
+		timeout := rejectTimeout
+		if gateway.HandshakeTimeout > 0 && gateway.HandshakeTimeout < timeout {
+			timeout = gateway.HandshakeTimeout
+		}
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	} else if gateway.HandshakeTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(gateway.HandshakeTimeout)); err != nil {
+			return err
+		}
+	}
+
 	connRemoteAddr := conn.RemoteAddr()
-	if gateway.receiveProxyProtocol {
-		header, err := proxyproto.Read(conn.Reader())
-		if err != nil {
+	if gateway.ReceiveProxyProtocol {
+		if gateway.TrustedProxies == nil || gateway.TrustedProxies.AllowedAddr(connRemoteAddr) {
+			addr, err := readProxyProtocolHeader(conn)
+			if err != nil {
+				return err
+			}
+			connRemoteAddr = addr
+			session.event.RemoteAddr = addr.String()
+		}
+
+		if gateway.IPFilter != nil && !gateway.IPFilter.AllowedAddr(connRemoteAddr) {
+			return errors.New("ip filter denied " + connRemoteAddr.String())
+		}
+	}
+
+	if full {
+		metrics.ConnectionsTotal.WithLabelValues("", metrics.ResultMaxConnections).Inc()
+		if err := rejectLogin(conn, connRemoteAddr, gateway.MaxConnectionsMessage); err != nil {
 			return err
 		}
-		connRemoteAddr = header.SourceAddr
+		return errors.New("max connections reached")
 	}
 
-	pk, err := conn.PeekPacket()
+	if gateway.RateLimiter != nil && !gateway.RateLimiter.Allow(addrIP(connRemoteAddr)) {
+		metrics.ConnectionsTotal.WithLabelValues("", metrics.ResultRateLimited).Inc()
+		if gateway.RateLimitMessage != "" {
+			if err := rejectLogin(conn, connRemoteAddr, gateway.RateLimitMessage); err != nil {
+				return err
+			}
+		}
+		return errors.New("rate limit exceeded for " + connRemoteAddr.String())
+	}
+
+	b, err := conn.Reader().Peek(1)
 	if err != nil {
 		return err
 	}
+	if b[0] == status.LegacyServerListPingID {
+		return gateway.serveLegacyPing(conn, addr, connRemoteAddr)
+	}
 
-	hs, err := handshaking.UnmarshalServerBoundHandshake(pk)
+	hs, err := peekHandshake(ctx, conn, session)
 	if err != nil {
+		var hsErr *handshakeError
+		if !errors.As(err, &hsErr) {
+			return err
+		}
+		data := hex.EncodeToString(hsErr.data)
+		metrics.ConnectionsTotal.WithLabelValues("", metrics.ResultInvalidHandshake).Inc()
+		session.logger.Warn("invalid handshake", "conn_id", session.event.ConnID, "remote_addr", session.event.RemoteAddr, "data", data, "error", err)
+		log.Printf("[w] %s sent a malformed handshake starting with %s; error: %s", connRemoteAddr, data, hsErr.err)
 		return err
 	}
+	metrics.HandshakeDuration.Observe(time.Since(acceptedAt).Seconds())
+
+	if gateway.RealIPPublicKey != nil {
+		realAddr, err := verifyRealIP(hs, gateway.RealIPPublicKey, time.Now(), gateway.realIPMaxAge())
+		if err != nil {
+			metrics.ConnectionsTotal.WithLabelValues("", metrics.ResultInvalidHandshake).Inc()
+			return fmt.Errorf("%s sent %w", connRemoteAddr, err)
+		}
+		connRemoteAddr = realAddr
+		conn = realIPConn{Conn: conn, remoteAddr: realAddr}
+		session.event.RemoteAddr = realAddr.String()
+
+		if gateway.IPFilter != nil && !gateway.IPFilter.AllowedAddr(connRemoteAddr) {
+			return errors.New("ip filter denied " + connRemoteAddr.String())
+		}
+	}
+	session.event.ProtocolVersion = int(hs.ProtocolVersion)
+	session.span.SetAttribute(AttributeProtocolVersion, int(hs.ProtocolVersion))
+	session.span.SetAttribute(AttributeRequestType, handshakeType(hs))
 
 	proxyUID := proxyUID(hs.ParseServerAddress(), addr)
 
 	log.Printf("[i] %s requests proxy with UID %s", connRemoteAddr, proxyUID)
-	v, ok := gateway.proxies.Load(proxyUID)
+	proxy, ok := gateway.findProxy(hs.ParseServerAddress(), addr)
 	if !ok {
-		// Client send an invalid address/port; we don't have a v for that address
+		// Client send an invalid address/port; we don't have a proxy for that address
+		metrics.HandshakesTotal.WithLabelValues("", handshakeType(hs)).Inc()
+		metrics.ConnectionsTotal.WithLabelValues("", metrics.ResultUnknownServer).Inc()
+		session.logger.Warn("no proxy found", "conn_id", session.event.ConnID, "proxy_uid", proxyUID)
+		if gateway.NoProxyMessage != "" {
+			if err := rejectLogin(conn, connRemoteAddr, gateway.NoProxyMessage); err != nil {
+				return err
+			}
+		}
 		return errors.New("no proxy with uid " + proxyUID)
 	}
-	proxy := v.(*Proxy)
 
-	if err := proxy.handleConn(conn, connRemoteAddr); err != nil {
-		proxy.CallbackLogger().LogEvent(callback.ErrorEvent{
+	metrics.HandshakesTotal.WithLabelValues(proxy.DomainName(), handshakeType(hs)).Inc()
+	session.logger.Info("routed connection", "conn_id", session.event.ConnID, "proxy_uid", proxy.UID())
+	if err := proxy.handleConn(ctx, conn, connRemoteAddr, session, gateway.BanStore); err != nil {
+		metrics.ConnectionsTotal.WithLabelValues(proxy.DomainName(), metrics.ResultError).Inc()
+		proxy.logEvent(callback.ErrorEvent{
 			Error:    err.Error(),
-			ProxyUID: proxyUID,
+			ProxyUID: proxy.UID(),
 		})
 		return err
 	}
+	metrics.ConnectionsTotal.WithLabelValues(proxy.DomainName(), metrics.ResultSuccess).Inc()
 	return nil
 }
+
+// ErrMalformedHandshake is returned for connections whose first packet is not a valid handshake
+var ErrMalformedHandshake = errors.New("malformed handshake")
+
+// maxHandshakeDataLength limits how many bytes of a malformed handshake are kept for the log
+const maxHandshakeDataLength = 32
+
+// handshakeError is a malformed handshake with the first bytes the client sent
+type handshakeError struct {
+	data []byte
+	err  error
+}
+
+func (err *handshakeError) Error() string {
+	return ErrMalformedHandshake.Error() + ": " + err.err.Error()
+}
+
+func (err *handshakeError) Is(target error) bool {
+	return target == ErrMalformedHandshake
+}
+
+func (err *handshakeError) Unwrap() error {
+	return err.err
+}
+
+// newHandshakeError classifies err of reading the handshake of conn.
+// Timeouts and closed connections are returned as they are since they say nothing about the bytes
+// the client sent, as are clients that close the connection without sending anything, like
+// health checks of load balancers and port scans do. Everything else becomes a handshakeError
+// with the bytes conn has buffered.
+func newHandshakeError(conn Conn, err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
+		return err
+	}
+
+	n := conn.Reader().Buffered()
+	if n == 0 && errors.Is(err, io.EOF) {
+		return err
+	}
+	if n > maxHandshakeDataLength {
+		n = maxHandshakeDataLength
+	}
+	data, _ := conn.Reader().Peek(n)
+	return &handshakeError{
+		data: append([]byte(nil), data...),
+		err:  err,
+	}
+}
+
+// peekHandshake peeks the handshake of conn in its own span
+func peekHandshake(ctx context.Context, conn Conn, session *connSession) (handshaking.ServerBoundHandshake, error) {
+	_, span := session.startSpan(ctx, SpanHandshake)
+	defer span.End()
+
+	pk, err := conn.PeekPacket()
+	if err != nil {
+		span.RecordError(err)
+		return handshaking.ServerBoundHandshake{}, newHandshakeError(conn, err)
+	}
+
+	hs, err := handshaking.UnmarshalServerBoundHandshake(pk)
+	if err != nil {
+		span.RecordError(err)
+		return hs, newHandshakeError(conn, err)
+	}
+	return hs, nil
+}
+
+// handshakeType returns the type label of hs for the HandshakesTotal metric
+func handshakeType(hs handshaking.ServerBoundHandshake) string {
+	switch {
+	case hs.IsStatusRequest():
+		return metrics.HandshakeTypeStatus
+	case hs.IsLoginRequest():
+		return metrics.HandshakeTypeLogin
+	default:
+		return metrics.HandshakeTypeUnknown
+	}
+}
+
+// regexpDomainPrefix marks a domain name as regular expression like in the server_name of Nginx
+const regexpDomainPrefix = "~"
+
+// findProxy returns the proxy for domain on the listener addr.
+// If no proxy has the exact domain name, proxies with a wildcard domain name
+// like *.example.com match any subdomain. The most specific wildcard wins.
+// After that domain names starting with ~ are matched as regular expressions
+// in the order they were registered.
+// A proxy with the domain name * is the fallback for all other domains.
+func (gateway *Gateway) findProxy(domain, addr string) (*Proxy, bool) {
+	if v, ok := gateway.proxies.Load(proxyUID(domain, addr)); ok {
+		return v.(*Proxy), true
+	}
+
+	labels := strings.Split(domain, ".")
+	for i := 1; i < len(labels); i++ {
+		wildcard := "*." + strings.Join(labels[i:], ".")
+		if v, ok := gateway.proxies.Load(proxyUID(wildcard, addr)); ok {
+			return v.(*Proxy), true
+		}
+	}
+
+	if proxy, ok := gateway.findRegexpProxy(strings.ToLower(domain), addr); ok {
+		return proxy, true
+	}
+
+	if v, ok := gateway.proxies.Load(proxyUID("*", addr)); ok {
+		return v.(*Proxy), true
+	}
+
+	return nil, false
+}
+
+func (gateway *Gateway) findRegexpProxy(domain, addr string) (*Proxy, bool) {
+	gateway.regexpMu.RLock()
+	defer gateway.regexpMu.RUnlock()
+
+	for _, rp := range gateway.regexpProxies {
+		if rp.addr == addr && rp.match(domain) {
+			return rp.proxy, true
+		}
+	}
+	return nil, false
+}
+
+// serveLegacyPing answers the server list ping of clients older than 1.7.
+// Clients before 1.6 do not send the address they connect to, so their ping
+// is only answered if a single proxy listens to addr.
+func (gateway *Gateway) serveLegacyPing(conn Conn, addr string, connRemoteAddr net.Addr) error {
+	ping, err := status.ReadLegacyServerListPing(conn.Reader())
+	if err != nil {
+		return err
+	}
+
+	var proxy *Proxy
+	if ping.ServerAddress != "" {
+		proxy, _ = gateway.findProxy(ping.ServerAddress, addr)
+	} else {
+		// Proxies with several domain names are stored once per UID
+		gateway.proxies.Range(func(k, v interface{}) bool {
+			if v.(*Proxy).ListenTo() != addr || v.(*Proxy) == proxy {
+				return true
+			}
+			if proxy != nil {
+				proxy = nil
+				return false
+			}
+			proxy = v.(*Proxy)
+			return true
+		})
+	}
+
+	if proxy == nil {
+		return fmt.Errorf("no proxy for legacy server list ping to %q on %s", ping.ServerAddress, addr)
+	}
+
+	log.Printf("[i] %s requests legacy status of proxy with UID %s", connRemoteAddr, proxy.UID())
+	return proxy.handleLegacyStatusRequest(conn, ping, connRemoteAddr)
+}
+
+// readProxyProtocolHeader reads an optional PROXY protocol v1 or v2 header from conn
+// and returns the address of the original client. If conn did not send a header or the
+// header carries no client address (LOCAL command or UNKNOWN family) the remote address
+// of conn is returned instead.
+func readProxyProtocolHeader(conn Conn) (net.Addr, error) {
+	header, err := proxyproto.Read(conn.Reader())
+	if err == proxyproto.ErrNoProxyProtocol {
+		return conn.RemoteAddr(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY protocol header from %s: %w", conn.RemoteAddr(), err)
+	}
+
+	if header.Command.IsLocal() || header.SourceAddr == nil {
+		return conn.RemoteAddr(), nil
+	}
+
+	return header.SourceAddr, nil
+}
+
+// rejectLogin sends a login disconnect packet with the given message
+// to conn if it requests a login. Status requests are not answered.
+// The login start is not read yet, so the message can't use the username.
+func rejectLogin(conn Conn, remoteAddr net.Addr, message string) error {
+	pk, err := conn.PeekPacket()
+	if err != nil {
+		return err
+	}
+
+	hs, err := handshaking.UnmarshalServerBoundHandshake(pk)
+	if err != nil {
+		return err
+	}
+
+	if !hs.IsLoginRequest() {
+		return nil
+	}
+
+	host := hs.ParseServerAddress()
+	fields := map[string]string{
+		"now":           time.Now().Format(time.RFC822),
+		"remoteAddress": remoteAddr.String(),
+		"localAddress":  conn.LocalAddr().String(),
+		"domain":        host,
+		"host":          host,
+		"ip":            addrIP(remoteAddr),
+	}
+
+	return conn.WritePacket(login.ClientBoundDisconnect{
+		Reason: renderMessage(message, fields),
+	}.Marshal())
+}
@@ -1,17 +1,43 @@
 package infrared
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf16"
 
+	"github.com/gofrs/uuid"
+	"github.com/haveachin/infrared/callback"
+	"github.com/haveachin/infrared/metrics"
 	"github.com/haveachin/infrared/protocol"
 	"github.com/haveachin/infrared/protocol/handshaking"
+	"github.com/haveachin/infrared/protocol/login"
 	"github.com/haveachin/infrared/protocol/status"
 	"github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var serverDomain string = "infrared.gateway"
@@ -78,6 +104,16 @@ func statusHandshakePort(portEnd int) protocol.Packet {
 	return serverHandshake(serverDomain, gatewayPort)
 }
 
+func loginHandshakePort(portEnd int) protocol.Packet {
+	hs := handshaking.ServerBoundHandshake{
+		ProtocolVersion: 574,
+		ServerAddress:   protocol.String(serverDomain),
+		ServerPort:      protocol.UnsignedShort(gatewayPort(portEnd)),
+		NextState:       2,
+	}
+	return hs.Marshal()
+}
+
 func serverHandshake(domain string, port int) protocol.Packet {
 	hs := handshaking.ServerBoundHandshake{
 		ProtocolVersion: 574,
@@ -417,7 +453,7 @@ func TestProxyProtocol(t *testing.T) {
 			go func(wg *sync.WaitGroup) {
 				config := createProxyProtocolConfig(tc.portEnd, tc.proxyproto)
 				gateway := Gateway{
-					receiveProxyProtocol: tc.receiveProxyproto,
+					ReceiveProxyProtocol: tc.receiveProxyproto,
 				}
 				proxies := configToProxies(config)
 				if err := gateway.ListenAndServe(proxies); err != nil {
@@ -466,6 +502,296 @@ func TestProxyProtocol(t *testing.T) {
 	}
 }
 
+func TestProxyProtocolIPFilter(t *testing.T) {
+	tt := []struct {
+		name    string
+		portEnd int
+		deny    []string
+		allowed bool
+	}{
+		{
+			name:    "ClientDenied",
+			portEnd: 618,
+			deny:    []string{"109.226.143.0/24"},
+			allowed: false,
+		},
+		{
+			name:    "LoadBalancerNotFiltered",
+			portEnd: 619,
+			deny:    []string{"127.0.0.0/8"},
+			allowed: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			filter, err := NewIPFilter(nil, tc.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config := proxyConfigWithPortEnd(tc.portEnd)
+			config.OfflineStatus = offlineStatus
+
+			gateway := Gateway{
+				ReceiveProxyProtocol: true,
+				IPFilter:             filter,
+			}
+			if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+				t.Fatalf("Can't start gateway: %v", err)
+			}
+			defer gateway.Close()
+
+			receivedVersion, testErr := statusDial(statusDialConfig{
+				pk:                      statusHandshakePort(tc.portEnd),
+				gatewayAddr:             gatewayAddr(tc.portEnd),
+				sendProxyProtocolHeader: true,
+			})
+			if allowed := testErr == nil; allowed != tc.allowed {
+				t.Fatalf("got: %v; want: %v", allowed, tc.allowed)
+			}
+			if tc.allowed && receivedVersion != offlineStatus.VersionName {
+				t.Errorf("got: %v; want: %v", receivedVersion, offlineStatus.VersionName)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolTrustedProxies(t *testing.T) {
+	tt := []struct {
+		name       string
+		portEnd    int
+		trusted    []string
+		sendHeader bool
+		allowed    bool
+	}{
+		{
+			name:       "TrustedHeader",
+			portEnd:    640,
+			trusted:    []string{"127.0.0.0/8"},
+			sendHeader: true,
+			allowed:    true,
+		},
+		{
+			name:       "UntrustedHeader",
+			portEnd:    641,
+			trusted:    []string{"10.0.0.0/8"},
+			sendHeader: true,
+			allowed:    false,
+		},
+		{
+			name:    "UntrustedWithoutHeader",
+			portEnd: 642,
+			trusted: []string{"10.0.0.0/8"},
+			allowed: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			trustedProxies, err := NewIPFilter(tc.trusted, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config := proxyConfigWithPortEnd(tc.portEnd)
+			config.OfflineStatus = offlineStatus
+
+			logger := &recordingConnLogger{}
+			gateway := Gateway{
+				ReceiveProxyProtocol: true,
+				TrustedProxies:       trustedProxies,
+				ConnLogger:           logger,
+			}
+			if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+				t.Fatalf("Can't start gateway: %v", err)
+			}
+			defer gateway.Close()
+
+			receivedVersion, testErr := statusDial(statusDialConfig{
+				pk:                      statusHandshakePort(tc.portEnd),
+				gatewayAddr:             gatewayAddr(tc.portEnd),
+				sendProxyProtocolHeader: tc.sendHeader,
+			})
+			if allowed := testErr == nil; allowed != tc.allowed {
+				t.Fatalf("got: %v; want: %v", allowed, tc.allowed)
+			}
+			if !tc.allowed {
+				return
+			}
+			if receivedVersion != offlineStatus.VersionName {
+				t.Errorf("got: %v; want: %v", receivedVersion, offlineStatus.VersionName)
+			}
+
+			expectedIP := "127.0.0.1"
+			if tc.sendHeader {
+				expectedIP = "109.226.143.210"
+			}
+			deadline := time.Now().Add(time.Second)
+			for time.Now().Before(deadline) {
+				events := logger.Events()
+				if len(events) == 0 {
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+				if last := events[len(events)-1]; last.Event == ConnEventDisconnected {
+					if ip := strings.Split(last.RemoteAddr, ":")[0]; ip != expectedIP {
+						t.Errorf("got: %v; want: %v", ip, expectedIP)
+					}
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			t.Error("connection did not disconnect")
+		})
+	}
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	clientAddr := &net.TCPAddr{IP: net.ParseIP("109.226.143.210"), Port: 54321}
+	gatewayAddr := &net.TCPAddr{IP: net.ParseIP("210.223.216.109"), Port: 25565}
+
+	headerWithTLVs := proxyproto.HeaderProxyFromAddrs(2, clientAddr, gatewayAddr)
+	if err := headerWithTLVs.SetTLVs([]proxyproto.TLV{
+		{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte(serverDomain)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name         string
+		header       *proxyproto.Header
+		expectedAddr string
+	}{
+		{
+			name:         "NoHeader",
+			header:       nil,
+			expectedAddr: "pipe",
+		},
+		{
+			name:         "Version1",
+			header:       proxyproto.HeaderProxyFromAddrs(1, clientAddr, gatewayAddr),
+			expectedAddr: clientAddr.String(),
+		},
+		{
+			name:         "Version2",
+			header:       proxyproto.HeaderProxyFromAddrs(2, clientAddr, gatewayAddr),
+			expectedAddr: clientAddr.String(),
+		},
+		{
+			name:         "Version2WithTLVs",
+			header:       headerWithTLVs,
+			expectedAddr: clientAddr.String(),
+		},
+		{
+			name: "Version2Local",
+			header: &proxyproto.Header{
+				Version:           2,
+				Command:           proxyproto.LOCAL,
+				TransportProtocol: proxyproto.UNSPEC,
+			},
+			expectedAddr: "pipe",
+		},
+		{
+			name: "Version1Unknown",
+			header: &proxyproto.Header{
+				Version:           1,
+				Command:           proxyproto.PROXY,
+				TransportProtocol: proxyproto.UNSPEC,
+			},
+			expectedAddr: "pipe",
+		},
+	}
+
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+
+			go func() {
+				if tc.header != nil {
+					if _, err := tc.header.WriteTo(c1); err != nil {
+						return
+					}
+				}
+				_ = wrapConn(c1).WritePacket(statusHandshakePort(0))
+			}()
+
+			conn := wrapConn(c2)
+			addr, err := readProxyProtocolHeader(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if addr.String() != tc.expectedAddr {
+				t.Errorf("got: %v; want: %v", addr, tc.expectedAddr)
+			}
+
+			pk, err := conn.ReadPacket()
+			if err != nil {
+				t.Fatalf("Can't read handshake after header: %v", err)
+			}
+
+			if _, err := handshaking.UnmarshalServerBoundHandshake(pk); err != nil {
+				t.Errorf("Can't unmarshal handshake after header: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadProxyProtocolHeader_Malformed(t *testing.T) {
+	tt := []struct {
+		name        string
+		preamble    []byte
+		expectError bool
+	}{
+		{
+			name:        "InvalidVersion1Address",
+			preamble:    []byte("PROXY TCP4 999.1.1.1 127.0.0.1 54321 25565\r\n"),
+			expectError: true,
+		},
+		{
+			name:        "Version1WithoutCRLF",
+			preamble:    []byte("PROXY TCP4 127.0.0.1 127.0.0.1 54321 25565\n"),
+			expectError: true,
+		},
+		{
+			name:        "Version2InvalidFamily",
+			preamble:    append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0xFF, 0x00, 0x00),
+			expectError: true,
+		},
+		{
+			name:        "GarbagePreamble",
+			preamble:    []byte("GET / HTTP/1.1\r\n"),
+			expectError: false,
+		},
+	}
+
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+
+			go func() {
+				_, _ = c1.Write(tc.preamble)
+			}()
+
+			addr, err := readProxyProtocolHeader(wrapConn(c2))
+			if (err != nil) != tc.expectError {
+				t.Fatalf("got error: %v; want error: %v", err, tc.expectError)
+			}
+
+			if !tc.expectError && addr.String() != c2.RemoteAddr().String() {
+				t.Errorf("got: %v; want: %v", addr, c2.RemoteAddr())
+			}
+		})
+	}
+}
+
 func TestRouting(t *testing.T) {
 	wg := &sync.WaitGroup{}
 	errorCh := make(chan *testError)
@@ -630,6 +956,3463 @@ func TestRouting(t *testing.T) {
 	}
 }
 
-func TestProxyBind(t *testing.T) {
-	// TODO: Figure out a way to test this
+func TestProxy_ServerDialer(t *testing.T) {
+	portEnd := 650
+	config := createBasicProxyConfig(serverDomain, gatewayAddr(portEnd), serverAddr(portEnd))
+	config.OfflineStatus = offlineStatus
+
+	requests := make(chan DialRequest, 1)
+	proxy := &Proxy{
+		Config: config,
+		ServerDialer: ServerDialerFunc(func(ctx context.Context, req DialRequest) (Conn, error) {
+			requests <- req
+			return nil, errors.New("server is offline")
+		}),
+	}
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe([]*Proxy{proxy}); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	tt := []struct {
+		name             string
+		handshake        protocol.Packet
+		next             protocol.Packet
+		expectedUsername string
+	}{
+		{
+			name:      "Status",
+			handshake: statusHandshakePort(portEnd),
+			next:      status.ServerBoundRequest{}.Marshal(),
+		},
+		{
+			name:             "Login",
+			handshake:        loginHandshakePort(portEnd),
+			next:             login.ServerLoginStart{Name: "Steve"}.Marshal(),
+			expectedUsername: "Steve",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			if err := sendHandshake(conn, tc.handshake); err != nil {
+				t.Fatalf("%s: %v", err.Message, err.Error)
+			}
+			if err := conn.WritePacket(tc.next); err != nil {
+				t.Fatal(err)
+			}
+			// The proxy answers with the offline status or disconnects the login
+			if _, err := conn.ReadPacket(); err != nil {
+				t.Fatal(err)
+			}
+
+			var req DialRequest
+			select {
+			case req = <-requests:
+			case <-time.After(time.Second):
+				t.Fatal("proxy did not call its server dialer")
+			}
+
+			expectedHandshake, err := handshaking.UnmarshalServerBoundHandshake(tc.handshake)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.ServerAddr != serverAddr(portEnd) {
+				t.Errorf("got: %v; want: %v", req.ServerAddr, serverAddr(portEnd))
+			}
+			if req.ClientAddr == nil || req.ClientAddr.String() != conn.LocalAddr().String() {
+				t.Errorf("got: %v; want: %v", req.ClientAddr, conn.LocalAddr())
+			}
+			if req.Handshake != expectedHandshake {
+				t.Errorf("got: %v; want: %v", req.Handshake, expectedHandshake)
+			}
+			if req.Username != tc.expectedUsername {
+				t.Errorf("got: %v; want: %v", req.Username, tc.expectedUsername)
+			}
+		})
+	}
+}
+
+func TestVersionRouting(t *testing.T) {
+	portEnd := 647
+	errorCh := make(chan *testError, 3)
+
+	legacyAddr := serverAddr(portEnd)
+	modernAddr := serverAddr(portEnd + 1)
+	defaultAddr := serverAddr(portEnd + 2)
+	statusListen(statusListenerConfig{addr: legacyAddr, status: statusPKWithVersion("legacy")}, errorCh)
+	statusListen(statusListenerConfig{addr: modernAddr, status: statusPKWithVersion("modern")}, errorCh)
+	statusListen(statusListenerConfig{addr: defaultAddr, status: statusPKWithVersion("default")}, errorCh)
+
+	config := createBasicProxyConfig(serverDomain, gatewayAddr(portEnd), defaultAddr)
+	config.VersionRoutes = []VersionRouteConfig{
+		{MinProtocol: 47, MaxProtocol: 340, ProxyTo: legacyAddr},
+		{MinProtocol: 735, ProxyTo: modernAddr},
+	}
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	select {
+	case err := <-errorCh:
+		t.Fatalf("%s: %v", err.Message, err.Error)
+	default:
+	}
+
+	tt := []struct {
+		name            string
+		protocolVersion int
+		expectedVersion string
+	}{
+		{
+			name:            "LegacyLowerBound",
+			protocolVersion: 47,
+			expectedVersion: "legacy",
+		},
+		{
+			name:            "LegacyUpperBound",
+			protocolVersion: 340,
+			expectedVersion: "legacy",
+		},
+		{
+			name:            "ModernWithoutUpperBound",
+			protocolVersion: 763,
+			expectedVersion: "modern",
+		},
+		{
+			name:            "UnmatchedBetweenRoutes",
+			protocolVersion: 578,
+			expectedVersion: "default",
+		},
+		{
+			name:            "UnmatchedBelowRoutes",
+			protocolVersion: 5,
+			expectedVersion: "default",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			hs := handshaking.ServerBoundHandshake{
+				ProtocolVersion: protocol.VarInt(tc.protocolVersion),
+				ServerAddress:   protocol.String(serverDomain),
+				ServerPort:      protocol.UnsignedShort(gatewayPort(portEnd)),
+				NextState:       handshaking.ServerBoundHandshakeStatusState,
+			}
+			receivedVersion, testErr := statusDial(statusDialConfig{
+				pk:          hs.Marshal(),
+				gatewayAddr: gatewayAddr(portEnd),
+			})
+			if testErr != nil {
+				t.Fatalf("%s: %v", testErr.Message, testErr.Error)
+			}
+			if receivedVersion != tc.expectedVersion {
+				t.Errorf("got: %v; want: %v", receivedVersion, tc.expectedVersion)
+			}
+		})
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	tt := []struct {
+		name          string
+		portEnd       int
+		sendHandshake bool
+		loginRequest  bool
+		shouldClose   bool
+	}{
+		{
+			name:          "StalledHandshake",
+			portEnd:       590,
+			sendHandshake: false,
+			shouldClose:   true,
+		},
+		{
+			name:          "FastHandshake",
+			portEnd:       591,
+			sendHandshake: true,
+			shouldClose:   false,
+		},
+		{
+			name:          "StalledLoginStart",
+			portEnd:       593,
+			sendHandshake: true,
+			loginRequest:  true,
+			shouldClose:   true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			config := proxyConfigWithPortEnd(tc.portEnd)
+			config.OnlineStatus = onlineStatus
+			config.OfflineStatus = offlineStatus
+
+			gateway := Gateway{
+				HandshakeTimeout: 100 * time.Millisecond,
+			}
+			if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+				t.Fatalf("Can't start gateway: %v", err)
+			}
+			defer gateway.Close()
+
+			conn, err := Dialer{}.Dial(gatewayAddr(tc.portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			if tc.sendHandshake {
+				pk := statusHandshakePort(tc.portEnd)
+				if tc.loginRequest {
+					pk = loginHandshakePort(tc.portEnd)
+				}
+				if err := sendHandshake(conn, pk); err != nil {
+					t.Fatalf("%s: %v", err.Message, err.Error)
+				}
+			}
+
+			if tc.sendHandshake && !tc.loginRequest {
+				if err := conn.WritePacket(status.ServerBoundRequest{}.Marshal()); err != nil {
+					t.Fatalf("Can't write status request packet: %v", err)
+				}
+			}
+
+			if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = conn.Read(make([]byte, 1))
+			closed := err == io.EOF
+			if closed != tc.shouldClose {
+				t.Errorf("got: %v; want: %v; error: %v", closed, tc.shouldClose, err)
+			}
+		})
+	}
+}
+
+func selfSignedTLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: serverDomain},
+		DNSNames:     []string{serverDomain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func TestTLSStatusRequest(t *testing.T) {
+	portEnd := 592
+	tlsConfig, err := selfSignedTLSConfig()
+	if err != nil {
+		t.Fatalf("Can't create TLS config: %v", err)
+	}
+
+	config := proxyConfigWithPortEnd(portEnd)
+	config.OfflineStatus = offlineStatus
+
+	gateway := Gateway{
+		TLSConfig: tlsConfig,
+	}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	netConn, err := tls.Dial("tcp", gatewayAddr(portEnd), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Can't make a TLS connection with gateway: %v", err)
+	}
+	conn := wrapConn(netConn)
+	defer conn.Close()
+
+	if err := sendHandshake(conn, statusHandshakePort(portEnd)); err != nil {
+		t.Fatalf("%s: %v", err.Message, err.Error)
+	}
+
+	if err := conn.WritePacket(status.ServerBoundRequest{}.Marshal()); err != nil {
+		t.Fatalf("Can't write status request packet: %v", err)
+	}
+
+	pk, err := conn.ReadPacket()
+	if err != nil {
+		t.Fatalf("Can't read status response packet: %v", err)
+	}
+
+	response, err := status.UnmarshalClientBoundResponse(pk)
+	if err != nil {
+		t.Fatalf("Can't unmarshal status response packet: %v", err)
+	}
+
+	res := status.ResponseJSON{}
+	if err := json.Unmarshal([]byte(response.JSONResponse), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Version.Name != offlineStatus.VersionName {
+		t.Errorf("got: %v; want: %v", res.Version.Name, offlineStatus.VersionName)
+	}
+}
+
+func readDisconnectMessage(conn Conn) (string, error) {
+	pk, err := conn.ReadPacket()
+	if err != nil {
+		return "", err
+	}
+
+	var reason protocol.Chat
+	if err := pk.Scan(&reason); err != nil {
+		return "", err
+	}
+
+	var description status.DescriptionJSON
+	if err := json.Unmarshal([]byte(reason), &description); err != nil {
+		return "", err
+	}
+	return description.Text, nil
+}
+
+func TestGateway_NumAcceptWorkers(t *testing.T) {
+	portEnd := 646
+	config := proxyConfigWithPortEnd(portEnd)
+	config.OfflineStatus = offlineStatus
+
+	gateway := Gateway{NumAcceptWorkers: 4}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	// Enough connections that every socket gets some of them
+	for i := 0; i < 32; i++ {
+		receivedVersion, testErr := statusDial(statusDialConfig{
+			pk:          statusHandshakePort(portEnd),
+			gatewayAddr: gatewayAddr(portEnd),
+		})
+		if testErr != nil {
+			t.Fatalf("%s: %v", testErr.Message, testErr.Error)
+		}
+		if receivedVersion != offlineStatus.VersionName {
+			t.Errorf("got: %v; want: %v", receivedVersion, offlineStatus.VersionName)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	tt := []struct {
+		name    string
+		portEnd int
+		message string
+	}{
+		{
+			name:    "DisconnectMessage",
+			portEnd: 594,
+			message: "Too many connections",
+		},
+		{
+			name:    "SilentDrop",
+			portEnd: 598,
+			message: "",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			config := proxyConfigWithPortEnd(tc.portEnd)
+			config.OfflineStatus = offlineStatus
+
+			gateway := Gateway{
+				RateLimiter:      NewIPRateLimiter(0.001, 1),
+				RateLimitMessage: tc.message,
+			}
+			if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+				t.Fatalf("Can't start gateway: %v", err)
+			}
+			defer gateway.Close()
+
+			receivedVersion, testErr := statusDial(statusDialConfig{
+				pk:          statusHandshakePort(tc.portEnd),
+				gatewayAddr: gatewayAddr(tc.portEnd),
+			})
+			if testErr != nil {
+				t.Fatalf("%s: %v", testErr.Message, testErr.Error)
+			}
+			if receivedVersion != offlineStatus.VersionName {
+				t.Errorf("got: %v; want: %v", receivedVersion, offlineStatus.VersionName)
+			}
+
+			conn, err := Dialer{}.Dial(gatewayAddr(tc.portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			if err := sendHandshake(conn, loginHandshakePort(tc.portEnd)); err != nil {
+				t.Fatalf("%s: %v", err.Message, err.Error)
+			}
+
+			if tc.message == "" {
+				if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+					t.Fatal(err)
+				}
+				// The gateway may reset the connection since the handshake is never read
+				if n, err := conn.Read(make([]byte, 1)); n > 0 || err == nil {
+					t.Errorf("got: %d bytes; want: connection closed without response", n)
+				}
+				return
+			}
+
+			receivedMessage, err := readDisconnectMessage(conn)
+			if err != nil {
+				t.Fatalf("Can't read disconnect packet: %v", err)
+			}
+
+			if receivedMessage != tc.message {
+				t.Errorf("got: %v; want: %v", receivedMessage, tc.message)
+			}
+		})
+	}
+}
+
+// waitActiveConns waits until n connections hold a slot of the MaxConnections of gateway
+func waitActiveConns(t *testing.T, gateway *Gateway, n int32) {
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&gateway.activeConns) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got: %d active connections; want: %d", atomic.LoadInt32(&gateway.activeConns), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	tt := []struct {
+		name    string
+		portEnd int
+		message string
+	}{
+		{
+			name:    "DisconnectMessage",
+			portEnd: 644,
+			message: "Infrared is full",
+		},
+		{
+			name:    "SilentDrop",
+			portEnd: 645,
+			message: "",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			config := proxyConfigWithPortEnd(tc.portEnd)
+			config.OfflineStatus = offlineStatus
+
+			gateway := Gateway{
+				MaxConnections:        2,
+				MaxConnectionsMessage: tc.message,
+			}
+			if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+				t.Fatalf("Can't start gateway: %v", err)
+			}
+			defer gateway.Close()
+
+			// Saturate the limit with connections that never send their handshake
+			var idleConns []Conn
+			for i := 0; i < gateway.MaxConnections; i++ {
+				conn, err := Dialer{}.Dial(gatewayAddr(tc.portEnd))
+				if err != nil {
+					t.Fatalf("Can't make a connection with gateway: %v", err)
+				}
+				defer conn.Close()
+				idleConns = append(idleConns, conn)
+			}
+			waitActiveConns(t, &gateway, int32(gateway.MaxConnections))
+
+			conn, err := Dialer{}.Dial(gatewayAddr(tc.portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			if err := sendHandshake(conn, loginHandshakePort(tc.portEnd)); err != nil {
+				t.Fatalf("%s: %v", err.Message, err.Error)
+			}
+
+			if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if tc.message == "" {
+				if n, err := conn.Read(make([]byte, 1)); n > 0 || err == nil {
+					t.Errorf("got: %d bytes; want: connection closed without response", n)
+				}
+			} else {
+				receivedMessage, err := readDisconnectMessage(conn)
+				if err != nil {
+					t.Fatalf("Can't read disconnect packet: %v", err)
+				}
+				if receivedMessage != tc.message {
+					t.Errorf("got: %v; want: %v", receivedMessage, tc.message)
+				}
+			}
+
+			// Refused connections must not hold a slot
+			waitActiveConns(t, &gateway, int32(gateway.MaxConnections))
+
+			idleConns[0].Close()
+			waitActiveConns(t, &gateway, int32(gateway.MaxConnections-1))
+
+			receivedVersion, testErr := statusDial(statusDialConfig{
+				pk:          statusHandshakePort(tc.portEnd),
+				gatewayAddr: gatewayAddr(tc.portEnd),
+			})
+			if testErr != nil {
+				t.Fatalf("%s: %v", testErr.Message, testErr.Error)
+			}
+			if receivedVersion != offlineStatus.VersionName {
+				t.Errorf("got: %v; want: %v", receivedVersion, offlineStatus.VersionName)
+			}
+		})
+	}
+}
+
+func TestMaxConnections_RejectingConns(t *testing.T) {
+	portEnd := 662
+	config := proxyConfigWithPortEnd(portEnd)
+
+	gateway := Gateway{
+		MaxConnections:        1,
+		MaxConnectionsMessage: "Infrared is full",
+	}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	dial := func() Conn {
+		conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+		if err != nil {
+			t.Fatalf("Can't make a connection with gateway: %v", err)
+		}
+		return conn
+	}
+	waitRejectingConns := func(n int32, timeout time.Duration) {
+		deadline := time.Now().Add(timeout)
+		for atomic.LoadInt32(&gateway.rejectingConns) != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("got: %d rejecting connections; want: %d", atomic.LoadInt32(&gateway.rejectingConns), n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	idleConn := dial()
+	defer idleConn.Close()
+	waitActiveConns(t, &gateway, 1)
+
+	// Connections beyond the limit that never send their handshake
+	for i := 0; i < maxRejectingConns; i++ {
+		conn := dial()
+		defer conn.Close()
+	}
+	waitRejectingConns(maxRejectingConns, time.Second)
+
+	// Once all rejecting slots are taken, connections are closed right away
+	conn := dial()
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(rejectTimeout / 2)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := conn.Read(make([]byte, 1)); n > 0 || err != io.EOF {
+		t.Errorf("got: %d bytes, %v; want: %v", n, err, io.EOF)
+	}
+
+	// Rejecting connections time out
+	waitRejectingConns(0, 2*rejectTimeout)
+}
+
+func TestNoProxyMessage(t *testing.T) {
+	tt := []struct {
+		name        string
+		portEnd     int
+		message     string
+		wantMessage string
+	}{
+		{
+			name:        "DisconnectMessage",
+			portEnd:     616,
+			message:     "No server found for {{domain}}",
+			wantMessage: "No server found for unknown.example.com",
+		},
+		{
+			name:    "SilentDrop",
+			portEnd: 617,
+			message: "",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			gateway := Gateway{
+				NoProxyMessage: tc.message,
+			}
+			if err := gateway.ListenAndServe(configToProxies(proxyConfigWithPortEnd(tc.portEnd))); err != nil {
+				t.Fatalf("Can't start gateway: %v", err)
+			}
+			defer gateway.Close()
+
+			conn, err := Dialer{}.Dial(gatewayAddr(tc.portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			hs := handshaking.ServerBoundHandshake{
+				ProtocolVersion: 574,
+				ServerAddress:   "unknown.example.com",
+				ServerPort:      protocol.UnsignedShort(gatewayPort(tc.portEnd)),
+				NextState:       2,
+			}
+			if err := sendHandshake(conn, hs.Marshal()); err != nil {
+				t.Fatalf("%s: %v", err.Message, err.Error)
+			}
+
+			if tc.message == "" {
+				if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+					t.Fatal(err)
+				}
+				if n, err := conn.Read(make([]byte, 1)); n > 0 || err == nil {
+					t.Errorf("got: %d bytes; want: connection closed without response", n)
+				}
+				return
+			}
+
+			receivedMessage, err := readDisconnectMessage(conn)
+			if err != nil {
+				t.Fatalf("Can't read disconnect packet: %v", err)
+			}
+
+			if receivedMessage != tc.wantMessage {
+				t.Errorf("got: %v; want: %v", receivedMessage, tc.wantMessage)
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	tt := []struct {
+		name          string
+		portEnd       int
+		closeClient   bool
+		expectedError error
+	}{
+		{
+			name:          "ClientLeaves",
+			portEnd:       595,
+			closeClient:   true,
+			expectedError: nil,
+		},
+		{
+			name:          "ForceClose",
+			portEnd:       596,
+			closeClient:   false,
+			expectedError: context.DeadlineExceeded,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			server, err := net.Listen("tcp", serverAddr(tc.portEnd))
+			if err != nil {
+				t.Fatalf("Can't listen to %v: %v", serverAddr(tc.portEnd), err)
+			}
+			defer server.Close()
+
+			go func() {
+				conn, err := server.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}()
+
+			gateway := Gateway{}
+			if err := gateway.ListenAndServe(configToProxies(proxyConfigWithPortEnd(tc.portEnd))); err != nil {
+				t.Fatalf("Can't start gateway: %v", err)
+			}
+
+			conn, err := Dialer{}.Dial(gatewayAddr(tc.portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			if err := sendHandshake(conn, loginHandshakePort(tc.portEnd)); err != nil {
+				t.Fatalf("%s: %v", err.Message, err.Error)
+			}
+
+			if err := conn.WritePacket(login.ServerLoginStart{Name: "Steve"}.Marshal()); err != nil {
+				t.Fatalf("Can't write login start packet: %v", err)
+			}
+
+			// Give the gateway time to pipe the connection
+			time.Sleep(50 * time.Millisecond)
+
+			if tc.closeClient {
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					conn.Close()
+				}()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			if err := gateway.Shutdown(ctx); err != tc.expectedError {
+				t.Errorf("got: %v; want: %v", err, tc.expectedError)
+			}
+
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("shutdown took %v", elapsed)
+			}
+
+			if _, err := net.Dial("tcp", gatewayAddr(tc.portEnd)); err == nil {
+				t.Error("gateway still accepts connections after shutdown")
+			}
+
+			if !tc.closeClient {
+				if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+					t.Errorf("got: %v; want: %v", err, io.EOF)
+				}
+			}
+		})
+	}
+}
+
+func TestGateway_RegisterProxyAfterShutdown(t *testing.T) {
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configToProxies(proxyConfigWithPortEnd(629))); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+
+	if err := gateway.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A config change while draining must not open a new listener
+	proxy := &Proxy{Config: proxyConfigWithPortEnd(630)}
+	if err := gateway.RegisterProxy(proxy); err != ErrGatewayClosed {
+		t.Errorf("got: %v; want: %v", err, ErrGatewayClosed)
+	}
+
+	if _, err := net.Dial("tcp", gatewayAddr(630)); err == nil {
+		t.Error("gateway opened a listener after shutdown")
+	}
+}
+
+func TestGateway_CloseRegisteredProxy(t *testing.T) {
+	portEnd := 663
+	gateway := Gateway{}
+	defer gateway.Close()
+
+	replaced := &Proxy{Config: proxyConfigWithPortEnd(portEnd)}
+	replacement := &Proxy{Config: proxyConfigWithPortEnd(portEnd)}
+	for _, proxy := range []*Proxy{replaced, replacement} {
+		if err := gateway.RegisterProxy(proxy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The replaced proxy is no longer registered, so closing it does nothing
+	gateway.CloseRegisteredProxy(replaced)
+	if v, ok := gateway.proxies.Load(replacement.UID()); !ok || v.(*Proxy) != replacement {
+		t.Errorf("got: %v; want: %v", v, replacement)
+	}
+
+	gateway.CloseRegisteredProxy(replacement)
+	if v, ok := gateway.proxies.Load(replacement.UID()); ok {
+		t.Errorf("got: %v; want: no proxy", v)
+	}
+}
+
+func TestGateway_ConcurrentProxyRegistration(t *testing.T) {
+	portEnd := 597
+	server, err := net.Listen("tcp", serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer server.Close()
+
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	gateway := Gateway{}
+	defer gateway.Close()
+
+	keepConfig := proxyConfigWithPortEnd(portEnd)
+	keepConfig.OnlineStatus = onlineStatus
+	keep := &Proxy{Config: keepConfig}
+	if err := gateway.RegisterProxy(keep); err != nil {
+		t.Fatalf("Can't register proxy: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		domain := routeVersionName(i)
+		go func() {
+			defer wg.Done()
+			proxy := &Proxy{Config: createBasicProxyConfig(domain, gatewayAddr(portEnd), serverAddr(portEnd))}
+			if err := gateway.RegisterProxy(proxy); err != nil {
+				t.Errorf("Can't register proxy: %v", err)
+				return
+			}
+			gateway.CloseProxy(proxy.UID())
+		}()
+		go func() {
+			defer wg.Done()
+			_ = gateway.ProxyUIDs()
+		}()
+		go func() {
+			defer wg.Done()
+			name, err := statusDial(statusDialConfig{
+				pk:          statusHandshakePort(portEnd),
+				gatewayAddr: gatewayAddr(portEnd),
+			})
+			if err != nil {
+				t.Errorf("%s: %v", err.Message, err.Error)
+				return
+			}
+			if name != onlineStatus.VersionName {
+				t.Errorf("got: %v; want: %v", name, onlineStatus.VersionName)
+			}
+		}()
+	}
+	wg.Wait()
+
+	uids := gateway.ProxyUIDs()
+	if len(uids) != 1 || uids[0] != keep.UID() {
+		t.Errorf("got: %v; want: %v", uids, []string{keep.UID()})
+	}
+}
+
+func TestServerBalancing(t *testing.T) {
+	portEnd := 599
+	servers := []ServerConfig{
+		{Address: serverAddr(599), Weight: 1},
+		{Address: serverAddr(600), Weight: 3},
+	}
+
+	var mu sync.Mutex
+	accepted := map[string]int{}
+	for _, server := range servers {
+		addr := server.Address
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("Can't listen to %v: %v", addr, err)
+		}
+		defer listener.Close()
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				accepted[addr]++
+				mu.Unlock()
+				conn.Close()
+			}
+		}()
+	}
+
+	config := proxyConfigWithPortEnd(portEnd)
+	config.Servers = servers
+	config.OnlineStatus = onlineStatus
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	for i := 0; i < 8; i++ {
+		_, err := statusDial(statusDialConfig{
+			pk:          statusHandshakePort(portEnd),
+			gatewayAddr: gatewayAddr(portEnd),
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", err.Message, err.Error)
+		}
+	}
+
+	// The servers may not have counted the last connection yet
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		total := 0
+		for _, n := range accepted {
+			total += n
+		}
+		mu.Unlock()
+		if total >= 8 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, server := range servers {
+		if want := server.Weight * 2; accepted[server.Address] != want {
+			t.Errorf("%s got: %d; want: %d", server.Address, accepted[server.Address], want)
+		}
+	}
+}
+
+func TestLegacyServerListPing(t *testing.T) {
+	tt := []struct {
+		name        string
+		portEnd     int
+		domainNames []string
+		ping        func(portEnd int) []byte
+	}{
+		{
+			name:    "1.4",
+			portEnd: 601,
+			ping: func(portEnd int) []byte {
+				return []byte{0xFE, 0x01}
+			},
+		},
+		{
+			name:        "1.4MultipleDomainNames",
+			portEnd:     661,
+			domainNames: []string{"a.example.com", "b.example.com"},
+			ping: func(portEnd int) []byte {
+				return []byte{0xFE, 0x01}
+			},
+		},
+		{
+			name:    "1.6",
+			portEnd: 602,
+			ping: func(portEnd int) []byte {
+				encode := func(s string) []byte {
+					chars := utf16.Encode([]rune(s))
+					b := []byte{byte(len(chars) >> 8), byte(len(chars))}
+					for _, c := range chars {
+						b = append(b, byte(c>>8), byte(c))
+					}
+					return b
+				}
+				port := gatewayPort(portEnd)
+				data := append([]byte{78}, encode(serverDomain)...)
+				data = append(data, byte(port>>24), byte(port>>16), byte(port>>8), byte(port))
+				b := append([]byte{0xFE, 0x01, 0xFA}, encode("MC|PingHost")...)
+				b = append(b, byte(len(data)>>8), byte(len(data)))
+				return append(b, data...)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			config := proxyConfigWithPortEnd(tc.portEnd)
+			config.DomainNames = tc.domainNames
+			config.OfflineStatus = offlineStatus
+
+			gateway := Gateway{}
+			if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+				t.Fatalf("Can't start gateway: %v", err)
+			}
+			defer gateway.Close()
+
+			conn, err := net.Dial("tcp", gatewayAddr(tc.portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write(tc.ping(tc.portEnd)); err != nil {
+				t.Fatalf("Can't write legacy ping: %v", err)
+			}
+
+			if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("Can't read legacy response: %v", err)
+			}
+
+			expected := status.LegacyResponse{
+				ProtocolVersion: offlineStatus.ProtocolNumber,
+				VersionName:     offlineStatus.VersionName,
+				MOTD:            offlineStatus.MOTD,
+				MaxPlayers:      offlineStatus.MaxPlayers,
+			}.Marshal()
+			if !bytes.Equal(b, expected) {
+				t.Errorf("got: %v; want: %v", b, expected)
+			}
+		})
+	}
+}
+
+func TestGateway_FindProxy(t *testing.T) {
+	addr := ":25565"
+	domains := []string{
+		"mc.example.com",
+		"*.example.com",
+		"*.mc.example.com",
+		"*.lobby.mc.example.com",
+	}
+
+	gateway := Gateway{}
+	for _, domain := range domains {
+		proxy := &Proxy{Config: createBasicProxyConfig(domain, addr, "")}
+		gateway.proxies.Store(proxy.UID(), proxy)
+	}
+
+	tt := []struct {
+		name           string
+		domain         string
+		addr           string
+		expectedDomain string
+	}{
+		{
+			name:           "ExactBeatsWildcard",
+			domain:         "mc.example.com",
+			addr:           addr,
+			expectedDomain: "mc.example.com",
+		},
+		{
+			name:           "CaseInsensitive",
+			domain:         "MC.Example.com",
+			addr:           addr,
+			expectedDomain: "mc.example.com",
+		},
+		{
+			name:           "MostSpecificWildcard",
+			domain:         "eu.mc.example.com",
+			addr:           addr,
+			expectedDomain: "*.mc.example.com",
+		},
+		{
+			name:           "MultiLevelWildcard",
+			domain:         "a.b.mc.example.com",
+			addr:           addr,
+			expectedDomain: "*.mc.example.com",
+		},
+		{
+			name:           "DeepestWildcard",
+			domain:         "eu.lobby.mc.example.com",
+			addr:           addr,
+			expectedDomain: "*.lobby.mc.example.com",
+		},
+		{
+			name:           "TopLevelWildcard",
+			domain:         "shop.example.com",
+			addr:           addr,
+			expectedDomain: "*.example.com",
+		},
+		{
+			name:   "NoMatch",
+			domain: "example.org",
+			addr:   addr,
+		},
+		{
+			name:   "WildcardDoesNotMatchApex",
+			domain: "example.com",
+			addr:   addr,
+		},
+		{
+			name:   "OtherListener",
+			domain: "mc.example.com",
+			addr:   ":25566",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy, ok := gateway.findProxy(tc.domain, tc.addr)
+			if tc.expectedDomain == "" {
+				if ok {
+					t.Errorf("got: %v; want: no proxy", proxy.DomainName())
+				}
+				return
+			}
+
+			if !ok {
+				t.Fatalf("got: no proxy; want: %v", tc.expectedDomain)
+			}
+
+			if proxy.DomainName() != tc.expectedDomain {
+				t.Errorf("got: %v; want: %v", proxy.DomainName(), tc.expectedDomain)
+			}
+		})
+	}
+}
+
+func TestGateway_FindProxyRegexp(t *testing.T) {
+	addr := ":25565"
+	domains := []string{
+		"mc.example.com",
+		"*.lobby.example.com",
+		`~^survival-\d+\.example\.com$`,
+		`~^[a-z]+-\d+\.example\.com$`,
+		`~^(eu|us)\.lobby\.example\.com$`,
+		"*",
+	}
+
+	gateway := Gateway{}
+	for _, domain := range domains {
+		if err := gateway.storeProxy(&Proxy{Config: createBasicProxyConfig(domain, addr, "")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := []struct {
+		name           string
+		domain         string
+		expectedDomain string
+	}{
+		{
+			name:           "ExactBeatsRegexp",
+			domain:         "mc.example.com",
+			expectedDomain: "mc.example.com",
+		},
+		{
+			name:           "WildcardBeatsRegexp",
+			domain:         "eu.lobby.example.com",
+			expectedDomain: "*.lobby.example.com",
+		},
+		{
+			name:           "FirstRegistered",
+			domain:         "survival-1.example.com",
+			expectedDomain: `~^survival-\d+\.example\.com$`,
+		},
+		{
+			name:           "SecondRegistered",
+			domain:         "creative-12.example.com",
+			expectedDomain: `~^[a-z]+-\d+\.example\.com$`,
+		},
+		{
+			name:           "CaseInsensitive",
+			domain:         "Creative-12.Example.com",
+			expectedDomain: `~^[a-z]+-\d+\.example\.com$`,
+		},
+		{
+			name:           "RegexpBeatsCatchAll",
+			domain:         "survival.example.com",
+			expectedDomain: "*",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy, ok := gateway.findProxy(tc.domain, addr)
+			if !ok {
+				t.Fatalf("got: no proxy; want: %v", tc.expectedDomain)
+			}
+			if proxy.DomainName() != tc.expectedDomain {
+				t.Errorf("got: %v; want: %v", proxy.DomainName(), tc.expectedDomain)
+			}
+		})
+	}
+}
+
+func TestGateway_RegisterProxyInvalidRegexp(t *testing.T) {
+	gateway := Gateway{}
+	proxy := &Proxy{Config: createBasicProxyConfig("~^mc-(\\d+.example.com$", ":25565", "")}
+	if err := gateway.storeProxy(proxy); err == nil {
+		t.Fatal("got: no error; want: invalid domain name")
+	}
+	if _, ok := gateway.proxies.Load(proxy.UID()); ok {
+		t.Error("proxy with invalid domain name was stored")
+	}
+}
+
+func TestGateway_CloseRegexpProxy(t *testing.T) {
+	addr := ":25565"
+	gateway := Gateway{}
+	proxy := &Proxy{Config: createBasicProxyConfig(`~^mc-\d+\.example\.com$`, addr, "")}
+	if err := gateway.storeProxy(proxy); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := gateway.findProxy("mc-1.example.com", addr); !ok {
+		t.Fatal("got: no proxy; want: regexp proxy")
+	}
+
+	gateway.CloseProxy(proxy.UID())
+	if _, ok := gateway.findProxy("mc-1.example.com", addr); ok {
+		t.Error("got: closed proxy; want: no proxy")
+	}
+}
+
+func BenchmarkGateway_FindProxyRegexp(b *testing.B) {
+	addr := ":25565"
+	gateway := Gateway{}
+	for i := 0; i < 100; i++ {
+		domain := fmt.Sprintf(`~^server%d-\d+\.example\.com$`, i)
+		if err := gateway.storeProxy(&Proxy{Config: createBasicProxyConfig(domain, addr, "")}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Matches the last of the 100 rules
+		if _, ok := gateway.findProxy("server99-1.example.com", addr); !ok {
+			b.Fatal("got: no proxy; want: server99")
+		}
+	}
+}
+
+func TestGateway_RegisterProxyDomainNames(t *testing.T) {
+	portEnd := 603
+	config := proxyConfigWithPortEnd(portEnd)
+	config.DomainName = "play.example.com"
+	config.DomainNames = []string{"example.com", "mc.example.org"}
+	proxy := &Proxy{Config: config}
+
+	gateway := Gateway{}
+	defer gateway.Close()
+	if err := gateway.RegisterProxy(proxy); err != nil {
+		t.Fatalf("Can't register proxy: %v", err)
+	}
+
+	domains := append([]string{config.DomainName}, config.DomainNames...)
+	for _, domain := range domains {
+		found, ok := gateway.findProxy(domain, gatewayAddr(portEnd))
+		if !ok {
+			t.Errorf("got: no proxy for %s", domain)
+			continue
+		}
+		if found != proxy {
+			t.Errorf("got: %p; want: %p", found, proxy)
+		}
+	}
+
+	if uids := gateway.ProxyUIDs(); len(uids) != len(domains) {
+		t.Errorf("got: %v; want: %d UIDs", uids, len(domains))
+	}
+
+	gateway.CloseProxy(proxy.UID())
+	if uids := gateway.ProxyUIDs(); len(uids) != 0 {
+		t.Errorf("got: %v; want: no UIDs", uids)
+	}
+}
+
+func TestBungeeCordForwarding(t *testing.T) {
+	portEnd := 604
+	server, err := Listen(serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer server.Close()
+
+	hsCh := make(chan handshaking.ServerBoundHandshake, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		pk, err := conn.ReadPacket()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		hs, err := handshaking.UnmarshalServerBoundHandshake(pk)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		hsCh <- hs
+	}()
+
+	config := proxyConfigWithPortEnd(portEnd)
+	config.BungeeCord = true
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't make a connection with gateway: %v", err)
+	}
+	defer conn.Close()
+
+	if err := sendHandshake(conn, loginHandshakePort(portEnd)); err != nil {
+		t.Fatalf("%s: %v", err.Message, err.Error)
+	}
+
+	loginStart := login.ServerLoginStart{Name: "Steve"}
+	if err := conn.WritePacket(loginStart.Marshal()); err != nil {
+		t.Fatalf("Can't write login start packet: %v", err)
+	}
+
+	select {
+	case hs := <-hsCh:
+		forwarding, ok := hs.BungeeCordForwarding()
+		if !ok {
+			t.Fatalf("got: %q; want: BungeeCord forwarding", hs.ServerAddress)
+		}
+
+		expected := handshaking.BungeeCordForwarding{
+			ServerAddress: serverDomain,
+			ClientIP:      "127.0.0.1",
+			UUID:          loginStart.OfflineUUID(),
+		}
+		if forwarding != expected {
+			t.Errorf("got: %v; want: %v", forwarding, expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not receive a handshake")
+	}
+}
+
+func TestGateway_BaseContext(t *testing.T) {
+	portEnd := 607
+	server, err := Listen(serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer server.Close()
+
+	connectedCh := make(chan struct{})
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := conn.ReadPacket(); err != nil {
+			t.Error(err)
+			return
+		}
+		close(connectedCh)
+		io.Copy(io.Discard, conn)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gateway := Gateway{
+		BaseContext: func() context.Context {
+			return ctx
+		},
+	}
+	if err := gateway.ListenAndServe(configToProxies(proxyConfigWithPortEnd(portEnd))); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't make a connection with gateway: %v", err)
+	}
+	defer conn.Close()
+
+	if err := sendHandshake(conn, loginHandshakePort(portEnd)); err != nil {
+		t.Fatalf("%s: %v", err.Message, err.Error)
+	}
+
+	select {
+	case <-connectedCh:
+	case <-time.After(time.Second):
+		t.Fatal("server did not receive a handshake")
+	}
+
+	cancel()
+
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got: %v; want: %v", err, io.EOF)
+	}
+}
+
+func TestStatusOverride(t *testing.T) {
+	portEnd := 608
+	server, err := Listen(serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer server.Close()
+
+	acceptedCh := make(chan struct{}, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+		acceptedCh <- struct{}{}
+	}()
+
+	config := proxyConfigWithPortEnd(portEnd)
+	config.StatusOverride = StatusConfig{
+		VersionName:    "Infrared Override",
+		ProtocolNumber: 755,
+		MaxPlayers:     100,
+		PlayersOnline:  42,
+		Favicon:        "iVBORw0KGgo=",
+		MOTD:           "Served by Infrared",
+	}
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't make a connection with gateway: %v", err)
+	}
+	defer conn.Close()
+
+	if err := sendHandshake(conn, statusHandshakePort(portEnd)); err != nil {
+		t.Fatalf("%s: %v", err.Message, err.Error)
+	}
+
+	if err := conn.WritePacket(status.ServerBoundRequest{}.Marshal()); err != nil {
+		t.Fatalf("Can't write status request packet: %v", err)
+	}
+
+	pk, err := conn.ReadPacket()
+	if err != nil {
+		t.Fatalf("Can't read status response packet: %v", err)
+	}
+
+	response, err := status.UnmarshalClientBoundResponse(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res status.ResponseJSON
+	if err := json.Unmarshal([]byte(response.JSONResponse), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := status.ResponseJSON{
+		Version: status.VersionJSON{
+			Name:     "Infrared Override",
+			Protocol: 755,
+		},
+		Players: status.PlayersJSON{
+			Max:    100,
+			Online: 42,
+		},
+		Description: status.DescriptionJSON{
+			Text: "Served by Infrared",
+		},
+		Favicon: "data:image/png;base64,iVBORw0KGgo=",
+	}
+	if res.Version != expected.Version || res.Players.Max != expected.Players.Max ||
+		res.Players.Online != expected.Players.Online || res.Description != expected.Description ||
+		res.Favicon != expected.Favicon {
+		t.Errorf("got: %v; want: %v", res, expected)
+	}
+
+	select {
+	case <-acceptedCh:
+		t.Error("server was dialed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConnectionMetrics(t *testing.T) {
+	portEnd := 609
+	// Status requests of other tests that close without a ping count as successes of serverDomain
+	domain := "metrics." + serverDomain
+	config := createBasicProxyConfig(domain, gatewayAddr(portEnd), serverAddr(portEnd))
+	config.StatusOverride = onlineStatus
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	tt := []struct {
+		name   string
+		server string
+		result string
+		send   func(conn Conn) error
+	}{
+		{
+			name:   "Success",
+			server: domain,
+			result: metrics.ResultSuccess,
+			send: func(conn Conn) error {
+				if err := conn.WritePacket(serverHandshake(domain, gatewayPort(portEnd))); err != nil {
+					return err
+				}
+				if err := conn.WritePacket(status.ServerBoundRequest{}.Marshal()); err != nil {
+					return err
+				}
+				if _, err := conn.ReadPacket(); err != nil {
+					return err
+				}
+				if err := conn.WritePacket(protocol.Packet{ID: 0x01, Data: make([]byte, 8)}); err != nil {
+					return err
+				}
+				_, err := conn.ReadPacket()
+				return err
+			},
+		},
+		{
+			name:   "UnknownServer",
+			result: metrics.ResultUnknownServer,
+			send: func(conn Conn) error {
+				return conn.WritePacket(serverHandshake("unknown.example.com", gatewayPort(portEnd)))
+			},
+		},
+		{
+			name:   "InvalidHandshake",
+			result: metrics.ResultInvalidHandshake,
+			send: func(conn Conn) error {
+				return conn.WritePacket(protocol.Packet{ID: 0x05})
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			counter := metrics.ConnectionsTotal.WithLabelValues(tc.server, tc.result)
+			want := testutil.ToFloat64(counter) + 1
+
+			conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			if err := tc.send(conn); err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+
+			deadline := time.Now().Add(time.Second)
+			for testutil.ToFloat64(counter) != want && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if got := testutil.ToFloat64(counter); got != want {
+				t.Errorf("got: %v; want: %v", got, want)
+			}
+		})
+	}
+}
+
+// gatheredValue returns the value of the counter name with labels in the metrics gathered from gatherer
+func gatheredValue(t *testing.T, gatherer prometheus.Gatherer, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestHandshakeAndLoginMetrics(t *testing.T) {
+	portEnd := 622
+	// Other tests count metrics of serverDomain too
+	domain := "handshakes." + serverDomain
+	config := createBasicProxyConfig(domain, gatewayAddr(portEnd), serverAddr(portEnd))
+	config.OfflineStatus = offlineStatus
+
+	registry := prometheus.NewRegistry()
+	if err := metrics.Register(registry); err != nil {
+		t.Fatal(err)
+	}
+
+	bans := NewMemoryBanStore()
+	bans.BanName("Notch", "banned")
+
+	gateway := Gateway{BanStore: bans}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	sendLogin := func(conn Conn, username string) error {
+		hs := handshaking.ServerBoundHandshake{
+			ProtocolVersion: 574,
+			ServerAddress:   protocol.String(domain),
+			ServerPort:      protocol.UnsignedShort(gatewayPort(portEnd)),
+			NextState:       handshaking.ServerBoundHandshakeLoginState,
+		}
+		if err := conn.WritePacket(hs.Marshal()); err != nil {
+			return err
+		}
+		if err := conn.WritePacket(login.ServerLoginStart{Name: protocol.String(username)}.Marshal()); err != nil {
+			return err
+		}
+		_, err := conn.ReadPacket()
+		return err
+	}
+
+	sends := []func(conn Conn) error{
+		func(conn Conn) error {
+			if err := conn.WritePacket(serverHandshake(domain, gatewayPort(portEnd))); err != nil {
+				return err
+			}
+			if err := conn.WritePacket(status.ServerBoundRequest{}.Marshal()); err != nil {
+				return err
+			}
+			_, err := conn.ReadPacket()
+			return err
+		},
+		func(conn Conn) error {
+			return sendLogin(conn, "Alex")
+		},
+		func(conn Conn) error {
+			return sendLogin(conn, "Notch")
+		},
+	}
+	for _, send := range sends {
+		conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+		if err != nil {
+			t.Fatalf("Can't make a connection with gateway: %v", err)
+		}
+		if err := send(conn); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	tt := []struct {
+		name     string
+		metric   string
+		labels   map[string]string
+		expected float64
+	}{
+		{
+			name:     "StatusHandshake",
+			metric:   "infrared_handshakes_total",
+			labels:   map[string]string{"server": domain, "type": metrics.HandshakeTypeStatus},
+			expected: 1,
+		},
+		{
+			name:     "LoginHandshake",
+			metric:   "infrared_handshakes_total",
+			labels:   map[string]string{"server": domain, "type": metrics.HandshakeTypeLogin},
+			expected: 2,
+		},
+		{
+			name:     "LoginOffline",
+			metric:   "infrared_logins_total",
+			labels:   map[string]string{"server": domain, "result": metrics.LoginResultOffline},
+			expected: 1,
+		},
+		{
+			name:     "LoginBanned",
+			metric:   "infrared_logins_total",
+			labels:   map[string]string{"server": domain, "result": metrics.LoginResultBanned},
+			expected: 1,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			deadline := time.Now().Add(time.Second)
+			for gatheredValue(t, registry, tc.metric, tc.labels) != tc.expected && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if got := gatheredValue(t, registry, tc.metric, tc.labels); got != tc.expected {
+				t.Errorf("got: %v; want: %v", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got: %d; want: %d", recorder.Code, http.StatusOK)
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, "infrared_proxies") {
+		t.Errorf("got: %q; want: infrared_proxies", body)
+	}
+}
+
+func TestCachedStatusRequest(t *testing.T) {
+	tt := []struct {
+		name            string
+		portEnd         int
+		server          func(listener Listener)
+		expectedVersion string
+	}{
+		{
+			name:    "ServerOnline",
+			portEnd: 610,
+			server: func(listener Listener) {
+				pk, _ := statusPKWithVersion(serverVersionName).StatusResponsePacket()
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					conn.WritePacket(pk)
+					conn.Close()
+				}
+			},
+			expectedVersion: serverVersionName,
+		},
+		{
+			name:    "ServerDropsConnection",
+			portEnd: 611,
+			server: func(listener Listener) {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+				}
+			},
+			expectedVersion: offlineStatus.VersionName,
+		},
+		{
+			name:            "ServerOffline",
+			portEnd:         612,
+			expectedVersion: offlineStatus.VersionName,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.server != nil {
+				listener, err := Listen(serverAddr(tc.portEnd))
+				if err != nil {
+					t.Fatalf("Can't listen to %v: %v", serverAddr(tc.portEnd), err)
+				}
+				defer listener.Close()
+				go tc.server(listener)
+			}
+
+			config := proxyConfigWithPortEnd(tc.portEnd)
+			config.OfflineStatus = offlineStatus
+			config.StatusCacheTTL = 1000
+			config.Timeout = 100
+
+			gateway := Gateway{}
+			if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+				t.Fatalf("Can't start gateway: %v", err)
+			}
+			defer gateway.Close()
+
+			version, err := statusDial(statusDialConfig{
+				pk:          statusHandshakePort(tc.portEnd),
+				gatewayAddr: gatewayAddr(tc.portEnd),
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", err.Message, err.Error)
+			}
+
+			if version != tc.expectedVersion {
+				t.Errorf("got: %v; want: %v", version, tc.expectedVersion)
+			}
+		})
+	}
+}
+
+func TestStatusPatch(t *testing.T) {
+	portEnd := 631
+	listener, err := Listen(serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer listener.Close()
+
+	go func() {
+		pk, _ := statusPKWithVersion(serverVersionName).StatusResponsePacket()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.WritePacket(pk)
+			conn.Close()
+		}
+	}()
+
+	config := proxyConfigWithPortEnd(portEnd)
+	config.StatusPatch = StatusPatchConfig{VersionName: "Patched"}
+	config.Timeout = 100
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	version, statusErr := statusDial(statusDialConfig{
+		pk:          statusHandshakePort(portEnd),
+		gatewayAddr: gatewayAddr(portEnd),
+	})
+	if statusErr != nil {
+		t.Fatalf("%s: %v", statusErr.Message, statusErr.Error)
+	}
+
+	if version != "Patched" {
+		t.Errorf("got: %v; want: %v", version, "Patched")
+	}
+}
+
+type recordingConnLogger struct {
+	mu     sync.Mutex
+	events []ConnEvent
+}
+
+func (logger *recordingConnLogger) LogConn(event ConnEvent) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.events = append(logger.events, event)
+}
+
+func (logger *recordingConnLogger) Events() []ConnEvent {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	return append([]ConnEvent{}, logger.events...)
+}
+
+func TestConnLogger(t *testing.T) {
+	portEnd := 613
+	server, err := Listen(serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer server.Close()
+
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for i := 0; i < 2; i++ {
+			if _, err := conn.ReadPacket(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		conn.Write([]byte("pong"))
+	}()
+
+	logger := &recordingConnLogger{}
+	gateway := Gateway{ConnLogger: logger}
+	if err := gateway.ListenAndServe(configToProxies(proxyConfigWithPortEnd(portEnd))); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't make a connection with gateway: %v", err)
+	}
+	defer conn.Close()
+
+	if err := sendHandshake(conn, loginHandshakePort(portEnd)); err != nil {
+		t.Fatalf("%s: %v", err.Message, err.Error)
+	}
+	if err := conn.WritePacket(login.ServerLoginStart{Name: "Steve"}.Marshal()); err != nil {
+		t.Fatalf("Can't write login start packet: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for len(logger.Events()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	events := logger.Events()
+	if len(events) != 3 {
+		t.Fatalf("got: %v; want: 3 events", events)
+	}
+
+	localAddr := conn.LocalAddr().String()
+	expected := []ConnEvent{
+		{
+			Event:      ConnEventConnected,
+			RemoteAddr: localAddr,
+		},
+		{
+			Event:           ConnEventRouted,
+			RemoteAddr:      localAddr,
+			ServerAddr:      serverAddr(portEnd),
+			ProtocolVersion: 574,
+		},
+		{
+			Event:           ConnEventDisconnected,
+			RemoteAddr:      localAddr,
+			ServerAddr:      serverAddr(portEnd),
+			ProtocolVersion: 574,
+			PlayerName:      "Steve",
+			BytesOut:        4,
+		},
+	}
+
+	for i, event := range events {
+		if event.Timestamp.IsZero() {
+			t.Errorf("%s: got no timestamp", event.Event)
+		}
+		if event.ConnID == "" || event.ConnID != events[0].ConnID {
+			t.Errorf("%s: got: %q; want: the same connection ID for all events", event.Event, event.ConnID)
+		}
+		event.Timestamp = time.Time{}
+		event.DurationMs = 0
+		event.ConnID = ""
+		if event != expected[i] {
+			t.Errorf("got: %v; want: %v", event, expected[i])
+		}
+	}
+}
+
+type recordingLogger struct {
+	mu      sync.Mutex
+	records []string
+}
+
+func (logger *recordingLogger) record(level, msg string, keysAndValues []interface{}) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(keysAndValues)%2 != 0 {
+		msg += " (odd number of fields)"
+	}
+	logger.records = append(logger.records, level+" "+msg)
+}
+
+func (logger *recordingLogger) Debug(msg string, keysAndValues ...interface{}) {
+	logger.record("debug", msg, keysAndValues)
+}
+
+func (logger *recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	logger.record("info", msg, keysAndValues)
+}
+
+func (logger *recordingLogger) Warn(msg string, keysAndValues ...interface{}) {
+	logger.record("warn", msg, keysAndValues)
+}
+
+func (logger *recordingLogger) Error(msg string, keysAndValues ...interface{}) {
+	logger.record("error", msg, keysAndValues)
+}
+
+// Records returns the level and message of all records and removes them from the logger
+func (logger *recordingLogger) Records() []string {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	records := logger.records
+	logger.records = nil
+	return records
+}
+
+func TestLogger(t *testing.T) {
+	portEnd := 637
+	server, err := Listen(serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer server.Close()
+
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	logger := &recordingLogger{}
+	gateway := Gateway{Logger: logger}
+	if err := gateway.ListenAndServe(configToProxies(proxyConfigWithPortEnd(portEnd))); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	tt := []struct {
+		name            string
+		domain          string
+		expectedRecords []string
+	}{
+		{
+			name:            "Login",
+			domain:          serverDomain,
+			expectedRecords: []string{"info routed connection", "info pipe closed"},
+		},
+		{
+			name:            "RoutingFailure",
+			domain:          "unknown.gateway",
+			expectedRecords: []string{"warn no proxy found"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			hsPk := handshaking.ServerBoundHandshake{
+				ProtocolVersion: 754,
+				ServerAddress:   protocol.String(tc.domain),
+				ServerPort:      protocol.UnsignedShort(gatewayPort(portEnd)),
+				NextState:       handshaking.ServerBoundHandshakeLoginState,
+			}.Marshal()
+			if err := sendHandshake(conn, hsPk); err != nil {
+				t.Fatalf("%s: %v", err.Message, err.Error)
+			}
+			if err := conn.WritePacket(login.ServerLoginStart{Name: "Steve"}.Marshal()); err != nil {
+				t.Fatalf("Can't write login start packet: %v", err)
+			}
+			// The gateway closes the connection after the server closed its side or no proxy was found
+			_, _ = io.Copy(io.Discard, conn)
+
+			var records []string
+			deadline := time.Now().Add(time.Second)
+			for len(records) < len(tc.expectedRecords) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+				records = append(records, logger.Records()...)
+			}
+
+			if !equalStrings(records, tc.expectedRecords) {
+				t.Errorf("got: %v; want: %v", records, tc.expectedRecords)
+			}
+		})
+	}
+}
+
+func TestMaxPlayers(t *testing.T) {
+	portEnd := 614
+	server, err := Listen(serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer server.Close()
+
+	acceptedCh := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			acceptedCh <- struct{}{}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	config := proxyConfigWithPortEnd(portEnd)
+	config.MaxPlayers = 2
+	config.FullMessage = "Sorry {{username}}, but the server is full."
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	join := func(username string) Conn {
+		conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+		if err != nil {
+			t.Fatalf("Can't make a connection with gateway: %v", err)
+		}
+		if err := sendHandshake(conn, loginHandshakePort(portEnd)); err != nil {
+			t.Fatalf("%s: %v", err.Message, err.Error)
+		}
+		if err := conn.WritePacket(login.ServerLoginStart{Name: protocol.String(username)}.Marshal()); err != nil {
+			t.Fatalf("Can't write login start packet: %v", err)
+		}
+		return conn
+	}
+
+	waitForAccept := func() {
+		select {
+		case <-acceptedCh:
+		case <-time.After(time.Second):
+			t.Fatal("server did not accept a connection")
+		}
+	}
+
+	var players []Conn
+	for i := 0; i < 2; i++ {
+		conn := join(fmt.Sprintf("Player%d", i))
+		defer conn.Close()
+		players = append(players, conn)
+		waitForAccept()
+	}
+
+	for i := 0; i < 3; i++ {
+		conn := join("Steve")
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		pk, err := conn.ReadPacket()
+		conn.Close()
+		if err != nil {
+			t.Fatalf("Can't read disconnect packet: %v", err)
+		}
+
+		disconnect, err := login.UnmarshalClientBoundDisconnect(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(disconnect.Reason), "Sorry Steve, but the server is full.") {
+			t.Errorf("got: %v; want: full message", disconnect.Reason)
+		}
+	}
+
+	select {
+	case <-acceptedCh:
+		t.Fatal("server was dialed for a rejected login")
+	default:
+	}
+
+	// A player leaving frees a slot
+	players[0].Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn := join("Alex")
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := conn.ReadPacket()
+		conn.Close()
+		if err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slot was not freed")
+		}
+	}
+	waitForAccept()
+}
+
+func TestServerMaxPlayers(t *testing.T) {
+	portEnd := 625
+	servers := []ServerConfig{
+		{Address: serverAddr(625), Weight: 1, MaxPlayers: 1},
+		{Address: serverAddr(626), Weight: 1, MaxPlayers: 1},
+	}
+
+	acceptedCh := make(chan string, 10)
+	for _, server := range servers {
+		addr := server.Address
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("Can't listen to %v: %v", addr, err)
+		}
+		defer listener.Close()
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				acceptedCh <- addr
+				go func() {
+					defer conn.Close()
+					io.Copy(io.Discard, conn)
+				}()
+			}
+		}()
+	}
+
+	config := proxyConfigWithPortEnd(portEnd)
+	config.Servers = servers
+	config.FullMessage = "Sorry {{username}}, but the server is full."
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	join := func(username string) Conn {
+		conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+		if err != nil {
+			t.Fatalf("Can't make a connection with gateway: %v", err)
+		}
+		if err := sendHandshake(conn, loginHandshakePort(portEnd)); err != nil {
+			t.Fatalf("%s: %v", err.Message, err.Error)
+		}
+		if err := conn.WritePacket(login.ServerLoginStart{Name: protocol.String(username)}.Marshal()); err != nil {
+			t.Fatalf("Can't write login start packet: %v", err)
+		}
+		return conn
+	}
+
+	// Every server gets one player although the second player could be sent to the full server
+	seen := map[string]bool{}
+	for i := 0; i < len(servers); i++ {
+		conn := join(fmt.Sprintf("Player%d", i))
+		defer conn.Close()
+		select {
+		case addr := <-acceptedCh:
+			seen[addr] = true
+		case <-time.After(time.Second):
+			t.Fatal("server did not accept a connection")
+		}
+	}
+	if len(seen) != len(servers) {
+		t.Errorf("got: %v; want: every server once", seen)
+	}
+
+	for i := 0; i < 3; i++ {
+		conn := join("Steve")
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		pk, err := conn.ReadPacket()
+		conn.Close()
+		if err != nil {
+			t.Fatalf("Can't read disconnect packet: %v", err)
+		}
+
+		disconnect, err := login.UnmarshalClientBoundDisconnect(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(disconnect.Reason), "Sorry Steve, but the server is full.") {
+			t.Errorf("got: %v; want: full message", disconnect.Reason)
+		}
+	}
+}
+
+func TestMaxPacketLength(t *testing.T) {
+	portEnd := 627
+	gateway := Gateway{MaxPacketLength: 64}
+	if err := gateway.ListenAndServe(configToProxies(proxyConfigWithPortEnd(portEnd))); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	conn, err := net.Dial("tcp", gatewayAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't make a connection with gateway: %v", err)
+	}
+	defer conn.Close()
+
+	// Announce a packet of the protocol maximum without sending it
+	if _, err := conn.Write(protocol.VarInt(protocol.MaxPacketLength).Encode()); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got: %v; want: %v", err, io.EOF)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	portEnd := 628
+	server, err := Listen(serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer server.Close()
+
+	acceptedCh := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			acceptedCh <- struct{}{}
+			conn.Close()
+		}
+	}()
+
+	config := proxyConfigWithPortEnd(portEnd)
+	config.Maintenance = true
+	config.MaintenanceMessage = "Sorry {{username}}, but {{domain}} is under maintenance."
+	proxies := configToProxies(config)
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(proxies); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	join := func() Conn {
+		conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+		if err != nil {
+			t.Fatalf("Can't make a connection with gateway: %v", err)
+		}
+		if err := sendHandshake(conn, loginHandshakePort(portEnd)); err != nil {
+			t.Fatalf("%s: %v", err.Message, err.Error)
+		}
+		if err := conn.WritePacket(login.ServerLoginStart{Name: "Steve"}.Marshal()); err != nil {
+			t.Fatalf("Can't write login start packet: %v", err)
+		}
+		return conn
+	}
+
+	conn := join()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	pk, err := conn.ReadPacket()
+	conn.Close()
+	if err != nil {
+		t.Fatalf("Can't read disconnect packet: %v", err)
+	}
+
+	disconnect, err := login.UnmarshalClientBoundDisconnect(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Sorry Steve, but " + serverDomain + " is under maintenance."
+	if !strings.Contains(string(disconnect.Reason), want) {
+		t.Errorf("got: %v; want: %v", disconnect.Reason, want)
+	}
+
+	select {
+	case <-acceptedCh:
+		t.Fatal("server was dialed during maintenance")
+	default:
+	}
+
+	proxies[0].SetMaintenance(false)
+	conn = join()
+	defer conn.Close()
+	select {
+	case <-acceptedCh:
+	case <-time.After(time.Second):
+		t.Fatal("server did not accept a connection after maintenance")
+	}
+}
+
+func TestBanStore(t *testing.T) {
+	tt := []struct {
+		name     string
+		portEnd  int
+		username string
+		banned   bool
+	}{
+		{
+			name:     "Banned",
+			portEnd:  620,
+			username: "Notch",
+			banned:   true,
+		},
+		{
+			name:     "NotBanned",
+			portEnd:  621,
+			username: "Alex",
+			banned:   false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			server, err := Listen(serverAddr(tc.portEnd))
+			if err != nil {
+				t.Fatalf("Can't listen to %v: %v", serverAddr(tc.portEnd), err)
+			}
+			defer server.Close()
+
+			acceptedCh := make(chan struct{}, 1)
+			go func() {
+				conn, err := server.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				acceptedCh <- struct{}{}
+				io.Copy(io.Discard, conn)
+			}()
+
+			bans := NewMemoryBanStore()
+			bans.BanName("Notch", "{{username}} is banned")
+
+			gateway := Gateway{BanStore: bans}
+			if err := gateway.ListenAndServe(configToProxies(proxyConfigWithPortEnd(tc.portEnd))); err != nil {
+				t.Fatalf("Can't start gateway: %v", err)
+			}
+			defer gateway.Close()
+
+			conn, err := Dialer{}.Dial(gatewayAddr(tc.portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			if err := sendHandshake(conn, loginHandshakePort(tc.portEnd)); err != nil {
+				t.Fatalf("%s: %v", err.Message, err.Error)
+			}
+			if err := conn.WritePacket(login.ServerLoginStart{Name: protocol.String(tc.username)}.Marshal()); err != nil {
+				t.Fatalf("Can't write login start packet: %v", err)
+			}
+
+			if !tc.banned {
+				select {
+				case <-acceptedCh:
+				case <-time.After(time.Second):
+					t.Fatal("server was not dialed for an unbanned player")
+				}
+				return
+			}
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			pk, err := conn.ReadPacket()
+			if err != nil {
+				t.Fatalf("Can't read disconnect packet: %v", err)
+			}
+
+			disconnect, err := login.UnmarshalClientBoundDisconnect(pk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(disconnect.Reason), "Notch is banned") {
+				t.Errorf("got: %v; want: ban reason", disconnect.Reason)
+			}
+
+			select {
+			case <-acceptedCh:
+				t.Error("server was dialed for a banned player")
+			default:
+			}
+		})
+	}
+}
+
+func TestCallbackEvents(t *testing.T) {
+	portEnd := 623
+	server, err := Listen(serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer server.Close()
+
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	type eventLog struct {
+		Event   string                   `json:"event"`
+		Payload callback.PlayerJoinEvent `json:"payload"`
+	}
+	eventCh := make(chan eventLog, 2)
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event eventLog
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		eventCh <- event
+	}))
+	defer callbackServer.Close()
+
+	config := proxyConfigWithPortEnd(portEnd)
+	config.CallbackServer = CallbackServerConfig{
+		URL:     callbackServer.URL,
+		Events:  []string{callback.EventTypePlayerJoin, callback.EventTypePlayerLeave},
+		Timeout: 1000,
+	}
+
+	gateway := Gateway{}
+	proxies := configToProxies(config)
+	if err := gateway.ListenAndServe(proxies); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't make a connection with gateway: %v", err)
+	}
+	if err := sendHandshake(conn, loginHandshakePort(portEnd)); err != nil {
+		t.Fatalf("%s: %v", err.Message, err.Error)
+	}
+	if err := conn.WritePacket(login.ServerLoginStart{Name: "Steve"}.Marshal()); err != nil {
+		t.Fatalf("Can't write login start packet: %v", err)
+	}
+
+	want := callback.PlayerJoinEvent{
+		Username:      "Steve",
+		RemoteAddress: conn.LocalAddr().String(),
+		TargetAddress: serverAddr(portEnd),
+		ProxyUID:      proxies[0].UID(),
+	}
+
+	events := map[string]callback.PlayerJoinEvent{}
+	for _, eventType := range []string{callback.EventTypePlayerJoin, callback.EventTypePlayerLeave} {
+		if eventType == callback.EventTypePlayerLeave {
+			conn.Close()
+		}
+
+		select {
+		case event := <-eventCh:
+			events[event.Event] = event.Payload
+		case <-time.After(time.Second):
+			t.Fatalf("got no %s event", eventType)
+		}
+	}
+
+	for _, eventType := range []string{callback.EventTypePlayerJoin, callback.EventTypePlayerLeave} {
+		if got, ok := events[eventType]; !ok || got != want {
+			t.Errorf("%s: got: %+v; want: %+v", eventType, got, want)
+		}
+	}
+}
+
+func TestGateway_FindProxyFallback(t *testing.T) {
+	addr := ":25565"
+	gateway := Gateway{}
+	for _, domain := range []string{"mc.example.com", "*.example.com", "*"} {
+		proxy := &Proxy{Config: createBasicProxyConfig(domain, addr, "")}
+		gateway.proxies.Store(proxy.UID(), proxy)
+	}
+
+	tt := []struct {
+		domain         string
+		addr           string
+		expectedDomain string
+	}{
+		{
+			domain:         "mc.example.com",
+			addr:           addr,
+			expectedDomain: "mc.example.com",
+		},
+		{
+			domain:         "shop.example.com",
+			addr:           addr,
+			expectedDomain: "*.example.com",
+		},
+		{
+			domain:         "example.org",
+			addr:           addr,
+			expectedDomain: "*",
+		},
+		{
+			domain:         "",
+			addr:           addr,
+			expectedDomain: "*",
+		},
+		{
+			domain: "example.org",
+			addr:   ":25566",
+		},
+	}
+
+	for _, tc := range tt {
+		proxy, ok := gateway.findProxy(tc.domain, tc.addr)
+		if tc.expectedDomain == "" {
+			if ok {
+				t.Errorf("got: %v; want: no proxy", proxy.DomainName())
+			}
+			continue
+		}
+
+		if !ok {
+			t.Errorf("%s got: no proxy; want: %v", tc.domain, tc.expectedDomain)
+			continue
+		}
+
+		if proxy.DomainName() != tc.expectedDomain {
+			t.Errorf("got: %v; want: %v", proxy.DomainName(), tc.expectedDomain)
+		}
+	}
+}
+
+func TestVelocityForwarding(t *testing.T) {
+	tt := []struct {
+		name          string
+		portEnd       int
+		proxySecret   string
+		serverSecret  string
+		expectedError error
+	}{
+		{
+			name:         "ValidSecret",
+			portEnd:      605,
+			proxySecret:  "secret",
+			serverSecret: "secret",
+		},
+		{
+			name:          "InvalidSecret",
+			portEnd:       606,
+			proxySecret:   "wrong secret",
+			serverSecret:  "secret",
+			expectedError: login.ErrInvalidVelocitySignature,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			server, err := Listen(serverAddr(tc.portEnd))
+			if err != nil {
+				t.Fatalf("Can't listen to %v: %v", serverAddr(tc.portEnd), err)
+			}
+			defer server.Close()
+
+			type result struct {
+				forwarding login.VelocityForwarding
+				err        error
+			}
+			resultCh := make(chan result, 1)
+			rejectMessage := "Unable to verify player details"
+			go func() {
+				conn, err := server.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				// Handshake and login start
+				for i := 0; i < 2; i++ {
+					if _, err := conn.ReadPacket(); err != nil {
+						resultCh <- result{err: err}
+						return
+					}
+				}
+
+				request := login.ClientBoundLoginPluginRequest{
+					MessageID: 7,
+					Channel:   login.VelocityForwardingChannel,
+					Data:      protocol.OptionalByteArray{login.VelocityForwardingVersion},
+				}
+				if err := conn.WritePacket(request.Marshal()); err != nil {
+					resultCh <- result{err: err}
+					return
+				}
+
+				pk, err := conn.ReadPacket()
+				if err != nil {
+					resultCh <- result{err: err}
+					return
+				}
+
+				response, err := login.UnmarshalServerBoundLoginPluginResponse(pk)
+				if err != nil {
+					resultCh <- result{err: err}
+					return
+				}
+
+				if response.MessageID != request.MessageID || !response.Successful {
+					resultCh <- result{err: fmt.Errorf("unexpected response %v", response)}
+					return
+				}
+
+				forwarding, err := login.UnmarshalVelocityForwarding(response.Data, []byte(tc.serverSecret))
+				if err != nil {
+					_ = conn.WritePacket(login.ClientBoundDisconnect{
+						Reason: protocol.Chat(fmt.Sprintf("{\"text\":\"%s\"}", rejectMessage)),
+					}.Marshal())
+				}
+				resultCh <- result{forwarding, err}
+			}()
+
+			config := proxyConfigWithPortEnd(tc.portEnd)
+			config.VelocitySecret = tc.proxySecret
+
+			gateway := Gateway{}
+			if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+				t.Fatalf("Can't start gateway: %v", err)
+			}
+			defer gateway.Close()
+
+			conn, err := Dialer{}.Dial(gatewayAddr(tc.portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			if err := sendHandshake(conn, loginHandshakePort(tc.portEnd)); err != nil {
+				t.Fatalf("%s: %v", err.Message, err.Error)
+			}
+
+			loginStart := login.ServerLoginStart{Name: "Steve"}
+			if err := conn.WritePacket(loginStart.Marshal()); err != nil {
+				t.Fatalf("Can't write login start packet: %v", err)
+			}
+
+			var res result
+			select {
+			case res = <-resultCh:
+			case <-time.After(time.Second):
+				t.Fatal("server did not receive forwarding data")
+			}
+
+			if res.err != tc.expectedError {
+				t.Fatalf("got: %v; want: %v", res.err, tc.expectedError)
+			}
+
+			if tc.expectedError != nil {
+				message, err := readDisconnectMessage(conn)
+				if err != nil {
+					t.Fatalf("Can't read disconnect packet: %v", err)
+				}
+				if message != rejectMessage {
+					t.Errorf("got: %v; want: %v", message, rejectMessage)
+				}
+				return
+			}
+
+			if res.forwarding.ClientIP != "127.0.0.1" {
+				t.Errorf("got: %v; want: %v", res.forwarding.ClientIP, "127.0.0.1")
+			}
+
+			if res.forwarding.Name != loginStart.Name {
+				t.Errorf("got: %v; want: %v", res.forwarding.Name, loginStart.Name)
+			}
+
+			gotUUID := strings.ReplaceAll(uuid.UUID(res.forwarding.UUID).String(), "-", "")
+			if gotUUID != loginStart.OfflineUUID() {
+				t.Errorf("got: %v; want: %v", gotUUID, loginStart.OfflineUUID())
+			}
+		})
+	}
+}
+
+func TestProxyBind(t *testing.T) {
+	// TODO: Figure out a way to test this
+}
+
+func TestLeastConnections(t *testing.T) {
+	portEnd := 632
+	servers := []ServerConfig{
+		{Address: serverAddr(632), Weight: 1},
+		{Address: serverAddr(633), Weight: 1},
+	}
+
+	acceptedCh := make(chan string, 10)
+	for _, server := range servers {
+		addr := server.Address
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("Can't listen to %v: %v", addr, err)
+		}
+		defer listener.Close()
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				acceptedCh <- addr
+				go func() {
+					defer conn.Close()
+					io.Copy(io.Discard, conn)
+				}()
+			}
+		}()
+	}
+
+	config := proxyConfigWithPortEnd(portEnd)
+	config.Servers = servers
+	config.Balancing = BalancingLeastConnections
+	proxies := configToProxies(config)
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(proxies); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	players := map[string]int{}
+	waitForServerPlayers := func(addr string) {
+		deadline := time.Now().Add(time.Second)
+		for proxies[0].ServerPlayers(addr) != players[addr] {
+			if time.Now().After(deadline) {
+				t.Fatalf("got: %d players on %s; want: %d", proxies[0].ServerPlayers(addr), addr, players[addr])
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	join := func(username string) (Conn, string) {
+		conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+		if err != nil {
+			t.Fatalf("Can't make a connection with gateway: %v", err)
+		}
+		if err := sendHandshake(conn, loginHandshakePort(portEnd)); err != nil {
+			t.Fatalf("%s: %v", err.Message, err.Error)
+		}
+		if err := conn.WritePacket(login.ServerLoginStart{Name: protocol.String(username)}.Marshal()); err != nil {
+			t.Fatalf("Can't write login start packet: %v", err)
+		}
+
+		select {
+		case addr := <-acceptedCh:
+			players[addr]++
+			waitForServerPlayers(addr)
+			return conn, addr
+		case <-time.After(time.Second):
+			t.Fatal("server did not accept a connection")
+		}
+		return nil, ""
+	}
+
+	conn1, addr1 := join("Player1")
+	defer conn1.Close()
+	conn2, addr2 := join("Player2")
+	defer conn2.Close()
+	if addr1 == addr2 {
+		t.Fatalf("got: both players on %s; want: one player per server", addr1)
+	}
+
+	// The third player makes one server carry two players
+	conn3, addr3 := join("Player3")
+	defer conn3.Close()
+
+	// The other server is empty after its player left
+	leaving, emptyAddr := conn1, addr1
+	if addr3 == addr1 {
+		leaving, emptyAddr = conn2, addr2
+	}
+	leaving.Close()
+	players[emptyAddr]--
+	waitForServerPlayers(emptyAddr)
+
+	conn4, addr4 := join("Player4")
+	defer conn4.Close()
+	if addr4 != emptyAddr {
+		t.Errorf("got: %v; want: %v", addr4, emptyAddr)
+	}
+}
+
+func TestRewriteHost(t *testing.T) {
+	portEnd := 635
+	server, err := Listen(serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer server.Close()
+
+	hsCh := make(chan handshaking.ServerBoundHandshake, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		pk, err := conn.ReadPacket()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		hs, err := handshaking.UnmarshalServerBoundHandshake(pk)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		hsCh <- hs
+	}()
+
+	config := createBasicProxyConfig("public.example.com", gatewayAddr(portEnd), serverAddr(portEnd))
+	config.RewriteHost = "internal.backend.local"
+	config.RewritePort = 25575
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't make a connection with gateway: %v", err)
+	}
+	defer conn.Close()
+
+	hsPk := handshaking.ServerBoundHandshake{
+		ProtocolVersion: 754,
+		ServerAddress:   "public.example.com",
+		ServerPort:      protocol.UnsignedShort(gatewayPort(portEnd)),
+		NextState:       handshaking.ServerBoundHandshakeLoginState,
+	}.Marshal()
+	if err := sendHandshake(conn, hsPk); err != nil {
+		t.Fatalf("%s: %v", err.Message, err.Error)
+	}
+	if err := conn.WritePacket(login.ServerLoginStart{Name: "Steve"}.Marshal()); err != nil {
+		t.Fatalf("Can't write login start packet: %v", err)
+	}
+
+	select {
+	case hs := <-hsCh:
+		expected := handshaking.ServerBoundHandshake{
+			ProtocolVersion: 754,
+			ServerAddress:   "internal.backend.local",
+			ServerPort:      25575,
+			NextState:       handshaking.ServerBoundHandshakeLoginState,
+		}
+		if hs != expected {
+			t.Errorf("got: %v; want: %v", hs, expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not receive a handshake")
+	}
+}
+
+func TestForgeHandshake(t *testing.T) {
+	portEnd := 651
+	server, err := Listen(serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer server.Close()
+
+	hsCh := make(chan handshaking.ServerBoundHandshake, 1)
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+
+			pk, err := conn.ReadPacket()
+			conn.Close()
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			hs, err := handshaking.UnmarshalServerBoundHandshake(pk)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			hsCh <- hs
+		}
+	}()
+
+	forgeConfig := createBasicProxyConfig("forge.example.com", gatewayAddr(portEnd), serverAddr(portEnd))
+	rewriteConfig := createBasicProxyConfig("rewrite.example.com", gatewayAddr(portEnd), serverAddr(portEnd))
+	rewriteConfig.RewriteHost = "internal.backend.local"
+	bungeeCordConfig := createBasicProxyConfig("bungeecord.example.com", gatewayAddr(portEnd), serverAddr(portEnd))
+	bungeeCordConfig.BungeeCord = true
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configsToProxies([]*ProxyConfig{forgeConfig, rewriteConfig, bungeeCordConfig})); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	tt := []struct {
+		name                  string
+		serverAddress         string
+		expectedServerAddress string
+	}{
+		{
+			name:                  "FML",
+			serverAddress:         "forge.example.com\x00FML\x00",
+			expectedServerAddress: "forge.example.com\x00FML\x00",
+		},
+		{
+			name:                  "FML2",
+			serverAddress:         "forge.example.com\x00FML2\x00",
+			expectedServerAddress: "forge.example.com\x00FML2\x00",
+		},
+		{
+			name:                  "FML3",
+			serverAddress:         "forge.example.com\x00FML3\x00",
+			expectedServerAddress: "forge.example.com\x00FML3\x00",
+		},
+		{
+			name:                  "RewriteHost",
+			serverAddress:         "rewrite.example.com\x00FML2\x00",
+			expectedServerAddress: "internal.backend.local\x00FML2\x00",
+		},
+		{
+			name:          "BungeeCord",
+			serverAddress: "bungeecord.example.com\x00FML2\x00",
+			expectedServerAddress: "bungeecord.example.com\x00127.0.0.1\x00" +
+				strings.ReplaceAll(login.ServerLoginStart{Name: "Steve"}.OfflineUUID(), "-", "") + "\x00FML2\x00",
+		},
+		{
+			name:          "BungeeCordForged",
+			serverAddress: "bungeecord.example.com\x001.2.3.4\x00069a79f444e94726a5befca90e38aaf5\x00[]",
+			expectedServerAddress: "bungeecord.example.com\x00127.0.0.1\x00" +
+				strings.ReplaceAll(login.ServerLoginStart{Name: "Steve"}.OfflineUUID(), "-", ""),
+		},
+		{
+			name:          "BungeeCordForgedWithFML2",
+			serverAddress: "bungeecord.example.com\x001.2.3.4\x00069a79f444e94726a5befca90e38aaf5\x00FML2\x00",
+			expectedServerAddress: "bungeecord.example.com\x00127.0.0.1\x00" +
+				strings.ReplaceAll(login.ServerLoginStart{Name: "Steve"}.OfflineUUID(), "-", "") + "\x00FML2\x00",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			hsPk := handshaking.ServerBoundHandshake{
+				ProtocolVersion: 754,
+				ServerAddress:   protocol.String(tc.serverAddress),
+				ServerPort:      protocol.UnsignedShort(gatewayPort(portEnd)),
+				NextState:       handshaking.ServerBoundHandshakeLoginState,
+			}.Marshal()
+			if err := sendHandshake(conn, hsPk); err != nil {
+				t.Fatalf("%s: %v", err.Message, err.Error)
+			}
+			if err := conn.WritePacket(login.ServerLoginStart{Name: "Steve"}.Marshal()); err != nil {
+				t.Fatalf("Can't write login start packet: %v", err)
+			}
+
+			select {
+			case hs := <-hsCh:
+				if string(hs.ServerAddress) != tc.expectedServerAddress {
+					t.Errorf("got: %q; want: %q", hs.ServerAddress, tc.expectedServerAddress)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("server did not receive a handshake; the Forge address did not match its proxy")
+			}
+		})
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	portEnd := 636
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := Listen(serverAddr(portEnd))
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr(portEnd), err)
+	}
+	defer server.Close()
+
+	acceptedCh := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			acceptedCh <- struct{}{}
+		}
+	}()
+
+	logger := &recordingConnLogger{}
+	gateway := Gateway{
+		RealIPPublicKey: &key.PublicKey,
+		ConnLogger:      logger,
+	}
+	config := createBasicProxyConfig("infrared", gatewayAddr(portEnd), serverAddr(portEnd))
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	signed := signRealIP(t, key, "infrared", "93.184.216.34:51234", strconv.FormatInt(time.Now().Unix(), 10))
+	parts := strings.Split(signed, handshaking.RealIPSeparator)
+	tampered := strings.Join([]string{parts[0], "1.2.3.4:51234", parts[2], parts[3]}, handshaking.RealIPSeparator)
+
+	tt := []struct {
+		name          string
+		serverAddress string
+		shouldConnect bool
+	}{
+		{
+			name:          "Signed",
+			serverAddress: signed,
+			shouldConnect: true,
+		},
+		{
+			name:          "Tampered",
+			serverAddress: tampered,
+		},
+		{
+			name:          "Unsigned",
+			serverAddress: "infrared",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			hsPk := handshaking.ServerBoundHandshake{
+				ProtocolVersion: 754,
+				ServerAddress:   protocol.String(tc.serverAddress),
+				ServerPort:      protocol.UnsignedShort(gatewayPort(portEnd)),
+				NextState:       handshaking.ServerBoundHandshakeLoginState,
+			}.Marshal()
+			if err := sendHandshake(conn, hsPk); err != nil {
+				t.Fatalf("%s: %v", err.Message, err.Error)
+			}
+			if err := conn.WritePacket(login.ServerLoginStart{Name: "Steve"}.Marshal()); err != nil {
+				t.Fatalf("Can't write login start packet: %v", err)
+			}
+
+			select {
+			case <-acceptedCh:
+				if !tc.shouldConnect {
+					t.Error("connection was proxied to the server")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tc.shouldConnect {
+					t.Error("connection was not proxied to the server")
+				}
+			}
+		})
+	}
+
+	var routed []string
+	for _, event := range logger.Events() {
+		if event.Event == ConnEventRouted {
+			routed = append(routed, event.RemoteAddr)
+		}
+	}
+	expected := []string{"93.184.216.34:51234"}
+	if len(routed) != len(expected) || routed[0] != expected[0] {
+		t.Errorf("got: %v; want: %v", routed, expected)
+	}
+}
+
+func TestGateway_ServeInvalidHandshake(t *testing.T) {
+	httpRequest := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	tt := []struct {
+		name string
+		data []byte
+		// keepOpen leaves the client connection open after data is sent
+		keepOpen     bool
+		expectedErr  error
+		malformed    bool
+		expectedData []byte
+	}{
+		{
+			name:        "Empty",
+			expectedErr: io.EOF,
+		},
+		{
+			name:         "InvalidPacketID",
+			data:         []byte{0x01, 0x01},
+			expectedErr:  protocol.ErrInvalidPacketID,
+			malformed:    true,
+			expectedData: []byte{0x01, 0x01},
+		},
+		{
+			name:         "TruncatedData",
+			data:         []byte{0x03, 0x00, 0xf2, 0x05},
+			expectedErr:  io.EOF,
+			malformed:    true,
+			expectedData: []byte{0x03, 0x00, 0xf2, 0x05},
+		},
+		{
+			name:         "TruncatedPacket",
+			data:         []byte{0x10, 0x00, 0xf2},
+			expectedErr:  io.EOF,
+			malformed:    true,
+			expectedData: []byte{0x10, 0x00, 0xf2},
+		},
+		{
+			name:         "TruncatedLength",
+			data:         []byte{0x80},
+			expectedErr:  io.EOF,
+			malformed:    true,
+			expectedData: []byte{0x80},
+		},
+		{
+			name:         "TooLong",
+			data:         []byte{0xff, 0xff, 0xff, 0x07},
+			expectedErr:  protocol.ErrPacketTooLong,
+			malformed:    true,
+			expectedData: []byte{0xff, 0xff, 0xff, 0x07},
+		},
+		{
+			name:         "NegativeAddressLength",
+			data:         []byte{0x08, 0x00, 0xf2, 0x05, 0xff, 0xff, 0xff, 0xff, 0x0f},
+			expectedErr:  protocol.ErrNegativeLength,
+			malformed:    true,
+			expectedData: []byte{0x08, 0x00, 0xf2, 0x05, 0xff, 0xff, 0xff, 0xff, 0x0f},
+		},
+		{
+			name:         "HTTPRequest",
+			data:         httpRequest,
+			expectedErr:  io.EOF,
+			malformed:    true,
+			expectedData: httpRequest[:maxHandshakeDataLength],
+		},
+		{
+			name:        "Timeout",
+			data:        []byte{0x10, 0x00},
+			keepOpen:    true,
+			expectedErr: os.ErrDeadlineExceeded,
+		},
+	}
+
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			client, conn := net.Pipe()
+			defer client.Close()
+			defer conn.Close()
+
+			go func() {
+				_, _ = client.Write(tc.data)
+				if !tc.keepOpen {
+					client.Close()
+				}
+			}()
+
+			gateway := Gateway{HandshakeTimeout: 100 * time.Millisecond}
+			session := newConnSession(nil, conn.RemoteAddr())
+			err := gateway.serve(context.Background(), wrapConn(conn), gatewayAddr(0), session)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("got: %v; want: %v", err, tc.expectedErr)
+			}
+			if malformed := errors.Is(err, ErrMalformedHandshake); malformed != tc.malformed {
+				t.Errorf("got: %v; want: %v", malformed, tc.malformed)
+			}
+
+			var hsErr *handshakeError
+			if !errors.As(err, &hsErr) {
+				return
+			}
+			if !bytes.Equal(hsErr.data, tc.expectedData) {
+				t.Errorf("got: %x; want: %x", hsErr.data, tc.expectedData)
+			}
+		})
+	}
+}
+
+func TestStickySessions(t *testing.T) {
+	portEnd := 638
+	serverAddrs := []string{serverAddr(portEnd), serverAddr(portEnd + 1)}
+	acceptedCh := make(chan string, 10)
+	for _, addr := range serverAddrs {
+		server, err := Listen(addr)
+		if err != nil {
+			t.Fatalf("Can't listen to %v: %v", addr, err)
+		}
+		defer server.Close()
+
+		go func(addr string) {
+			for {
+				conn, err := server.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+				acceptedCh <- addr
+			}
+		}(addr)
+	}
+
+	config := createBasicProxyConfig(serverDomain, gatewayAddr(portEnd), "")
+	config.Servers = []ServerConfig{
+		{Address: serverAddrs[0]},
+		{Address: serverAddrs[1]},
+	}
+	config.StickySessionTTL = 60000
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	login := func(name string) string {
+		conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+		if err != nil {
+			t.Fatalf("Can't make a connection with gateway: %v", err)
+		}
+		defer conn.Close()
+
+		if err := sendHandshake(conn, loginHandshakePort(portEnd)); err != nil {
+			t.Fatalf("%s: %v", err.Message, err.Error)
+		}
+		if err := conn.WritePacket(login.ServerLoginStart{Name: protocol.String(name)}.Marshal()); err != nil {
+			t.Fatalf("Can't write login start packet: %v", err)
+		}
+
+		select {
+		case addr := <-acceptedCh:
+			return addr
+		case <-time.After(time.Second):
+			t.Fatal("no server accepted the login")
+			return ""
+		}
+	}
+
+	// Without sticky sessions round-robin would alternate between the servers
+	expected := login("Steve")
+	for i := 0; i < 3; i++ {
+		if addr := login("Steve"); addr != expected {
+			t.Errorf("login %d: got: %v; want: %v", i+2, addr, expected)
+		}
+	}
+}
+
+func TestStickySessions_VersionRoutes(t *testing.T) {
+	portEnd := 657
+	defaultAddr := serverAddr(portEnd)
+	modernAddr := serverAddr(portEnd + 1)
+	acceptedCh := make(chan string, 10)
+	for _, addr := range []string{defaultAddr, modernAddr} {
+		server, err := Listen(addr)
+		if err != nil {
+			t.Fatalf("Can't listen to %v: %v", addr, err)
+		}
+		defer server.Close()
+
+		go func(addr string) {
+			for {
+				conn, err := server.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+				acceptedCh <- addr
+			}
+		}(addr)
+	}
+
+	config := createBasicProxyConfig(serverDomain, gatewayAddr(portEnd), defaultAddr)
+	config.VersionRoutes = []VersionRouteConfig{
+		{MinProtocol: 735, ProxyTo: modernAddr},
+	}
+	config.StickySessionTTL = 60000
+
+	gateway := Gateway{}
+	if err := gateway.ListenAndServe(configToProxies(config)); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	login := func(protocolVersion int) string {
+		conn, err := Dialer{}.Dial(gatewayAddr(portEnd))
+		if err != nil {
+			t.Fatalf("Can't make a connection with gateway: %v", err)
+		}
+		defer conn.Close()
+
+		hs := handshaking.ServerBoundHandshake{
+			ProtocolVersion: protocol.VarInt(protocolVersion),
+			ServerAddress:   protocol.String(serverDomain),
+			ServerPort:      protocol.UnsignedShort(gatewayPort(portEnd)),
+			NextState:       handshaking.ServerBoundHandshakeLoginState,
+		}
+		if err := sendHandshake(conn, hs.Marshal()); err != nil {
+			t.Fatalf("%s: %v", err.Message, err.Error)
+		}
+		if err := conn.WritePacket(login.ServerLoginStart{Name: "Steve"}.Marshal()); err != nil {
+			t.Fatalf("Can't write login start packet: %v", err)
+		}
+
+		select {
+		case addr := <-acceptedCh:
+			return addr
+		case <-time.After(time.Second):
+			t.Fatal("no server accepted the login")
+			return ""
+		}
+	}
+
+	// The sticky session of the default server must not override the version route
+	tt := []struct {
+		protocolVersion int
+		expectedAddr    string
+	}{
+		{protocolVersion: 574, expectedAddr: defaultAddr},
+		{protocolVersion: 763, expectedAddr: modernAddr},
+		{protocolVersion: 574, expectedAddr: defaultAddr},
+	}
+
+	for i, tc := range tt {
+		if addr := login(tc.protocolVersion); addr != tc.expectedAddr {
+			t.Errorf("login %d with protocol %d: got: %v; want: %v", i+1, tc.protocolVersion, addr, tc.expectedAddr)
+		}
+	}
 }
@@ -0,0 +1,212 @@
+package infrared
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/haveachin/infrared/protocol"
+	"github.com/haveachin/infrared/protocol/handshaking"
+	"github.com/haveachin/infrared/protocol/status"
+	"github.com/pires/go-proxyproto"
+)
+
+// HealthChecker periodically probes servers with a status request.
+// A server becomes unhealthy after UnhealthyThreshold consecutive failed probes
+// and healthy again after HealthyThreshold consecutive successful probes.
+// Servers are healthy when they are added.
+type HealthChecker struct {
+	Interval           time.Duration
+	Timeout            time.Duration
+	UnhealthyThreshold int
+	HealthyThreshold   int
+
+	// ProxyProtocol sends a PROXY protocol LOCAL header before each probe
+	// for servers that expect a PROXY protocol header on every connection
+	ProxyProtocol bool
+	// Dialer is used to dial the servers. If nil a Dialer with Timeout is used.
+	Dialer *Dialer
+	// OnChange is called from the checker goroutine when a server changes its health
+	OnChange func(addr string, healthy bool)
+
+	mu      sync.Mutex
+	servers map[string]*serverHealth
+}
+
+type serverHealth struct {
+	healthy   bool
+	successes int
+	failures  int
+}
+
+// Add adds addr to the servers that are probed
+func (hc *HealthChecker) Add(addr string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.servers == nil {
+		hc.servers = map[string]*serverHealth{}
+	}
+	if _, ok := hc.servers[addr]; ok {
+		return
+	}
+	hc.servers[addr] = &serverHealth{healthy: true}
+}
+
+// Remove stops probing addr
+func (hc *HealthChecker) Remove(addr string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	delete(hc.servers, addr)
+}
+
+// Healthy reports whether addr is healthy. Unknown servers are not healthy.
+func (hc *HealthChecker) Healthy(addr string) bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	server, ok := hc.servers[addr]
+	return ok && server.healthy
+}
+
+// Run probes all servers every Interval until ctx is done
+func (hc *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			hc.checkAll()
+		}
+	}
+}
+
+func (hc *HealthChecker) checkAll() {
+	hc.mu.Lock()
+	addrs := make([]string, 0, len(hc.servers))
+	for addr := range hc.servers {
+		addrs = append(addrs, addr)
+	}
+	hc.mu.Unlock()
+
+	for _, addr := range addrs {
+		hc.report(addr, hc.probe(addr))
+	}
+}
+
+// report records the result of a probe and calls OnChange if the health of addr changed
+func (hc *HealthChecker) report(addr string, err error) {
+	hc.mu.Lock()
+	server, ok := hc.servers[addr]
+	if !ok {
+		hc.mu.Unlock()
+		return
+	}
+
+	changed := false
+	if err == nil {
+		server.failures = 0
+		server.successes++
+		if !server.healthy && server.successes >= threshold(hc.HealthyThreshold) {
+			server.healthy = true
+			changed = true
+		}
+	} else {
+		server.successes = 0
+		server.failures++
+		if server.healthy && server.failures >= threshold(hc.UnhealthyThreshold) {
+			server.healthy = false
+			changed = true
+		}
+	}
+	healthy := server.healthy
+	hc.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if healthy {
+		log.Printf("[i] %s passed its health checks and is healthy again", addr)
+	} else {
+		log.Printf("[w] %s failed its health checks and is unhealthy; error: %s", addr, err)
+	}
+
+	if hc.OnChange != nil {
+		hc.OnChange(addr, healthy)
+	}
+}
+
+func threshold(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// probe sends a status request to addr and waits for the status response
+func (hc *HealthChecker) probe(addr string) error {
+	dialer := hc.Dialer
+	if dialer == nil {
+		dialer = &Dialer{Dialer: net.Dialer{Timeout: hc.Timeout}}
+	}
+
+	conn, err := dialer.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(hc.Timeout)); err != nil {
+		return err
+	}
+
+	if hc.ProxyProtocol {
+		header := proxyproto.Header{
+			Version: 2,
+			Command: proxyproto.LOCAL,
+		}
+		if _, err := header.WriteTo(conn); err != nil {
+			return err
+		}
+	}
+
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		// The address is resolved by the dialer
+		host, portString = addr, minecraftPort
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return err
+	}
+
+	hs := handshaking.ServerBoundHandshake{
+		ProtocolVersion: -1,
+		ServerAddress:   protocol.String(host),
+		ServerPort:      protocol.UnsignedShort(port),
+		NextState:       handshaking.ServerBoundHandshakeStatusState,
+	}
+	if err := conn.WritePacket(hs.Marshal()); err != nil {
+		return err
+	}
+
+	if err := conn.WritePacket(status.ServerBoundRequest{}.Marshal()); err != nil {
+		return err
+	}
+
+	pk, err := conn.ReadPacket()
+	if err != nil {
+		return err
+	}
+
+	if _, err := status.UnmarshalClientBoundResponse(pk); err != nil {
+		return fmt.Errorf("failed to parse status response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package infrared
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared/protocol/status"
+	"github.com/pires/go-proxyproto"
+)
+
+func TestHealthChecker_Report(t *testing.T) {
+	errProbe := errors.New("probe failed")
+
+	tt := []struct {
+		name            string
+		results         []error
+		expectedHealthy []bool
+		expectedChanges int
+	}{
+		{
+			name:            "StaysHealthyBelowThreshold",
+			results:         []error{errProbe, nil, errProbe, errProbe, nil},
+			expectedHealthy: []bool{true, true, true, true, true},
+			expectedChanges: 0,
+		},
+		{
+			name:            "BecomesUnhealthy",
+			results:         []error{errProbe, errProbe, errProbe, errProbe},
+			expectedHealthy: []bool{true, true, false, false},
+			expectedChanges: 1,
+		},
+		{
+			name:            "RecoversAfterHealthyThreshold",
+			results:         []error{errProbe, errProbe, errProbe, nil, errProbe, nil, nil},
+			expectedHealthy: []bool{true, true, false, false, false, false, true},
+			expectedChanges: 2,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			changes := 0
+			hc := HealthChecker{
+				UnhealthyThreshold: 3,
+				HealthyThreshold:   2,
+				OnChange: func(addr string, healthy bool) {
+					changes++
+				},
+			}
+			hc.Add("localhost:25565")
+
+			for i, err := range tc.results {
+				hc.report("localhost:25565", err)
+				if healthy := hc.Healthy("localhost:25565"); healthy != tc.expectedHealthy[i] {
+					t.Errorf("probe %d got: %v; want: %v", i, healthy, tc.expectedHealthy[i])
+				}
+			}
+
+			if changes != tc.expectedChanges {
+				t.Errorf("got: %d changes; want: %d", changes, tc.expectedChanges)
+			}
+		})
+	}
+}
+
+func TestHealthChecker_Probe(t *testing.T) {
+	tt := []struct {
+		name          string
+		proxyProtocol bool
+		respond       bool
+		expectError   bool
+	}{
+		{
+			name:        "Online",
+			respond:     true,
+			expectError: false,
+		},
+		{
+			name:          "OnlineWithProxyProtocol",
+			proxyProtocol: true,
+			respond:       true,
+			expectError:   false,
+		},
+		{
+			name:        "NoResponse",
+			respond:     false,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			listener, err := Listen("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				if tc.proxyProtocol {
+					header, err := proxyproto.Read(conn.Reader())
+					if err != nil || !header.Command.IsLocal() {
+						t.Errorf("got: %v, %v; want: LOCAL header", header, err)
+						return
+					}
+				}
+
+				// Handshake and status request
+				for i := 0; i < 2; i++ {
+					if _, err := conn.ReadPacket(); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+
+				if !tc.respond {
+					return
+				}
+
+				pk := status.ClientBoundResponse{JSONResponse: "{}"}.Marshal()
+				if err := conn.WritePacket(pk); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			hc := HealthChecker{
+				Timeout:       time.Second,
+				ProxyProtocol: tc.proxyProtocol,
+			}
+			err = hc.probe(listener.Addr().String())
+			if (err != nil) != tc.expectError {
+				t.Errorf("got: %v; want error: %v", err, tc.expectError)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestHealthChecker_Run(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	// Nothing listens on addr anymore so every probe fails
+	listener.Close()
+
+	changed := make(chan bool, 1)
+	hc := HealthChecker{
+		Interval:           10 * time.Millisecond,
+		Timeout:            100 * time.Millisecond,
+		UnhealthyThreshold: 2,
+		OnChange: func(addr string, healthy bool) {
+			changed <- healthy
+		},
+	}
+	hc.Add(addr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		hc.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case healthy := <-changed:
+		if healthy {
+			t.Error("got: healthy; want: unhealthy")
+		}
+	case <-time.After(time.Second):
+		t.Error("server was not marked unhealthy")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Run did not return after cancel")
+	}
+}
@@ -0,0 +1,96 @@
+package infrared
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// IPFilter allows or denies IPs based on CIDR lists. Deny rules take precedence
+// over allow rules and an empty allow list allows every IP that is not denied.
+// The lists can be replaced at any time with SetCIDRs.
+type IPFilter struct {
+	mu    sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter creates an IPFilter from CIDR notated allow and deny lists
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	var filter IPFilter
+	if err := filter.SetCIDRs(allow, deny); err != nil {
+		return nil, err
+	}
+	return &filter, nil
+}
+
+// SetCIDRs replaces the allow and deny lists of the filter
+func (filter *IPFilter) SetCIDRs(allow, deny []string) error {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return err
+	}
+
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return err
+	}
+
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	filter.allow = allowNets
+	filter.deny = denyNets
+	return nil
+}
+
+// Allowed reports whether ip passes the filter
+func (filter *IPFilter) Allowed(ip net.IP) bool {
+	filter.mu.RLock()
+	defer filter.mu.RUnlock()
+
+	if containsIP(filter.deny, ip) {
+		return false
+	}
+
+	if len(filter.allow) == 0 {
+		return true
+	}
+
+	return containsIP(filter.allow, ip)
+}
+
+// AllowedAddr reports whether the IP of addr passes the filter.
+// Addresses without an IP are only allowed if the allow list is empty.
+func (filter *IPFilter) AllowedAddr(addr net.Addr) bool {
+	return filter.Allowed(net.ParseIP(addrIP(addr)))
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
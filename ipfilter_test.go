@@ -0,0 +1,164 @@
+package infrared
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIPFilter_Allowed(t *testing.T) {
+	tt := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		ip      string
+		allowed bool
+	}{
+		{
+			name:    "NoRules",
+			ip:      "127.0.0.1",
+			allowed: true,
+		},
+		{
+			name:    "AllowOnlyMatch",
+			allow:   []string{"10.0.0.0/8"},
+			ip:      "10.1.2.3",
+			allowed: true,
+		},
+		{
+			name:    "AllowOnlyNoMatch",
+			allow:   []string{"10.0.0.0/8"},
+			ip:      "192.168.0.1",
+			allowed: false,
+		},
+		{
+			name:    "DenyOnlyMatch",
+			deny:    []string{"192.168.0.0/16"},
+			ip:      "192.168.0.1",
+			allowed: false,
+		},
+		{
+			name:    "DenyOnlyNoMatch",
+			deny:    []string{"192.168.0.0/16"},
+			ip:      "10.0.0.1",
+			allowed: true,
+		},
+		{
+			name:    "OverlapDenyWins",
+			allow:   []string{"10.0.0.0/8"},
+			deny:    []string{"10.0.0.0/24"},
+			ip:      "10.0.0.5",
+			allowed: false,
+		},
+		{
+			name:    "OverlapAllowedOutsideDeny",
+			allow:   []string{"10.0.0.0/8"},
+			deny:    []string{"10.0.0.0/24"},
+			ip:      "10.0.1.5",
+			allowed: true,
+		},
+		{
+			name:    "IPv6Allow",
+			allow:   []string{"2001:db8::/32"},
+			ip:      "2001:db8::1",
+			allowed: true,
+		},
+		{
+			name:    "IPv6Deny",
+			allow:   []string{"2001:db8::/32"},
+			deny:    []string{"2001:db8:1::/48"},
+			ip:      "2001:db8:1::1",
+			allowed: false,
+		},
+		{
+			name:    "IPv4NotInIPv6Allow",
+			allow:   []string{"2001:db8::/32"},
+			ip:      "10.0.0.1",
+			allowed: false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			filter, err := NewIPFilter(tc.allow, tc.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if allowed := filter.Allowed(net.ParseIP(tc.ip)); allowed != tc.allowed {
+				t.Errorf("got: %v; want: %v", allowed, tc.allowed)
+			}
+		})
+	}
+}
+
+func TestIPFilter_SetCIDRs(t *testing.T) {
+	filter, err := NewIPFilter(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filter.Allowed(net.ParseIP("127.0.0.1")) {
+		t.Error("denied IP is allowed")
+	}
+
+	if err := filter.SetCIDRs(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !filter.Allowed(net.ParseIP("127.0.0.1")) {
+		t.Error("IP is still denied after reload")
+	}
+
+	if err := filter.SetCIDRs([]string{"invalid"}, nil); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+}
+
+func TestListener_IPFilter(t *testing.T) {
+	filter, err := NewIPFilter(nil, []string{"127.0.0.0/8", "::1/128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.IPFilter = filter
+	defer listener.Close()
+
+	acceptedCh := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+		close(acceptedCh)
+	}()
+
+	// The connection might already be reset while dialing
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err == nil {
+		defer conn.Close()
+
+		if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := conn.Read(make([]byte, 1))
+		if err == nil || n != 0 {
+			t.Errorf("denied connection received data: %d bytes", n)
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Error("denied connection was not closed")
+		}
+	}
+
+	select {
+	case <-acceptedCh:
+		t.Error("denied connection was handed to the gateway")
+	default:
+	}
+}
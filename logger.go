@@ -0,0 +1,30 @@
+package infrared
+
+// Logger receives structured records about how the gateway handles connections.
+// Every record has a message and fields as alternating keys and values,
+// for example Info("routed connection", "conn_id", id, "proxy_uid", uid).
+// Records are created per connection and never per packet.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// loggerOrNoop returns logger or a logger that discards every record if logger is nil
+func loggerOrNoop(logger Logger) Logger {
+	if logger == nil {
+		return noopLogger{}
+	}
+	return logger
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Debug(msg string, keysAndValues ...interface{}) {}
+
+func (noopLogger) Info(msg string, keysAndValues ...interface{}) {}
+
+func (noopLogger) Warn(msg string, keysAndValues ...interface{}) {}
+
+func (noopLogger) Error(msg string, keysAndValues ...interface{}) {}
@@ -0,0 +1,186 @@
+package infrared
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/haveachin/infrared/protocol"
+)
+
+// DefaultDisconnectMessage is sent instead of a disconnect message template that can't be rendered
+const DefaultDisconnectMessage = "Disconnected"
+
+// messagePlaceholders are the placeholders disconnect message templates may use.
+// A placeholder without a value for the message is replaced with nothing.
+var messagePlaceholders = map[string]bool{
+	"username":      true,
+	"now":           true,
+	"remoteAddress": true,
+	"localAddress":  true,
+	"domain":        true,
+	"host":          true,
+	"ip":            true,
+	"proxyTo":       true,
+	"listenTo":      true,
+}
+
+// colorCodes maps the legacy color codes to the colors of chat components
+var colorCodes = map[byte]string{
+	'0': "black",
+	'1': "dark_blue",
+	'2': "dark_green",
+	'3': "dark_aqua",
+	'4': "dark_red",
+	'5': "dark_purple",
+	'6': "gold",
+	'7': "gray",
+	'8': "dark_gray",
+	'9': "blue",
+	'a': "green",
+	'b': "aqua",
+	'c': "red",
+	'd': "light_purple",
+	'e': "yellow",
+	'f': "white",
+}
+
+// chatComponent is the JSON chat component that clients show as disconnect reason
+type chatComponent struct {
+	Text          string          `json:"text"`
+	Color         string          `json:"color,omitempty"`
+	Bold          bool            `json:"bold,omitempty"`
+	Italic        bool            `json:"italic,omitempty"`
+	Underlined    bool            `json:"underlined,omitempty"`
+	Strikethrough bool            `json:"strikethrough,omitempty"`
+	Obfuscated    bool            `json:"obfuscated,omitempty"`
+	Extra         []chatComponent `json:"extra,omitempty"`
+}
+
+func (c chatComponent) styled() bool {
+	return c.Color != "" || c.Bold || c.Italic || c.Underlined || c.Strikethrough || c.Obfuscated
+}
+
+// applyCode changes the style of c like the legacy format code does and reports if code is one.
+// Colors and the reset code clear the formats like they do in the game.
+func (c *chatComponent) applyCode(code byte) bool {
+	if code >= 'A' && code <= 'Z' {
+		code += 'a' - 'A'
+	}
+
+	if color, ok := colorCodes[code]; ok {
+		*c = chatComponent{Color: color}
+		return true
+	}
+
+	switch code {
+	case 'k':
+		c.Obfuscated = true
+	case 'l':
+		c.Bold = true
+	case 'm':
+		c.Strikethrough = true
+	case 'n':
+		c.Underlined = true
+	case 'o':
+		c.Italic = true
+	case 'r':
+		*c = chatComponent{}
+	default:
+		return false
+	}
+	return true
+}
+
+// parseCode returns the style after the color or format code that s starts with and the length of the code
+func (c chatComponent) parseCode(s string) (chatComponent, int, bool) {
+	for _, prefix := range []string{"&", "§"} {
+		if !strings.HasPrefix(s, prefix) || len(s) == len(prefix) {
+			continue
+		}
+		if !c.applyCode(s[len(prefix)]) {
+			return c, 0, false
+		}
+		return c, len(prefix) + 1, true
+	}
+	return c, 0, false
+}
+
+// renderMessage renders a disconnect message template to a JSON chat component.
+// Placeholders like {{username}} are replaced with their value in fields.
+// Color and format codes like &c or §l style the text that follows them; a single & that
+// isn't followed by a code stays as it is. Values of placeholders are never styled,
+// since clients choose some of them. Templates with unknown or unclosed placeholders
+// are logged and the DefaultDisconnectMessage is rendered instead.
+func renderMessage(template string, fields map[string]string) protocol.Chat {
+	components, err := parseMessage(template, fields)
+	if err != nil {
+		log.Printf("[w] Invalid disconnect message %q; error: %s", template, err)
+		components = []chatComponent{{Text: DefaultDisconnectMessage}}
+	}
+
+	// Messages without codes stay a plain text component
+	root := chatComponent{}
+	switch {
+	case len(components) == 1 && !components[0].styled():
+		root = components[0]
+	case len(components) > 0:
+		root.Extra = components
+	}
+
+	// Clients show & and < as they are, so they don't need to be escaped
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(root); err != nil {
+		return protocol.Chat(`{"text":"` + DefaultDisconnectMessage + `"}`)
+	}
+	return protocol.Chat(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// parseMessage splits template into components with the same style
+func parseMessage(template string, fields map[string]string) ([]chatComponent, error) {
+	var components []chatComponent
+	style := chatComponent{}
+	var text strings.Builder
+
+	flush := func() {
+		if text.Len() == 0 {
+			return
+		}
+		component := style
+		component.Text = text.String()
+		components = append(components, component)
+		text.Reset()
+	}
+
+	for i := 0; i < len(template); i++ {
+		if strings.HasPrefix(template[i:], "{{") {
+			end := strings.Index(template[i+2:], "}}")
+			if end < 0 {
+				return nil, errors.New("unclosed placeholder")
+			}
+			name := template[i+2 : i+2+end]
+			if !messagePlaceholders[name] {
+				return nil, fmt.Errorf("unknown placeholder %q", name)
+			}
+			text.WriteString(fields[name])
+			i += end + 3
+			continue
+		}
+
+		if next, n, ok := style.parseCode(template[i:]); ok {
+			flush()
+			style = next
+			i += n - 1
+			continue
+		}
+		text.WriteByte(template[i])
+	}
+	flush()
+
+	return components, nil
+}
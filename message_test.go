@@ -0,0 +1,165 @@
+package infrared
+
+import (
+	"testing"
+
+	"github.com/haveachin/infrared/protocol"
+)
+
+func TestRenderMessage(t *testing.T) {
+	fields := map[string]string{
+		"username":      "Steve",
+		"now":           "17 Oct 26 12:00 UTC",
+		"remoteAddress": "203.0.113.7:53412",
+		"localAddress":  "10.0.0.1:25565",
+		"domain":        "mc.example.com",
+		"host":          "play.example.com",
+		"ip":            "203.0.113.7",
+		"proxyTo":       "10.0.0.2:25565",
+		"listenTo":      ":25565",
+	}
+
+	tt := []struct {
+		name     string
+		template string
+		expected protocol.Chat
+	}{
+		{
+			name:     "Plain",
+			template: "Server is offline",
+			expected: `{"text":"Server is offline"}`,
+		},
+		{
+			name:     "Empty",
+			template: "",
+			expected: `{"text":""}`,
+		},
+		{
+			name:     "Username",
+			template: "Sorry {{username}}",
+			expected: `{"text":"Sorry Steve"}`,
+		},
+		{
+			name:     "Now",
+			template: "{{now}}",
+			expected: `{"text":"17 Oct 26 12:00 UTC"}`,
+		},
+		{
+			name:     "RemoteAddress",
+			template: "{{remoteAddress}}",
+			expected: `{"text":"203.0.113.7:53412"}`,
+		},
+		{
+			name:     "LocalAddress",
+			template: "{{localAddress}}",
+			expected: `{"text":"10.0.0.1:25565"}`,
+		},
+		{
+			name:     "Domain",
+			template: "{{domain}}",
+			expected: `{"text":"mc.example.com"}`,
+		},
+		{
+			name:     "Host",
+			template: "{{host}}",
+			expected: `{"text":"play.example.com"}`,
+		},
+		{
+			name:     "IP",
+			template: "Banned {{ip}}",
+			expected: `{"text":"Banned 203.0.113.7"}`,
+		},
+		{
+			name:     "ProxyTo",
+			template: "{{proxyTo}}",
+			expected: `{"text":"10.0.0.2:25565"}`,
+		},
+		{
+			name:     "ListenTo",
+			template: "{{listenTo}}",
+			expected: `{"text":":25565"}`,
+		},
+		{
+			name:     "Color",
+			template: "&cSorry {{username}}",
+			expected: `{"text":"","extra":[{"text":"Sorry Steve","color":"red"}]}`,
+		},
+		{
+			name:     "SectionSign",
+			template: "§6Gold",
+			expected: `{"text":"","extra":[{"text":"Gold","color":"gold"}]}`,
+		},
+		{
+			name:     "UpperCaseCode",
+			template: "&AGreen",
+			expected: `{"text":"","extra":[{"text":"Green","color":"green"}]}`,
+		},
+		{
+			name:     "Formats",
+			template: "&l&nBold &oand more",
+			expected: `{"text":"","extra":[{"text":"Bold ","bold":true,"underlined":true},{"text":"and more","bold":true,"italic":true,"underlined":true}]}`,
+		},
+		{
+			name:     "ColorResetsFormats",
+			template: "&lBold &9blue",
+			expected: `{"text":"","extra":[{"text":"Bold ","bold":true},{"text":"blue","color":"blue"}]}`,
+		},
+		{
+			name:     "Reset",
+			template: "Offline &4{{host}}&r, sorry",
+			expected: `{"text":"","extra":[{"text":"Offline "},{"text":"play.example.com","color":"dark_red"},{"text":", sorry"}]}`,
+		},
+		{
+			name:     "StrikethroughAndObfuscated",
+			template: "&m&kgone",
+			expected: `{"text":"","extra":[{"text":"gone","strikethrough":true,"obfuscated":true}]}`,
+		},
+		{
+			name:     "LiteralAmpersand",
+			template: "Tom & Jerry &z&",
+			expected: `{"text":"Tom & Jerry &z&"}`,
+		},
+		{
+			name:     "Escaping",
+			template: "\"quoted\"\nnext line",
+			expected: `{"text":"\"quoted\"\nnext line"}`,
+		},
+		{
+			name:     "UnknownPlaceholder",
+			template: "Sorry {{player}}",
+			expected: `{"text":"` + DefaultDisconnectMessage + `"}`,
+		},
+		{
+			name:     "UnclosedPlaceholder",
+			template: "Sorry {{username",
+			expected: `{"text":"` + DefaultDisconnectMessage + `"}`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if msg := renderMessage(tc.template, fields); msg != tc.expected {
+				t.Errorf("got: %v; want: %v", msg, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRenderMessage_ValuesAreNotStyled(t *testing.T) {
+	fields := map[string]string{
+		"username": "&c\"}§l{{ip}}",
+		"ip":       "203.0.113.7",
+	}
+
+	expected := protocol.Chat(`{"text":"Hi &c\"}§l{{ip}}"}`)
+	if msg := renderMessage("Hi {{username}}", fields); msg != expected {
+		t.Errorf("got: %v; want: %v", msg, expected)
+	}
+}
+
+func TestRenderMessage_MissingValue(t *testing.T) {
+	expected := protocol.Chat(`{"text":"Hi "}`)
+	if msg := renderMessage("Hi {{username}}", nil); msg != expected {
+		t.Errorf("got: %v; want: %v", msg, expected)
+	}
+}
@@ -0,0 +1,117 @@
+// Package metrics holds the Prometheus metrics of Infrared
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Values of the result label of ConnectionsTotal
+const (
+	ResultSuccess          = "success"
+	ResultError            = "error"
+	ResultRateLimited      = "rate_limited"
+	ResultInvalidHandshake = "invalid_handshake"
+	ResultUnknownServer    = "unknown_server"
+	ResultMaxConnections   = "max_connections"
+)
+
+// Values of the type label of HandshakesTotal
+const (
+	HandshakeTypeStatus  = "status"
+	HandshakeTypeLogin   = "login"
+	HandshakeTypeUnknown = "unknown"
+)
+
+// Values of the result label of LoginsTotal
+const (
+	LoginResultSuccess     = "success"
+	LoginResultError       = "error"
+	LoginResultOffline     = "offline"
+	LoginResultFull        = "full"
+	LoginResultBanned      = "banned"
+	LoginResultMaintenance = "maintenance"
+)
+
+// Values of the direction label of BytesProxiedTotal
+const (
+	DirectionServerBound = "serverbound"
+	DirectionClientBound = "clientbound"
+)
+
+var (
+	ProxiesActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "infrared_proxies",
+		Help: "The total number of proxies running",
+	})
+	PlayersConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "infrared_connected",
+		Help: "The total number of connected players",
+	}, []string{"host"})
+
+	ConnectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "infrared_connections_total",
+		Help: "The total number of handled connections by server and result",
+	}, []string{"server", "result"})
+	HandshakesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "infrared_handshakes_total",
+		Help: "The total number of handshakes by server and requested type",
+	}, []string{"server", "type"})
+	LoginsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "infrared_logins_total",
+		Help: "The total number of logins by server and result",
+	}, []string{"server", "result"})
+	ActiveConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "infrared_active_connections",
+		Help: "The number of connections that are currently proxied to a server",
+	}, []string{"server"})
+	BytesProxiedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "infrared_bytes_proxied_total",
+		Help: "The total number of bytes proxied by server and direction",
+	}, []string{"server", "direction"})
+	HandshakeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "infrared_handshake_duration_seconds",
+		Help:    "The time from accepting a connection until its handshake is read",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(collectors()...)
+}
+
+// collectors returns every metric of Infrared
+func collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		ProxiesActive,
+		PlayersConnected,
+		ConnectionsTotal,
+		HandshakesTotal,
+		LoginsTotal,
+		ActiveConnections,
+		BytesProxiedTotal,
+		HandshakeDuration,
+	}
+}
+
+// Register registers every metric of Infrared with registerer in addition to the default registry
+func Register(registerer prometheus.Registerer) error {
+	for _, c := range collectors() {
+		if err := registerer.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves all metrics of the default registry in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// HandlerFor serves the metrics of gatherer in the Prometheus exposition format
+func HandlerFor(gatherer prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
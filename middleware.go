@@ -0,0 +1,138 @@
+package infrared
+
+import (
+	"context"
+
+	"github.com/haveachin/infrared/protocol"
+	"github.com/haveachin/infrared/protocol/login"
+)
+
+// Direction is the direction a packet travels in a pipe
+type Direction int
+
+const (
+	// DirectionServerBound is the direction from the client to the server
+	DirectionServerBound Direction = iota
+	// DirectionClientBound is the direction from the server to the client
+	DirectionClientBound
+)
+
+// PacketMiddleware inspects, modifies or drops the packets of a PipeWithMiddleware
+type PacketMiddleware interface {
+	// Handle returns the packet that is forwarded instead of pk.
+	// If it returns nil and no error pk is dropped.
+	// An error ends the pipe.
+	Handle(pk protocol.Packet, direction Direction) (*protocol.Packet, error)
+}
+
+// PipeWithMiddleware works like Pipe but reads the data packet by packet and passes
+// every packet through mw before it is forwarded. The client has to be c1 and the server c2.
+// Since the packets have to be readable, this only works as long as the connections
+// are not encrypted, for example for servers in offline mode.
+// Pipes start in the login state, so a Set Compression packet of the server
+// enables compression for both connections after it is forwarded.
+// Connections of a Listener or Dialer with a PacketPool read into the pool and
+// reuse the data of every packet once it is forwarded, so middleware has to copy data it keeps.
+// The byte counts of the PipeResult hold the length of the forwarded packet IDs and data.
+func PipeWithMiddleware(c1, c2 Conn, mw PacketMiddleware) PipeResult {
+	return PipeContextWithMiddleware(context.Background(), c1, c2, mw)
+}
+
+// PipeContextWithMiddleware works like PipeWithMiddleware but also closes both connections when ctx is done
+func PipeContextWithMiddleware(ctx context.Context, c1, c2 Conn, mw PacketMiddleware) PipeResult {
+	return pipeContext(ctx, c1, c2, func(src, dst Conn, toC2 bool) (int64, error) {
+		direction := DirectionClientBound
+		if toC2 {
+			direction = DirectionServerBound
+		}
+		return pipePackets(src, dst, mw, direction)
+	})
+}
+
+// pooledPacketReader reads packets that are handed back once they are no longer used
+type pooledPacketReader interface {
+	ReadPooledPacket() (*protocol.Packet, error)
+	ReleasePacket(pk *protocol.Packet)
+}
+
+// pipePackets copies packets from src through mw to dst until either of them fails.
+// It returns the number of packet bytes written to dst and the error that ended the copy.
+func pipePackets(src, dst Conn, mw PacketMiddleware, direction Direction) (int64, error) {
+	pooled, _ := src.(pooledPacketReader)
+	var written int64
+	// Only the server sends Set Compression and only until the login succeeds
+	inLogin := direction == DirectionClientBound
+	for {
+		var pk *protocol.Packet
+		var err error
+		if pooled != nil {
+			pk, err = pooled.ReadPooledPacket()
+		} else {
+			pk, err = readPacket(src)
+		}
+		if err != nil {
+			return written, err
+		}
+
+		n, err := forwardPacket(src, dst, mw, *pk, direction, &inLogin)
+		// The forwarded packet may share the data of pk, so pk is only released once it is written
+		if pooled != nil {
+			pooled.ReleasePacket(pk)
+		}
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+func readPacket(c Conn) (*protocol.Packet, error) {
+	pk, err := c.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	return &pk, nil
+}
+
+// forwardPacket passes pk through mw and writes the packet mw forwards to dst.
+// It returns the number of packet bytes written to dst.
+func forwardPacket(src, dst Conn, mw PacketMiddleware, pk protocol.Packet, direction Direction, inLogin *bool) (int64, error) {
+	forward, err := mw.Handle(pk, direction)
+	if err != nil || forward == nil {
+		return 0, err
+	}
+
+	if *inLogin && forward.ID == login.ClientBoundSetCompressionPacketID {
+		if err := enableCompression(src, dst, *forward); err != nil {
+			return 0, err
+		}
+		return int64(len(forward.Data) + 1), nil
+	}
+	if *inLogin && forward.ID == login.ClientBoundLoginSuccessPacketID {
+		*inLogin = false
+	}
+
+	if err := dst.WritePacket(*forward); err != nil {
+		return 0, err
+	}
+	return int64(len(forward.Data) + 1), nil
+}
+
+// enableCompression enables the compression of the Set Compression packet pk on server
+// and client and forwards pk uncompressed to client. Compression is enabled first,
+// so that the pipe to the server already expects the compressed packets the client answers with.
+func enableCompression(server, client Conn, pk protocol.Packet) error {
+	setCompression, err := login.UnmarshalClientBoundSetCompression(pk)
+	if err != nil {
+		return err
+	}
+
+	bb, err := pk.Marshal()
+	if err != nil {
+		return err
+	}
+	server.EnableCompression(int(setCompression.Threshold))
+	client.EnableCompression(int(setCompression.Threshold))
+	_, err = client.Write(bb)
+	return err
+}
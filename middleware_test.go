@@ -0,0 +1,263 @@
+package infrared
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared/protocol"
+	"github.com/haveachin/infrared/protocol/login"
+)
+
+// dropPacketMiddleware drops all packets with id and records the directions it has seen
+type dropPacketMiddleware struct {
+	id         byte
+	directions chan Direction
+}
+
+func (mw dropPacketMiddleware) Handle(pk protocol.Packet, direction Direction) (*protocol.Packet, error) {
+	mw.directions <- direction
+	if pk.ID == mw.id {
+		return nil, nil
+	}
+	return &pk, nil
+}
+
+type failingMiddleware struct {
+	err error
+}
+
+func (mw failingMiddleware) Handle(pk protocol.Packet, direction Direction) (*protocol.Packet, error) {
+	return nil, mw.err
+}
+
+func TestPipeWithMiddleware(t *testing.T) {
+	tt := []struct {
+		name      string
+		direction Direction
+	}{
+		{
+			name:      "ServerBound",
+			direction: DirectionServerBound,
+		},
+		{
+			name:      "ClientBound",
+			direction: DirectionClientBound,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			client, c1 := net.Pipe()
+			c2, server := net.Pipe()
+
+			mw := dropPacketMiddleware{
+				id:         0x0F,
+				directions: make(chan Direction, 3),
+			}
+			resultCh := make(chan PipeResult, 1)
+			go func() {
+				resultCh <- PipeWithMiddleware(wrapConn(c1), wrapConn(c2), mw)
+			}()
+
+			src, dst := wrapConn(client), wrapConn(server)
+			if tc.direction == DirectionClientBound {
+				src, dst = dst, src
+			}
+
+			go func() {
+				for _, id := range []byte{0x01, 0x0F, 0x02} {
+					if err := src.WritePacket(protocol.Packet{ID: id, Data: []byte{id}}); err != nil {
+						return
+					}
+				}
+			}()
+
+			for _, id := range []byte{0x01, 0x02} {
+				pk, err := dst.ReadPacket()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if pk.ID != id {
+					t.Errorf("got: %#x; want: %#x", pk.ID, id)
+				}
+			}
+
+			for i := 0; i < 3; i++ {
+				if direction := <-mw.directions; direction != tc.direction {
+					t.Errorf("got: %v; want: %v", direction, tc.direction)
+				}
+			}
+
+			client.Close()
+			server.Close()
+			result := <-resultCh
+
+			bytes := result.BytesC1ToC2
+			if tc.direction == DirectionClientBound {
+				bytes = result.BytesC2ToC1
+			}
+			if bytes != 4 {
+				t.Errorf("got: %d; want: %d", bytes, 4)
+			}
+		})
+	}
+}
+
+func TestPipeWithMiddleware_Error(t *testing.T) {
+	client, c1 := net.Pipe()
+	c2, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errMiddleware := errors.New("middleware failed")
+	resultCh := make(chan PipeResult, 1)
+	go func() {
+		resultCh <- PipeWithMiddleware(wrapConn(c1), wrapConn(c2), failingMiddleware{err: errMiddleware})
+	}()
+
+	go func() {
+		_ = wrapConn(client).WritePacket(protocol.Packet{ID: 0x01})
+	}()
+
+	select {
+	case result := <-resultCh:
+		if result.Err != errMiddleware {
+			t.Errorf("got: %v; want: %v", result.Err, errMiddleware)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("PipeWithMiddleware did not return after the middleware failed")
+	}
+}
+
+func TestPipeWithMiddleware_SetCompression(t *testing.T) {
+	client, c1 := net.Pipe()
+	c2, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// The middleware can only drop the packet if the pipe decompresses it
+	mw := dropPacketMiddleware{id: 0x02, directions: make(chan Direction, 16)}
+	go func() {
+		for range mw.directions {
+		}
+	}()
+	go PipeWithMiddleware(wrapConn(c1), wrapConn(c2), mw)
+
+	threshold := 16
+	packets := []protocol.Packet{
+		{ID: 0x01, Data: bytes.Repeat([]byte{0x01}, threshold*2)},
+		{ID: 0x02, Data: []byte{0x02}},
+		{ID: 0x04, Data: []byte{0x04}},
+	}
+	forwarded := []protocol.Packet{packets[0], packets[2]}
+	clientConn, serverConn := wrapConn(client), wrapConn(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The pipe to the server is already waiting for the next packet when compression is enabled
+	go clientConn.WritePacket(login.ServerLoginStart{Name: "Steve"}.Marshal())
+	if _, err := serverConn.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	go func() {
+		setCompression := login.ClientBoundSetCompression{Threshold: protocol.VarInt(threshold)}.Marshal()
+		if err := serverConn.WritePacket(setCompression); err != nil {
+			return
+		}
+		serverConn.EnableCompression(threshold)
+		for _, pk := range packets {
+			if err := serverConn.WritePacket(pk); err != nil {
+				return
+			}
+		}
+	}()
+
+	pk, err := clientConn.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk.ID != login.ClientBoundSetCompressionPacketID {
+		t.Fatalf("got: %#x; want: %#x", pk.ID, login.ClientBoundSetCompressionPacketID)
+	}
+	clientConn.EnableCompression(threshold)
+
+	for _, want := range forwarded {
+		got, err := clientConn.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != want.ID || !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("client received: got: %v; want: %v", got, want)
+		}
+	}
+
+	go func() {
+		for _, pk := range packets {
+			if err := clientConn.WritePacket(pk); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, want := range forwarded {
+		got, err := serverConn.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != want.ID || !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("server received: got: %v; want: %v", got, want)
+		}
+	}
+}
+
+func TestPipeWithMiddleware_PacketPool(t *testing.T) {
+	client, c1 := net.Pipe()
+	c2, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	pool := &protocol.PacketPool{}
+	pc1, pc2 := wrapConn(c1), wrapConn(c2)
+	pc1.packetPool = pool
+	pc2.packetPool = pool
+
+	mw := dropPacketMiddleware{id: 0x0F, directions: make(chan Direction, 16)}
+	go func() {
+		for range mw.directions {
+		}
+	}()
+	go PipeWithMiddleware(pc1, pc2, mw)
+
+	// Packets of different lengths reuse the data of the packets before them
+	packets := []protocol.Packet{
+		{ID: 0x01, Data: bytes.Repeat([]byte{0x01}, 64)},
+		{ID: 0x0F, Data: bytes.Repeat([]byte{0x0F}, 32)},
+		{ID: 0x02, Data: []byte{0x02}},
+		{ID: 0x03, Data: bytes.Repeat([]byte{0x03}, 128)},
+	}
+	forwarded := []protocol.Packet{packets[0], packets[2], packets[3]}
+
+	src, dst := wrapConn(client), wrapConn(server)
+	go func() {
+		for _, pk := range packets {
+			if err := src.WritePacket(pk); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, want := range forwarded {
+		got, err := dst.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != want.ID || !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("got: %v; want: %v", got, want)
+		}
+	}
+}
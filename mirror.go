@@ -0,0 +1,154 @@
+package infrared
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/haveachin/infrared/protocol"
+)
+
+// mirrorQueueLength is the number of writes a shadow server can fall behind before mirroring stops
+const mirrorQueueLength = 256
+
+// shadowMirror sends a copy of everything written to a server to a shadow server and discards
+// everything the shadow server answers. It works in the background, so a slow or failing
+// shadow server never affects the player. Since the copy has to be complete to make sense,
+// mirroring stops for good as soon as a write is dropped or fails.
+type shadowMirror struct {
+	addr    string
+	writes  chan []byte
+	done    chan struct{}
+	once    sync.Once
+	stopped int32
+}
+
+// startMirror dials addr with dialer in the background and mirrors the writes of the connection for req to it
+func startMirror(dialer ServerDialer, addr string, req DialRequest) *shadowMirror {
+	m := &shadowMirror{
+		addr:   addr,
+		writes: make(chan []byte, mirrorQueueLength),
+		done:   make(chan struct{}),
+	}
+	req.ServerAddr = addr
+	go m.run(dialer, req)
+	return m
+}
+
+func (m *shadowMirror) run(dialer ServerDialer, req DialRequest) {
+	defer m.recoverPanic()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-m.done
+		cancel()
+	}()
+
+	shadow, err := dialer.DialServer(ctx, req)
+	if err != nil {
+		m.stop("dialing failed", err)
+		return
+	}
+	defer shadow.Close()
+	go func() {
+		defer m.recoverPanic()
+		_, _ = io.Copy(io.Discard, shadow)
+	}()
+
+	for {
+		select {
+		case b := <-m.writes:
+			if err := m.write(shadow, b); err != nil {
+				return
+			}
+		case <-m.done:
+			// Send what was written before the connection ended
+			for {
+				select {
+				case b := <-m.writes:
+					if err := m.write(shadow, b); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (m *shadowMirror) write(shadow Conn, b []byte) error {
+	if _, err := shadow.Write(b); err != nil {
+		m.stop("writing failed", err)
+		return err
+	}
+	return nil
+}
+
+// stop ends mirroring and logs why unless it was already stopped
+func (m *shadowMirror) stop(reason string, err error) {
+	if atomic.CompareAndSwapInt32(&m.stopped, 0, 1) {
+		log.Printf("[w] Stopped mirroring to %s; %s; error: %v", m.addr, reason, err)
+	}
+}
+
+// recoverPanic stops mirroring if the shadow server panicked; it has to be deferred
+func (m *shadowMirror) recoverPanic() {
+	if r := recover(); r != nil {
+		m.stop("mirroring panicked", fmt.Errorf("%v", r))
+	}
+}
+
+// send queues a copy of b for the shadow server
+func (m *shadowMirror) send(b []byte) {
+	if atomic.LoadInt32(&m.stopped) == 1 {
+		return
+	}
+
+	select {
+	case m.writes <- append([]byte(nil), b...):
+	default:
+		m.stop("shadow server fell behind", io.ErrShortWrite)
+	}
+}
+
+// close ends the mirror once the queued writes are sent
+func (m *shadowMirror) close() {
+	m.once.Do(func() {
+		close(m.done)
+	})
+}
+
+// mirrorConn is a server Conn that mirrors everything written to it
+type mirrorConn struct {
+	Conn
+	mirror *shadowMirror
+}
+
+func (c mirrorConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.mirror.send(b[:n])
+	}
+	return n, err
+}
+
+// WritePacket mirrors the packet uncompressed; proxies never enable compression on server connections
+func (c mirrorConn) WritePacket(pk protocol.Packet) error {
+	if err := c.Conn.WritePacket(pk); err != nil {
+		return err
+	}
+	if bb, err := pk.Marshal(); err == nil {
+		c.mirror.send(bb)
+	}
+	return nil
+}
+
+func (c mirrorConn) Close() error {
+	c.mirror.close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,255 @@
+package infrared
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared/protocol/login"
+)
+
+// serveMirrorTarget accepts one connection on addr, sends what it reads of the
+// length of expected to received and answers with answer
+func serveMirrorTarget(t *testing.T, addr string, expected, answer []byte, received chan<- []byte) net.Listener {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		bb := make([]byte, len(expected))
+		n, _ := io.ReadFull(c, bb)
+		received <- bb[:n]
+		c.Write(answer)
+		io.Copy(io.Discard, c)
+	}()
+	return l
+}
+
+func TestProxy_MirrorTo(t *testing.T) {
+	shadowAddr := serverAddr(655)
+
+	tt := []struct {
+		name    string
+		portEnd int
+		// shadow serves the shadow server if set
+		shadow bool
+		// panics makes dialing the shadow server panic
+		panics bool
+	}{
+		{
+			name:    "Shadow",
+			portEnd: 652,
+			shadow:  true,
+		},
+		{
+			name:    "PanickingShadow",
+			portEnd: 653,
+			panics:  true,
+		},
+		{
+			name:    "OfflineShadow",
+			portEnd: 654,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			hsPk := loginHandshakePort(tc.portEnd)
+			handshake, err := hsPk.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			loginStartPk := login.ServerLoginStart{Name: "Steve"}.Marshal()
+			loginStart, err := loginStartPk.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := append(append(handshake, loginStart...), "hello"...)
+
+			received := make(chan []byte, 1)
+			l := serveMirrorTarget(t, serverAddr(tc.portEnd), expected, []byte("world"), received)
+			defer l.Close()
+
+			shadowReceived := make(chan []byte, 1)
+			if tc.shadow {
+				l := serveMirrorTarget(t, shadowAddr, expected, []byte("ignored by the proxy"), shadowReceived)
+				defer l.Close()
+			}
+
+			config := createBasicProxyConfig(serverDomain, gatewayAddr(tc.portEnd), serverAddr(tc.portEnd))
+			config.MirrorTo = shadowAddr
+			proxy := &Proxy{Config: config}
+			if tc.panics {
+				proxy.ServerDialer = ServerDialerFunc(func(ctx context.Context, req DialRequest) (Conn, error) {
+					if req.ServerAddr == shadowAddr {
+						panic("shadow server failed")
+					}
+					return Dialer{}.DialServer(ctx, req)
+				})
+			}
+
+			gateway := Gateway{}
+			if err := gateway.ListenAndServe([]*Proxy{proxy}); err != nil {
+				t.Fatalf("Can't start gateway: %v", err)
+			}
+			defer gateway.Close()
+
+			conn, err := net.Dial("tcp", gatewayAddr(tc.portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write(expected); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case bb := <-received:
+				if !bytes.Equal(bb, expected) {
+					t.Errorf("server received: got: %x; want: %x", bb, expected)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("server did not receive the connection")
+			}
+
+			// Only the answer of the server reaches the client
+			answer := make([]byte, len("world"))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(conn, answer); err != nil {
+				t.Fatal(err)
+			}
+			if string(answer) != "world" {
+				t.Errorf("got: %q; want: %q", answer, "world")
+			}
+
+			if !tc.shadow {
+				return
+			}
+			select {
+			case bb := <-shadowReceived:
+				if !bytes.Equal(bb, expected) {
+					t.Errorf("shadow server received: got: %x; want: %x", bb, expected)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("shadow server did not receive the connection")
+			}
+		})
+	}
+}
+
+func TestMirrorConn_ShadowFallsBehind(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go io.Copy(io.Discard, c2)
+
+	// Nothing reads from the shadow server, so every write to it blocks
+	shadow, _ := net.Pipe()
+	defer shadow.Close()
+	dialer := ServerDialerFunc(func(ctx context.Context, req DialRequest) (Conn, error) {
+		return wrapConn(shadow), nil
+	})
+
+	mirror := startMirror(dialer, "shadow", DialRequest{})
+	rconn := mirrorConn{Conn: wrapConn(c1), mirror: mirror}
+	defer rconn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < mirrorQueueLength*2; i++ {
+			if _, err := rconn.Write([]byte("data")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes to the server were blocked by the shadow server")
+	}
+	if atomic.LoadInt32(&mirror.stopped) != 1 {
+		t.Error("got: mirroring; want: stopped")
+	}
+}
+
+// panickingConn panics when it is read from or written to
+type panickingConn struct {
+	Conn
+	read  bool
+	write bool
+}
+
+func (c panickingConn) Read(b []byte) (int, error) {
+	if c.read {
+		panic("read failed")
+	}
+	return c.Conn.Read(b)
+}
+
+func (c panickingConn) Write(b []byte) (int, error) {
+	if c.write {
+		panic("write failed")
+	}
+	return c.Conn.Write(b)
+}
+
+func TestMirrorConn_PanickingShadow(t *testing.T) {
+	tt := []struct {
+		name  string
+		read  bool
+		write bool
+	}{
+		{
+			name: "Read",
+			read: true,
+		},
+		{
+			name:  "Write",
+			write: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			go io.Copy(io.Discard, c2)
+
+			shadow, shadowServer := net.Pipe()
+			defer shadow.Close()
+			go io.Copy(io.Discard, shadowServer)
+			dialer := ServerDialerFunc(func(ctx context.Context, req DialRequest) (Conn, error) {
+				return panickingConn{Conn: wrapConn(shadow), read: tc.read, write: tc.write}, nil
+			})
+
+			mirror := startMirror(dialer, "shadow", DialRequest{})
+			rconn := mirrorConn{Conn: wrapConn(c1), mirror: mirror}
+			defer rconn.Close()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for atomic.LoadInt32(&mirror.stopped) != 1 {
+				if time.Now().After(deadline) {
+					t.Fatal("got: mirroring; want: stopped")
+				}
+				if _, err := rconn.Write([]byte("data")); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+// Package otel traces the connections of an infrared.Gateway with OpenTelemetry.
+// It is a module of its own so that Infrared itself does not depend on OpenTelemetry.
+package otel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/haveachin/infrared"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName is the name of the tracer that creates the spans
+const InstrumentationName = "github.com/haveachin/infrared"
+
+// Tracer is an infrared.Tracer that creates OpenTelemetry spans
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer creates a Tracer that uses a tracer of provider
+func NewTracer(provider trace.TracerProvider) *Tracer {
+	return &Tracer{
+		tracer: provider.Tracer(InstrumentationName),
+	}
+}
+
+func (tracer *Tracer) Start(ctx context.Context, name string) (context.Context, infrared.Span) {
+	ctx, s := tracer.tracer.Start(ctx, name)
+	return ctx, span{s}
+}
+
+type span struct {
+	span trace.Span
+}
+
+func (s span) SetAttribute(key string, value interface{}) {
+	var kv attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		kv = attribute.String(key, v)
+	case int:
+		kv = attribute.Int(key, v)
+	case int64:
+		kv = attribute.Int64(key, v)
+	case bool:
+		kv = attribute.Bool(key, v)
+	default:
+		kv = attribute.String(key, fmt.Sprint(v))
+	}
+	s.span.SetAttributes(kv)
+}
+
+func (s span) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s span) End() {
+	s.span.End()
+}
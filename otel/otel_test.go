@@ -0,0 +1,115 @@
+package otel
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared"
+	"github.com/haveachin/infrared/protocol"
+	"github.com/haveachin/infrared/protocol/handshaking"
+	"github.com/haveachin/infrared/protocol/login"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer_Login(t *testing.T) {
+	gatewayAddr := ":30624"
+	serverAddr := ":20624"
+
+	server, err := net.Listen("tcp", serverAddr)
+	if err != nil {
+		t.Fatalf("Can't listen to %v: %v", serverAddr, err)
+	}
+	defer server.Close()
+
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	gateway := infrared.Gateway{Tracer: NewTracer(provider)}
+	proxy := &infrared.Proxy{
+		Config: &infrared.ProxyConfig{
+			DomainName: "infrared.gateway",
+			ListenTo:   gatewayAddr,
+			ProxyTo:    serverAddr,
+		},
+	}
+	if err := gateway.ListenAndServe([]*infrared.Proxy{proxy}); err != nil {
+		t.Fatalf("Can't start gateway: %v", err)
+	}
+	defer gateway.Close()
+
+	conn, err := infrared.Dialer{}.Dial(gatewayAddr)
+	if err != nil {
+		t.Fatalf("Can't make a connection with gateway: %v", err)
+	}
+
+	hs := handshaking.ServerBoundHandshake{
+		ProtocolVersion: 755,
+		ServerAddress:   "infrared.gateway",
+		ServerPort:      30624,
+		NextState:       handshaking.ServerBoundHandshakeLoginState,
+	}
+	if err := conn.WritePacket(hs.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WritePacket(login.ServerLoginStart{Name: protocol.String("Steve")}.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the gateway time to read the login start before the connection ends
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for len(exporter.GetSpans()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	for _, name := range []string{infrared.SpanConnection, infrared.SpanHandshake, infrared.SpanDial} {
+		if _, ok := spans[name]; !ok {
+			t.Fatalf("got no %s span; got: %v", name, spans)
+		}
+	}
+
+	root := spans[infrared.SpanConnection]
+	for _, name := range []string{infrared.SpanHandshake, infrared.SpanDial} {
+		if parent := spans[name].Parent.SpanID(); parent != root.SpanContext.SpanID() {
+			t.Errorf("%s: got parent: %v; want: %v", name, parent, root.SpanContext.SpanID())
+		}
+	}
+
+	expected := map[attribute.Key]attribute.Value{
+		infrared.AttributeServerAddress:   attribute.StringValue(serverAddr),
+		infrared.AttributePlayerName:      attribute.StringValue("Steve"),
+		infrared.AttributeProtocolVersion: attribute.IntValue(755),
+		infrared.AttributeRequestType:     attribute.StringValue("login"),
+	}
+	got := map[attribute.Key]attribute.Value{}
+	for _, kv := range root.Attributes {
+		got[kv.Key] = kv.Value
+	}
+	for key, value := range expected {
+		if got[key] != value {
+			t.Errorf("%s: got: %v; want: %v", key, got[key].Emit(), value.Emit())
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MaxUncompressedPacketLength is the largest data length that is accepted in a compressed packet
+const MaxUncompressedPacketLength = 1 << 21
+
+var (
+	// ErrBadlyCompressed is returned if a compressed packet is smaller than the threshold
+	ErrBadlyCompressed = errors.New("badly compressed packet")
+
+	zlibReaderPool sync.Pool
+	zlibWriterPool = sync.Pool{
+		New: func() interface{} {
+			return zlib.NewWriter(nil)
+		},
+	}
+)
+
+// MarshalCompressed encodes the packet in the format that is used after compression is enabled.
+// The data is only compressed if the packet is at least threshold bytes long.
+func (pk *Packet) MarshalCompressed(threshold int) ([]byte, error) {
+	data := append([]byte{pk.ID}, pk.Data...)
+
+	dataLength := 0
+	if len(data) >= threshold {
+		dataLength = len(data)
+
+		var buf bytes.Buffer
+		zw := zlibWriterPool.Get().(*zlib.Writer)
+		zw.Reset(&buf)
+		_, err := zw.Write(data)
+		if err == nil {
+			err = zw.Close()
+		}
+		zlibWriterPool.Put(zw)
+		if err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+
+	dataLengthBytes := VarInt(int32(dataLength)).Encode()
+	packetLength := VarInt(int32(len(dataLengthBytes) + len(data))).Encode()
+
+	packedData := make([]byte, 0, len(packetLength)+len(dataLengthBytes)+len(data))
+	packedData = append(packedData, packetLength...)
+	packedData = append(packedData, dataLengthBytes...)
+	return append(packedData, data...), nil
+}
+
+// ReadCompressedPacket decodes a byte stream in the format that is used after compression is enabled,
+// decompresses it if needed and cuts the first Packet out
+func ReadCompressedPacket(r DecodeReader, threshold int) (Packet, error) {
+	data, err := ReadPacketBytes(r)
+	if err != nil {
+		return Packet{}, err
+	}
+
+	br := bytes.NewReader(data)
+	var dataLength VarInt
+	if err := dataLength.Decode(br); err != nil {
+		return Packet{}, err
+	}
+
+	if dataLength == 0 {
+		data = data[len(data)-br.Len():]
+	} else {
+		if int(dataLength) < threshold {
+			return Packet{}, ErrBadlyCompressed
+		}
+		if dataLength > MaxUncompressedPacketLength {
+			return Packet{}, fmt.Errorf("data length %d of compressed packet is too long", dataLength)
+		}
+
+		if data, err = decompress(br, int(dataLength)); err != nil {
+			return Packet{}, fmt.Errorf("decompressing the packet failed: %v", err)
+		}
+	}
+
+	if len(data) < 1 {
+		return Packet{}, fmt.Errorf("packet length too short")
+	}
+
+	return Packet{
+		ID:   data[0],
+		Data: data[1:],
+	}, nil
+}
+
+// PeekCompressedPacket decodes and decompresses a byte stream and peeks the first Packet
+func PeekCompressedPacket(p PeekReader, threshold int) (Packet, error) {
+	r := bytePeeker{
+		PeekReader: p,
+		cursor:     0,
+	}
+
+	return ReadCompressedPacket(&r, threshold)
+}
+
+func decompress(r io.Reader, dataLength int) ([]byte, error) {
+	var zr io.ReadCloser
+	var err error
+	if pooled, ok := zlibReaderPool.Get().(io.ReadCloser); ok {
+		zr = pooled
+		err = zr.(zlib.Resetter).Reset(r, nil)
+	} else {
+		zr, err = zlib.NewReader(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer zlibReaderPool.Put(zr)
+
+	data := make([]byte, dataLength)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, err
+	}
+
+	// The data length has to match the decompressed data exactly
+	if n, _ := zr.Read(make([]byte, 1)); n > 0 {
+		return nil, errors.New("decompressed data is longer than the data length")
+	}
+
+	return data, zr.Close()
+}
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacket_MarshalCompressed(t *testing.T) {
+	tt := []struct {
+		name       string
+		packet     Packet
+		threshold  int
+		compressed bool
+	}{
+		{
+			name:      "BelowThreshold",
+			packet:    Packet{ID: 0x0f, Data: []byte{0x00, 0xf2}},
+			threshold: 256,
+		},
+		{
+			name:       "AboveThreshold",
+			packet:     Packet{ID: 0x0f, Data: bytes.Repeat([]byte("infrared"), 64)},
+			threshold:  256,
+			compressed: true,
+		},
+		{
+			name:       "ZeroThreshold",
+			packet:     Packet{ID: 0x00},
+			threshold:  0,
+			compressed: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := tc.packet.MarshalCompressed(tc.threshold)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := bytes.NewReader(b)
+			var packetLength, dataLength VarInt
+			if err := ScanFields(r, &packetLength, &dataLength); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.compressed {
+				if int(dataLength) != len(tc.packet.Data)+1 {
+					t.Errorf("got: %d; want: %d", dataLength, len(tc.packet.Data)+1)
+				}
+			} else {
+				if dataLength != 0 {
+					t.Errorf("got: %d; want: %d", dataLength, 0)
+				}
+
+				want := append([]byte{tc.packet.ID}, tc.packet.Data...)
+				if got := b[len(b)-r.Len():]; !bytes.Equal(got, want) {
+					t.Errorf("got: %v; want: %v", got, want)
+				}
+			}
+
+			pk, err := ReadCompressedPacket(bytes.NewReader(b), tc.threshold)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pk.ID != tc.packet.ID || !bytes.Equal(pk.Data, tc.packet.Data) {
+				t.Errorf("got: %v; want: %v", pk, tc.packet)
+			}
+		})
+	}
+}
+
+func TestReadCompressedPacket_Invalid(t *testing.T) {
+	pk := Packet{ID: 0x00, Data: bytes.Repeat([]byte{0x01}, 64)}
+	b, err := pk.MarshalCompressed(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadCompressedPacket(bytes.NewReader(b), 128); err != ErrBadlyCompressed {
+		t.Errorf("got: %v; want: %v", err, ErrBadlyCompressed)
+	}
+
+	// Claim a shorter data length than the compressed data has
+	tampered := append([]byte{}, b...)
+	tampered[1]--
+	if _, err := ReadCompressedPacket(bytes.NewReader(tampered), 16); err == nil {
+		t.Error("got no error")
+	}
+}
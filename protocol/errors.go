@@ -6,4 +6,8 @@ import (
 
 var (
 	ErrInvalidPacketID = errors.New("invalid packet id")
+	// ErrPacketTooLong is returned if the length of a packet exceeds the allowed maximum
+	ErrPacketTooLong = errors.New("packet too long")
+	// ErrNegativeLength is returned if a length prefix of a field is negative
+	ErrNegativeLength = errors.New("negative length")
 )
@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// packetFuzzCorpus are the seeds of the packet fuzz targets
+var packetFuzzCorpus = [][]byte{
+	// Empty input
+	{},
+	// Packet without data
+	{0x01, 0x00},
+	// Packet with data
+	{0x03, 0x00, 0x00, 0xf2},
+	// Zero length
+	{0x00},
+	// Length VarInt with continuation bits beyond five bytes
+	{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01},
+	// Negative length
+	{0xff, 0xff, 0xff, 0xff, 0x0f, 0x00},
+	// Length beyond MaxPacketLength
+	{0x80, 0x80, 0x80, 0x01, 0x00},
+	// Length longer than the data
+	{0x10, 0x00, 0x01},
+	// Data longer than the length
+	{0x01, 0x00, 0x01, 0x02, 0x03},
+}
+
+// FuzzReadPacket feeds arbitrary bytes to ReadPacket and PeekPacket.
+// Both must return an error instead of panicking and must agree on the packet they decode.
+// A decoded packet has to decode to the same packet after it is marshaled again.
+//
+// Run it with:
+//
+//	go test ./protocol -run '^$' -fuzz FuzzReadPacket -fuzztime 1m
+func FuzzReadPacket(f *testing.F) {
+	for _, data := range packetFuzzCorpus {
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pk, err := ReadPacket(bytes.NewReader(data))
+
+		peeked, peekErr := PeekPacket(bufio.NewReader(bytes.NewReader(data)))
+		if (err == nil) != (peekErr == nil) {
+			t.Fatalf("got: %v; want: %v", peekErr, err)
+		}
+		if err != nil {
+			return
+		}
+		if peeked.ID != pk.ID || !bytes.Equal(peeked.Data, pk.Data) {
+			t.Errorf("got: %v; want: %v", peeked, pk)
+		}
+
+		if len(pk.Data)+1 > MaxPacketLength {
+			t.Errorf("got: %d; want: <= %d", len(pk.Data)+1, MaxPacketLength)
+		}
+
+		bb, err := pk.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := ReadPacket(bytes.NewReader(bb))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.ID != pk.ID || !bytes.Equal(again.Data, pk.Data) {
+			t.Errorf("got: %v; want: %v", again, pk)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package handshaking
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared/protocol"
+)
+
+// FuzzUnmarshalServerBoundHandshake feeds arbitrary packet data to UnmarshalServerBoundHandshake
+// and to the methods that parse the server address of the handshake. None of them may panic.
+// A decoded handshake has to decode to the same handshake after it is marshaled again.
+//
+// Run it with:
+//
+//	go test ./protocol/handshaking -run '^$' -fuzz FuzzUnmarshalServerBoundHandshake -fuzztime 1m
+func FuzzUnmarshalServerBoundHandshake(f *testing.F) {
+	seeds := [][]byte{
+		// Empty data
+		{},
+		// Valid handshake
+		ServerBoundHandshake{
+			ProtocolVersion: 754,
+			ServerAddress:   "example.com",
+			ServerPort:      25565,
+			NextState:       ServerBoundHandshakeLoginState,
+		}.Marshal().Data,
+		// Forge and RealIP server addresses
+		ServerBoundHandshake{ServerAddress: "example.com\x00FML2\x00", NextState: ServerBoundHandshakeStatusState}.Marshal().Data,
+		ServerBoundHandshake{ServerAddress: "example.com///127.0.0.1:25565///1600000000///c2lnbmF0dXJl"}.Marshal().Data,
+		// Protocol version VarInt with continuation bits beyond five bytes
+		{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01},
+		// Server address longer than its declared length
+		{0xf2, 0x05, 0x02, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x63, 0xdd, 0x02},
+		// Server address shorter than its declared length
+		{0xf2, 0x05, 0x7f, 'e', 'x'},
+		// Negative server address length
+		{0xf2, 0x05, 0xff, 0xff, 0xff, 0xff, 0x0f, 'e', 'x'},
+	}
+	for _, data := range seeds {
+		f.Add(data)
+	}
+
+	clientAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25565}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hs, err := UnmarshalServerBoundHandshake(protocol.Packet{
+			ID:   ServerBoundHandshakePacketID,
+			Data: data,
+		})
+		if err != nil {
+			return
+		}
+
+		again, err := UnmarshalServerBoundHandshake(hs.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != hs {
+			t.Errorf("got: %v; want: %v", again, hs)
+		}
+
+		hs.ParseServerAddress()
+		hs.IsForgeAddress()
+		hs.IsRealIPAddress()
+		hs.BungeeCordForwarding()
+
+		rewritten := hs
+		rewritten.RewriteServerAddress("backend.local")
+		realIP := hs
+		realIP.UpgradeToRealIP(clientAddr, time.Unix(1600000000, 0))
+		bungeeCord := hs
+		bungeeCord.UpgradeToBungeeCord(clientAddr, "069a79f444e94726a5befca90e38aaf5")
+	})
+}
@@ -14,8 +14,9 @@ const (
 	ServerBoundHandshakeStatusState = protocol.Byte(1)
 	ServerBoundHandshakeLoginState  = protocol.Byte(2)
 
-	ForgeSeparator  = "\x00"
-	RealIPSeparator = "///"
+	ForgeSeparator      = "\x00"
+	RealIPSeparator     = "///"
+	BungeeCordSeparator = "\x00"
 )
 
 type ServerBoundHandshake struct {
@@ -81,6 +82,20 @@ func (pk ServerBoundHandshake) ParseServerAddress() string {
 	return addr
 }
 
+// RewriteServerAddress replaces the host of the server address with host
+// and keeps the Forge or RealIP data that follows it
+func (pk *ServerBoundHandshake) RewriteServerAddress(host string) {
+	addr := string(pk.ServerAddress)
+	end := len(addr)
+	for _, separator := range []string{ForgeSeparator, RealIPSeparator} {
+		if i := strings.Index(addr, separator); i >= 0 && i < end {
+			end = i
+		}
+	}
+
+	pk.ServerAddress = protocol.String(host + addr[end:])
+}
+
 func (pk *ServerBoundHandshake) UpgradeToRealIP(clientAddr net.Addr, timestamp time.Time) {
 	if pk.IsRealIPAddress() {
 		return
@@ -97,3 +112,81 @@ func (pk *ServerBoundHandshake) UpgradeToRealIP(clientAddr net.Addr, timestamp t
 
 	pk.ServerAddress = protocol.String(addr)
 }
+
+// BungeeCordForwarding is the player data that BungeeCord forwards
+// in the server address of the handshake
+type BungeeCordForwarding struct {
+	ServerAddress string
+	ClientIP      string
+	// UUID of the player without dashes
+	UUID string
+	// Properties is the JSON encoded list of the player's profile properties
+	Properties string
+}
+
+// BungeeCordForwarding parses the BungeeCord forwarding data from the server address.
+// It returns false if the server address does not carry BungeeCord forwarding data.
+func (pk ServerBoundHandshake) BungeeCordForwarding() (BungeeCordForwarding, bool) {
+	parts := strings.SplitN(string(pk.ServerAddress), BungeeCordSeparator, 4)
+	if len(parts) < 3 || !isUUID(parts[2]) {
+		return BungeeCordForwarding{}, false
+	}
+
+	forwarding := BungeeCordForwarding{
+		ServerAddress: parts[0],
+		ClientIP:      parts[1],
+		UUID:          parts[2],
+	}
+	if len(parts) > 3 {
+		// The Forge marker of the client follows the forwarding data
+		properties := strings.SplitN(parts[3], ForgeSeparator, 2)[0]
+		if !strings.HasPrefix(properties, "FML") {
+			forwarding.Properties = properties
+		}
+	}
+	return forwarding, true
+}
+
+// UpgradeToBungeeCord embeds the IP of the client and the UUID of the player into the
+// server address like BungeeCord does when ip_forward is enabled.
+// Forwarding data that the client sent itself is replaced, so that clients can't choose
+// their own IP, UUID or profile properties. The Forge marker of the server address is kept
+// after the forwarding data.
+func (pk *ServerBoundHandshake) UpgradeToBungeeCord(clientAddr net.Addr, uuid string) {
+	clientIP := clientAddr.String()
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+
+	pk.ServerAddress = protocol.String(strings.Join([]string{
+		pk.ParseServerAddress(),
+		clientIP,
+		strings.ReplaceAll(uuid, "-", ""),
+	}, BungeeCordSeparator) + pk.forgeMarker())
+}
+
+// forgeMarker returns the Forge marker of the server address, like "\x00FML2\x00",
+// without any data that comes before it
+func (pk ServerBoundHandshake) forgeMarker() string {
+	parts := strings.Split(string(pk.ServerAddress), ForgeSeparator)
+	for i := 1; i < len(parts); i++ {
+		if strings.HasPrefix(parts[i], "FML") {
+			return ForgeSeparator + strings.Join(parts[i:], ForgeSeparator)
+		}
+	}
+	return ""
+}
+
+func isUUID(s string) bool {
+	s = strings.ReplaceAll(s, "-", "")
+	if len(s) != 32 {
+		return false
+	}
+
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
@@ -362,3 +362,242 @@ func BenchmarkHandshakingServerBoundHandshake_Marshal(b *testing.B) {
 		}
 	}
 }
+
+func TestServerBoundHandshake_UpgradeToBungeeCord(t *testing.T) {
+	tt := []struct {
+		addr       string
+		clientAddr net.TCPAddr
+		uuid       string
+		expected   BungeeCordForwarding
+	}{
+		{
+			addr: "example.com",
+			clientAddr: net.TCPAddr{
+				IP:   net.IPv4(127, 0, 0, 1),
+				Port: 12345,
+			},
+			uuid: "b50ad385-829d-3141-a216-7e7d7539ba7f",
+			expected: BungeeCordForwarding{
+				ServerAddress: "example.com",
+				ClientIP:      "127.0.0.1",
+				UUID:          "b50ad385829d3141a2167e7d7539ba7f",
+			},
+		},
+		{
+			addr: "example.com\x00FML\x00",
+			clientAddr: net.TCPAddr{
+				IP:   net.ParseIP("2001:db8::1"),
+				Port: 25565,
+			},
+			uuid: "b50ad385829d3141a2167e7d7539ba7f",
+			expected: BungeeCordForwarding{
+				ServerAddress: "example.com",
+				ClientIP:      "2001:db8::1",
+				UUID:          "b50ad385829d3141a2167e7d7539ba7f",
+			},
+		},
+		{
+			// Forwarding data forged by the client is replaced
+			addr: "example.com\x001.2.3.4\x00069a79f444e94726a5befca90e38aaf5\x00[{\"name\":\"textures\"}]",
+			clientAddr: net.TCPAddr{
+				IP:   net.IPv4(127, 0, 0, 1),
+				Port: 12345,
+			},
+			uuid: "b50ad385829d3141a2167e7d7539ba7f",
+			expected: BungeeCordForwarding{
+				ServerAddress: "example.com",
+				ClientIP:      "127.0.0.1",
+				UUID:          "b50ad385829d3141a2167e7d7539ba7f",
+			},
+		},
+		{
+			addr: "example.com\x001.2.3.4\x00069a79f444e94726a5befca90e38aaf5\x00FML2\x00",
+			clientAddr: net.TCPAddr{
+				IP:   net.IPv4(127, 0, 0, 1),
+				Port: 12345,
+			},
+			uuid: "b50ad385829d3141a2167e7d7539ba7f",
+			expected: BungeeCordForwarding{
+				ServerAddress: "example.com",
+				ClientIP:      "127.0.0.1",
+				UUID:          "b50ad385829d3141a2167e7d7539ba7f",
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		hs := ServerBoundHandshake{ServerAddress: protocol.String(tc.addr)}
+		hs.UpgradeToBungeeCord(&tc.clientAddr, tc.uuid)
+
+		// Round trip through the wire format
+		hs, err := UnmarshalServerBoundHandshake(hs.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		forwarding, ok := hs.BungeeCordForwarding()
+		if !ok {
+			t.Errorf("got: no forwarding in %q", hs.ServerAddress)
+			continue
+		}
+
+		if forwarding != tc.expected {
+			t.Errorf("got: %v; want: %v", forwarding, tc.expected)
+		}
+
+		if hs.ParseServerAddress() != tc.expected.ServerAddress {
+			t.Errorf("got: %v; want: %v", hs.ParseServerAddress(), tc.expected.ServerAddress)
+		}
+	}
+}
+
+func TestServerBoundHandshake_BungeeCordForwarding(t *testing.T) {
+	tt := []struct {
+		addr     string
+		ok       bool
+		expected BungeeCordForwarding
+	}{
+		{
+			addr: "example.com",
+			ok:   false,
+		},
+		{
+			addr: "example.com\x00FML\x00",
+			ok:   false,
+		},
+		{
+			addr: "example.com\x00127.0.0.1\x00b50ad385829d3141a2167e7d7539ba7f\x00[]",
+			ok:   true,
+			expected: BungeeCordForwarding{
+				ServerAddress: "example.com",
+				ClientIP:      "127.0.0.1",
+				UUID:          "b50ad385829d3141a2167e7d7539ba7f",
+				Properties:    "[]",
+			},
+		},
+		{
+			addr: "example.com\x00127.0.0.1\x00b50ad385829d3141a2167e7d7539ba7f\x00FML2\x00",
+			ok:   true,
+			expected: BungeeCordForwarding{
+				ServerAddress: "example.com",
+				ClientIP:      "127.0.0.1",
+				UUID:          "b50ad385829d3141a2167e7d7539ba7f",
+			},
+		},
+		{
+			addr: "example.com\x00127.0.0.1\x00b50ad385829d3141a2167e7d7539ba7f\x00[]\x00FML2\x00",
+			ok:   true,
+			expected: BungeeCordForwarding{
+				ServerAddress: "example.com",
+				ClientIP:      "127.0.0.1",
+				UUID:          "b50ad385829d3141a2167e7d7539ba7f",
+				Properties:    "[]",
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		hs := ServerBoundHandshake{ServerAddress: protocol.String(tc.addr)}
+		forwarding, ok := hs.BungeeCordForwarding()
+		if ok != tc.ok {
+			t.Errorf("%q got: %v; want: %v", tc.addr, ok, tc.ok)
+			continue
+		}
+
+		if forwarding != tc.expected {
+			t.Errorf("got: %v; want: %v", forwarding, tc.expected)
+		}
+	}
+}
+
+func TestServerBoundHandshake_UpgradeToBungeeCord_PreservesFields(t *testing.T) {
+	hs := ServerBoundHandshake{
+		ProtocolVersion: 754,
+		ServerAddress:   "example.com",
+		ServerPort:      25565,
+		NextState:       ServerBoundHandshakeLoginState,
+	}
+
+	clientAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+	upgraded := hs
+	upgraded.UpgradeToBungeeCord(clientAddr, "b50ad385829d3141a2167e7d7539ba7f")
+
+	upgraded, err := UnmarshalServerBoundHandshake(upgraded.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upgraded.ProtocolVersion != hs.ProtocolVersion {
+		t.Errorf("got: %v; want: %v", upgraded.ProtocolVersion, hs.ProtocolVersion)
+	}
+
+	if upgraded.ServerPort != hs.ServerPort {
+		t.Errorf("got: %v; want: %v", upgraded.ServerPort, hs.ServerPort)
+	}
+
+	if upgraded.NextState != hs.NextState {
+		t.Errorf("got: %v; want: %v", upgraded.NextState, hs.NextState)
+	}
+
+	expectedAddr := "example.com\x00127.0.0.1\x00b50ad385829d3141a2167e7d7539ba7f"
+	if string(upgraded.ServerAddress) != expectedAddr {
+		t.Errorf("got: %q; want: %q", upgraded.ServerAddress, expectedAddr)
+	}
+
+	// Upgrading twice must not nest the forwarding data
+	upgraded.UpgradeToBungeeCord(clientAddr, "b50ad385829d3141a2167e7d7539ba7f")
+	if string(upgraded.ServerAddress) != expectedAddr {
+		t.Errorf("got: %q; want: %q", upgraded.ServerAddress, expectedAddr)
+	}
+}
+
+func TestServerBoundHandshake_RewriteServerAddress(t *testing.T) {
+	tt := []struct {
+		name     string
+		addr     string
+		expected string
+	}{
+		{
+			name:     "Host",
+			addr:     "public.example.com",
+			expected: "internal.backend.local",
+		},
+		{
+			name:     "Forge",
+			addr:     "public.example.com\x00FML\x00",
+			expected: "internal.backend.local\x00FML\x00",
+		},
+		{
+			name:     "RealIP",
+			addr:     "public.example.com///127.0.0.1:12345///1617000000",
+			expected: "internal.backend.local///127.0.0.1:12345///1617000000",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			hs := ServerBoundHandshake{
+				ProtocolVersion: 754,
+				ServerAddress:   protocol.String(tc.addr),
+				ServerPort:      25565,
+				NextState:       ServerBoundHandshakeLoginState,
+			}
+			hs.RewriteServerAddress("internal.backend.local")
+
+			rewritten, err := UnmarshalServerBoundHandshake(hs.Marshal())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(rewritten.ServerAddress) != tc.expected {
+				t.Errorf("got: %q; want: %q", rewritten.ServerAddress, tc.expected)
+			}
+			if rewritten.ProtocolVersion != 754 {
+				t.Errorf("got: %v; want: %v", rewritten.ProtocolVersion, 754)
+			}
+			if rewritten.NextState != ServerBoundHandshakeLoginState {
+				t.Errorf("got: %v; want: %v", rewritten.NextState, ServerBoundHandshakeLoginState)
+			}
+		})
+	}
+}
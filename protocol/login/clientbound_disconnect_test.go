@@ -43,3 +43,40 @@ func TestClientBoundDisconnect_Marshal(t *testing.T) {
 		}
 	}
 }
+
+func TestUnmarshalClientBoundDisconnect(t *testing.T) {
+	tt := []struct {
+		packet         protocol.Packet
+		unmarshalledPk ClientBoundDisconnect
+	}{
+		{
+			packet: protocol.Packet{
+				ID:   0x00,
+				Data: []byte{0x00},
+			},
+			unmarshalledPk: ClientBoundDisconnect{
+				Reason: protocol.Chat(""),
+			},
+		},
+		{
+			packet: protocol.Packet{
+				ID:   0x00,
+				Data: []byte{0x0d, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x2c, 0x20, 0x57, 0x6f, 0x72, 0x6c, 0x64, 0x21},
+			},
+			unmarshalledPk: ClientBoundDisconnect{
+				Reason: protocol.Chat("Hello, World!"),
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		pk, err := UnmarshalClientBoundDisconnect(tc.packet)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if pk.Reason != tc.unmarshalledPk.Reason {
+			t.Errorf("got: %v, want: %v", pk.Reason, tc.unmarshalledPk.Reason)
+		}
+	}
+}
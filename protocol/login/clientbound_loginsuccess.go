@@ -0,0 +1,4 @@
+package login
+
+// ClientBoundLoginSuccessPacketID is the ID of the packet that ends the login state
+const ClientBoundLoginSuccessPacketID byte = 0x02
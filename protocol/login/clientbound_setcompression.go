@@ -0,0 +1,35 @@
+package login
+
+import (
+	"github.com/haveachin/infrared/protocol"
+)
+
+const ClientBoundSetCompressionPacketID byte = 0x03
+
+// ClientBoundSetCompression is sent by the server before the login success.
+// All following packets of both sides that are at least Threshold bytes long are compressed.
+// A negative Threshold disables compression.
+type ClientBoundSetCompression struct {
+	Threshold protocol.VarInt
+}
+
+func (pk ClientBoundSetCompression) Marshal() protocol.Packet {
+	return protocol.MarshalPacket(
+		ClientBoundSetCompressionPacketID,
+		pk.Threshold,
+	)
+}
+
+func UnmarshalClientBoundSetCompression(packet protocol.Packet) (ClientBoundSetCompression, error) {
+	var pk ClientBoundSetCompression
+
+	if packet.ID != ClientBoundSetCompressionPacketID {
+		return pk, protocol.ErrInvalidPacketID
+	}
+
+	if err := packet.Scan(&pk.Threshold); err != nil {
+		return pk, err
+	}
+
+	return pk, nil
+}
@@ -0,0 +1,82 @@
+package login
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/haveachin/infrared/protocol"
+)
+
+func TestClientBoundSetCompression_Marshal(t *testing.T) {
+	tt := []struct {
+		packet          ClientBoundSetCompression
+		marshaledPacket protocol.Packet
+	}{
+		{
+			packet: ClientBoundSetCompression{
+				Threshold: 256,
+			},
+			marshaledPacket: protocol.Packet{
+				ID:   0x03,
+				Data: []byte{0x80, 0x02},
+			},
+		},
+		{
+			packet: ClientBoundSetCompression{
+				Threshold: -1,
+			},
+			marshaledPacket: protocol.Packet{
+				ID:   0x03,
+				Data: []byte{0xff, 0xff, 0xff, 0xff, 0x0f},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		pk := tc.packet.Marshal()
+
+		if pk.ID != ClientBoundSetCompressionPacketID {
+			t.Error("invalid packet id")
+		}
+
+		if !bytes.Equal(pk.Data, tc.marshaledPacket.Data) {
+			t.Errorf("got: %v, want: %v", pk.Data, tc.marshaledPacket.Data)
+		}
+	}
+}
+
+func TestUnmarshalClientBoundSetCompression(t *testing.T) {
+	tt := []struct {
+		packet         protocol.Packet
+		unmarshalledPk ClientBoundSetCompression
+		err            error
+	}{
+		{
+			packet: protocol.Packet{
+				ID:   0x03,
+				Data: []byte{0x80, 0x02},
+			},
+			unmarshalledPk: ClientBoundSetCompression{
+				Threshold: 256,
+			},
+		},
+		{
+			packet: protocol.Packet{
+				ID:   0x00,
+				Data: []byte{0x80, 0x02},
+			},
+			err: protocol.ErrInvalidPacketID,
+		},
+	}
+
+	for _, tc := range tt {
+		pk, err := UnmarshalClientBoundSetCompression(tc.packet)
+		if err != tc.err {
+			t.Errorf("got: %v, want: %v", err, tc.err)
+		}
+
+		if pk.Threshold != tc.unmarshalledPk.Threshold {
+			t.Errorf("got: %v, want: %v", pk.Threshold, tc.unmarshalledPk.Threshold)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package login
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+
 	"github.com/haveachin/infrared/protocol"
 )
 
@@ -10,6 +13,23 @@ type ServerLoginStart struct {
 	Name protocol.String
 }
 
+func (pk ServerLoginStart) Marshal() protocol.Packet {
+	return protocol.MarshalPacket(
+		ServerBoundLoginStartPacketID,
+		pk.Name,
+	)
+}
+
+// OfflineUUID returns the UUID an offline mode server assigns to the player
+// as 32 hex digits without dashes
+func (pk ServerLoginStart) OfflineUUID() string {
+	hash := md5.Sum([]byte("OfflinePlayer:" + string(pk.Name)))
+	// Set the version to 3 (name based, MD5) and the variant to RFC 4122
+	hash[6] = hash[6]&0x0f | 0x30
+	hash[8] = hash[8]&0x3f | 0x80
+	return hex.EncodeToString(hash[:])
+}
+
 func UnmarshalServerBoundLoginStart(packet protocol.Packet) (ServerLoginStart, error) {
 	var pk ServerLoginStart
 
@@ -1,10 +1,49 @@
 package login
 
 import (
+	"bytes"
 	"github.com/haveachin/infrared/protocol"
 	"testing"
 )
 
+func TestServerLoginStart_Marshal(t *testing.T) {
+	tt := []struct {
+		packet          ServerLoginStart
+		marshaledPacket protocol.Packet
+	}{
+		{
+			packet: ServerLoginStart{
+				Name: protocol.String(""),
+			},
+			marshaledPacket: protocol.Packet{
+				ID:   0x00,
+				Data: []byte{0x00},
+			},
+		},
+		{
+			packet: ServerLoginStart{
+				Name: protocol.String("Hello, World!"),
+			},
+			marshaledPacket: protocol.Packet{
+				ID:   0x00,
+				Data: []byte{0x0d, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x2c, 0x20, 0x57, 0x6f, 0x72, 0x6c, 0x64, 0x21},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		pk := tc.packet.Marshal()
+
+		if pk.ID != ServerBoundLoginStartPacketID {
+			t.Error("invalid packet id")
+		}
+
+		if !bytes.Equal(pk.Data, tc.marshaledPacket.Data) {
+			t.Errorf("got: %v, want: %v", pk.Data, tc.marshaledPacket.Data)
+		}
+	}
+}
+
 func TestUnmarshalServerBoundLoginStart(t *testing.T) {
 	tt := []struct {
 		packet             protocol.Packet
@@ -41,3 +80,26 @@ func TestUnmarshalServerBoundLoginStart(t *testing.T) {
 		}
 	}
 }
+
+func TestServerLoginStart_OfflineUUID(t *testing.T) {
+	tt := []struct {
+		name string
+		uuid string
+	}{
+		{
+			name: "Notch",
+			uuid: "b50ad385829d3141a2167e7d7539ba7f",
+		},
+		{
+			name: "Steve",
+			uuid: "5627dd98e6be3c21b8a8e92344183641",
+		},
+	}
+
+	for _, tc := range tt {
+		pk := ServerLoginStart{Name: protocol.String(tc.name)}
+		if uuid := pk.OfflineUUID(); uuid != tc.uuid {
+			t.Errorf("got: %v; want: %v", uuid, tc.uuid)
+		}
+	}
+}
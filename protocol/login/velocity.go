@@ -0,0 +1,128 @@
+package login
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/haveachin/infrared/protocol"
+)
+
+const (
+	// VelocityForwardingChannel is the channel of the login plugin request
+	// that servers send to ask for Velocity modern forwarding data
+	VelocityForwardingChannel = "velocity:player_info"
+	// VelocityForwardingVersion is the version of the modern forwarding data
+	// that every server with Velocity support understands
+	VelocityForwardingVersion = 1
+)
+
+var ErrInvalidVelocitySignature = errors.New("invalid velocity forwarding signature")
+
+// VelocityForwarding is the player data of Velocity's modern forwarding
+type VelocityForwarding struct {
+	ClientIP   protocol.String
+	UUID       protocol.UUID
+	Name       protocol.String
+	Properties []ProfileProperty
+}
+
+// ProfileProperty is a property of a game profile like the skin textures.
+// The signature is only sent if it is not empty.
+type ProfileProperty struct {
+	Name      protocol.String
+	Value     protocol.String
+	Signature protocol.String
+}
+
+func (p ProfileProperty) encode() []byte {
+	var data []byte
+	data = append(data, p.Name.Encode()...)
+	data = append(data, p.Value.Encode()...)
+	hasSignature := protocol.Boolean(p.Signature != "")
+	data = append(data, hasSignature.Encode()...)
+	if hasSignature {
+		data = append(data, p.Signature.Encode()...)
+	}
+	return data
+}
+
+func (p *ProfileProperty) decode(r protocol.DecodeReader) error {
+	var hasSignature protocol.Boolean
+	if err := protocol.ScanFields(r, &p.Name, &p.Value, &hasSignature); err != nil {
+		return err
+	}
+
+	if hasSignature {
+		return p.Signature.Decode(r)
+	}
+	return nil
+}
+
+// Marshal encodes the forwarding data and signs it with the secret
+// that is shared with the server
+func (f VelocityForwarding) Marshal(secret []byte) []byte {
+	var data []byte
+	data = append(data, protocol.VarInt(VelocityForwardingVersion).Encode()...)
+	data = append(data, f.ClientIP.Encode()...)
+	data = append(data, f.UUID.Encode()...)
+	data = append(data, f.Name.Encode()...)
+	data = append(data, protocol.VarInt(len(f.Properties)).Encode()...)
+	for _, property := range f.Properties {
+		data = append(data, property.encode()...)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return append(mac.Sum(nil), data...)
+}
+
+// UnmarshalVelocityForwarding verifies the signature of the forwarding data
+// with the shared secret and decodes it
+func UnmarshalVelocityForwarding(data, secret []byte) (VelocityForwarding, error) {
+	var f VelocityForwarding
+
+	if len(data) < sha256.Size {
+		return f, ErrInvalidVelocitySignature
+	}
+
+	signature, data := data[:sha256.Size], data[sha256.Size:]
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return f, ErrInvalidVelocitySignature
+	}
+
+	r := bytes.NewReader(data)
+	var version protocol.VarInt
+	var propertyCount protocol.VarInt
+	if err := protocol.ScanFields(
+		r,
+		&version,
+		&f.ClientIP,
+		&f.UUID,
+		&f.Name,
+		&propertyCount,
+	); err != nil {
+		return f, err
+	}
+
+	if version != VelocityForwardingVersion {
+		return f, errors.New("unsupported velocity forwarding version")
+	}
+
+	if propertyCount < 0 || int(propertyCount) > r.Len() {
+		return f, errors.New("invalid velocity forwarding property count")
+	}
+
+	for i := 0; i < int(propertyCount); i++ {
+		var property ProfileProperty
+		if err := property.decode(r); err != nil {
+			return f, err
+		}
+		f.Properties = append(f.Properties, property)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,143 @@
+package login
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/haveachin/infrared/protocol"
+)
+
+func TestVelocityForwarding_Marshal(t *testing.T) {
+	forwarding := VelocityForwarding{
+		ClientIP: protocol.String("127.0.0.1"),
+		UUID:     protocol.UUID(uuid.Must(uuid.FromString("b50ad385829d3141a2167e7d7539ba7f"))),
+		Name:     protocol.String("Notch"),
+	}
+
+	tt := []struct {
+		name          string
+		signSecret    string
+		verifySecret  string
+		expectedError error
+	}{
+		{
+			name:         "ValidSignature",
+			signSecret:   "secret",
+			verifySecret: "secret",
+		},
+		{
+			name:          "InvalidSignature",
+			signSecret:    "secret",
+			verifySecret:  "other secret",
+			expectedError: ErrInvalidVelocitySignature,
+		},
+	}
+
+	for _, tc := range tt {
+		data := forwarding.Marshal([]byte(tc.signSecret))
+
+		got, err := UnmarshalVelocityForwarding(data, []byte(tc.verifySecret))
+		if err != tc.expectedError {
+			t.Errorf("%s: got: %v; want: %v", tc.name, err, tc.expectedError)
+			continue
+		}
+
+		if err == nil && !reflect.DeepEqual(got, forwarding) {
+			t.Errorf("%s: got: %v; want: %v", tc.name, got, forwarding)
+		}
+	}
+}
+
+func TestVelocityForwarding_MarshalSignature(t *testing.T) {
+	uid := protocol.UUID(uuid.Must(uuid.FromString("b50ad385829d3141a2167e7d7539ba7f")))
+
+	tt := []struct {
+		name       string
+		forwarding VelocityForwarding
+		signature  string
+	}{
+		{
+			name: "NoProperties",
+			forwarding: VelocityForwarding{
+				ClientIP: "127.0.0.1",
+				UUID:     uid,
+				Name:     "Notch",
+			},
+			signature: "a6a50456f3ed2a56250d62d69684f91be3cfe973893ff3593081c0a32b2279ec",
+		},
+		{
+			name: "SignedProperty",
+			forwarding: VelocityForwarding{
+				ClientIP: "127.0.0.1",
+				UUID:     uid,
+				Name:     "Notch",
+				Properties: []ProfileProperty{
+					{Name: "textures", Value: "value", Signature: "sig"},
+				},
+			},
+			signature: "ead06341c9a83d3cb722bfc4c215873131306974f6a7808b457b071fdd0decf3",
+		},
+	}
+
+	for _, tc := range tt {
+		data := tc.forwarding.Marshal([]byte("secret"))
+
+		expected, err := hex.DecodeString(tc.signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := data[:len(expected)]; !bytes.Equal(got, expected) {
+			t.Errorf("%s: got: %x; want: %x", tc.name, got, expected)
+		}
+
+		got, err := UnmarshalVelocityForwarding(data, []byte("secret"))
+		if err != nil {
+			t.Errorf("%s: got error: %v", tc.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tc.forwarding) {
+			t.Errorf("%s: got: %v; want: %v", tc.name, got, tc.forwarding)
+		}
+	}
+}
+
+func TestLoginPluginRequestResponse(t *testing.T) {
+	request := ClientBoundLoginPluginRequest{
+		MessageID: 42,
+		Channel:   VelocityForwardingChannel,
+		Data:      protocol.OptionalByteArray{VelocityForwardingVersion},
+	}
+
+	gotRequest, err := UnmarshalClientBoundLoginPluginRequest(request.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotRequest.MessageID != request.MessageID || gotRequest.Channel != request.Channel || string(gotRequest.Data) != string(request.Data) {
+		t.Errorf("got: %v; want: %v", gotRequest, request)
+	}
+
+	response := ServerBoundLoginPluginResponse{
+		MessageID:  42,
+		Successful: true,
+		Data:       protocol.OptionalByteArray("data"),
+	}
+
+	gotResponse, err := UnmarshalServerBoundLoginPluginResponse(response.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotResponse.MessageID != response.MessageID || gotResponse.Successful != response.Successful || string(gotResponse.Data) != string(response.Data) {
+		t.Errorf("got: %v; want: %v", gotResponse, response)
+	}
+
+	if _, err := UnmarshalClientBoundLoginPluginRequest(response.Marshal()); err != protocol.ErrInvalidPacketID {
+		t.Errorf("got: %v; want: %v", err, protocol.ErrInvalidPacketID)
+	}
+}
@@ -6,6 +6,10 @@ import (
 	"io"
 )
 
+// MaxPacketLength is the largest packet length the protocol allows.
+// It is the largest number that fits into a VarInt of three bytes.
+const MaxPacketLength = 1<<21 - 1
+
 // Packet is the raw representation of message that is send between the client and the server
 type Packet struct {
 	ID   byte
@@ -52,21 +56,66 @@ func MarshalPacket(ID byte, fields ...FieldEncoder) Packet {
 
 // ReadPacketBytes decodes a byte stream and cuts the first Packet as a byte array out
 func ReadPacketBytes(r DecodeReader) ([]byte, error) {
+	id, dataLength, err := readPacketHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 1+dataLength)
+	data[0] = id
+	if err := readPacketData(r, data[1:]); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// readPacketHeader reads the length and the ID of the next packet of r
+// and returns the ID and the length of the data that follows it
+func readPacketHeader(r DecodeReader) (byte, int, error) {
+	packetLength, err := readPacketLength(r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	id, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading the content of the packet failed: %w", err)
+	}
+
+	return id, packetLength - 1, nil
+}
+
+// readPacketData reads the data of the packet whose header was just read into data
+func readPacketData(r DecodeReader, data []byte) error {
+	if _, err := io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("reading the content of the packet failed: %w", err)
+	}
+	return nil
+}
+
+// readPacketLength decodes the length of a packet and checks it against
+// the MaxPacketLength before anything is allocated for the packet
+func readPacketLength(r DecodeReader) (int, error) {
 	var packetLength VarInt
 	if err := packetLength.Decode(r); err != nil {
-		return nil, err
+		return 0, err
 	}
 
 	if packetLength < 1 {
-		return nil, fmt.Errorf("packet length too short")
+		return 0, fmt.Errorf("packet length too short")
 	}
 
-	data := make([]byte, packetLength)
-	if _, err := io.ReadFull(r, data); err != nil {
-		return nil, fmt.Errorf("reading the content of the packet failed: %v", err)
+	if packetLength > MaxPacketLength {
+		return 0, fmt.Errorf("%w: length of %d bytes exceeds the maximum of %d", ErrPacketTooLong, packetLength, MaxPacketLength)
 	}
 
-	return data, nil
+	return int(packetLength), nil
+}
+
+// PeekPacketLength decodes the length of the next packet without consuming anything
+func PeekPacketLength(p PeekReader) (int, error) {
+	return readPacketLength(&bytePeeker{PeekReader: p})
 }
 
 // ReadPacket decodes and decompresses a byte stream and cuts the first Packet out
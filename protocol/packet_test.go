@@ -3,6 +3,9 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"math"
+	"runtime"
 	"testing"
 )
 
@@ -235,3 +238,78 @@ func TestPeekPacket(t *testing.T) {
 		}
 	}
 }
+
+func TestReadPacketBytes_MaxPacketLength(t *testing.T) {
+	tt := []struct {
+		name   string
+		length int
+		ok     bool
+	}{
+		{
+			name:   "Maximum",
+			length: MaxPacketLength,
+			ok:     true,
+		},
+		{
+			name:   "TooLong",
+			length: MaxPacketLength + 1,
+		},
+		{
+			name:   "Huge",
+			length: math.MaxInt32,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			data := VarInt(int32(tc.length)).Encode()
+			if tc.ok {
+				data = append(data, make([]byte, tc.length)...)
+			}
+
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			bb, err := ReadPacketBytes(bytes.NewReader(data))
+			runtime.ReadMemStats(&after)
+
+			if tc.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(bb) != tc.length {
+					t.Errorf("got: %d; want: %d", len(bb), tc.length)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrPacketTooLong) {
+				t.Errorf("got: %v; want: %v", err, ErrPacketTooLong)
+			}
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > MaxPacketLength {
+				t.Errorf("got: %d allocated bytes; want: less than %d", allocated, MaxPacketLength)
+			}
+		})
+	}
+}
+
+func TestPeekPacketLength(t *testing.T) {
+	data := []byte{0x03, 0x00, 0x00, 0xf2}
+	r := bufio.NewReader(bytes.NewReader(data))
+
+	length, err := PeekPacketLength(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != 3 {
+		t.Errorf("got: %d; want: %d", length, 3)
+	}
+
+	// Nothing was consumed
+	pk, err := ReadPacket(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pk.Data, []byte{0x00, 0xf2}) {
+		t.Errorf("got: %v; want: %v", pk.Data, []byte{0x00, 0xf2})
+	}
+}
@@ -1,6 +1,9 @@
 package protocol
 
-import "io"
+import (
+	"bufio"
+	"io"
+)
 
 type PeekReader interface {
 	Peek(n int) ([]byte, error)
@@ -38,3 +41,38 @@ func (peeker *bytePeeker) ReadByte() (byte, error) {
 
 	return b, nil
 }
+
+// peekVarInt decodes the VarInt at the cursor in one batch
+// if the PeekReader is a bufio.Reader that has it fully buffered
+func (peeker *bytePeeker) peekVarInt() (VarInt, bool) {
+	r, ok := peeker.PeekReader.(*bufio.Reader)
+	if !ok {
+		return 0, false
+	}
+
+	n := r.Buffered()
+	if n > peeker.cursor+8 {
+		n = peeker.cursor + 8
+	}
+	if n <= peeker.cursor {
+		return 0, false
+	}
+	bb, err := r.Peek(n)
+	if err != nil {
+		return 0, false
+	}
+	bb = bb[peeker.cursor:]
+
+	// Single byte VarInts, like the length of most packets, need no decoding
+	if bb[0] < 0x80 {
+		peeker.cursor++
+		return VarInt(bb[0]), true
+	}
+
+	value, length, ok := decodeVarInt(bb)
+	if !ok {
+		return 0, false
+	}
+	peeker.cursor += length
+	return value, true
+}
@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"sync"
+)
+
+// maxPooledDataLength is the largest data buffer a PacketPool keeps.
+// Larger buffers are left to the garbage collector so that a few big packets
+// don't pin their memory in the pool.
+const maxPooledDataLength = 1 << 16
+
+// PacketPool reuses packets and their data buffers across reads to take load off
+// the garbage collector when many connections read packets at once.
+// The zero value is ready to use. A PacketPool is safe for concurrent use.
+type PacketPool struct {
+	pool sync.Pool
+}
+
+// Get returns an empty packet from the pool or a new one if the pool is empty
+func (p *PacketPool) Get() *Packet {
+	if pk, ok := p.pool.Get().(*Packet); ok {
+		return pk
+	}
+	return &Packet{}
+}
+
+// Put zeroes pk and returns it to the pool. The capacity of its data buffer is kept
+// for the next packet, so pk and its data must not be used after Put.
+func (p *PacketPool) Put(pk *Packet) {
+	if pk == nil {
+		return
+	}
+
+	pk.ID = 0
+	if cap(pk.Data) > maxPooledDataLength {
+		pk.Data = nil
+	} else {
+		pk.Data = pk.Data[:0]
+	}
+	p.pool.Put(pk)
+}
+
+// ReadPacket works like ReadPacket but reads into a packet from the pool.
+// The caller owns the returned packet and should Put it back once it is done with it.
+func (p *PacketPool) ReadPacket(r DecodeReader) (*Packet, error) {
+	id, dataLength, err := readPacketHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	pk := p.Get()
+	pk.ID = id
+	if cap(pk.Data) < dataLength {
+		pk.Data = make([]byte, dataLength)
+	}
+	pk.Data = pk.Data[:dataLength]
+	if err := readPacketData(r, pk.Data); err != nil {
+		p.Put(pk)
+		return nil, err
+	}
+
+	return pk, nil
+}
@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestPacketPool_ReadPacket(t *testing.T) {
+	tt := []struct {
+		name          string
+		data          []byte
+		packet        Packet
+		dataAfterRead []byte
+	}{
+		{
+			name: "WithData",
+			data: []byte{0x03, 0x00, 0x00, 0xf2, 0x05, 0x0f, 0x00, 0xf2, 0x03, 0x50},
+			packet: Packet{
+				ID:   0x00,
+				Data: []byte{0x00, 0xf2},
+			},
+			dataAfterRead: []byte{0x05, 0x0f, 0x00, 0xf2, 0x03, 0x50},
+		},
+		{
+			name: "WithoutData",
+			data: []byte{0x01, 0x0f, 0x30, 0x01},
+			packet: Packet{
+				ID:   0x0f,
+				Data: []byte{},
+			},
+			dataAfterRead: []byte{0x30, 0x01},
+		},
+	}
+
+	pool := &PacketPool{}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(tc.data)
+			pk, err := pool.ReadPacket(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pool.Put(pk)
+
+			if pk.ID != tc.packet.ID {
+				t.Errorf("packet ID: got: %v; want: %v", pk.ID, tc.packet.ID)
+			}
+
+			if !bytes.Equal(pk.Data, tc.packet.Data) {
+				t.Errorf("packet data: got: %v; want: %v", pk.Data, tc.packet.Data)
+			}
+
+			if !bytes.Equal(buf.Bytes(), tc.dataAfterRead) {
+				t.Errorf("data after read: got: %v; want: %v", buf.Bytes(), tc.dataAfterRead)
+			}
+		})
+	}
+}
+
+func TestPacketPool_ReadPacketTruncated(t *testing.T) {
+	tt := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "Length",
+			data: []byte{0x80},
+		},
+		{
+			name: "ID",
+			data: []byte{0x03},
+		},
+		{
+			name: "Data",
+			data: []byte{0x03, 0x00, 0x00},
+		},
+	}
+
+	pool := &PacketPool{}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			pk, err := pool.ReadPacket(bytes.NewReader(tc.data))
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("got: %v; want: %v", err, io.ErrUnexpectedEOF)
+			}
+			if pk != nil {
+				t.Errorf("got: %v; want: nil", pk)
+			}
+		})
+	}
+}
+
+func TestPacketPool_Put(t *testing.T) {
+	tt := []struct {
+		name        string
+		data        []byte
+		expectedCap int
+	}{
+		{
+			name:        "KeepsData",
+			data:        make([]byte, 16),
+			expectedCap: 16,
+		},
+		{
+			name:        "DropsLargeData",
+			data:        make([]byte, maxPooledDataLength+1),
+			expectedCap: 0,
+		},
+	}
+
+	pool := &PacketPool{}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			pk := &Packet{ID: 0x0f, Data: tc.data}
+			pool.Put(pk)
+
+			if pk.ID != 0 {
+				t.Errorf("got: %v; want: %v", pk.ID, 0)
+			}
+			if len(pk.Data) != 0 {
+				t.Errorf("got: %v; want: %v", len(pk.Data), 0)
+			}
+			if cap(pk.Data) != tc.expectedCap {
+				t.Errorf("got: %v; want: %v", cap(pk.Data), tc.expectedCap)
+			}
+		})
+	}
+}
+
+// BenchmarkReadPacket compares the allocations of reading packets with and without a PacketPool.
+// Run it with -benchtime=1000000x for one million reads.
+func BenchmarkReadPacket(b *testing.B) {
+	pk := Packet{ID: 0x00, Data: make([]byte, 256)}
+	bb, err := pk.Marshal()
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := bytes.NewReader(bb)
+
+	b.Run("WithoutPool", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(bb)
+			if _, err := ReadPacket(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("WithPool", func(b *testing.B) {
+		pool := &PacketPool{}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(bb)
+			pk, err := pool.ReadPacket(r)
+			if err != nil {
+				b.Fatal(err)
+			}
+			pool.Put(pk)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package status
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/haveachin/infrared/protocol"
+)
+
+const (
+	// LegacyServerListPingID is the first byte of the server list ping of clients older than 1.7
+	LegacyServerListPingID byte = 0xFE
+	// LegacyResponseID is the first byte of the response to a legacy server list ping
+	LegacyResponseID byte = 0xFF
+
+	legacyPingPayload       byte = 0x01
+	legacyPluginMessageID   byte = 0xFA
+	legacyPingHostChannel        = "MC|PingHost"
+	legacyResponseSeparator      = "\x00"
+)
+
+// LegacyServerListPing is the server list ping of clients from 1.4 to 1.6.
+// Only 1.6 clients send the protocol version and the address they connect to.
+type LegacyServerListPing struct {
+	ProtocolVersion byte
+	ServerAddress   string
+	ServerPort      int
+}
+
+// ReadLegacyServerListPing reads a legacy server list ping from r.
+// The optional parts of the ping are only read if they are already buffered
+// since older clients wait for the response after sending the first bytes.
+func ReadLegacyServerListPing(r *bufio.Reader) (LegacyServerListPing, error) {
+	var ping LegacyServerListPing
+
+	id, err := r.ReadByte()
+	if err != nil {
+		return ping, err
+	}
+	if id != LegacyServerListPingID {
+		return ping, protocol.ErrInvalidPacketID
+	}
+
+	if r.Buffered() == 0 {
+		return ping, nil
+	}
+	if payload, err := r.ReadByte(); err != nil || payload != legacyPingPayload {
+		return ping, errors.New("invalid legacy server list ping payload")
+	}
+
+	if r.Buffered() == 0 {
+		return ping, nil
+	}
+	if id, err := r.ReadByte(); err != nil || id != legacyPluginMessageID {
+		return ping, errors.New("invalid legacy server list ping plugin message")
+	}
+
+	channel, err := readLegacyString(r)
+	if err != nil {
+		return ping, err
+	}
+	if channel != legacyPingHostChannel {
+		return ping, fmt.Errorf("invalid legacy server list ping channel %q", channel)
+	}
+
+	var dataLength uint16
+	if err := binary.Read(r, binary.BigEndian, &dataLength); err != nil {
+		return ping, err
+	}
+
+	if ping.ProtocolVersion, err = r.ReadByte(); err != nil {
+		return ping, err
+	}
+
+	if ping.ServerAddress, err = readLegacyString(r); err != nil {
+		return ping, err
+	}
+
+	var port int32
+	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+		return ping, err
+	}
+	ping.ServerPort = int(port)
+
+	return ping, nil
+}
+
+// readLegacyString reads a string with a short length prefix in UTF-16BE
+func readLegacyString(r io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+
+	chars := make([]uint16, length)
+	if err := binary.Read(r, binary.BigEndian, chars); err != nil {
+		return "", err
+	}
+
+	return string(utf16.Decode(chars)), nil
+}
+
+// LegacyResponse is the response to a legacy server list ping
+type LegacyResponse struct {
+	ProtocolVersion int
+	VersionName     string
+	MOTD            string
+	PlayersOnline   int
+	MaxPlayers      int
+}
+
+// LegacyResponseFromJSON converts the JSON of a status response to a LegacyResponse
+func LegacyResponseFromJSON(jsonResponse string) (LegacyResponse, error) {
+	var res struct {
+		Version     VersionJSON     `json:"version"`
+		Players     PlayersJSON     `json:"players"`
+		Description json.RawMessage `json:"description"`
+	}
+	if err := json.Unmarshal([]byte(jsonResponse), &res); err != nil {
+		return LegacyResponse{}, err
+	}
+
+	// The description is either a plain string or a chat component
+	var motd string
+	if err := json.Unmarshal(res.Description, &motd); err != nil {
+		var description DescriptionJSON
+		if err := json.Unmarshal(res.Description, &description); err == nil {
+			motd = description.Text
+		}
+	}
+
+	return LegacyResponse{
+		ProtocolVersion: res.Version.Protocol,
+		VersionName:     res.Version.Name,
+		MOTD:            motd,
+		PlayersOnline:   res.Players.Online,
+		MaxPlayers:      res.Players.Max,
+	}, nil
+}
+
+// Marshal encodes the response in the format that clients from 1.4 to 1.6 expect
+func (res LegacyResponse) Marshal() []byte {
+	fields := []string{
+		"§1",
+		strconv.Itoa(res.ProtocolVersion),
+		res.VersionName,
+		res.MOTD,
+		strconv.Itoa(res.PlayersOnline),
+		strconv.Itoa(res.MaxPlayers),
+	}
+	for i, field := range fields {
+		fields[i] = strings.ReplaceAll(field, legacyResponseSeparator, "")
+	}
+
+	chars := utf16.Encode([]rune(strings.Join(fields, legacyResponseSeparator)))
+	b := make([]byte, 3, 3+len(chars)*2)
+	b[0] = LegacyResponseID
+	binary.BigEndian.PutUint16(b[1:3], uint16(len(chars)))
+	for _, c := range chars {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return b
+}
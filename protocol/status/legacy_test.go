@@ -0,0 +1,151 @@
+package status
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+func legacyString(s string) []byte {
+	chars := utf16.Encode([]rune(s))
+	b := make([]byte, 2, 2+len(chars)*2)
+	binary.BigEndian.PutUint16(b, uint16(len(chars)))
+	for _, c := range chars {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return b
+}
+
+// legacyPing1_6 returns the server list ping of a 1.6 client
+func legacyPing1_6(protocolVersion byte, host string, port int32) []byte {
+	hostBytes := legacyString(host)
+	data := []byte{protocolVersion}
+	data = append(data, hostBytes...)
+	data = append(data, byte(port>>24), byte(port>>16), byte(port>>8), byte(port))
+
+	b := []byte{0xFE, 0x01, 0xFA}
+	b = append(b, legacyString("MC|PingHost")...)
+	b = append(b, byte(len(data)>>8), byte(len(data)))
+	return append(b, data...)
+}
+
+func TestReadLegacyServerListPing(t *testing.T) {
+	tt := []struct {
+		name     string
+		data     []byte
+		expected LegacyServerListPing
+	}{
+		{
+			name:     "1.4",
+			data:     []byte{0xFE, 0x01},
+			expected: LegacyServerListPing{},
+		},
+		{
+			name: "1.6",
+			data: legacyPing1_6(78, "mc.example.com", 25565),
+			expected: LegacyServerListPing{
+				ProtocolVersion: 78,
+				ServerAddress:   "mc.example.com",
+				ServerPort:      25565,
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		r := bufio.NewReader(bytes.NewReader(tc.data))
+		// Fill the buffer like a single network read would
+		if _, err := r.Peek(len(tc.data)); err != nil {
+			t.Fatal(err)
+		}
+
+		ping, err := ReadLegacyServerListPing(r)
+		if err != nil {
+			t.Errorf("%s: got error: %v", tc.name, err)
+			continue
+		}
+
+		if ping != tc.expected {
+			t.Errorf("%s: got: %v; want: %v", tc.name, ping, tc.expected)
+		}
+	}
+}
+
+func TestReadLegacyServerListPing_Invalid(t *testing.T) {
+	tt := [][]byte{
+		{0x00},
+		{0xFE, 0x02},
+		{0xFE, 0x01, 0xFB},
+		legacyPing1_6(78, "mc.example.com", 25565)[:20],
+	}
+
+	for _, data := range tt {
+		r := bufio.NewReader(bytes.NewReader(data))
+		if _, err := r.Peek(len(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ReadLegacyServerListPing(r); err == nil {
+			t.Errorf("%v: got no error", data)
+		}
+	}
+}
+
+func TestLegacyResponse_Marshal(t *testing.T) {
+	res := LegacyResponse{
+		ProtocolVersion: 78,
+		VersionName:     "1.6.4",
+		MOTD:            "A Minecraft Server",
+		PlayersOnline:   3,
+		MaxPlayers:      20,
+	}
+
+	expected := []byte{0xFF, 0x00, 0x23}
+	for _, c := range utf16.Encode([]rune("§1\x0078\x001.6.4\x00A Minecraft Server\x003\x0020")) {
+		expected = append(expected, byte(c>>8), byte(c))
+	}
+
+	if got := res.Marshal(); !bytes.Equal(got, expected) {
+		t.Errorf("got: %v; want: %v", got, expected)
+	}
+}
+
+func TestLegacyResponseFromJSON(t *testing.T) {
+	tt := []struct {
+		json     string
+		expected LegacyResponse
+	}{
+		{
+			json: `{"version":{"name":"1.17","protocol":755},"players":{"max":20,"online":1},"description":{"text":"Powered by Infrared"}}`,
+			expected: LegacyResponse{
+				ProtocolVersion: 755,
+				VersionName:     "1.17",
+				MOTD:            "Powered by Infrared",
+				PlayersOnline:   1,
+				MaxPlayers:      20,
+			},
+		},
+		{
+			json: `{"version":{"name":"1.8","protocol":47},"players":{"max":10,"online":0},"description":"Plain MOTD"}`,
+			expected: LegacyResponse{
+				ProtocolVersion: 47,
+				VersionName:     "1.8",
+				MOTD:            "Plain MOTD",
+				MaxPlayers:      10,
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		res, err := LegacyResponseFromJSON(tc.json)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if res != tc.expected {
+			t.Errorf("got: %v; want: %v", res, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package status
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/haveachin/infrared/protocol"
+)
+
+func TestServerBoundPing_Marshal(t *testing.T) {
+	pk := ServerBoundPing{Payload: 0x0123456789ABCDEF}.Marshal()
+
+	if pk.ID != ServerBoundPingPacketID {
+		t.Errorf("got: %v; want: %v", pk.ID, ServerBoundPingPacketID)
+	}
+	expected := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF}
+	if !bytes.Equal(pk.Data, expected) {
+		t.Errorf("got: %v; want: %v", pk.Data, expected)
+	}
+}
+
+func TestUnmarshalServerBoundPing(t *testing.T) {
+	tt := []struct {
+		name            string
+		packet          protocol.Packet
+		expectedPayload protocol.Long
+		expectedErr     bool
+	}{
+		{
+			name:            "Ping",
+			packet:          protocol.Packet{ID: 0x01, Data: []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF}},
+			expectedPayload: 0x0123456789ABCDEF,
+		},
+		{
+			name:        "InvalidPacketID",
+			packet:      protocol.Packet{ID: 0x00, Data: []byte{0, 0, 0, 0, 0, 0, 0, 1}},
+			expectedErr: true,
+		},
+		{
+			name:        "Truncated",
+			packet:      protocol.Packet{ID: 0x01, Data: []byte{0x01, 0x23}},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			pk, err := UnmarshalServerBoundPing(tc.packet)
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("got: %v; want error: %v", err, tc.expectedErr)
+			}
+			if pk.Payload != tc.expectedPayload {
+				t.Errorf("got: %v; want: %v", pk.Payload, tc.expectedPayload)
+			}
+		})
+	}
+}
+
+func TestClientBoundPong_Marshal(t *testing.T) {
+	pk := ClientBoundPong{Payload: -1}.Marshal()
+
+	pong, err := UnmarshalClientBoundPong(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pong.Payload != -1 {
+		t.Errorf("got: %v; want: %v", pong.Payload, -1)
+	}
+}
@@ -2,9 +2,11 @@ package protocol
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"github.com/gofrs/uuid"
 	"io"
+	"math/bits"
 )
 
 // A Field is both FieldEncoder and FieldDecoder
@@ -59,15 +61,24 @@ type (
 	OptionalByteArray []byte
 )
 
-// ReadNBytes read N bytes from bytes.Reader
+// ReadNBytes read N bytes from bytes.Reader.
+// Clients choose n, so no more than MaxPacketLength bytes are allocated up front.
 func ReadNBytes(r DecodeReader, n int) ([]byte, error) {
-	bb := make([]byte, n)
-	var err error
+	if n < 0 {
+		return nil, ErrNegativeLength
+	}
+
+	size := n
+	if size > MaxPacketLength {
+		size = MaxPacketLength
+	}
+	bb := make([]byte, 0, size)
 	for i := 0; i < n; i++ {
-		bb[i], err = r.ReadByte()
+		b, err := r.ReadByte()
 		if err != nil {
 			return nil, err
 		}
+		bb = append(bb, b)
 	}
 	return bb, nil
 }
@@ -190,8 +201,47 @@ func (v VarInt) Encode() []byte {
 	return bb
 }
 
-// Decode a VarInt
+// Decode a VarInt. VarInts that are peeked from a bufio.Reader
+// and fully buffered are decoded in one batch.
 func (v *VarInt) Decode(r DecodeReader) error {
+	if peeker, ok := r.(*bytePeeker); ok {
+		if value, ok := peeker.peekVarInt(); ok {
+			*v = value
+			return nil
+		}
+	}
+
+	return v.decodeBytewise(r)
+}
+
+// decodeVarInt decodes the VarInt at the start of bb and returns it with its length.
+// It loads the bytes into one word and finds the last byte and the value with bit operations
+// instead of a loop over the bytes. It fails if the VarInt does not end within the first five bytes of bb;
+// decodeBytewise reports the errors in that case.
+func decodeVarInt(bb []byte) (VarInt, int, bool) {
+	var x uint64
+	if len(bb) >= 8 {
+		x = binary.LittleEndian.Uint64(bb)
+	} else {
+		for i := len(bb) - 1; i >= 0; i-- {
+			x = x<<8 | uint64(bb[i])
+		}
+	}
+
+	// The first byte without continuation bit is the last one; bytes after bb look like
+	// one, so the length has to be checked against bb
+	length := bits.TrailingZeros64(^x&0x8080808080)/8 + 1
+	if length > len(bb) {
+		return 0, 0, false
+	}
+
+	x &= 1<<(8*uint(length)) - 1
+	n := x&0x7f | x>>1&0x3f80 | x>>2&0x1fc000 | x>>3&0xfe00000 | x>>4&0xf0000000
+	return VarInt(uint32(n)), length, true
+}
+
+// decodeBytewise decodes a VarInt one byte at a time
+func (v *VarInt) decodeBytewise(r DecodeReader) error {
 	var n uint32
 	for i := 0; ; i++ {
 		sec, err := r.ReadByte()
@@ -223,6 +273,9 @@ func (b *ByteArray) Decode(r DecodeReader) error {
 	if err := length.Decode(r); err != nil {
 		return err
 	}
+	if length < 0 {
+		return ErrNegativeLength
+	}
 	*b = make([]byte, length)
 	_, err := r.Read(*b)
 	return err
@@ -1,10 +1,15 @@
 package protocol
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
 	"github.com/gofrs/uuid"
 	"io"
+	"math"
 	"testing"
+	"testing/iotest"
 )
 
 func TestReadNBytes(t *testing.T) {
@@ -25,6 +30,38 @@ func TestReadNBytes(t *testing.T) {
 	}
 }
 
+func TestReadNBytes_NegativeLength(t *testing.T) {
+	if _, err := ReadNBytes(bytes.NewBuffer([]byte{0x00}), -1); err != ErrNegativeLength {
+		t.Errorf("got: %v; want: %v", err, ErrNegativeLength)
+	}
+}
+
+func TestDecodeNegativeLength(t *testing.T) {
+	negativeLength := []byte{0xff, 0xff, 0xff, 0xff, 0x0f}
+
+	tt := []struct {
+		name  string
+		field FieldDecoder
+	}{
+		{
+			name:  "String",
+			field: new(String),
+		},
+		{
+			name:  "ByteArray",
+			field: new(ByteArray),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.field.Decode(bytes.NewReader(negativeLength)); err != ErrNegativeLength {
+				t.Errorf("got: %v; want: %v", err, ErrNegativeLength)
+			}
+		})
+	}
+}
+
 var booleanTestTable = []struct {
 	decoded Boolean
 	encoded []byte
@@ -127,6 +164,175 @@ func TestVarInt_Decode(t *testing.T) {
 	}
 }
 
+// varIntBoundaries returns the values around the limits of every VarInt length
+func varIntBoundaries() []uint32 {
+	values := []uint32{0, 1, math.MaxInt32, math.MaxInt32 + 1, math.MaxUint32}
+	for shift := uint(7); shift < 32; shift += 7 {
+		values = append(values, 1<<shift-1, 1<<shift, 1<<shift+1)
+	}
+	return values
+}
+
+func TestVarInt_DecodeRange(t *testing.T) {
+	values := varIntBoundaries()
+	// A prime stride walks the whole signed and unsigned range with varying low bits
+	for n := uint64(0); n <= math.MaxUint32; n += 4099 {
+		values = append(values, uint32(n))
+	}
+
+	for _, value := range values {
+		encoded := VarInt(value).Encode()
+
+		decoded, length, ok := decodeVarInt(encoded)
+		if !ok || decoded != VarInt(value) || length != len(encoded) {
+			t.Fatalf("got: %v, %v, %v; want: %v, %v, %v", decoded, length, ok, VarInt(value), len(encoded), true)
+		}
+
+		var bytewise VarInt
+		if err := bytewise.decodeBytewise(bytes.NewReader(encoded)); err != nil || bytewise != VarInt(value) {
+			t.Fatalf("got: %v, %v; want: %v, %v", bytewise, err, VarInt(value), nil)
+		}
+	}
+}
+
+func TestVarInt_DecodePeeked(t *testing.T) {
+	tt := []struct {
+		name string
+		data []byte
+		// oneByteReads makes the buffered reader see one byte at a time,
+		// so the VarInt is never fully buffered
+		oneByteReads   bool
+		expected       VarInt
+		expectedLength int
+		expectedErr    error
+	}{
+		{
+			name:           "OneByte",
+			data:           []byte{0x7f, 0x01},
+			expected:       127,
+			expectedLength: 1,
+		},
+		{
+			name:           "TwoBytes",
+			data:           []byte{0x80, 0x01, 0x01},
+			expected:       128,
+			expectedLength: 2,
+		},
+		{
+			name:           "FiveBytesMax",
+			data:           []byte{0xff, 0xff, 0xff, 0xff, 0x0f, 0x01},
+			expected:       -1,
+			expectedLength: 5,
+		},
+		{
+			name:           "FiveBytesMin",
+			data:           []byte{0x80, 0x80, 0x80, 0x80, 0x08},
+			expected:       math.MinInt32,
+			expectedLength: 5,
+		},
+		{
+			name:           "FifthByteHighBits",
+			data:           []byte{0xff, 0xff, 0xff, 0xff, 0x7f},
+			expected:       -1,
+			expectedLength: 5,
+		},
+		{
+			name:           "NotBuffered",
+			data:           []byte{0x80, 0x80, 0x80, 0x80, 0x08, 0x01},
+			oneByteReads:   true,
+			expected:       math.MinInt32,
+			expectedLength: 5,
+		},
+		{
+			name:        "TooBig",
+			data:        []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x00},
+			expectedErr: errors.New("VarInt is too big"),
+		},
+		{
+			name:        "Truncated",
+			data:        []byte{0x80, 0x80},
+			expectedErr: io.EOF,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(tc.data)
+			if tc.oneByteReads {
+				r = iotest.OneByteReader(r)
+			}
+			br := bufio.NewReader(r)
+			peeker := &bytePeeker{PeekReader: br}
+
+			var actual VarInt
+			err := actual.Decode(peeker)
+			if tc.expectedErr != nil {
+				if err == nil || err.Error() != tc.expectedErr.Error() {
+					t.Errorf("got: %v; want: %v", err, tc.expectedErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual != tc.expected {
+				t.Errorf("got: %v; want: %v", actual, tc.expected)
+			}
+			if peeker.cursor != tc.expectedLength {
+				t.Errorf("got: %v; want: %v", peeker.cursor, tc.expectedLength)
+			}
+
+			// Peeking consumes nothing
+			rest, err := io.ReadAll(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rest, tc.data) {
+				t.Errorf("got: %v; want: %v", rest, tc.data)
+			}
+		})
+	}
+}
+
+// BenchmarkVarInt_Decode compares decoding a peeked VarInt one byte at a time with decoding it in one batch
+func BenchmarkVarInt_Decode(b *testing.B) {
+	for _, value := range []VarInt{1, 300, 2097151, 268435455, -1} {
+		encoded := value.Encode()
+		r := bufio.NewReader(bytes.NewReader(encoded))
+		if _, err := r.Peek(len(encoded)); err != nil {
+			b.Fatal(err)
+		}
+
+		decoders := []struct {
+			name   string
+			decode func(v *VarInt, r DecodeReader) error
+		}{
+			{
+				name:   "Bytewise",
+				decode: (*VarInt).decodeBytewise,
+			},
+			{
+				name:   "Batched",
+				decode: (*VarInt).Decode,
+			},
+		}
+
+		for _, decoder := range decoders {
+			b.Run(fmt.Sprintf("%dBytes/%s", len(encoded), decoder.name), func(b *testing.B) {
+				peeker := &bytePeeker{PeekReader: r}
+				var v VarInt
+				for i := 0; i < b.N; i++ {
+					peeker.cursor = 0
+					if err := decoder.decode(&v, peeker); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
 var stringTestTable = []struct {
 	decoded String
 	encoded []byte
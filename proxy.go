@@ -1,28 +1,31 @@
 package infrared
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gofrs/uuid"
 	"github.com/haveachin/infrared/callback"
+	"github.com/haveachin/infrared/metrics"
 	"github.com/haveachin/infrared/process"
 	"github.com/haveachin/infrared/protocol"
 	"github.com/haveachin/infrared/protocol/handshaking"
 	"github.com/haveachin/infrared/protocol/login"
+	"github.com/haveachin/infrared/protocol/status"
 	"github.com/pires/go-proxyproto"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-)
-
-var (
-	playersConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "infrared_connected",
-		Help: "The total number of connected players",
-	}, []string{"host"})
 )
 
 func proxyUID(domain, addr string) string {
@@ -31,10 +34,22 @@ func proxyUID(domain, addr string) string {
 
 type Proxy struct {
 	Config *ProxyConfig
-
-	cancelTimeoutFunc func()
-	players           map[Conn]string
-	mu                sync.Mutex
+	// ServerDialer dials the servers of the proxy; the Dialer of the config if nil.
+	// Failover, retries and circuit breakers apply to every address it is asked to dial.
+	// Health checks always use the Dialer of the config.
+	ServerDialer ServerDialer
+	// Tap receives a copy of the data piped between the client and the server after the login if set
+	Tap Tap
+
+	cancelTimeoutFunc     func()
+	cancelHealthCheckFunc func()
+	players               map[Conn]string
+	serverPlayers         map[string]int
+	unhealthy             map[string]bool
+	circuitBreakers       map[string]*CircuitBreaker
+	stickySessions        *StickySessionStore
+	mu                    sync.Mutex
+	statusCache           statusCache
 }
 
 func (proxy *Proxy) Process() process.Process {
@@ -79,6 +94,13 @@ func (proxy *Proxy) DomainName() string {
 	return proxy.Config.DomainName
 }
 
+// DomainNames returns the domain name and all additional domain names of the proxy
+func (proxy *Proxy) DomainNames() []string {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return append([]string{proxy.Config.DomainName}, proxy.Config.DomainNames...)
+}
+
 func (proxy *Proxy) ListenTo() string {
 	proxy.Config.RLock()
 	defer proxy.Config.RUnlock()
@@ -91,18 +113,268 @@ func (proxy *Proxy) ProxyTo() string {
 	return proxy.Config.ProxyTo
 }
 
+// ServerAddr returns the address of the server a new connection should be proxied to.
+// If servers are configured they take turns by weight or, with least connections balancing,
+// the server with the fewest players per weight is picked. Otherwise proxyTo is used.
+// Servers that reached their maxPlayers are skipped unless all of them are full.
+func (proxy *Proxy) ServerAddr() string {
+	proxy.Config.Lock()
+	defer proxy.Config.Unlock()
+	if balancer := proxy.Config.Balancer(); balancer != nil {
+		if proxy.Config.Balancing == BalancingLeastConnections {
+			if addr, ok := proxy.leastConnectionsAddr(balancer); ok {
+				return addr
+			}
+		}
+
+		fullAddr := ""
+		for i := 0; i < len(proxy.Config.Servers); i++ {
+			addr, ok := balancer.Next()
+			if !ok {
+				break
+			}
+			if !proxy.isServerFull(addr, proxy.Config.serverMaxPlayers(addr)) {
+				return addr
+			}
+			fullAddr = addr
+		}
+		if fullAddr != "" {
+			return fullAddr
+		}
+	}
+	return proxy.Config.ProxyTo
+}
+
+// leastConnectionsAddr returns the server of balancer that has the fewest players per weight
+// and is not full. Ties go to the server whose turn it is by round-robin.
+// The caller has to hold the lock of the config.
+func (proxy *Proxy) leastConnectionsAddr(balancer *WeightedRoundRobin) (string, bool) {
+	weights := balancer.Weights()
+	turn, _ := balancer.Next()
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	best := ""
+	var bestLoad float64
+	consider := func(addr string) {
+		maxPlayers := proxy.Config.serverMaxPlayers(addr)
+		if maxPlayers > 0 && proxy.serverPlayers[addr] >= maxPlayers {
+			return
+		}
+		load := float64(proxy.serverPlayers[addr]) / float64(weights[addr])
+		if best == "" || load < bestLoad {
+			best, bestLoad = addr, load
+		}
+	}
+
+	consider(turn)
+	for addr := range weights {
+		consider(addr)
+	}
+	return best, best != ""
+}
+
+// ServerMaxPlayers returns the maximum number of players of the server with addr
+// or zero if the server has no limit
+func (proxy *Proxy) ServerMaxPlayers(addr string) int {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.serverMaxPlayers(addr)
+}
+
+// StickySessionTTL returns how long players are routed back to the server of their last login.
+// Zero disables sticky sessions.
+func (proxy *Proxy) StickySessionTTL() time.Duration {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return time.Millisecond * time.Duration(proxy.Config.StickySessionTTL)
+}
+
+// StickySessions returns the sticky sessions of the players of the proxy
+// or nil if sticky sessions are disabled
+func (proxy *Proxy) StickySessions() *StickySessionStore {
+	ttl := proxy.StickySessionTTL()
+	if ttl <= 0 {
+		return nil
+	}
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if proxy.stickySessions == nil {
+		proxy.stickySessions = &StickySessionStore{TTL: ttl}
+	}
+	return proxy.stickySessions
+}
+
+// canaryAddr returns the address of the canary server for the share of calls
+// that the canary fraction of the proxy config defines
+func (proxy *Proxy) canaryAddr() (string, bool) {
+	proxy.Config.RLock()
+	canary := proxy.Config.Canary
+	proxy.Config.RUnlock()
+
+	if canary.ProxyTo == "" || canary.Fraction <= 0 {
+		return "", false
+	}
+	return canary.ProxyTo, rand.Float64() < canary.Fraction
+}
+
+// anyProtocolVersion dials the servers of a proxy without looking at its version routes
+const anyProtocolVersion = -1
+
+// versionRouteAddr returns the address of the first version route that matches protocolVersion
+func (proxy *Proxy) versionRouteAddr(protocolVersion int) (string, bool) {
+	if protocolVersion == anyProtocolVersion {
+		return "", false
+	}
+
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	for _, route := range proxy.Config.VersionRoutes {
+		if route.Matches(protocolVersion) {
+			return route.ProxyTo, true
+		}
+	}
+	return "", false
+}
+
+// servesVersion reports if the server at addr may be dialed for a client with protocolVersion.
+// A client that matches a version route only goes to the server of its route
+// and other clients never go to the server of a version route.
+func (proxy *Proxy) servesVersion(addr string, protocolVersion int) bool {
+	if protocolVersion == anyProtocolVersion {
+		return true
+	}
+	if routeAddr, routed := proxy.versionRouteAddr(protocolVersion); routed {
+		return addr == routeAddr
+	}
+
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	for _, route := range proxy.Config.VersionRoutes {
+		if route.ProxyTo == addr {
+			return false
+		}
+	}
+	return true
+}
+
+func (proxy *Proxy) FallbackTo() []string {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.FallbackTo
+}
+
+// MirrorTo returns the address of the shadow server that gets a copy of every connection
+func (proxy *Proxy) MirrorTo() string {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.MirrorTo
+}
+
+// CaptureDir returns the directory that a capture of every login is written to
+func (proxy *Proxy) CaptureDir() string {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.CaptureDir
+}
+
+// CaptureMaxBytes returns the size that a capture stops at
+func (proxy *Proxy) CaptureMaxBytes() int64 {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	if proxy.Config.CaptureMaxBytes <= 0 {
+		return DefaultCaptureMaxBytes
+	}
+	return int64(proxy.Config.CaptureMaxBytes)
+}
+
+func (proxy *Proxy) DialRetries() int {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.DialRetries
+}
+
+// DialRetryDelays returns the delay before the first retry of a dial
+// and the maximum delay that the doubling delays are capped at
+func (proxy *Proxy) DialRetryDelays() (time.Duration, time.Duration) {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return time.Millisecond * time.Duration(proxy.Config.DialRetryDelay),
+		time.Millisecond * time.Duration(proxy.Config.DialRetryMaxDelay)
+}
+
 func (proxy *Proxy) Dialer() (*Dialer, error) {
 	proxy.Config.RLock()
 	defer proxy.Config.RUnlock()
 	return proxy.Config.Dialer()
 }
 
+// serverDialer returns the ServerDialer of the proxy or the Dialer of its config
+func (proxy *Proxy) serverDialer() (ServerDialer, error) {
+	if proxy.ServerDialer != nil {
+		return proxy.ServerDialer, nil
+	}
+	return proxy.Dialer()
+}
+
 func (proxy *Proxy) DisconnectMessage() string {
 	proxy.Config.RLock()
 	defer proxy.Config.RUnlock()
 	return proxy.Config.DisconnectMessage
 }
 
+func (proxy *Proxy) MaxPlayers() int {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.MaxPlayers
+}
+
+func (proxy *Proxy) FullMessage() string {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.FullMessage
+}
+
+// Values of the maintenance override of a ProxyConfig
+const (
+	maintenanceFromConfig int32 = iota
+	maintenanceOn
+	maintenanceOff
+)
+
+// InMaintenance reports whether logins are rejected with the maintenance message
+func (proxy *Proxy) InMaintenance() bool {
+	switch atomic.LoadInt32(&proxy.Config.maintenance) {
+	case maintenanceOn:
+		return true
+	case maintenanceOff:
+		return false
+	}
+
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.Maintenance
+}
+
+// SetMaintenance atomically turns the maintenance mode on or off at runtime
+// without waiting for connections that read the config.
+// The next reload of the config file overrides it.
+func (proxy *Proxy) SetMaintenance(enabled bool) {
+	mode := maintenanceOff
+	if enabled {
+		mode = maintenanceOn
+	}
+	atomic.StoreInt32(&proxy.Config.maintenance, mode)
+}
+
+func (proxy *Proxy) MaintenanceMessage() string {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.MaintenanceMessage
+}
+
 func (proxy *Proxy) IsOnlineStatusConfigured() bool {
 	proxy.Config.Lock()
 	defer proxy.Config.Unlock()
@@ -121,12 +393,82 @@ func (proxy *Proxy) OfflineStatusPacket() (protocol.Packet, error) {
 	return proxy.Config.OfflineStatus.StatusResponsePacket()
 }
 
+// IsStatusOverrideConfigured reports whether status requests are answered
+// with the status override instead of asking the server
+func (proxy *Proxy) IsStatusOverrideConfigured() bool {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.StatusOverride.ProtocolNumber != 0
+}
+
+// StatusPatch returns the fields that are changed in the status response of the server
+func (proxy *Proxy) StatusPatch() StatusPatchConfig {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.StatusPatch
+}
+
+// AggregatePlayers returns true if the status response shows the players of all servers
+func (proxy *Proxy) AggregatePlayers() bool {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.AggregatePlayers && len(proxy.Config.Servers) > 0
+}
+
+func (proxy *Proxy) StatusOverridePacket() (protocol.Packet, error) {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.StatusOverride.StatusResponsePacket()
+}
+
 func (proxy *Proxy) Timeout() time.Duration {
 	proxy.Config.RLock()
 	defer proxy.Config.RUnlock()
 	return time.Millisecond * time.Duration(proxy.Config.Timeout)
 }
 
+func (proxy *Proxy) StatusCacheTTL() time.Duration {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return time.Millisecond * time.Duration(proxy.Config.StatusCacheTTL)
+}
+
+// PipeBufferSize returns the size of the buffer that is used to copy data
+// in each direction between the player and the server
+func (proxy *Proxy) PipeBufferSize() int {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	if proxy.Config.PipeBufferSize <= 0 {
+		return DefaultPipeBufferSize
+	}
+	return proxy.Config.PipeBufferSize
+}
+
+// IdleTimeout returns how long a piped connection may go without any data
+// in either direction before it is closed. Zero means it is never closed for being idle.
+func (proxy *Proxy) IdleTimeout() time.Duration {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return time.Millisecond * time.Duration(proxy.Config.IdleTimeout)
+}
+
+// BandwidthLimits returns the bytes per second a player may send to (ingress)
+// and receive from (egress) the server. Zero means unlimited.
+func (proxy *Proxy) BandwidthLimits() (ingressBytesPerSec, egressBytesPerSec int) {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.IngressBytesPerSec, proxy.Config.EgressBytesPerSec
+}
+
+// throttle limits the bandwidth of the player connection conn if the proxy has any bandwidth limits
+func (proxy *Proxy) throttle(conn Conn) Conn {
+	ingress, egress := proxy.BandwidthLimits()
+	if ingress <= 0 && egress <= 0 {
+		return conn
+	}
+	return NewThrottledConn(conn, ingress, egress)
+}
+
 func (proxy *Proxy) DockerTimeout() time.Duration {
 	proxy.Config.RLock()
 	defer proxy.Config.RUnlock()
@@ -145,12 +487,43 @@ func (proxy *Proxy) RealIP() bool {
 	return proxy.Config.RealIP
 }
 
+func (proxy *Proxy) BungeeCord() bool {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.BungeeCord
+}
+
+func (proxy *Proxy) VelocitySecret() string {
+	proxy.Config.RLock()
+	defer proxy.Config.RUnlock()
+	return proxy.Config.VelocitySecret
+}
+
+// rewriteHandshake replaces the server address and port of hs with the rewrite host
+// and rewrite port for the server with addr. It returns false if nothing is rewritten.
+// The gateway has routed the connection by the original address at this point.
+func (proxy *Proxy) rewriteHandshake(hs *handshaking.ServerBoundHandshake, addr string) bool {
+	proxy.Config.RLock()
+	host, port := proxy.Config.serverRewrite(addr)
+	proxy.Config.RUnlock()
+
+	if host != "" {
+		hs.RewriteServerAddress(host)
+	}
+	if port > 0 {
+		hs.ServerPort = protocol.UnsignedShort(port)
+	}
+	return host != "" || port > 0
+}
+
 func (proxy *Proxy) CallbackLogger() callback.Logger {
 	proxy.Config.RLock()
 	defer proxy.Config.RUnlock()
 	return callback.Logger{
-		URL:    proxy.Config.CallbackServer.URL,
-		Events: proxy.Config.CallbackServer.Events,
+		URL:     proxy.Config.CallbackServer.URL,
+		Events:  proxy.Config.CallbackServer.Events,
+		Timeout: time.Millisecond * time.Duration(proxy.Config.CallbackServer.Timeout),
+		Retries: proxy.Config.CallbackServer.Retries,
 	}
 }
 
@@ -158,6 +531,16 @@ func (proxy *Proxy) UID() string {
 	return proxyUID(proxy.DomainName(), proxy.ListenTo())
 }
 
+// UIDs returns the UIDs of all domain names of the proxy
+func (proxy *Proxy) UIDs() []string {
+	listenTo := proxy.ListenTo()
+	var uids []string
+	for _, domainName := range proxy.DomainNames() {
+		uids = append(uids, proxyUID(domainName, listenTo))
+	}
+	return uids
+}
+
 func (proxy *Proxy) addPlayer(conn Conn, username string) {
 	proxy.mu.Lock()
 	defer proxy.mu.Unlock()
@@ -167,6 +550,69 @@ func (proxy *Proxy) addPlayer(conn Conn, username string) {
 	proxy.players[conn] = username
 }
 
+// reservePlayerSlot adds conn as a player without a name yet
+// unless the proxy already has the maximum number of players
+func (proxy *Proxy) reservePlayerSlot(conn Conn) bool {
+	maxPlayers := proxy.MaxPlayers()
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if proxy.players == nil {
+		proxy.players = map[Conn]string{}
+	}
+	if maxPlayers > 0 && len(proxy.players) >= maxPlayers {
+		return false
+	}
+	proxy.players[conn] = ""
+	return true
+}
+
+// PlayerCount returns the number of players that are connected through the proxy
+func (proxy *Proxy) PlayerCount() int {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	return len(proxy.players)
+}
+
+// ServerPlayers returns the number of players that are connected to the server with addr
+func (proxy *Proxy) ServerPlayers(addr string) int {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	return proxy.serverPlayers[addr]
+}
+
+func (proxy *Proxy) isServerFull(addr string, maxPlayers int) bool {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	return maxPlayers > 0 && proxy.serverPlayers[addr] >= maxPlayers
+}
+
+// reserveServerSlot counts a player on the server with addr
+// unless the server already has its maximum number of players
+func (proxy *Proxy) reserveServerSlot(addr string) bool {
+	maxPlayers := proxy.ServerMaxPlayers(addr)
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if proxy.serverPlayers == nil {
+		proxy.serverPlayers = map[string]int{}
+	}
+	if maxPlayers > 0 && proxy.serverPlayers[addr] >= maxPlayers {
+		return false
+	}
+	proxy.serverPlayers[addr]++
+	return true
+}
+
+func (proxy *Proxy) releaseServerSlot(addr string) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	proxy.serverPlayers[addr]--
+	if proxy.serverPlayers[addr] <= 0 {
+		delete(proxy.serverPlayers, addr)
+	}
+}
+
 func (proxy *Proxy) removePlayer(conn Conn) int {
 	proxy.mu.Lock()
 	defer proxy.mu.Unlock()
@@ -178,13 +624,18 @@ func (proxy *Proxy) removePlayer(conn Conn) int {
 	return len(proxy.players)
 }
 
+// logEvent posts event to the callback server in the background
+// so that a slow callback server does not hold up any connection
 func (proxy *Proxy) logEvent(event callback.Event) {
-	if _, err := proxy.CallbackLogger().LogEvent(event); err != nil {
-		log.Println("[w] Failed callback logging; error:", err)
-	}
+	logger := proxy.CallbackLogger()
+	go func() {
+		if _, err := logger.LogEvent(event); err != nil {
+			log.Println("[w] Failed callback logging; error:", err)
+		}
+	}()
 }
 
-func (proxy *Proxy) handleConn(conn Conn, connRemoteAddr net.Addr) error {
+func (proxy *Proxy) handleConn(ctx context.Context, conn Conn, connRemoteAddr net.Addr, session *connSession, bans BanStore) error {
 	pk, err := conn.ReadPacket()
 	if err != nil {
 		return err
@@ -195,18 +646,120 @@ func (proxy *Proxy) handleConn(conn Conn, connRemoteAddr net.Addr) error {
 		return err
 	}
 
+	if err := endReadRate(conn, hs); err != nil {
+		return err
+	}
+
+	// Status requests are frequent and rarely worth debugging, so only logins are captured
+	tap := proxy.Tap
+	if dir := proxy.CaptureDir(); dir != "" && hs.IsLoginRequest() {
+		capture, err := createCaptureFile(conn, dir, connRemoteAddr, proxy.CaptureMaxBytes())
+		if err != nil {
+			log.Printf("[w] Failed to capture the connection of %s; error: %s", connRemoteAddr, err)
+		} else {
+			defer capture.Close()
+			capture.capturePacket(CaptureInbound, pk)
+			conn = capture
+			tap = captureTap(capture.CapturingConn, proxy.Tap)
+		}
+	}
+
 	proxyDomain := proxy.DomainName()
-	proxyTo := proxy.ProxyTo()
 	proxyUID := proxy.UID()
 
-	dialer, err := proxy.Dialer()
-	if err != nil {
-		return err
+	if hs.IsStatusRequest() && proxy.IsStatusOverrideConfigured() {
+		return proxy.handleStatusOverrideRequest(conn)
+	}
+
+	if hs.IsStatusRequest() && !proxy.IsOnlineStatusConfigured() && (proxy.StatusCacheTTL() > 0 || !proxy.StatusPatch().IsZero() || proxy.AggregatePlayers()) {
+		return proxy.handleServerStatusRequest(conn, pk, connRemoteAddr)
+	}
+
+	loginResult := ""
+	countLogin := func(result string) {
+		loginResult = result
+		metrics.LoginsTotal.WithLabelValues(proxyDomain, result).Inc()
+	}
+	if hs.IsLoginRequest() {
+		// Logins that end before the player is connected or rejected are errors
+		defer func() {
+			if loginResult == "" {
+				countLogin(metrics.LoginResultError)
+			}
+		}()
+	}
+
+	if hs.IsLoginRequest() && proxy.InMaintenance() {
+		log.Printf("[i] %s is in maintenance; rejecting login of %s", proxyUID, connRemoteAddr)
+		countLogin(metrics.LoginResultMaintenance)
+		return proxy.disconnectLogin(conn, hs, connRemoteAddr, proxy.MaintenanceMessage())
+	}
+
+	if hs.IsLoginRequest() && bans != nil {
+		reason, banned, err := banReason(conn, bans)
+		if err != nil {
+			return fmt.Errorf("failed to parse login start: %w", err)
+		}
+		if banned {
+			log.Printf("[i] %s is banned; rejecting login through %s", connRemoteAddr, proxyUID)
+			countLogin(metrics.LoginResultBanned)
+			return proxy.disconnectLogin(conn, hs, connRemoteAddr, reason)
+		}
+	}
+
+	if hs.IsLoginRequest() {
+		if !proxy.reservePlayerSlot(conn) {
+			log.Printf("[i] %s is full; rejecting login of %s", proxyUID, connRemoteAddr)
+			countLogin(metrics.LoginResultFull)
+			return proxy.disconnectLogin(conn, hs, connRemoteAddr, proxy.FullMessage())
+		}
+		// Frees the slot on every return; removing the player again later is a no-op
+		defer proxy.removePlayer(conn)
+	}
+
+	var preferredAddrs []string
+	var playerID uuid.UUID
+	stickySessions := proxy.StickySessions()
+	if hs.IsLoginRequest() && stickySessions != nil {
+		playerID, err = loginUUID(conn)
+		if err != nil {
+			return fmt.Errorf("failed to parse login start: %w", err)
+		}
+		if addr, ok := stickySessions.Server(playerID); ok {
+			preferredAddrs = append(preferredAddrs, addr)
+		}
+	}
+
+	req := &DialRequest{
+		ClientAddr: connRemoteAddr,
+		Handshake:  hs,
+	}
+	// Only a custom dialer waits for the login start; the default one dials right away
+	if hs.IsLoginRequest() && proxy.ServerDialer != nil {
+		req.Username, err = loginUsername(conn)
+		if err != nil {
+			return fmt.Errorf("failed to parse login start: %w", err)
+		}
 	}
 
-	rconn, err := dialer.Dial(proxyTo)
+	dialCtx, dialSpan := session.startSpan(ctx, SpanDial)
+	rconn, proxyTo, err := proxy.dialServerFor(dialCtx, req, hs.IsLoginRequest(), preferredAddrs...)
+	if err != nil {
+		dialSpan.RecordError(err)
+	}
+	dialSpan.End()
+	if errors.Is(err, errServersFull) {
+		log.Printf("[i] Every server of %s is full; rejecting login of %s", proxyUID, connRemoteAddr)
+		countLogin(metrics.LoginResultFull)
+		return proxy.disconnectLogin(conn, hs, connRemoteAddr, proxy.FullMessage())
+	}
+	if errors.Is(err, ErrDialTimeout) {
+		log.Printf("[i] %s timed out connecting to the server; is the target offline? error: %s", proxyUID, err)
+	} else if err != nil {
+		log.Printf("[i] %s did not respond to ping; is the target offline? error: %s", proxyUID, err)
+	}
 	if err != nil {
-		log.Printf("[i] %s did not respond to ping; is the target offline?", proxyTo)
+		session.logger.Error("dial failed", "conn_id", session.event.ConnID, "proxy_uid", proxyUID, "error", err)
 		if hs.IsStatusRequest() {
 			return proxy.handleStatusRequest(conn, false)
 		}
@@ -214,24 +767,38 @@ func (proxy *Proxy) handleConn(conn Conn, connRemoteAddr net.Addr) error {
 			return err
 		}
 		proxy.timeoutProcess()
-		return proxy.handleLoginRequest(conn)
+		countLogin(metrics.LoginResultOffline)
+		return proxy.handleLoginRequest(conn, hs, connRemoteAddr)
 	}
 	defer rconn.Close()
+	if hs.IsLoginRequest() {
+		defer proxy.releaseServerSlot(proxyTo)
+	}
+	if mirrorTo := proxy.MirrorTo(); mirrorTo != "" {
+		if dialer, err := proxy.serverDialer(); err == nil {
+			mirror := startMirror(dialer, mirrorTo, *req)
+			defer mirror.close()
+			// Piped connections are copied instead of spliced, so that the mirror sees every write
+			rconn = mirrorConn{Conn: rconn, mirror: mirror}
+		}
+	}
+	if hs.IsLoginRequest() && stickySessions != nil {
+		stickySessions.Assign(playerID, proxyTo)
+	}
+	session.event.ServerAddr = proxyTo
+	session.span.SetAttribute(AttributeServerAddress, proxyTo)
+	session.log(ConnEventRouted)
 
 	if hs.IsStatusRequest() && proxy.IsOnlineStatusConfigured() {
 		return proxy.handleStatusRequest(conn, true)
 	}
 
+	if proxy.rewriteHandshake(&hs, proxyTo) {
+		pk = hs.Marshal()
+	}
+
 	if proxy.ProxyProtocol() {
-		header := &proxyproto.Header{
-			Version:           2,
-			Command:           proxyproto.PROXY,
-			TransportProtocol: proxyproto.TCPv4,
-			SourceAddr:        connRemoteAddr,
-			DestinationAddr:   rconn.RemoteAddr(),
-		}
-
-		if _, err = header.WriteTo(rconn); err != nil {
+		if err := writeProxyProtocolHeader(rconn, connRemoteAddr, rconn.RemoteAddr()); err != nil {
 			return err
 		}
 	}
@@ -239,6 +806,13 @@ func (proxy *Proxy) handleConn(conn Conn, connRemoteAddr net.Addr) error {
 	if proxy.RealIP() {
 		hs.UpgradeToRealIP(connRemoteAddr, time.Now())
 		pk = hs.Marshal()
+	} else if proxy.BungeeCord() && hs.IsLoginRequest() {
+		loginStart, err := peekLoginStart(conn)
+		if err != nil {
+			return err
+		}
+		hs.UpgradeToBungeeCord(connRemoteAddr, loginStart.OfflineUUID())
+		pk = hs.Marshal()
 	}
 
 	if err := rconn.WritePacket(pk); err != nil {
@@ -253,6 +827,13 @@ func (proxy *Proxy) handleConn(conn Conn, connRemoteAddr net.Addr) error {
 		if err != nil {
 			return err
 		}
+		if secret := proxy.VelocitySecret(); secret != "" {
+			if err := handleVelocityForwarding(conn, rconn, connRemoteAddr, username, []byte(secret)); err != nil {
+				return err
+			}
+		}
+		session.event.PlayerName = username
+		session.span.SetAttribute(AttributePlayerName, username)
 		proxy.addPlayer(conn, username)
 		proxy.logEvent(callback.PlayerJoinEvent{
 			Username:      username,
@@ -260,12 +841,25 @@ func (proxy *Proxy) handleConn(conn Conn, connRemoteAddr net.Addr) error {
 			TargetAddress: proxyTo,
 			ProxyUID:      proxyUID,
 		})
-		playersConnected.With(prometheus.Labels{"host": proxyDomain}).Inc()
+		metrics.PlayersConnected.With(prometheus.Labels{"host": proxyDomain}).Inc()
+		countLogin(metrics.LoginResultSuccess)
 		connected = true
 	}
 
-	go pipe(rconn, conn)
-	pipe(conn, rconn)
+	// Reset any handshake deadline the gateway set on the connection
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	metrics.ActiveConnections.WithLabelValues(proxyDomain).Inc()
+	result := PipeContextWithTap(ctx, proxy.throttle(conn), rconn, proxy.PipeBufferSize(), proxy.IdleTimeout(), tap)
+	metrics.ActiveConnections.WithLabelValues(proxyDomain).Dec()
+	session.event.BytesIn = result.BytesC1ToC2
+	session.event.BytesOut = result.BytesC2ToC1
+	metrics.BytesProxiedTotal.WithLabelValues(proxyDomain, metrics.DirectionServerBound).Add(float64(result.BytesC1ToC2))
+	metrics.BytesProxiedTotal.WithLabelValues(proxyDomain, metrics.DirectionClientBound).Add(float64(result.BytesC2ToC1))
+	log.Printf("[i] %s sent %d bytes to and received %d bytes from %s", connRemoteAddr, result.BytesC1ToC2, result.BytesC2ToC1, proxyTo)
+	session.logger.Info("pipe closed", "conn_id", session.event.ConnID, "server_addr", proxyTo, "bytes_in", result.BytesC1ToC2, "bytes_out", result.BytesC2ToC1)
 
 	if connected {
 		proxy.logEvent(callback.PlayerLeaveEvent{
@@ -274,34 +868,280 @@ func (proxy *Proxy) handleConn(conn Conn, connRemoteAddr net.Addr) error {
 			TargetAddress: proxyTo,
 			ProxyUID:      proxyUID,
 		})
-		playersConnected.With(prometheus.Labels{"host": proxyDomain}).Dec()
+		metrics.PlayersConnected.With(prometheus.Labels{"host": proxyDomain}).Dec()
 	}
 
 	remainingPlayers := proxy.removePlayer(conn)
 	if remainingPlayers <= 0 {
 		proxy.timeoutProcess()
 	}
-	return nil
+	return result.Err
+}
+
+// DefaultPipeBufferSize is the size of the buffer Pipe uses for each direction
+const DefaultPipeBufferSize = 0xffff
+
+// ErrIdleTimeout is the error of a PipeResult if the pipe was closed
+// because no data was read in either direction for the idle timeout
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// pipeBufferPools holds a *sync.Pool of buffers for every buffer size in use
+var pipeBufferPools sync.Map
+
+// PipeResult holds the outcome of a Pipe
+type PipeResult struct {
+	BytesC1ToC2 int64
+	BytesC2ToC1 int64
+	// Err is nil if both directions ended with an EOF
+	Err error
+}
+
+// Pipe copies data between c1 and c2 in both directions and blocks until both directions are done.
+// As soon as one direction ends both connections are closed to unblock the other direction.
+func Pipe(c1, c2 Conn) PipeResult {
+	return PipeContext(context.Background(), c1, c2)
+}
+
+// PipeContext works like Pipe but also closes both connections when ctx is done.
+// In that case the PipeResult holds the context's error, otherwise the first error
+// that is not an EOF or caused by closing the connections.
+func PipeContext(ctx context.Context, c1, c2 Conn) PipeResult {
+	return PipeContextWithBufferSize(ctx, c1, c2, DefaultPipeBufferSize)
+}
+
+// PipeContextWithBufferSize works like PipeContext but copies the data with buffers of bufferSize bytes.
+// Larger buffers need fewer reads for high throughput, smaller ones save memory per connection.
+// A bufferSize of zero or less uses the DefaultPipeBufferSize.
+func PipeContextWithBufferSize(ctx context.Context, c1, c2 Conn, bufferSize int) PipeResult {
+	if bufferSize <= 0 {
+		bufferSize = DefaultPipeBufferSize
+	}
+
+	return pipeContext(ctx, c1, c2, func(src, dst Conn, toC2 bool) (int64, error) {
+		return pipe(src, dst, bufferSize, nil, nil)
+	})
+}
+
+// PipeContextWithIdleTimeout works like PipeContextWithBufferSize but also closes both connections
+// when no data was read in either direction for idleTimeout. This ends pipes with a client that
+// vanished without closing its connection. The PipeResult then holds ErrIdleTimeout.
+// An idleTimeout of zero or less disables it.
+func PipeContextWithIdleTimeout(ctx context.Context, c1, c2 Conn, bufferSize int, idleTimeout time.Duration) PipeResult {
+	return PipeContextWithTap(ctx, c1, c2, bufferSize, idleTimeout, nil)
+}
+
+// PipeContextWithTap works like PipeContextWithIdleTimeout but also hands a copy of every chunk
+// it relays to tap unless tap is nil. Tapped connections are never spliced, since the tap
+// needs the data in user space.
+func PipeContextWithTap(ctx context.Context, c1, c2 Conn, bufferSize int, idleTimeout time.Duration, tap Tap) PipeResult {
+	if idleTimeout <= 0 && tap == nil {
+		return PipeContextWithBufferSize(ctx, c1, c2, bufferSize)
+	}
+	if bufferSize <= 0 {
+		bufferSize = DefaultPipeBufferSize
+	}
+
+	idleCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var activity *pipeActivity
+	if idleTimeout > 0 {
+		activity = &pipeActivity{}
+		activity.touch()
+		go func() {
+			if activity.watch(idleCtx, idleTimeout) {
+				cancel()
+			}
+		}()
+	}
+
+	var t *pipeTap
+	if tap != nil {
+		t = newPipeTap(tap)
+		defer t.close()
+	}
+
+	result := pipeContext(idleCtx, c1, c2, func(src, dst Conn, toC2 bool) (int64, error) {
+		direction := DirectionClientBound
+		if toC2 {
+			direction = DirectionServerBound
+		}
+		return pipe(src, dst, bufferSize, activity, t.tapFunc(direction))
+	})
+
+	// Only the watcher cancels idleCtx while ctx itself is not done
+	if result.Err == context.Canceled && ctx.Err() == nil {
+		result.Err = ErrIdleTimeout
+	}
+	return result
 }
 
-func pipe(src, dst Conn) {
-	buffer := make([]byte, 0xffff)
+// pipeActivity tracks when data was last read from either connection of a pipe
+type pipeActivity struct {
+	lastRead int64
+}
+
+func (activity *pipeActivity) touch() {
+	atomic.StoreInt64(&activity.lastRead, time.Now().UnixNano())
+}
+
+func (activity *pipeActivity) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&activity.lastRead)))
+}
+
+// watch checks the activity in intervals of a fraction of timeout, but at most every millisecond,
+// and returns true as soon as nothing was read for timeout or false when ctx is done
+func (activity *pipeActivity) watch(ctx context.Context, timeout time.Duration) bool {
+	interval := timeout / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+			if activity.idleFor() >= timeout {
+				return true
+			}
+		}
+	}
+}
+
+// pipeContext runs copyFunc in both directions between c1 and c2 until both are done.
+// The toC2 argument of copyFunc is true for the direction from c1 to c2.
+func pipeContext(ctx context.Context, c1, c2 Conn, copyFunc func(src, dst Conn, toC2 bool) (int64, error)) PipeResult {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c1.Close()
+			c2.Close()
+		case <-done:
+		}
+	}()
+
+	type pipeResult struct {
+		toC2 bool
+		n    int64
+		err  error
+	}
+
+	resultCh := make(chan pipeResult, 2)
+	go func() {
+		n, err := copyFunc(c1, c2, true)
+		resultCh <- pipeResult{toC2: true, n: n, err: err}
+	}()
+	go func() {
+		n, err := copyFunc(c2, c1, false)
+		resultCh <- pipeResult{toC2: false, n: n, err: err}
+	}()
+
+	var result PipeResult
+	for i := 0; i < 2; i++ {
+		r := <-resultCh
+		if r.toC2 {
+			result.BytesC1ToC2 = r.n
+		} else {
+			result.BytesC2ToC1 = r.n
+		}
+
+		if i == 0 {
+			c1.Close()
+			c2.Close()
+			if r.err != io.EOF {
+				result.Err = r.err
+			}
+			continue
+		}
+
+		// The second direction usually fails because we closed its connections.
+		// Only the first error is returned since the second one is most likely caused by it.
+		if result.Err != nil || r.err == io.EOF || errors.Is(r.err, net.ErrClosed) || errors.Is(r.err, io.ErrClosedPipe) {
+			continue
+		}
+		result.Err = r.err
+	}
+
+	if ctx.Err() != nil {
+		result.Err = ctx.Err()
+	}
+
+	return result
+}
+
+// pipe copies data from src to dst until either of them fails.
+// Plain TCP connections are spliced on Linux so that the data is never copied to user space;
+// all other connections are copied through a buffer of bufferSize bytes.
+// Every successful read is recorded in activity unless it is nil.
+// Every written chunk is passed to tap unless it is nil, which disables splicing.
+// It returns the number of bytes written to dst and the error that ended the copy.
+func pipe(src, dst Conn, bufferSize int, activity *pipeActivity, tap func([]byte)) (int64, error) {
+	if tap == nil {
+		if written, ok, err := splicePipe(src, dst, activity); ok {
+			return written, err
+		}
+	}
+	return bufferedPipe(src, dst, bufferSize, activity, tap)
+}
+
+// bufferedPipe copies data from src to dst through a buffer of bufferSize bytes like pipe
+func bufferedPipe(src, dst Conn, bufferSize int, activity *pipeActivity, tap func([]byte)) (int64, error) {
+	pool := pipeBufferPool(bufferSize)
+	bufferPtr := pool.Get().(*[]byte)
+	defer pool.Put(bufferPtr)
+	buffer := *bufferPtr
+	var written int64
 
 	for {
 		n, err := src.Read(buffer)
 		if err != nil {
-			return
+			return written, err
+		}
+		if activity != nil {
+			activity.touch()
 		}
 
 		data := buffer[:n]
 
-		_, err = dst.Write(data)
+		nw, err := dst.Write(data)
+		written += int64(nw)
+		if tap != nil && nw > 0 {
+			tap(data[:nw])
+		}
 		if err != nil {
-			return
+			return written, err
 		}
 	}
 }
 
+func pipeBufferPool(size int) *sync.Pool {
+	if pool, ok := pipeBufferPools.Load(size); ok {
+		return pool.(*sync.Pool)
+	}
+
+	pool, _ := pipeBufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} {
+			buffer := make([]byte, size)
+			return &buffer
+		},
+	})
+	return pool.(*sync.Pool)
+}
+
+// writeProxyProtocolHeader writes a PROXY protocol v2 header to w that describes
+// a connection from clientAddr to serverAddr. The address family (IPv4 or IPv6)
+// is derived from clientAddr.
+func writeProxyProtocolHeader(w io.Writer, clientAddr, serverAddr net.Addr) error {
+	header := proxyproto.HeaderProxyFromAddrs(2, clientAddr, serverAddr)
+	_, err := header.WriteTo(w)
+	return err
+}
+
 func (proxy *Proxy) startProcessIfNotRunning() error {
 	if proxy.Process() == nil {
 		return nil
@@ -357,22 +1197,416 @@ func (proxy *Proxy) cancelProcessTimeout() {
 	proxy.cancelTimeoutFunc = nil
 }
 
+// ErrDialTimeout is returned when every dial of a new connection timed out
+var ErrDialTimeout = errors.New("dial timed out")
+
+// errServersFull is returned when a player slot was requested but every server is full
+var errServersFull = errors.New("all servers are full")
+
+// dialServer dials the server of a new connection without a client and without looking at the version routes
+func (proxy *Proxy) dialServer(ctx context.Context, preferredAddrs ...string) (Conn, string, error) {
+	return proxy.dialServerFor(ctx, nil, false, preferredAddrs...)
+}
+
+// dialServerFor dials the server of a new connection for the client of req
+// and returns the connection and its address. A nil req dials without a client
+// and without looking at the version routes.
+// The preferredAddrs are tried before the server of the matching version route or,
+// if no route matches, the server the balancer picks.
+// Without preferredAddrs and a matching route the canary server is tried first for its fraction of the connections.
+// If the server can't be reached the fallback servers are tried in order.
+// Every server is dialed up to 1 + dialRetries times before moving on to the next one.
+// The retries back off exponentially with jitter and stop as soon as ctx is done.
+// If reserveSlot is set, a player slot is reserved on every server before it is dialed
+// and full servers are skipped. The slot of the returned server has to be released
+// with releaseServerSlot; errServersFull is returned if every server is full.
+func (proxy *Proxy) dialServerFor(ctx context.Context, req *DialRequest, reserveSlot bool, preferredAddrs ...string) (Conn, string, error) {
+	dialer, err := proxy.serverDialer()
+	if err != nil {
+		return nil, "", err
+	}
+
+	dialReq := DialRequest{}
+	protocolVersion := anyProtocolVersion
+	if req != nil {
+		dialReq = *req
+		protocolVersion = int(req.Handshake.ProtocolVersion)
+	}
+
+	// Preferred servers might not support the version of the client
+	var addrs []string
+	for _, addr := range preferredAddrs {
+		if proxy.servesVersion(addr, protocolVersion) {
+			addrs = append(addrs, addr)
+		}
+	}
+	serverAddr, routed := proxy.versionRouteAddr(protocolVersion)
+	if !routed && len(addrs) == 0 {
+		if addr, ok := proxy.canaryAddr(); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	retries := proxy.DialRetries()
+	delay, maxDelay := proxy.DialRetryDelays()
+
+	var errs []string
+	timedOut := true
+	allFull := true
+	balanced := false
+	for i := 0; i < len(addrs) || !balanced; i++ {
+		// The balancer is only asked for a server once the preferred servers failed,
+		// so that it does not skip a server for connections that never use it
+		if i == len(addrs) {
+			balanced = true
+			if !routed {
+				serverAddr = proxy.ServerAddr()
+			}
+			if len(addrs) == 0 || addrs[len(addrs)-1] != serverAddr {
+				addrs = append(addrs, serverAddr)
+			}
+			addrs = append(addrs, proxy.FallbackTo()...)
+			if i == len(addrs) {
+				break
+			}
+		}
+
+		addr := addrs[i]
+		if proxy.isUnhealthy(addr) {
+			errs = append(errs, fmt.Sprintf("%s: failed health check", addr))
+			timedOut = false
+			allFull = false
+			continue
+		}
+
+		cb := proxy.circuitBreaker(addr)
+		if cb != nil {
+			if err := cb.Allow(); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", addr, err))
+				timedOut = false
+				allFull = false
+				continue
+			}
+		}
+
+		if reserveSlot && !proxy.reserveServerSlot(addr) {
+			errs = append(errs, fmt.Sprintf("%s: %s", addr, errServersFull))
+			timedOut = false
+			continue
+		}
+		allFull = false
+
+		var dialErr error
+		for attempt := 0; attempt <= retries; attempt++ {
+			if attempt > 0 {
+				if err := sleepContext(ctx, retryBackoff(attempt, delay, maxDelay)); err != nil {
+					if cb != nil {
+						cb.Report(err)
+					}
+					if reserveSlot {
+						proxy.releaseServerSlot(addr)
+					}
+					errs = append(errs, fmt.Sprintf("%s: %s", addr, err))
+					return nil, "", errors.New(strings.Join(errs, "; "))
+				}
+			}
+
+			dialReq.ServerAddr = addr
+			rconn, err := dialer.DialServer(ctx, dialReq)
+			if err != nil {
+				dialErr = err
+				errs = append(errs, fmt.Sprintf("%s: %s", addr, err))
+				if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+					timedOut = false
+				}
+				continue
+			}
+
+			if cb != nil {
+				cb.Report(nil)
+			}
+			if len(errs) > 0 {
+				log.Printf("[w] Failed over to %s for %s; errors: %s", addr, proxy.UID(), strings.Join(errs, "; "))
+			}
+			return rconn, addr, nil
+		}
+
+		if cb != nil {
+			cb.Report(dialErr)
+		}
+		if reserveSlot {
+			proxy.releaseServerSlot(addr)
+		}
+	}
+
+	if allFull && len(addrs) > 0 {
+		return nil, "", fmt.Errorf("%w: %s", errServersFull, strings.Join(errs, "; "))
+	}
+	if timedOut {
+		return nil, "", fmt.Errorf("%w: %s", ErrDialTimeout, strings.Join(errs, "; "))
+	}
+	return nil, "", errors.New(strings.Join(errs, "; "))
+}
+
+// maxRetryBackoff is the longest delay between two retries that can still be doubled without overflowing
+const maxRetryBackoff = time.Duration(math.MaxInt64 / 2)
+
+// retryBackoff returns the delay before the retry with the given number.
+// The delay starts at delay and doubles with every retry up to maxDelay,
+// if maxDelay is greater than zero. A random half of the delay is jitter,
+// so that clients that failed together do not retry together.
+func retryBackoff(retry int, delay, maxDelay time.Duration) time.Duration {
+	if delay <= 0 {
+		return 0
+	}
+	if maxDelay <= 0 || maxDelay > maxRetryBackoff {
+		maxDelay = maxRetryBackoff
+	}
+
+	for i := 1; i < retry && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// sleepContext waits for d or returns the error of ctx if it is done before
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleVelocityForwarding answers the Velocity modern forwarding request of the server
+// with the signed player data. If the first packet of the server is not a forwarding
+// request it is passed on to the client.
+func handleVelocityForwarding(conn, rconn Conn, connRemoteAddr net.Addr, username string, secret []byte) error {
+	pk, err := rconn.ReadPacket()
+	if err != nil {
+		return err
+	}
+
+	request, err := login.UnmarshalClientBoundLoginPluginRequest(pk)
+	if err != nil || request.Channel != login.VelocityForwardingChannel {
+		return conn.WritePacket(pk)
+	}
+
+	loginStart := login.ServerLoginStart{Name: protocol.String(username)}
+	id, err := uuid.FromString(loginStart.OfflineUUID())
+	if err != nil {
+		return err
+	}
+
+	forwarding := login.VelocityForwarding{
+		ClientIP: protocol.String(addrIP(connRemoteAddr)),
+		UUID:     protocol.UUID(id),
+		Name:     loginStart.Name,
+	}
+
+	return rconn.WritePacket(login.ServerBoundLoginPluginResponse{
+		MessageID:  request.MessageID,
+		Successful: true,
+		Data:       forwarding.Marshal(secret),
+	}.Marshal())
+}
+
+// startHealthCheck stops any running health check and starts checking the
+// configured servers if health checks are enabled. Unhealthy servers are
+// removed from the balancer until they are healthy again.
+func (proxy *Proxy) startHealthCheck() {
+	proxy.stopHealthCheck()
+
+	proxy.Config.RLock()
+	cfg := proxy.Config.HealthCheck
+	servers := proxy.Config.Servers
+	proxyBind := proxy.Config.ProxyBind
+	proxyProtocol := proxy.Config.ProxyProtocol
+	proxyTo := proxy.Config.ProxyTo
+	proxy.Config.RUnlock()
+
+	proxy.mu.Lock()
+	proxy.unhealthy = nil
+	proxy.mu.Unlock()
+
+	if cfg.Interval <= 0 || (len(servers) == 0 && proxyTo == "") {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	timeout := time.Millisecond * time.Duration(cfg.Timeout)
+	hc := &HealthChecker{
+		Interval:           time.Millisecond * time.Duration(cfg.Interval),
+		Timeout:            timeout,
+		UnhealthyThreshold: cfg.UnhealthyThreshold,
+		HealthyThreshold:   cfg.HealthyThreshold,
+		ProxyProtocol:      proxyProtocol,
+		Dialer: &Dialer{
+			Dialer: net.Dialer{
+				Timeout: timeout,
+				LocalAddr: &net.TCPAddr{
+					IP: net.ParseIP(proxyBind),
+				},
+			},
+			SRV: defaultSRVCache,
+		},
+		OnChange: func(addr string, healthy bool) {
+			if ctx.Err() != nil {
+				return
+			}
+			proxy.setServerHealth(addr, healthy)
+		},
+	}
+	for _, server := range servers {
+		hc.Add(server.Address)
+	}
+	if proxyTo != "" {
+		hc.Add(proxyTo)
+	}
+
+	proxy.mu.Lock()
+	proxy.cancelHealthCheckFunc = cancel
+	proxy.mu.Unlock()
+
+	go hc.Run(ctx)
+}
+
+func (proxy *Proxy) stopHealthCheck() {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if proxy.cancelHealthCheckFunc == nil {
+		return
+	}
+
+	proxy.cancelHealthCheckFunc()
+	proxy.cancelHealthCheckFunc = nil
+}
+
+// setServerHealth adds a healthy server back to the balancer or removes an unhealthy one.
+// Unhealthy servers are not dialed until they are healthy again.
+func (proxy *Proxy) setServerHealth(addr string, healthy bool) {
+	proxy.Config.Lock()
+	defer proxy.Config.Unlock()
+
+	proxy.mu.Lock()
+	if proxy.unhealthy == nil {
+		proxy.unhealthy = map[string]bool{}
+	}
+	if healthy {
+		delete(proxy.unhealthy, addr)
+	} else {
+		proxy.unhealthy[addr] = true
+	}
+	proxy.mu.Unlock()
+
+	balancer := proxy.Config.Balancer()
+	if balancer == nil {
+		return
+	}
+
+	if !healthy {
+		balancer.Remove(addr)
+		return
+	}
+
+	for _, server := range proxy.Config.Servers {
+		if server.Address == addr {
+			balancer.Add(addr, server.Weight)
+		}
+	}
+}
+
+// circuitBreaker returns the circuit breaker of the server addr
+// or nil if the proxy has no circuit breaker configured
+func (proxy *Proxy) circuitBreaker(addr string) *CircuitBreaker {
+	proxy.Config.RLock()
+	cfg := proxy.Config.CircuitBreaker
+	proxy.Config.RUnlock()
+	if cfg.FailureThreshold <= 0 {
+		return nil
+	}
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if proxy.circuitBreakers == nil {
+		proxy.circuitBreakers = map[string]*CircuitBreaker{}
+	}
+	cb, ok := proxy.circuitBreakers[addr]
+	if !ok {
+		cb = &CircuitBreaker{
+			FailureThreshold: cfg.FailureThreshold,
+			RecoveryTimeout:  time.Millisecond * time.Duration(cfg.RecoveryTimeout),
+		}
+		proxy.circuitBreakers[addr] = cb
+	}
+	return cb
+}
+
+func (proxy *Proxy) isUnhealthy(addr string) bool {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	return proxy.unhealthy[addr]
+}
+
+// peekLoginStart peeks the login start of conn without consuming it
+func peekLoginStart(conn Conn) (login.ServerLoginStart, error) {
+	pk, err := conn.PeekPacket()
+	if err != nil {
+		return login.ServerLoginStart{}, err
+	}
+
+	loginStart, err := login.UnmarshalServerBoundLoginStart(pk)
+	if err != nil {
+		return login.ServerLoginStart{}, fmt.Errorf("failed to parse login start: %w", err)
+	}
+	return loginStart, nil
+}
+
+// loginUsername peeks the login start of conn and returns the name of the player
+func loginUsername(conn Conn) (string, error) {
+	loginStart, err := peekLoginStart(conn)
+	if err != nil {
+		return "", err
+	}
+	return string(loginStart.Name), nil
+}
+
 func (proxy *Proxy) sniffUsername(conn, rconn Conn, connRemoteAddr net.Addr) (string, error) {
 	pk, err := conn.ReadPacket()
 	if err != nil {
 		return "", err
 	}
-	rconn.WritePacket(pk)
+	if err := rconn.WritePacket(pk); err != nil {
+		return "", err
+	}
 
 	ls, err := login.UnmarshalServerBoundLoginStart(pk)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to parse login start: %w", err)
 	}
 	log.Printf("[i] %s with username %s connects through %s", connRemoteAddr, ls.Name, proxy.UID())
 	return string(ls.Name), nil
 }
 
-func (proxy *Proxy) handleLoginRequest(conn Conn) error {
+func (proxy *Proxy) handleLoginRequest(conn Conn, hs handshaking.ServerBoundHandshake, remoteAddr net.Addr) error {
+	return proxy.disconnectLogin(conn, hs, remoteAddr, proxy.DisconnectMessage())
+}
+
+// disconnectLogin reads the login start of conn and disconnects it with message.
+// The message is rendered like the disconnect message; remoteAddr is the address of the client.
+func (proxy *Proxy) disconnectLogin(conn Conn, hs handshaking.ServerBoundHandshake, remoteAddr net.Addr, message string) error {
 	packet, err := conn.ReadPacket()
 	if err != nil {
 		return err
@@ -380,26 +1614,23 @@ func (proxy *Proxy) handleLoginRequest(conn Conn) error {
 
 	loginStart, err := login.UnmarshalServerBoundLoginStart(packet)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to parse login start: %w", err)
 	}
 
-	message := proxy.DisconnectMessage()
-	templates := map[string]string{
+	fields := map[string]string{
 		"username":      string(loginStart.Name),
 		"now":           time.Now().Format(time.RFC822),
-		"remoteAddress": conn.LocalAddr().String(),
+		"remoteAddress": remoteAddr.String(),
 		"localAddress":  conn.LocalAddr().String(),
 		"domain":        proxy.DomainName(),
+		"host":          hs.ParseServerAddress(),
+		"ip":            addrIP(remoteAddr),
 		"proxyTo":       proxy.ProxyTo(),
 		"listenTo":      proxy.ListenTo(),
 	}
 
-	for key, value := range templates {
-		message = strings.Replace(message, fmt.Sprintf("{{%s}}", key), value, -1)
-	}
-
 	return conn.WritePacket(login.ClientBoundDisconnect{
-		Reason: protocol.Chat(fmt.Sprintf("{\"text\":\"%s\"}", message)),
+		Reason: renderMessage(message, fields),
 	}.Marshal())
 }
 
@@ -423,14 +1654,300 @@ func (proxy *Proxy) handleStatusRequest(conn Conn, online bool) error {
 		}
 	}
 
+	return writeStatusResponse(conn, responsePk)
+}
+
+// handleStatusOverrideRequest answers a status request with the status override without dialing the server
+func (proxy *Proxy) handleStatusOverrideRequest(conn Conn) error {
+	_, err := conn.ReadPacket()
+	if err != nil {
+		return err
+	}
+
+	responsePk, err := proxy.StatusOverridePacket()
+	if err != nil {
+		return err
+	}
+
+	return writeStatusResponse(conn, responsePk)
+}
+
+// handleServerStatusRequest answers a status request with the status response of the server
+// instead of piping the request to the server, so that the response can be cached and patched.
+// The server is only asked for its status if the cached response is older than the status cache TTL.
+func (proxy *Proxy) handleServerStatusRequest(conn Conn, hsPk protocol.Packet, connRemoteAddr net.Addr) error {
+	_, err := conn.ReadPacket()
+	if err != nil {
+		return err
+	}
+
+	responsePk, err := proxy.patchedServerStatus(hsPk, connRemoteAddr)
+	if err != nil {
+		log.Printf("[i] %s did not respond to status request; is the target offline? error: %s", proxy.ProxyTo(), err)
+		responsePk, err = proxy.OfflineStatusPacket()
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeStatusResponse(conn, responsePk)
+}
+
+// handleLegacyStatusRequest answers the server list ping of clients older than 1.7
+// with the status that a modern client would get and closes the connection
+func (proxy *Proxy) handleLegacyStatusRequest(conn Conn, ping status.LegacyServerListPing, connRemoteAddr net.Addr) error {
+	hs := handshaking.ServerBoundHandshake{
+		ProtocolVersion: -1,
+		ServerAddress:   protocol.String(proxy.DomainName()),
+		NextState:       handshaking.ServerBoundHandshakeStatusState,
+	}
+	if ping.ServerPort > 0 {
+		hs.ServerPort = protocol.UnsignedShort(ping.ServerPort)
+	} else if _, port, err := net.SplitHostPort(proxy.ListenTo()); err == nil {
+		p, _ := strconv.Atoi(port)
+		hs.ServerPort = protocol.UnsignedShort(p)
+	}
+
+	var responsePk protocol.Packet
+	var err error
+	if proxy.IsStatusOverrideConfigured() {
+		responsePk, err = proxy.StatusOverridePacket()
+	} else {
+		responsePk, err = proxy.patchedServerStatus(hs.Marshal(), connRemoteAddr)
+		switch {
+		case err != nil:
+			log.Printf("[i] %s did not respond to status request; is the target offline? error: %s", proxy.ProxyTo(), err)
+			responsePk, err = proxy.OfflineStatusPacket()
+		case proxy.IsOnlineStatusConfigured():
+			responsePk, err = proxy.OnlineStatusPacket()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	response, err := status.UnmarshalClientBoundResponse(responsePk)
+	if err != nil {
+		return err
+	}
+
+	legacyResponse, err := status.LegacyResponseFromJSON(string(response.JSONResponse))
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(legacyResponse.Marshal())
+	return err
+}
+
+// InvalidateStatusCache drops the cached status response of the server
+func (proxy *Proxy) InvalidateStatusCache() {
+	proxy.statusCache.invalidate()
+}
+
+// serverStatus returns the status response of the server.
+// The response is cached if a status cache TTL is configured.
+func (proxy *Proxy) serverStatus(hsPk protocol.Packet, connRemoteAddr net.Addr) (protocol.Packet, error) {
+	ttl := proxy.StatusCacheTTL()
+	if ttl <= 0 {
+		return proxy.fetchStatus(hsPk, connRemoteAddr)
+	}
+
+	return proxy.statusCache.get(ttl, func() (protocol.Packet, error) {
+		return proxy.fetchStatus(hsPk, connRemoteAddr)
+	})
+}
+
+// patchedServerStatus returns the status response of the server with the status patch applied
+func (proxy *Proxy) patchedServerStatus(hsPk protocol.Packet, connRemoteAddr net.Addr) (protocol.Packet, error) {
+	responsePk, err := proxy.serverStatus(hsPk, connRemoteAddr)
+	if err != nil {
+		return protocol.Packet{}, err
+	}
+
+	patch := proxy.StatusPatch()
+	if patch.IsZero() {
+		return responsePk, nil
+	}
+	return patch.Apply(responsePk)
+}
+
+// fetchStatus dials the server and requests its status response
+func (proxy *Proxy) fetchStatus(hsPk protocol.Packet, connRemoteAddr net.Addr) (protocol.Packet, error) {
+	if proxy.AggregatePlayers() {
+		return proxy.fetchAggregatedStatus(hsPk, connRemoteAddr)
+	}
+
+	rconn, addr, err := proxy.dialServer(context.Background())
+	if err != nil {
+		return protocol.Packet{}, err
+	}
+	defer rconn.Close()
+
+	return proxy.requestStatus(rconn, addr, hsPk, connRemoteAddr)
+}
+
+// fetchAggregatedStatus requests the status of all healthy servers in parallel and returns
+// the response of the first server that answered with the players of all servers summed up.
+// Servers that fail to answer or can't be reached within the timeout of the proxy are not counted.
+func (proxy *Proxy) fetchAggregatedStatus(hsPk protocol.Packet, connRemoteAddr net.Addr) (protocol.Packet, error) {
+	dialer, err := proxy.serverDialer()
+	if err != nil {
+		return protocol.Packet{}, err
+	}
+
+	ctx := context.Background()
+	if timeout := proxy.Timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	proxy.Config.RLock()
+	servers := proxy.Config.Servers
+	proxy.Config.RUnlock()
+
+	type result struct {
+		pk      protocol.Packet
+		players status.PlayersJSON
+		err     error
+	}
+
+	results := make([]result, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		if proxy.isUnhealthy(server.Address) {
+			results[i].err = fmt.Errorf("%s: failed health check", server.Address)
+			continue
+		}
+
+		wg.Add(1)
+		go func(res *result, addr string) {
+			defer wg.Done()
+
+			rconn, err := dialer.DialServer(ctx, DialRequest{ServerAddr: addr})
+			if err != nil {
+				res.err = fmt.Errorf("%s: %w", addr, err)
+				return
+			}
+			defer rconn.Close()
+
+			res.pk, res.err = proxy.requestStatus(rconn, addr, hsPk, connRemoteAddr)
+			if res.err != nil {
+				res.err = fmt.Errorf("%s: %w", addr, res.err)
+				return
+			}
+			res.players, res.err = statusPlayers(res.pk)
+			if res.err != nil {
+				res.err = fmt.Errorf("%s: %w", addr, res.err)
+			}
+		}(&results[i], server.Address)
+	}
+	wg.Wait()
+
+	var responsePk *protocol.Packet
+	var online, maxPlayers int
+	var errs []string
+	for i := range results {
+		res := results[i]
+		if res.err != nil {
+			errs = append(errs, res.err.Error())
+			continue
+		}
+		if responsePk == nil {
+			responsePk = &res.pk
+		}
+		online += res.players.Online
+		maxPlayers += res.players.Max
+	}
+
+	if responsePk == nil {
+		return protocol.Packet{}, errors.New(strings.Join(errs, "; "))
+	}
+	if len(errs) > 0 {
+		log.Printf("[w] Left servers out of the player count of %s; errors: %s", proxy.UID(), strings.Join(errs, "; "))
+	}
+
+	return StatusPatchConfig{PlayersOnline: online, MaxPlayers: maxPlayers}.Apply(*responsePk)
+}
+
+// statusPlayers returns the players of a status response
+func statusPlayers(responsePk protocol.Packet) (status.PlayersJSON, error) {
+	response, err := status.UnmarshalClientBoundResponse(responsePk)
+	if err != nil {
+		return status.PlayersJSON{}, err
+	}
+
+	// Only the players are parsed, since the description may be any chat component
+	var res struct {
+		Players status.PlayersJSON `json:"players"`
+	}
+	if err := json.Unmarshal([]byte(response.JSONResponse), &res); err != nil {
+		return status.PlayersJSON{}, fmt.Errorf("failed to parse status response: %w", err)
+	}
+	return res.Players, nil
+}
+
+// requestStatus requests the status response of the server with addr on rconn
+func (proxy *Proxy) requestStatus(rconn Conn, addr string, hsPk protocol.Packet, connRemoteAddr net.Addr) (protocol.Packet, error) {
+	hs, err := handshaking.UnmarshalServerBoundHandshake(hsPk)
+	if err != nil {
+		return protocol.Packet{}, err
+	}
+	if proxy.rewriteHandshake(&hs, addr) {
+		hsPk = hs.Marshal()
+	}
+
+	if err := rconn.SetDeadline(time.Now().Add(proxy.Timeout())); err != nil {
+		return protocol.Packet{}, err
+	}
+
+	if proxy.ProxyProtocol() {
+		if err := writeProxyProtocolHeader(rconn, connRemoteAddr, rconn.RemoteAddr()); err != nil {
+			return protocol.Packet{}, err
+		}
+	}
+
+	if err := rconn.WritePacket(hsPk); err != nil {
+		return protocol.Packet{}, err
+	}
+
+	if err := rconn.WritePacket(status.ServerBoundRequest{}.Marshal()); err != nil {
+		return protocol.Packet{}, err
+	}
+
+	responsePk, err := rconn.ReadPacket()
+	if err != nil {
+		return protocol.Packet{}, err
+	}
+
+	if _, err := status.UnmarshalClientBoundResponse(responsePk); err != nil {
+		return protocol.Packet{}, fmt.Errorf("failed to parse status response: %w", err)
+	}
+
+	return responsePk, nil
+}
+
+// writeStatusResponse sends responsePk to conn and answers the ping that follows it with a pong
+// that carries the same payload, so that clients can show their latency.
+// Clients that close the connection without a ping are fine.
+func writeStatusResponse(conn Conn, responsePk protocol.Packet) error {
 	if err := conn.WritePacket(responsePk); err != nil {
 		return err
 	}
 
 	pingPk, err := conn.ReadPacket()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	return conn.WritePacket(pingPk)
+	ping, err := status.UnmarshalServerBoundPing(pingPk)
+	if err != nil {
+		return fmt.Errorf("failed to parse status ping: %w", err)
+	}
+
+	return conn.WritePacket(status.ClientBoundPong{Payload: ping.Payload}.Marshal())
 }
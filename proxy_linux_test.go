@@ -0,0 +1,63 @@
+package infrared
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// blackholeAddr returns the address of a listener whose accept queue is full,
+// so that every further dial hangs until it times out
+func blackholeAddr(t *testing.T) string {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(sa.(*syscall.SockaddrInet4).Port))
+
+	// Fill the accept queue
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return addr
+}
+
+func TestProxy_DialTimeout(t *testing.T) {
+	proxy := Proxy{Config: &ProxyConfig{
+		ProxyTo:     blackholeAddr(t),
+		Timeout:     10000,
+		DialTimeout: 100,
+	}}
+
+	start := time.Now()
+	rconn, _, err := proxy.dialServer(context.Background())
+	if err == nil {
+		rconn.Close()
+		t.Fatal("got no error")
+	}
+
+	if !errors.Is(err, ErrDialTimeout) {
+		t.Errorf("got: %v; want: %v", err, ErrDialTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("got: %v; want: return after the dial timeout of 100ms", elapsed)
+	}
+}
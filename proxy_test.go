@@ -0,0 +1,1360 @@
+package infrared
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared/protocol"
+	"github.com/haveachin/infrared/protocol/handshaking"
+	"github.com/haveachin/infrared/protocol/login"
+	"github.com/haveachin/infrared/protocol/status"
+)
+
+func TestProxy_SniffUsername(t *testing.T) {
+	tt := []struct {
+		name     string
+		username string
+	}{
+		{
+			name:     "SimpleName",
+			username: "foo",
+		},
+		{
+			name:     "NameWithUnderscore",
+			username: "Steve_123",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			client, conn := net.Pipe()
+			rconn, server := net.Pipe()
+			defer client.Close()
+			defer conn.Close()
+			defer rconn.Close()
+			defer server.Close()
+
+			go func() {
+				pk := login.ServerLoginStart{Name: protocol.String(tc.username)}.Marshal()
+				_ = wrapConn(client).WritePacket(pk)
+			}()
+
+			relayedCh := make(chan string, 1)
+			go func() {
+				pk, err := wrapConn(server).ReadPacket()
+				if err != nil {
+					relayedCh <- ""
+					return
+				}
+				ls, _ := login.UnmarshalServerBoundLoginStart(pk)
+				relayedCh <- string(ls.Name)
+			}()
+
+			proxy := Proxy{Config: &ProxyConfig{}}
+			username, err := proxy.sniffUsername(wrapConn(conn), wrapConn(rconn), conn.RemoteAddr())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if username != tc.username {
+				t.Errorf("got: %v; want: %v", username, tc.username)
+			}
+
+			if relayed := <-relayedCh; relayed != tc.username {
+				t.Errorf("relayed: got: %v; want: %v", relayed, tc.username)
+			}
+		})
+	}
+}
+
+func TestProxy_SniffUsername_InvalidPacket(t *testing.T) {
+	client, conn := net.Pipe()
+	rconn, server := net.Pipe()
+	defer client.Close()
+	defer conn.Close()
+	defer rconn.Close()
+	defer server.Close()
+
+	go func() {
+		_ = wrapConn(client).WritePacket(protocol.Packet{ID: 0x01})
+	}()
+
+	go func() {
+		_, _ = wrapConn(server).ReadPacket()
+	}()
+
+	proxy := Proxy{Config: &ProxyConfig{}}
+	_, err := proxy.sniffUsername(wrapConn(conn), wrapConn(rconn), conn.RemoteAddr())
+	if !errors.Is(err, protocol.ErrInvalidPacketID) {
+		t.Errorf("got: %v; want: %v", err, protocol.ErrInvalidPacketID)
+	}
+}
+
+func TestPeekLoginStart(t *testing.T) {
+	tt := []struct {
+		name        string
+		pk          protocol.Packet
+		username    string
+		expectedErr error
+	}{
+		{
+			name:     "LoginStart",
+			pk:       login.ServerLoginStart{Name: "Steve_123"}.Marshal(),
+			username: "Steve_123",
+		},
+		{
+			name:        "InvalidPacketID",
+			pk:          protocol.Packet{ID: 0x01},
+			expectedErr: protocol.ErrInvalidPacketID,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			client, conn := net.Pipe()
+			defer client.Close()
+			defer conn.Close()
+
+			go func() {
+				_ = wrapConn(client).WritePacket(tc.pk)
+			}()
+
+			c := wrapConn(conn)
+			loginStart, err := peekLoginStart(c)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("got: %v; want: %v", err, tc.expectedErr)
+			}
+			if string(loginStart.Name) != tc.username {
+				t.Errorf("got: %v; want: %v", loginStart.Name, tc.username)
+			}
+
+			// The login start is still there for the server
+			pk, err := c.ReadPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pk.ID != tc.pk.ID || !bytes.Equal(pk.Data, tc.pk.Data) {
+				t.Errorf("got: %v; want: %v", pk, tc.pk)
+			}
+		})
+	}
+}
+
+func TestPipe(t *testing.T) {
+	tt := []struct {
+		name        string
+		bytesC1ToC2 int
+		bytesC2ToC1 int
+		bufferSize  int
+	}{
+		{
+			name:        "NoData",
+			bytesC1ToC2: 0,
+			bytesC2ToC1: 0,
+		},
+		{
+			name:        "OneDirection",
+			bytesC1ToC2: 1024,
+			bytesC2ToC1: 0,
+		},
+		{
+			name:        "BothDirections",
+			bytesC1ToC2: 200000,
+			bytesC2ToC1: 70000,
+		},
+		{
+			name:        "SmallBuffer",
+			bytesC1ToC2: 200000,
+			bytesC2ToC1: 70000,
+			bufferSize:  16,
+		},
+	}
+
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			client, c1 := net.Pipe()
+			c2, server := net.Pipe()
+
+			resultCh := make(chan PipeResult, 1)
+			go func() {
+				resultCh <- PipeContextWithBufferSize(context.Background(), wrapConn(c1), wrapConn(c2), tc.bufferSize)
+			}()
+
+			go func() {
+				if tc.bytesC2ToC1 > 0 {
+					_, _ = server.Write(make([]byte, tc.bytesC2ToC1))
+				}
+			}()
+			if _, err := io.ReadFull(client, make([]byte, tc.bytesC2ToC1)); err != nil {
+				t.Fatal(err)
+			}
+
+			go func() {
+				if tc.bytesC1ToC2 > 0 {
+					_, _ = client.Write(make([]byte, tc.bytesC1ToC2))
+				}
+				client.Close()
+			}()
+			if _, err := io.ReadFull(server, make([]byte, tc.bytesC1ToC2)); err != nil {
+				t.Fatal(err)
+			}
+
+			result := <-resultCh
+			server.Close()
+
+			if result.Err != nil {
+				t.Errorf("unexpected error: %v", result.Err)
+			}
+
+			if result.BytesC1ToC2 != int64(tc.bytesC1ToC2) {
+				t.Errorf("c1 to c2: got: %d; want: %d", result.BytesC1ToC2, tc.bytesC1ToC2)
+			}
+
+			if result.BytesC2ToC1 != int64(tc.bytesC2ToC1) {
+				t.Errorf("c2 to c1: got: %d; want: %d", result.BytesC2ToC1, tc.bytesC2ToC1)
+			}
+		})
+	}
+}
+
+func TestPipe_CountsBufferedData(t *testing.T) {
+	client, c1 := net.Pipe()
+	c2, server := net.Pipe()
+	defer server.Close()
+
+	payload := []byte("Hello, World!")
+	go func() {
+		_, _ = client.Write(payload)
+		client.Close()
+	}()
+
+	// The gateway peeks the handshake before piping, so some data
+	// is already buffered in the reader of the connection
+	conn := wrapConn(c1)
+	if _, err := conn.Reader().Peek(5); err != nil {
+		t.Fatal(err)
+	}
+
+	resultCh := make(chan PipeResult, 1)
+	go func() {
+		resultCh <- Pipe(conn, wrapConn(c2))
+	}()
+
+	if _, err := io.ReadFull(server, make([]byte, len(payload))); err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-resultCh
+	if result.BytesC1ToC2 != int64(len(payload)) {
+		t.Errorf("got: %d; want: %d", result.BytesC1ToC2, len(payload))
+	}
+}
+
+func TestPipeContext_Cancel(t *testing.T) {
+	client, c1 := net.Pipe()
+	c2, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resultCh := make(chan PipeResult, 1)
+	go func() {
+		resultCh <- PipeContext(ctx, wrapConn(c1), wrapConn(c2))
+	}()
+
+	// Transfer some data and leave both directions blocked in Read
+	go func() {
+		_, _ = client.Write([]byte("Hello, World!"))
+	}()
+	if _, err := io.ReadFull(server, make([]byte, 13)); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	select {
+	case result := <-resultCh:
+		if result.Err != context.Canceled {
+			t.Errorf("got: %v; want: %v", result.Err, context.Canceled)
+		}
+		if result.BytesC1ToC2 != 13 {
+			t.Errorf("got: %d; want: %d", result.BytesC1ToC2, 13)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("PipeContext did not return after cancellation")
+	}
+}
+
+// failingConn replaces every read error of the underlying connection with err.
+// If immediate is set, Read fails without reading at all.
+type failingConn struct {
+	net.Conn
+	err       error
+	immediate bool
+}
+
+func (c failingConn) Read(b []byte) (int, error) {
+	if c.immediate {
+		return 0, c.err
+	}
+
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		return n, c.err
+	}
+	return n, nil
+}
+
+func TestPipe_FirstError(t *testing.T) {
+	client, c1 := net.Pipe()
+	c2, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errFirst := errors.New("first")
+	errSecond := errors.New("second")
+
+	resultCh := make(chan PipeResult, 1)
+	go func() {
+		resultCh <- Pipe(
+			wrapConn(failingConn{Conn: c1, err: errFirst, immediate: true}),
+			wrapConn(failingConn{Conn: c2, err: errSecond}),
+		)
+	}()
+
+	select {
+	case result := <-resultCh:
+		if result.Err != errFirst {
+			t.Errorf("got: %v; want: %v", result.Err, errFirst)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pipe did not return after the first direction failed")
+	}
+}
+
+// closeCountingConn counts how often it was closed
+type closeCountingConn struct {
+	net.Conn
+	closes *int32
+}
+
+func (c closeCountingConn) Close() error {
+	atomic.AddInt32(c.closes, 1)
+	return c.Conn.Close()
+}
+
+func TestPipe_ClosesConnections(t *testing.T) {
+	client, c1 := net.Pipe()
+	c2, server := net.Pipe()
+	defer server.Close()
+
+	var closes1, closes2 int32
+	resultCh := make(chan PipeResult, 1)
+	go func() {
+		resultCh <- Pipe(
+			wrapConn(closeCountingConn{Conn: c1, closes: &closes1}),
+			wrapConn(closeCountingConn{Conn: c2, closes: &closes2}),
+		)
+	}()
+
+	// Ending one direction has to tear down both connections
+	client.Close()
+
+	select {
+	case <-resultCh:
+	case <-time.After(time.Second):
+		t.Fatal("Pipe did not return after the client closed its connection")
+	}
+
+	for name, closes := range map[string]int32{"c1": atomic.LoadInt32(&closes1), "c2": atomic.LoadInt32(&closes2)} {
+		if closes == 0 {
+			t.Errorf("%s: got: %d closes; want: at least 1", name, closes)
+		}
+	}
+
+	// Connections are closed again by the deferred teardown of the gateway, which must not panic
+	conn := wrapConn(closeCountingConn{Conn: c1, closes: &closes1})
+	if err := conn.Close(); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("got: %v; want: %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestPipeContextWithIdleTimeout(t *testing.T) {
+	idleTimeout := 100 * time.Millisecond
+
+	tt := []struct {
+		name string
+		// traffic is how long data keeps flowing before the pipe goes silent
+		traffic time.Duration
+	}{
+		{
+			name:    "Silence",
+			traffic: 0,
+		},
+		{
+			name:    "Traffic",
+			traffic: 3 * idleTimeout,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			client, c1 := net.Pipe()
+			c2, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go func() {
+				_, _ = io.Copy(io.Discard, server)
+			}()
+
+			start := time.Now()
+			resultCh := make(chan PipeResult, 1)
+			go func() {
+				resultCh <- PipeContextWithIdleTimeout(context.Background(), wrapConn(c1), wrapConn(c2), 0, idleTimeout)
+			}()
+
+			for time.Since(start) < tc.traffic {
+				if _, err := client.Write([]byte{0x00}); err != nil {
+					t.Fatalf("pipe closed after %v despite traffic: %v", time.Since(start), err)
+				}
+				time.Sleep(idleTimeout / 5)
+			}
+
+			select {
+			case result := <-resultCh:
+				if result.Err != ErrIdleTimeout {
+					t.Errorf("got: %v; want: %v", result.Err, ErrIdleTimeout)
+				}
+				// The watcher notices the silence up to a quarter of the idle timeout late
+				elapsed := time.Since(start)
+				minElapsed := tc.traffic + idleTimeout - idleTimeout/5
+				maxElapsed := tc.traffic + idleTimeout*3/2 + idleTimeout/4
+				if elapsed < minElapsed || elapsed > maxElapsed {
+					t.Errorf("got: %v; want: between %v and %v", elapsed, minElapsed, maxElapsed)
+				}
+			case <-time.After(tc.traffic + 10*idleTimeout):
+				t.Fatal("PipeContextWithIdleTimeout did not return after being idle")
+			}
+		})
+	}
+}
+
+func TestPipeContextWithIdleTimeout_Tiny(t *testing.T) {
+	c1, client := net.Pipe()
+	c2, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	resultCh := make(chan PipeResult, 1)
+	go func() {
+		resultCh <- PipeContextWithIdleTimeout(context.Background(), wrapConn(c1), wrapConn(c2), 0, time.Nanosecond)
+	}()
+
+	select {
+	case result := <-resultCh:
+		if result.Err != ErrIdleTimeout {
+			t.Errorf("got: %v; want: %v", result.Err, ErrIdleTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("PipeContextWithIdleTimeout did not return after being idle")
+	}
+}
+
+func TestPipeContextWithIdleTimeout_Disabled(t *testing.T) {
+	client, c1 := net.Pipe()
+	c2, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	resultCh := make(chan PipeResult, 1)
+	go func() {
+		resultCh <- PipeContextWithIdleTimeout(context.Background(), wrapConn(c1), wrapConn(c2), 0, 0)
+	}()
+
+	select {
+	case result := <-resultCh:
+		t.Fatalf("pipe without idle timeout returned: %v", result.Err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func BenchmarkPipe(b *testing.B) {
+	payload := make([]byte, 1<<20)
+
+	for _, bufferSize := range []int{4 << 10, 32 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("%dKB", bufferSize>>10), func(b *testing.B) {
+			client, c1 := net.Pipe()
+			c2, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go PipeContextWithBufferSize(context.Background(), wrapConn(c1), wrapConn(c2), bufferSize)
+			go io.Copy(io.Discard, server)
+
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if _, err := client.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteProxyProtocolHeader(t *testing.T) {
+	signature := []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+	tt := []struct {
+		name         string
+		clientAddr   *net.TCPAddr
+		serverAddr   *net.TCPAddr
+		familyByte   byte
+		addressBlock []byte
+	}{
+		{
+			name:       "IPv4",
+			clientAddr: &net.TCPAddr{IP: net.ParseIP("109.226.143.210"), Port: 54321},
+			serverAddr: &net.TCPAddr{IP: net.ParseIP("210.223.216.109"), Port: 25565},
+			familyByte: 0x11,
+			addressBlock: []byte{
+				109, 226, 143, 210,
+				210, 223, 216, 109,
+				0xD4, 0x31,
+				0x63, 0xDD,
+			},
+		},
+		{
+			name:       "IPv6",
+			clientAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 54321},
+			serverAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 25565},
+			familyByte: 0x21,
+			addressBlock: []byte{
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x02,
+				0xD4, 0x31,
+				0x63, 0xDD,
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeProxyProtocolHeader(&buf, tc.clientAddr, tc.serverAddr); err != nil {
+				t.Fatal(err)
+			}
+			bb := buf.Bytes()
+
+			if !bytes.Equal(bb[:12], signature) {
+				t.Errorf("signature: got: %v; want: %v", bb[:12], signature)
+			}
+
+			if bb[12] != 0x21 {
+				t.Errorf("version and command: got: %#x; want: %#x", bb[12], 0x21)
+			}
+
+			if bb[13] != tc.familyByte {
+				t.Errorf("family: got: %#x; want: %#x", bb[13], tc.familyByte)
+			}
+
+			length := int(bb[14])<<8 | int(bb[15])
+			if length != len(tc.addressBlock) {
+				t.Errorf("length: got: %d; want: %d", length, len(tc.addressBlock))
+			}
+
+			if !bytes.Equal(bb[16:], tc.addressBlock) {
+				t.Errorf("address block: got: %v; want: %v", bb[16:], tc.addressBlock)
+			}
+		})
+	}
+}
+
+func TestProxy_SetServerHealth(t *testing.T) {
+	proxy := Proxy{Config: &ProxyConfig{
+		ProxyTo: "fallback:25565",
+		Servers: []ServerConfig{
+			{Address: "a:25565", Weight: 1},
+			{Address: "b:25565", Weight: 1},
+		},
+	}}
+
+	proxy.setServerHealth("b:25565", false)
+	for i := 0; i < 4; i++ {
+		if addr := proxy.ServerAddr(); addr != "a:25565" {
+			t.Errorf("got: %v; want: %v", addr, "a:25565")
+		}
+	}
+
+	proxy.setServerHealth("a:25565", false)
+	if addr := proxy.ServerAddr(); addr != "fallback:25565" {
+		t.Errorf("got: %v; want: %v", addr, "fallback:25565")
+	}
+
+	proxy.setServerHealth("b:25565", true)
+	if addr := proxy.ServerAddr(); addr != "b:25565" {
+		t.Errorf("got: %v; want: %v", addr, "b:25565")
+	}
+}
+
+func TestProxy_ServerAddrLeastConnections(t *testing.T) {
+	proxy := Proxy{Config: &ProxyConfig{
+		ProxyTo:   "fallback:25565",
+		Balancing: BalancingLeastConnections,
+		Servers: []ServerConfig{
+			{Address: "a:25565", Weight: 1},
+			{Address: "b:25565", Weight: 2},
+			{Address: "c:25565", Weight: 1, MaxPlayers: 1},
+		},
+	}}
+
+	tt := []struct {
+		name         string
+		reserve      string
+		unhealthy    string
+		expectedAddr string
+	}{
+		{
+			name:         "TieGoesToRoundRobin",
+			expectedAddr: "b:25565",
+		},
+		{
+			name:         "FewestPlayers",
+			reserve:      "b:25565",
+			expectedAddr: "a:25565",
+		},
+		{
+			name:         "PlayersPerWeight",
+			reserve:      "a:25565",
+			expectedAddr: "c:25565",
+		},
+		{
+			name:         "SkipsFullServer",
+			reserve:      "c:25565",
+			expectedAddr: "b:25565",
+		},
+		{
+			name:         "SkipsUnhealthyServer",
+			reserve:      "b:25565",
+			unhealthy:    "a:25565",
+			expectedAddr: "b:25565",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.reserve != "" && !proxy.reserveServerSlot(tc.reserve) {
+				t.Fatalf("could not reserve a slot on %s", tc.reserve)
+			}
+			if tc.unhealthy != "" {
+				proxy.setServerHealth(tc.unhealthy, false)
+			}
+
+			if addr := proxy.ServerAddr(); addr != tc.expectedAddr {
+				t.Errorf("got: %v; want: %v", addr, tc.expectedAddr)
+			}
+		})
+	}
+}
+
+func TestProxy_SetMaintenance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.json")
+	if err := os.WriteFile(path, []byte(`{"maintenance": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := Proxy{Config: &ProxyConfig{}}
+	if proxy.InMaintenance() {
+		t.Error("got: in maintenance; want: not in maintenance")
+	}
+
+	proxy.SetMaintenance(true)
+	if !proxy.InMaintenance() {
+		t.Error("got: not in maintenance; want: in maintenance")
+	}
+
+	proxy.SetMaintenance(false)
+	proxy.Config.reload(path)
+	if !proxy.InMaintenance() {
+		t.Error("got: not in maintenance after reload; want: maintenance of the config file")
+	}
+}
+
+func TestProxy_RewriteHandshake(t *testing.T) {
+	proxy := Proxy{Config: &ProxyConfig{
+		RewriteHost: "proxy.backend.local",
+		Servers: []ServerConfig{
+			{Address: "a:25565", RewriteHost: "a.backend.local", RewritePort: 25570},
+			{Address: "b:25565", RewritePort: 25571},
+			{Address: "c:25565"},
+		},
+	}}
+
+	tt := []struct {
+		addr         string
+		expectedHost string
+		expectedPort int
+	}{
+		{
+			addr:         "a:25565",
+			expectedHost: "a.backend.local",
+			expectedPort: 25570,
+		},
+		{
+			addr:         "b:25565",
+			expectedHost: "proxy.backend.local",
+			expectedPort: 25571,
+		},
+		{
+			addr:         "c:25565",
+			expectedHost: "proxy.backend.local",
+			expectedPort: 25565,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.addr, func(t *testing.T) {
+			hs := handshaking.ServerBoundHandshake{
+				ProtocolVersion: 754,
+				ServerAddress:   "public.example.com",
+				ServerPort:      25565,
+				NextState:       handshaking.ServerBoundHandshakeLoginState,
+			}
+			if !proxy.rewriteHandshake(&hs, tc.addr) {
+				t.Fatal("got: not rewritten")
+			}
+
+			if string(hs.ServerAddress) != tc.expectedHost {
+				t.Errorf("got: %v; want: %v", hs.ServerAddress, tc.expectedHost)
+			}
+			if int(hs.ServerPort) != tc.expectedPort {
+				t.Errorf("got: %v; want: %v", hs.ServerPort, tc.expectedPort)
+			}
+		})
+	}
+}
+
+func TestProxy_DialServer(t *testing.T) {
+	online, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer online.Close()
+
+	// Reserve an address that refuses connections
+	offline, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offlineAddr := offline.Addr().String()
+	offline.Close()
+
+	onlineAddr := online.Addr().String()
+
+	tt := []struct {
+		name           string
+		proxyTo        string
+		fallbackTo     []string
+		dialRetries    int
+		expectedAddr   string
+		expectedErrors int
+	}{
+		{
+			name:         "PrimaryOnline",
+			proxyTo:      onlineAddr,
+			fallbackTo:   []string{offlineAddr},
+			expectedAddr: onlineAddr,
+		},
+		{
+			name:         "Failover",
+			proxyTo:      offlineAddr,
+			fallbackTo:   []string{offlineAddr, onlineAddr},
+			expectedAddr: onlineAddr,
+		},
+		{
+			name:           "AllOffline",
+			proxyTo:        offlineAddr,
+			fallbackTo:     []string{offlineAddr},
+			expectedErrors: 2,
+		},
+		{
+			name:           "AllOfflineWithRetries",
+			proxyTo:        offlineAddr,
+			fallbackTo:     []string{offlineAddr},
+			dialRetries:    2,
+			expectedErrors: 6,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := Proxy{Config: &ProxyConfig{
+				ProxyTo:     tc.proxyTo,
+				FallbackTo:  tc.fallbackTo,
+				DialRetries: tc.dialRetries,
+				Timeout:     1000,
+			}}
+
+			rconn, addr, err := proxy.dialServer(context.Background())
+			if tc.expectedErrors > 0 {
+				if err == nil {
+					rconn.Close()
+					t.Fatal("got no error")
+				}
+				if errs := len(strings.Split(err.Error(), "; ")); errs != tc.expectedErrors {
+					t.Errorf("got: %d errors; want: %d", errs, tc.expectedErrors)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rconn.Close()
+
+			if addr != tc.expectedAddr {
+				t.Errorf("got: %v; want: %v", addr, tc.expectedAddr)
+			}
+		})
+	}
+}
+
+func TestProxy_DialServerUnhealthy(t *testing.T) {
+	online, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer online.Close()
+	onlineAddr := online.Addr().String()
+
+	proxy := Proxy{Config: &ProxyConfig{
+		ProxyTo: onlineAddr,
+		Timeout: 1000,
+	}}
+
+	proxy.setServerHealth(onlineAddr, false)
+	rconn, _, err := proxy.dialServer(context.Background())
+	if err == nil {
+		rconn.Close()
+		t.Fatal("got no error for an unhealthy server")
+	}
+	if !strings.Contains(err.Error(), "failed health check") {
+		t.Errorf("got: %v; want: failed health check", err)
+	}
+
+	proxy.setServerHealth(onlineAddr, true)
+	rconn, addr, err := proxy.dialServer(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rconn.Close()
+
+	if addr != onlineAddr {
+		t.Errorf("got: %v; want: %v", addr, onlineAddr)
+	}
+}
+
+func TestProxy_DialServerReserveSlot(t *testing.T) {
+	online, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer online.Close()
+	onlineAddr := online.Addr().String()
+
+	offline, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offlineAddr := offline.Addr().String()
+	offline.Close()
+
+	proxy := Proxy{Config: &ProxyConfig{
+		Servers: []ServerConfig{{Address: onlineAddr, Weight: 1, MaxPlayers: 1}},
+		Timeout: 1000,
+	}}
+
+	rconn, addr, err := proxy.dialServerFor(context.Background(), nil, true, offlineAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rconn.Close()
+	if addr != onlineAddr {
+		t.Errorf("got: %v; want: %v", addr, onlineAddr)
+	}
+	if players := proxy.serverPlayers[offlineAddr]; players != 0 {
+		t.Errorf("got: %d players on %s after a failed dial; want: 0", players, offlineAddr)
+	}
+	if players := proxy.serverPlayers[onlineAddr]; players != 1 {
+		t.Errorf("got: %d players on %s; want: 1", players, onlineAddr)
+	}
+
+	rconn, _, err = proxy.dialServerFor(context.Background(), nil, true)
+	if !errors.Is(err, errServersFull) {
+		if err == nil {
+			rconn.Close()
+		}
+		t.Errorf("got: %v; want: %v", err, errServersFull)
+	}
+
+	proxy.releaseServerSlot(onlineAddr)
+	rconn, _, err = proxy.dialServerFor(context.Background(), nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rconn.Close()
+}
+
+func TestProxy_DialServerPreferredKeepsBalancer(t *testing.T) {
+	online, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer online.Close()
+	onlineAddr := online.Addr().String()
+
+	newProxy := func() *Proxy {
+		return &Proxy{Config: &ProxyConfig{
+			Servers: []ServerConfig{
+				{Address: "a:25565", Weight: 1},
+				{Address: "b:25565", Weight: 1},
+			},
+			Timeout: 1000,
+		}}
+	}
+	expectedAddr := newProxy().ServerAddr()
+
+	proxy := newProxy()
+	rconn, addr, err := proxy.dialServer(context.Background(), onlineAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rconn.Close()
+	if addr != onlineAddr {
+		t.Errorf("got: %v; want: %v", addr, onlineAddr)
+	}
+
+	if addr := proxy.ServerAddr(); addr != expectedAddr {
+		t.Errorf("got: %v; want: %v", addr, expectedAddr)
+	}
+}
+
+func TestProxy_CanaryAddr(t *testing.T) {
+	lookups := 10000
+
+	for _, fraction := range []float64{0, 0.05, 0.5, 1} {
+		t.Run(fmt.Sprint(fraction), func(t *testing.T) {
+			proxy := Proxy{Config: &ProxyConfig{
+				ProxyTo: "stable:25565",
+				Canary: CanaryConfig{
+					ProxyTo:  "canary:25565",
+					Fraction: fraction,
+				},
+			}}
+
+			canary := 0
+			for i := 0; i < lookups; i++ {
+				if addr, ok := proxy.canaryAddr(); ok {
+					if addr != "canary:25565" {
+						t.Fatalf("got: %v; want: %v", addr, "canary:25565")
+					}
+					canary++
+				}
+			}
+
+			got := float64(canary) / float64(lookups)
+			if math.Abs(got-fraction) > 0.02 {
+				t.Errorf("got: %v; want: %v ± 0.02", got, fraction)
+			}
+		})
+	}
+}
+
+func TestProxy_DialServerCanaryFallsThrough(t *testing.T) {
+	stable, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stable.Close()
+
+	offline, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offlineAddr := offline.Addr().String()
+	offline.Close()
+
+	proxy := Proxy{Config: &ProxyConfig{
+		ProxyTo: stable.Addr().String(),
+		Timeout: 1000,
+		Canary: CanaryConfig{
+			ProxyTo:  offlineAddr,
+			Fraction: 1,
+		},
+	}}
+
+	rconn, addr, err := proxy.dialServer(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rconn.Close()
+
+	if addr != stable.Addr().String() {
+		t.Errorf("got: %v; want: %v", addr, stable.Addr())
+	}
+}
+
+func TestProxy_DialServerCircuitBreaker(t *testing.T) {
+	offline, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offlineAddr := offline.Addr().String()
+	offline.Close()
+
+	proxy := Proxy{Config: &ProxyConfig{
+		ProxyTo: offlineAddr,
+		Timeout: 1000,
+		CircuitBreaker: CircuitBreakerConfig{
+			FailureThreshold: 2,
+			RecoveryTimeout:  60000,
+		},
+	}}
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := proxy.dialServer(context.Background()); err == nil || strings.Contains(err.Error(), ErrCircuitOpen.Error()) {
+			t.Fatalf("dial %d: got: %v; want: a dial error", i, err)
+		}
+	}
+
+	_, _, err = proxy.dialServer(context.Background())
+	if err == nil || !strings.Contains(err.Error(), ErrCircuitOpen.Error()) {
+		t.Errorf("got: %v; want: %v", err, ErrCircuitOpen)
+	}
+
+	expected := CircuitStats{State: CircuitOpen, Failures: 2}
+	if stats := proxy.circuitBreaker(offlineAddr).Stats(); stats != expected {
+		t.Errorf("got: %v; want: %v", stats, expected)
+	}
+}
+
+func TestWriteStatusResponse(t *testing.T) {
+	responsePk := status.ClientBoundResponse{JSONResponse: `{"version":{"name":"Infrared"}}`}.Marshal()
+
+	tt := []struct {
+		name        string
+		pingPk      *protocol.Packet
+		expectedErr bool
+	}{
+		{
+			name:   "Ping",
+			pingPk: &[]protocol.Packet{status.ServerBoundPing{Payload: 0x0123456789ABCDEF}.Marshal()}[0],
+		},
+		{
+			name:   "NegativePayload",
+			pingPk: &[]protocol.Packet{status.ServerBoundPing{Payload: -42}.Marshal()}[0],
+		},
+		{
+			name: "DisconnectWithoutPing",
+		},
+		{
+			name:        "InvalidPing",
+			pingPk:      &protocol.Packet{ID: 0x02},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			client, conn := net.Pipe()
+			defer client.Close()
+			defer conn.Close()
+
+			pongCh := make(chan protocol.Packet, 1)
+			go func() {
+				defer close(pongCh)
+				c := wrapConn(client)
+				if _, err := c.ReadPacket(); err != nil {
+					t.Error(err)
+					return
+				}
+				if tc.pingPk == nil {
+					c.Close()
+					return
+				}
+				if err := c.WritePacket(*tc.pingPk); err != nil {
+					t.Error(err)
+					return
+				}
+				if pk, err := c.ReadPacket(); err == nil {
+					pongCh <- pk
+				}
+			}()
+
+			err := writeStatusResponse(wrapConn(conn), responsePk)
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("got: %v; want error: %v", err, tc.expectedErr)
+			}
+			if tc.expectedErr || tc.pingPk == nil {
+				return
+			}
+
+			pongPk := <-pongCh
+			pong, err := status.UnmarshalClientBoundPong(pongPk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ping, _ := status.UnmarshalServerBoundPing(*tc.pingPk)
+			if pong.Payload != ping.Payload {
+				t.Errorf("got: %v; want: %v", pong.Payload, ping.Payload)
+			}
+		})
+	}
+}
+
+// serveStatus answers every status request on listener with statusCfg
+func serveStatus(listener net.Listener, statusCfg StatusConfig) {
+	pk, _ := statusCfg.StatusResponsePacket()
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(c Conn) {
+			defer c.Close()
+			for i := 0; i < 2; i++ {
+				if _, err := c.ReadPacket(); err != nil {
+					return
+				}
+			}
+			c.WritePacket(pk)
+		}(wrapConn(c))
+	}
+}
+
+func TestProxy_AggregatedStatus(t *testing.T) {
+	var servers []ServerConfig
+	for _, online := range []int{3, 5, 7} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go serveStatus(listener, StatusConfig{
+			VersionName:    "Backend",
+			ProtocolNumber: 754,
+			MaxPlayers:     10,
+			PlayersOnline:  online,
+		})
+		servers = append(servers, ServerConfig{Address: listener.Addr().String(), Weight: 1})
+	}
+
+	// Reserve an address that refuses connections
+	offline, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offline.Close()
+	servers = append(servers, ServerConfig{Address: offline.Addr().String(), Weight: 1})
+
+	proxy := Proxy{Config: &ProxyConfig{
+		Servers:          servers,
+		AggregatePlayers: true,
+		Timeout:          1000,
+	}}
+
+	responsePk, err := proxy.fetchStatus(serverHandshake("infrared", 25565), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	players, err := statusPlayers(responsePk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if players.Online != 15 {
+		t.Errorf("online: got: %d; want: %d", players.Online, 15)
+	}
+	if players.Max != 30 {
+		t.Errorf("max: got: %d; want: %d", players.Max, 30)
+	}
+}
+
+func TestProxy_AggregatedStatusDialTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go serveStatus(listener, StatusConfig{
+		VersionName:    "Backend",
+		ProtocolNumber: 754,
+		MaxPlayers:     10,
+		PlayersOnline:  3,
+	})
+
+	proxy := Proxy{
+		Config: &ProxyConfig{
+			Servers: []ServerConfig{
+				{Address: listener.Addr().String(), Weight: 1},
+				{Address: "hanging:25565", Weight: 1},
+			},
+			AggregatePlayers: true,
+			Timeout:          100,
+		},
+		// Dials to the hanging server only end with their context
+		ServerDialer: ServerDialerFunc(func(ctx context.Context, req DialRequest) (Conn, error) {
+			if req.ServerAddr == "hanging:25565" {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return Dialer{}.DialServer(ctx, req)
+		}),
+	}
+
+	resultCh := make(chan error, 1)
+	go func() {
+		responsePk, err := proxy.fetchStatus(serverHandshake("infrared", 25565), nil)
+		if err != nil {
+			resultCh <- err
+			return
+		}
+		players, err := statusPlayers(responsePk)
+		if err == nil && players.Online != 3 {
+			err = fmt.Errorf("online: got: %d; want: %d", players.Online, 3)
+		}
+		resultCh <- err
+	}()
+
+	select {
+	case err := <-resultCh:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the status was not returned after the timeout")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tt := []struct {
+		name     string
+		retry    int
+		delay    time.Duration
+		maxDelay time.Duration
+		expected time.Duration
+	}{
+		{
+			name:     "Disabled",
+			retry:    3,
+			expected: 0,
+		},
+		{
+			name:     "FirstRetry",
+			retry:    1,
+			delay:    100 * time.Millisecond,
+			expected: 100 * time.Millisecond,
+		},
+		{
+			name:     "Doubles",
+			retry:    3,
+			delay:    100 * time.Millisecond,
+			expected: 400 * time.Millisecond,
+		},
+		{
+			name:     "Capped",
+			retry:    10,
+			delay:    100 * time.Millisecond,
+			maxDelay: time.Second,
+			expected: time.Second,
+		},
+		{
+			name:     "UncappedDoesNotOverflow",
+			retry:    1000,
+			delay:    100 * time.Millisecond,
+			expected: maxRetryBackoff,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				d := retryBackoff(tc.retry, tc.delay, tc.maxDelay)
+				if d < tc.expected/2 || d > tc.expected {
+					t.Fatalf("got: %v; want: between %v and %v", d, tc.expected/2, tc.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestProxy_DialServerBackoff(t *testing.T) {
+	// Reserve an address that refuses connections until the server comes up
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	proxy := Proxy{Config: &ProxyConfig{
+		ProxyTo:        addr,
+		DialRetries:    8,
+		DialRetryDelay: 10,
+		Timeout:        1000,
+	}}
+
+	t.Run("ServerComesUp", func(t *testing.T) {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer listener.Close()
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}()
+
+		rconn, dialedAddr, err := proxy.dialServer(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rconn.Close()
+
+		if dialedAddr != addr {
+			t.Errorf("got: %v; want: %v", dialedAddr, addr)
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		proxy.Config.DialRetryDelay = 1000
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		if rconn, _, err := proxy.dialServer(ctx); err == nil {
+			rconn.Close()
+			t.Fatal("got no error")
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("got: %v; want: return when the context is done", elapsed)
+		}
+	})
+}
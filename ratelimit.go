@@ -0,0 +1,124 @@
+package infrared
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter decides if a new connection from the given IP is allowed
+type RateLimiter interface {
+	Allow(ip string) bool
+}
+
+// defaultRateLimitCleanupInterval is the CleanupInterval of an IPRateLimiter that has none
+const defaultRateLimitCleanupInterval = time.Minute
+
+// IPRateLimiter is a token bucket RateLimiter that keeps one bucket per IP.
+// Buckets of IPs that did not connect for CleanupInterval are removed once they are full again,
+// so that removing them never resets a limit. The zero CleanupInterval means one minute.
+type IPRateLimiter struct {
+	ConnectionsPerSecond float64
+	BurstSize            int
+	CleanupInterval      time.Duration
+
+	mu          sync.Mutex
+	limiters    map[string]*ipLimiter
+	lastCleanup time.Time
+}
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewIPRateLimiter creates an IPRateLimiter that allows connectionsPerSecond
+// connections per IP with bursts of up to burstSize connections
+func NewIPRateLimiter(connectionsPerSecond float64, burstSize int) *IPRateLimiter {
+	return &IPRateLimiter{
+		ConnectionsPerSecond: connectionsPerSecond,
+		BurstSize:            burstSize,
+		CleanupInterval:      defaultRateLimitCleanupInterval,
+	}
+}
+
+func (l *IPRateLimiter) Allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.limiters == nil {
+		l.limiters = map[string]*ipLimiter{}
+		l.lastCleanup = now
+	}
+
+	if now.Sub(l.lastCleanup) >= l.cleanupInterval() {
+		l.cleanup(now)
+	}
+
+	ipl, ok := l.limiters[ip]
+	if !ok {
+		ipl = &ipLimiter{
+			limiter: rate.NewLimiter(rate.Limit(l.ConnectionsPerSecond), l.BurstSize),
+		}
+		l.limiters[ip] = ipl
+	}
+	ipl.lastSeen = now
+
+	return ipl.limiter.AllowN(now, 1)
+}
+
+func (l *IPRateLimiter) cleanupInterval() time.Duration {
+	if l.CleanupInterval <= 0 {
+		return defaultRateLimitCleanupInterval
+	}
+	return l.CleanupInterval
+}
+
+// refillDuration returns how long an empty bucket takes to fill up again
+// and false if it never does
+func (l *IPRateLimiter) refillDuration() (time.Duration, bool) {
+	if l.ConnectionsPerSecond <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(l.BurstSize) / l.ConnectionsPerSecond * float64(time.Second)), true
+}
+
+// cleanup removes all limiters that were not used for the cleanup interval
+// and that are full again. Buckets never run below zero, so a bucket that was idle
+// for the refill duration is full.
+func (l *IPRateLimiter) cleanup(now time.Time) {
+	idle := l.cleanupInterval()
+	refill, ok := l.refillDuration()
+	if !ok {
+		l.lastCleanup = now
+		return
+	}
+	if refill > idle {
+		idle = refill
+	}
+
+	for ip, ipl := range l.limiters {
+		if now.Sub(ipl.lastSeen) >= idle {
+			delete(l.limiters, ip)
+		}
+	}
+	l.lastCleanup = now
+}
+
+func (l *IPRateLimiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.limiters)
+}
+
+// addrIP returns the IP part of addr or the whole address if it has no port
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
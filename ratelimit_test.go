@@ -0,0 +1,114 @@
+package infrared
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIPRateLimiter_Allow(t *testing.T) {
+	tt := []struct {
+		name            string
+		burstSize       int
+		connections     int
+		expectedAllowed int
+	}{
+		{
+			name:            "UnderLimit",
+			burstSize:       5,
+			connections:     3,
+			expectedAllowed: 3,
+		},
+		{
+			name:            "OverLimit",
+			burstSize:       5,
+			connections:     10,
+			expectedAllowed: 5,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter := NewIPRateLimiter(0.001, tc.burstSize)
+
+			allowed := 0
+			for i := 0; i < tc.connections; i++ {
+				if limiter.Allow("127.0.0.1") {
+					allowed++
+				}
+			}
+
+			if allowed != tc.expectedAllowed {
+				t.Errorf("got: %d; want: %d", allowed, tc.expectedAllowed)
+			}
+
+			if !limiter.Allow("127.0.0.2") {
+				t.Error("other IP got limited")
+			}
+		})
+	}
+}
+
+func TestIPRateLimiter_ZeroCleanupInterval(t *testing.T) {
+	limiter := &IPRateLimiter{ConnectionsPerSecond: 0.001, BurstSize: 3}
+
+	for i := 0; i < limiter.BurstSize; i++ {
+		if !limiter.Allow("127.0.0.1") {
+			t.Fatalf("connection %d got limited", i)
+		}
+	}
+	if limiter.Allow("127.0.0.1") {
+		t.Error("got: allowed; want: limited after the burst")
+	}
+}
+
+func TestIPRateLimiter_CleanupKeepsDrainedBuckets(t *testing.T) {
+	limiter := NewIPRateLimiter(0.001, 1)
+	limiter.CleanupInterval = 10 * time.Millisecond
+
+	limiter.Allow("127.0.0.1")
+	time.Sleep(20 * time.Millisecond)
+	if limiter.Allow("127.0.0.1") {
+		t.Error("got: allowed; want: limited since the bucket did not refill")
+	}
+}
+
+func TestIPRateLimiter_Cleanup(t *testing.T) {
+	// Buckets refill within 10ms
+	limiter := NewIPRateLimiter(100, 1)
+	limiter.CleanupInterval = 10 * time.Millisecond
+
+	limiter.Allow("127.0.0.1")
+	limiter.Allow("127.0.0.2")
+	if size := limiter.size(); size != 2 {
+		t.Fatalf("got: %d; want: %d", size, 2)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	limiter.Allow("127.0.0.3")
+	if size := limiter.size(); size != 1 {
+		t.Errorf("got: %d; want: %d", size, 1)
+	}
+}
+
+func TestAddrIP(t *testing.T) {
+	tt := []struct {
+		addr net.Addr
+		ip   string
+	}{
+		{
+			addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 25565},
+			ip:   "127.0.0.1",
+		},
+		{
+			addr: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 25565},
+			ip:   "::1",
+		},
+	}
+
+	for _, tc := range tt {
+		if ip := addrIP(tc.addr); ip != tc.ip {
+			t.Errorf("got: %v; want: %v", ip, tc.ip)
+		}
+	}
+}
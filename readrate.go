@@ -0,0 +1,132 @@
+package infrared
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/haveachin/infrared/protocol/handshaking"
+)
+
+// MinReadRate is the minimum rate at which clients have to send data until their handshake and login start are read.
+// Clients that send fewer than Bytes in any Window, like slow-loris attacks do, are disconnected.
+// The zero value disables it.
+type MinReadRate struct {
+	Bytes  int
+	Window time.Duration
+}
+
+func (rate MinReadRate) enabled() bool {
+	return rate.Bytes > 0 && rate.Window > 0
+}
+
+// readRateConn closes its connection if it reads less than its MinReadRate.
+// The rate is enforced until the read deadline is cleared, which ends the handshake phase,
+// or until endReadRate stops it.
+type readRateConn struct {
+	net.Conn
+	rate MinReadRate
+
+	mu      sync.Mutex
+	n       int
+	timer   *time.Timer
+	stopped bool
+}
+
+func newReadRateConn(c net.Conn, rate MinReadRate) *readRateConn {
+	rc := &readRateConn{
+		Conn: c,
+		rate: rate,
+	}
+	rc.mu.Lock()
+	rc.timer = time.AfterFunc(rate.Window, rc.check)
+	rc.mu.Unlock()
+	return rc
+}
+
+func (c *readRateConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.n += n
+	c.mu.Unlock()
+	return n, err
+}
+
+// check closes the connection if it read too little in the last window and starts the next window otherwise
+func (c *readRateConn) check() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return
+	}
+
+	if c.n < c.rate.Bytes {
+		c.stopped = true
+		log.Printf("[w] %s sent %d bytes in %s during its handshake; at least %d are required; closing connection",
+			c.RemoteAddr(), c.n, c.rate.Window, c.rate.Bytes)
+		_ = c.Conn.Close()
+		return
+	}
+
+	c.n = 0
+	c.timer.Reset(c.rate.Window)
+}
+
+func (c *readRateConn) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stopped = true
+	c.timer.Stop()
+}
+
+func (c *readRateConn) SetDeadline(t time.Time) error {
+	if t.IsZero() {
+		c.stop()
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *readRateConn) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		c.stop()
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *readRateConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// endReadRate stops the MinReadRate check of c as soon as the client sent its handshake hs
+// and, for logins, its login start. Clients wait for the server after that, so a slow
+// server must not get them disconnected.
+func endReadRate(c Conn, hs handshaking.ServerBoundHandshake) error {
+	wrapped := c
+	for {
+		unwrapper, ok := wrapped.(interface{ Unwrap() Conn })
+		if !ok {
+			break
+		}
+		wrapped = unwrapper.Unwrap()
+	}
+	base, ok := wrapped.(*conn)
+	if !ok {
+		return nil
+	}
+	rc, ok := base.Conn.(*readRateConn)
+	if !ok {
+		return nil
+	}
+
+	if hs.IsLoginRequest() {
+		if _, err := c.PeekPacket(); err != nil {
+			return err
+		}
+	}
+	rc.stop()
+	return nil
+}
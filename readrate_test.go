@@ -0,0 +1,185 @@
+package infrared
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared/protocol"
+	"github.com/haveachin/infrared/protocol/handshaking"
+	"github.com/haveachin/infrared/protocol/login"
+)
+
+func TestListener_MinReadRate(t *testing.T) {
+	tt := []struct {
+		name           string
+		chunkSize      int
+		endHandshake   bool
+		shouldBeKilled bool
+	}{
+		{
+			name:           "SlowSender",
+			chunkSize:      1,
+			shouldBeKilled: true,
+		},
+		{
+			name:      "FastSender",
+			chunkSize: 32,
+		},
+		{
+			name:         "SlowSenderAfterHandshake",
+			chunkSize:    1,
+			endHandshake: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener := Listener{
+				Listener: l,
+				MinReadRate: MinReadRate{
+					Bytes:  16,
+					Window: 100 * time.Millisecond,
+				},
+			}
+			defer listener.Close()
+
+			go func() {
+				c, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer c.Close()
+
+				chunk := make([]byte, tc.chunkSize)
+				for i := 0; i < 15; i++ {
+					if _, err := c.Write(chunk); err != nil {
+						return
+					}
+					time.Sleep(30 * time.Millisecond)
+				}
+			}()
+
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if tc.endHandshake {
+				if err := conn.SetReadDeadline(time.Time{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err = io.Copy(io.Discard, conn)
+			if killed := err != nil; killed != tc.shouldBeKilled {
+				t.Errorf("got: %v; want: %v", killed, tc.shouldBeKilled)
+			}
+		})
+	}
+}
+
+func TestGateway_MinReadRate_SlowDialer(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name    string
+		portEnd int
+		realIP  bool
+	}{
+		{
+			name:    "Plain",
+			portEnd: 656,
+		},
+		{
+			name:    "RealIP",
+			portEnd: 664,
+			realIP:  true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			hs := handshaking.ServerBoundHandshake{
+				ProtocolVersion: 574,
+				ServerAddress:   protocol.String(serverDomain),
+				ServerPort:      protocol.UnsignedShort(gatewayPort(tc.portEnd)),
+				NextState:       handshaking.ServerBoundHandshakeLoginState,
+			}
+			var gateway Gateway
+			if tc.realIP {
+				signed := signRealIP(t, key, serverDomain, "93.184.216.34:51234", strconv.FormatInt(time.Now().Unix(), 10))
+				hs.ServerAddress = protocol.String(signed)
+				gateway.RealIPPublicKey = &key.PublicKey
+			}
+			hsPk := hs.Marshal()
+			handshake, err := hsPk.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			loginStartPk := login.ServerLoginStart{Name: "Steve"}.Marshal()
+			loginStart, err := loginStartPk.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := append(handshake, loginStart...)
+
+			received := make(chan []byte, 1)
+			l := serveMirrorTarget(t, serverAddr(tc.portEnd), expected, []byte("world"), received)
+			defer l.Close()
+
+			rate := MinReadRate{
+				Bytes:  16,
+				Window: 100 * time.Millisecond,
+			}
+			proxy := &Proxy{
+				Config: createBasicProxyConfig(serverDomain, gatewayAddr(tc.portEnd), serverAddr(tc.portEnd)),
+				// The client sends nothing while the server takes several windows to connect
+				ServerDialer: ServerDialerFunc(func(ctx context.Context, req DialRequest) (Conn, error) {
+					time.Sleep(rate.Window * 5)
+					return Dialer{}.DialServer(ctx, req)
+				}),
+			}
+
+			gateway.MinReadRate = rate
+			if err := gateway.ListenAndServe([]*Proxy{proxy}); err != nil {
+				t.Fatalf("Can't start gateway: %v", err)
+			}
+			defer gateway.Close()
+
+			conn, err := net.Dial("tcp", gatewayAddr(tc.portEnd))
+			if err != nil {
+				t.Fatalf("Can't make a connection with gateway: %v", err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write(expected); err != nil {
+				t.Fatal(err)
+			}
+
+			answer := make([]byte, len("world"))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(conn, answer); err != nil {
+				t.Fatalf("client was disconnected while the server was dialed: %v", err)
+			}
+			if string(answer) != "world" {
+				t.Errorf("got: %q; want: %q", answer, "world")
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package infrared
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haveachin/infrared/protocol/handshaking"
+)
+
+// ErrInvalidRealIP is returned for handshakes without valid signed RealIP data
+var ErrInvalidRealIP = errors.New("invalid RealIP handshake")
+
+// DefaultRealIPMaxAge is how far the timestamp of signed RealIP data may be off if no other age is set
+const DefaultRealIPMaxAge = 30 * time.Second
+
+// ParseRealIPPublicKey parses the PEM encoded ECDSA public key that RealIP handshakes are signed with
+func ParseRealIPPublicKey(bb []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(bb)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is a %T; must be ECDSA", key)
+	}
+	return ecdsaKey, nil
+}
+
+// verifyRealIP checks the signature of the RealIP data in the server address of hs
+// and returns the client address it carries. Signed RealIP data, like TCPShield sends it,
+// has the format host///ip:port///timestamp///signature where signature is the Base64
+// encoded ECDSA signature of the SHA-512 hash of host///ip:port///timestamp.
+// The timestamp may be off from now by at most maxAge in either direction,
+// so that captured handshakes can't be replayed later.
+func verifyRealIP(hs handshaking.ServerBoundHandshake, key *ecdsa.PublicKey, now time.Time, maxAge time.Duration) (net.Addr, error) {
+	addr := strings.SplitN(string(hs.ServerAddress), handshaking.ForgeSeparator, 2)[0]
+	parts := strings.Split(addr, handshaking.RealIPSeparator)
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("%w: no signed RealIP data", ErrInvalidRealIP)
+	}
+
+	timestamp, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid timestamp %q", ErrInvalidRealIP, parts[2])
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid signature encoding", ErrInvalidRealIP)
+	}
+
+	hash := sha512.Sum512([]byte(strings.Join(parts[:3], handshaking.RealIPSeparator)))
+	if !ecdsa.VerifyASN1(key, hash[:], signature) {
+		return nil, fmt.Errorf("%w: signature does not match", ErrInvalidRealIP)
+	}
+
+	if age := now.Sub(time.Unix(timestamp, 0)); age > maxAge || age < -maxAge {
+		return nil, fmt.Errorf("%w: timestamp %d is off by %s", ErrInvalidRealIP, timestamp, age)
+	}
+
+	host, port, err := net.SplitHostPort(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid client address %q", ErrInvalidRealIP, parts[1])
+	}
+	ip := net.ParseIP(host)
+	portNumber, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: invalid client address %q", ErrInvalidRealIP, parts[1])
+	}
+	return &net.TCPAddr{IP: ip, Port: portNumber}, nil
+}
+
+// realIPConn is a Conn with the client address of its RealIP handshake as remote address
+type realIPConn struct {
+	Conn
+	remoteAddr net.Addr
+}
+
+func (c realIPConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// Unwrap returns the wrapped Conn
+func (c realIPConn) Unwrap() Conn {
+	return c.Conn
+}
@@ -0,0 +1,145 @@
+package infrared
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared/protocol"
+	"github.com/haveachin/infrared/protocol/handshaking"
+)
+
+// signRealIP returns host///clientAddr///timestamp///signature signed like TCPShield does
+func signRealIP(t *testing.T, key *ecdsa.PrivateKey, host, clientAddr, timestamp string) string {
+	t.Helper()
+	data := strings.Join([]string{host, clientAddr, timestamp}, handshaking.RealIPSeparator)
+	hash := sha512.Sum512([]byte(data))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data + handshaking.RealIPSeparator + base64.StdEncoding.EncodeToString(signature)
+}
+
+func TestVerifyRealIP(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := signRealIP(t, key, "example.com", "93.184.216.34:51234", "1700000000")
+	signedAt := time.Unix(1700000000, 0)
+	parts := strings.Split(signed, handshaking.RealIPSeparator)
+
+	tt := []struct {
+		name          string
+		serverAddress string
+		age           time.Duration
+		expectedAddr  string
+		expectedErr   bool
+	}{
+		{
+			name:          "Valid",
+			serverAddress: signed,
+			expectedAddr:  "93.184.216.34:51234",
+		},
+		{
+			name:          "ValidWithForge",
+			serverAddress: signed + handshaking.ForgeSeparator + "FML2" + handshaking.ForgeSeparator,
+			expectedAddr:  "93.184.216.34:51234",
+		},
+		{
+			name:          "Delayed",
+			serverAddress: signed,
+			age:           DefaultRealIPMaxAge,
+			expectedAddr:  "93.184.216.34:51234",
+		},
+		{
+			name:          "Expired",
+			serverAddress: signed,
+			age:           DefaultRealIPMaxAge + time.Second,
+			expectedErr:   true,
+		},
+		{
+			name:          "FromTheFuture",
+			serverAddress: signed,
+			age:           -DefaultRealIPMaxAge - time.Second,
+			expectedErr:   true,
+		},
+		{
+			name:          "TamperedIP",
+			serverAddress: strings.Join([]string{parts[0], "1.2.3.4:51234", parts[2], parts[3]}, handshaking.RealIPSeparator),
+			expectedErr:   true,
+		},
+		{
+			name:          "TamperedHost",
+			serverAddress: strings.Join([]string{"evil.com", parts[1], parts[2], parts[3]}, handshaking.RealIPSeparator),
+			expectedErr:   true,
+		},
+		{
+			name:          "Unsigned",
+			serverAddress: strings.Join(parts[:3], handshaking.RealIPSeparator),
+			expectedErr:   true,
+		},
+		{
+			name:          "NoRealIP",
+			serverAddress: "example.com",
+			expectedErr:   true,
+		},
+		{
+			name:          "InvalidSignatureEncoding",
+			serverAddress: strings.Join([]string{parts[0], parts[1], parts[2], "%%%"}, handshaking.RealIPSeparator),
+			expectedErr:   true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			hs := handshaking.ServerBoundHandshake{ServerAddress: protocol.String(tc.serverAddress)}
+			addr, err := verifyRealIP(hs, &key.PublicKey, signedAt.Add(tc.age), DefaultRealIPMaxAge)
+			if tc.expectedErr {
+				if !errors.Is(err, ErrInvalidRealIP) {
+					t.Errorf("got: %v; want: %v", err, ErrInvalidRealIP)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != tc.expectedAddr {
+				t.Errorf("got: %v; want: %v", addr, tc.expectedAddr)
+			}
+		})
+	}
+}
+
+func TestParseRealIPPublicKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	publicKey, err := ParseRealIPPublicKey(bb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !publicKey.Equal(&key.PublicKey) {
+		t.Errorf("got: %v; want: %v", publicKey, key.PublicKey)
+	}
+
+	if _, err := ParseRealIPPublicKey([]byte("not a key")); err == nil {
+		t.Error("got: nil; want: error")
+	}
+}
@@ -0,0 +1,128 @@
+package infrared
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// ReusePortListener holds several sockets that are bound to the same address.
+// On Linux the sockets are opened with SO_REUSEPORT, so that the kernel spreads incoming
+// connections across them. Every socket of Sockets should be served by its own goroutine
+// so that connections are accepted in parallel; Accept funnels all of them through one call.
+// On other platforms it falls back to a single socket.
+type ReusePortListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closed    chan struct{}
+
+	// mu guards starting the accept goroutines of Accept against Close
+	mu        sync.Mutex
+	started   bool
+	isClosed  bool
+	closeErr  error
+	acceptsWg sync.WaitGroup
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// ListenReusePort opens n sockets on addr of network.
+// If the port of addr is 0 all sockets share the port that the first one got.
+func ListenReusePort(network, addr string, n int) (*ReusePortListener, error) {
+	if n < 1 || !reusePortSupported {
+		n = 1
+	}
+
+	lc := net.ListenConfig{Control: reusePortControl}
+	l := &ReusePortListener{
+		accepted: make(chan acceptResult),
+		closed:   make(chan struct{}),
+	}
+	for i := 0; i < n; i++ {
+		socket, err := lc.Listen(context.Background(), network, addr)
+		if err != nil {
+			for _, socket := range l.listeners {
+				socket.Close()
+			}
+			return nil, err
+		}
+		addr = socket.Addr().String()
+		l.listeners = append(l.listeners, socket)
+	}
+	return l, nil
+}
+
+// Sockets returns the sockets of l. Each of them accepts its share of the connections.
+func (l *ReusePortListener) Sockets() []net.Listener {
+	return l.listeners
+}
+
+// Accept waits for the next connection that one of the sockets accepted.
+// The first call starts one goroutine per socket that accepts connections for it.
+func (l *ReusePortListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if !l.started && !l.isClosed {
+		l.started = true
+		for _, socket := range l.listeners {
+			l.acceptsWg.Add(1)
+			go l.acceptLoop(socket)
+		}
+	}
+	l.mu.Unlock()
+
+	select {
+	case res := <-l.accepted:
+		return res.conn, res.err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *ReusePortListener) acceptLoop(socket net.Listener) {
+	defer l.acceptsWg.Done()
+
+	for {
+		conn, err := socket.Accept()
+		select {
+		case l.accepted <- acceptResult{conn: conn, err: err}:
+		case <-l.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// Close closes all sockets and waits for the goroutines of Accept to return
+func (l *ReusePortListener) Close() error {
+	l.mu.Lock()
+	if l.isClosed {
+		l.mu.Unlock()
+		return l.closeErr
+	}
+	l.isClosed = true
+	close(l.closed)
+	for _, socket := range l.listeners {
+		if err := socket.Close(); err != nil && l.closeErr == nil {
+			l.closeErr = err
+		}
+	}
+	l.mu.Unlock()
+
+	l.acceptsWg.Wait()
+	return l.closeErr
+}
+
+// Addr returns the address that all sockets are bound to
+func (l *ReusePortListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
+
+// NumSockets returns the number of sockets that accept connections
+func (l *ReusePortListener) NumSockets() int {
+	return len(l.listeners)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package infrared
+
+import "syscall"
+
+// reusePortSupported is false since only Linux spreads connections across SO_REUSEPORT sockets
+const reusePortSupported = false
+
+var reusePortControl func(network, address string, c syscall.RawConn) error
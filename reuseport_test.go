@@ -0,0 +1,202 @@
+package infrared
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenReusePort(t *testing.T) {
+	tt := []struct {
+		name            string
+		n               int
+		expectedSockets int
+	}{
+		{
+			name:            "SingleSocket",
+			n:               1,
+			expectedSockets: 1,
+		},
+		{
+			name:            "ZeroSockets",
+			n:               0,
+			expectedSockets: 1,
+		},
+		{
+			name:            "FourSockets",
+			n:               4,
+			expectedSockets: 4,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if !reusePortSupported {
+				tc.expectedSockets = 1
+			}
+
+			l, err := ListenReusePort("tcp", "127.0.0.1:0", tc.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			if n := l.NumSockets(); n != tc.expectedSockets {
+				t.Errorf("got: %d sockets; want: %d", n, tc.expectedSockets)
+			}
+
+			conns := 20
+			go func() {
+				for i := 0; i < conns; i++ {
+					c, err := net.Dial("tcp", l.Addr().String())
+					if err != nil {
+						return
+					}
+					c.Write([]byte{byte(i)})
+					c.Close()
+				}
+			}()
+
+			// The kernel decides which socket gets a connection
+			accepted := make(chan error)
+			closed := make(chan error, len(l.Sockets()))
+			for _, socket := range l.Sockets() {
+				go func(socket net.Listener) {
+					for {
+						c, err := socket.Accept()
+						if err != nil {
+							closed <- err
+							return
+						}
+						c.SetReadDeadline(time.Now().Add(time.Second))
+						_, err = c.Read(make([]byte, 1))
+						c.Close()
+						accepted <- err
+					}
+				}(socket)
+			}
+
+			for i := 0; i < conns; i++ {
+				select {
+				case err := <-accepted:
+					if err != nil {
+						t.Errorf("got: %v; want: %v", err, nil)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("got: %d connections; want: %d", i, conns)
+				}
+			}
+
+			if err := l.Close(); err != nil {
+				t.Errorf("got: %v; want: %v", err, nil)
+			}
+			for range l.Sockets() {
+				if err := <-closed; !errors.Is(err, net.ErrClosed) {
+					t.Errorf("got: %v; want: %v", err, net.ErrClosed)
+				}
+			}
+			if _, err := net.DialTimeout("tcp", l.Addr().String(), time.Second); err == nil {
+				t.Error("got: nil; want: error for a dial to a closed listener")
+			}
+		})
+	}
+}
+
+func TestReusePortListener_Accept(t *testing.T) {
+	l, err := ListenReusePort("tcp", "127.0.0.1:0", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Accept gets the connections of every socket
+	conns := 20
+	go func() {
+		for i := 0; i < conns; i++ {
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	for i := 0; i < conns; i++ {
+		accepted := make(chan error, 1)
+		go func() {
+			c, err := l.Accept()
+			if err == nil {
+				c.Close()
+			}
+			accepted <- err
+		}()
+
+		select {
+		case err := <-accepted:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got: %d connections; want: %d", i, conns)
+		}
+	}
+
+	if err := l.Close(); err != nil {
+		t.Errorf("got: %v; want: %v", err, nil)
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got: %v; want: %v", err, net.ErrClosed)
+	}
+}
+
+func TestListenReusePort_AddressInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The address is taken by a socket without SO_REUSEPORT
+	if _, err := ListenReusePort("tcp", l.Addr().String(), 2); err == nil {
+		t.Error("got: nil; want: error for an address that is in use")
+	}
+}
+
+func BenchmarkReusePortListener(b *testing.B) {
+	for _, n := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("Sockets%d", n), func(b *testing.B) {
+			l, err := ListenReusePort("tcp", "127.0.0.1:0", n)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer l.Close()
+
+			for _, socket := range l.Sockets() {
+				go func(socket net.Listener) {
+					for {
+						c, err := socket.Accept()
+						if err != nil {
+							return
+						}
+						c.Close()
+					}
+				}(socket)
+			}
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c, err := net.Dial("tcp", l.Addr().String())
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					c.Close()
+				}
+			})
+		})
+	}
+}
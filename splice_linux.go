@@ -0,0 +1,110 @@
+package infrared
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSpliceSize is the most data that is moved through the kernel pipe at once
+const maxSpliceSize = 1 << 16
+
+// splicePipe moves data from src to dst through a kernel pipe with splice(2),
+// so that it is never copied to user space. Data that src has already buffered is written first.
+// It reports false without touching either connection if they are not both plain TCP connections.
+func splicePipe(src, dst Conn, activity *pipeActivity) (int64, bool, error) {
+	srcConn, srcRaw, ok := spliceConn(src)
+	if !ok {
+		return 0, false, nil
+	}
+	dstConn, dstRaw, ok := spliceConn(dst)
+	if !ok {
+		return 0, false, nil
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	var written int64
+	if buffered := srcConn.r.Buffered(); buffered > 0 {
+		b, _ := srcConn.r.Peek(buffered)
+		n, err := dstConn.Write(b)
+		written += int64(n)
+		if err != nil {
+			return written, true, err
+		}
+		srcConn.r.Discard(n)
+	}
+
+	for {
+		var n int
+		var spliceErr error
+		if err := srcRaw.Read(func(fd uintptr) bool {
+			n, spliceErr = splice(int(fd), p[1], maxSpliceSize)
+			return spliceErr != syscall.EAGAIN
+		}); err != nil {
+			return written, true, err
+		}
+		if spliceErr != nil {
+			return written, true, os.NewSyscallError("splice", spliceErr)
+		}
+		if n == 0 {
+			return written, true, io.EOF
+		}
+		atomic.AddInt64(&srcConn.bytesRead, int64(n))
+		if activity != nil {
+			activity.touch()
+		}
+
+		for n > 0 {
+			var m int
+			if err := dstRaw.Write(func(fd uintptr) bool {
+				m, spliceErr = splice(p[0], int(fd), n)
+				return spliceErr != syscall.EAGAIN
+			}); err != nil {
+				return written, true, err
+			}
+			if spliceErr != nil {
+				return written, true, os.NewSyscallError("splice", spliceErr)
+			}
+			if m == 0 {
+				return written, true, io.ErrShortWrite
+			}
+			n -= m
+			written += int64(m)
+			atomic.AddInt64(&dstConn.bytesWritten, int64(m))
+		}
+	}
+}
+
+// splice moves up to n bytes from rfd to wfd without blocking.
+// syscall.Splice returns an int64 on some architectures and an int on others.
+func splice(rfd, wfd, n int) (int, error) {
+	written, err := syscall.Splice(rfd, nil, wfd, nil, n, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+	return int(written), err
+}
+
+// spliceConn returns the raw socket of c if it is a TCP connection without encryption
+func spliceConn(c Conn) (*conn, syscall.RawConn, bool) {
+	wrapped, ok := c.(*conn)
+	if !ok || !wrapped.isPlain() {
+		return nil, nil, false
+	}
+	tcpConn, ok := wrapped.Conn.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, nil, false
+	}
+	return wrapped, raw, true
+}
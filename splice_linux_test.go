@@ -0,0 +1,212 @@
+package infrared
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a TCP connection on the loopback interface
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	c2, ok := <-accepted
+	if !ok {
+		tb.Fatal("failed to accept connection")
+	}
+	tb.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return c1, c2
+}
+
+func TestSplicePipe(t *testing.T) {
+	client, srcNetConn := tcpPair(t)
+	dstNetConn, server := tcpPair(t)
+	src, dst := wrapConn(srcNetConn), wrapConn(dstNetConn)
+
+	data := bytes.Repeat([]byte("infrared"), 100000)
+	if _, err := client.Write(data[:8]); err != nil {
+		t.Fatal(err)
+	}
+	// The first bytes are already buffered when the splicing starts
+	if _, err := src.Reader().Peek(8); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		client.Write(data[8:])
+		client.Close()
+	}()
+
+	received := make(chan []byte)
+	go func() {
+		bb, _ := io.ReadAll(server)
+		received <- bb
+	}()
+
+	written, ok, err := splicePipe(src, dst, nil)
+	if !ok {
+		t.Fatal("got: not spliced; want: spliced")
+	}
+	if err != io.EOF {
+		t.Errorf("got: %v; want: %v", err, io.EOF)
+	}
+	if written != int64(len(data)) {
+		t.Errorf("got: %d bytes; want: %d", written, len(data))
+	}
+	if n := src.BytesRead(); n != int64(len(data)) {
+		t.Errorf("got: %d bytes read; want: %d", n, len(data))
+	}
+	if n := dst.BytesWritten(); n != int64(len(data)) {
+		t.Errorf("got: %d bytes written; want: %d", n, len(data))
+	}
+
+	dstNetConn.Close()
+	if bb := <-received; !bytes.Equal(bb, data) {
+		t.Errorf("got: %d bytes; want: the %d bytes that were sent", len(bb), len(data))
+	}
+}
+
+func TestSplicePipe_Fallback(t *testing.T) {
+	_, tcpConn := tcpPair(t)
+	pipeConn, _ := net.Pipe()
+	defer pipeConn.Close()
+
+	block, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cipherTCPConn := tcpPair(t)
+	encrypted := wrapConn(cipherTCPConn)
+	encrypted.SetCipher(cipher.NewCFBEncrypter(block, make([]byte, 16)), cipher.NewCFBDecrypter(block, make([]byte, 16)))
+
+	tt := []struct {
+		name string
+		src  Conn
+		dst  Conn
+	}{
+		{
+			name: "NonTCPSource",
+			src:  wrapConn(pipeConn),
+			dst:  wrapConn(tcpConn),
+		},
+		{
+			name: "NonTCPDestination",
+			src:  wrapConn(tcpConn),
+			dst:  wrapConn(pipeConn),
+		},
+		{
+			name: "Encrypted",
+			src:  encrypted,
+			dst:  wrapConn(tcpConn),
+		},
+		{
+			name: "Throttled",
+			src:  NewThrottledConn(wrapConn(tcpConn), 1024, 1024),
+			dst:  wrapConn(tcpConn),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, ok, _ := splicePipe(tc.src, tc.dst, nil); ok {
+				t.Error("got: spliced; want: not spliced")
+			}
+		})
+	}
+}
+
+func BenchmarkPipe_Splice(b *testing.B) {
+	const size = 1 << 30
+
+	tt := []struct {
+		name string
+		pipe func(src, dst Conn) (int64, error)
+	}{
+		{
+			name: "Buffered",
+			pipe: func(src, dst Conn) (int64, error) {
+				return bufferedPipe(src, dst, DefaultPipeBufferSize, nil, nil)
+			},
+		},
+		{
+			name: "Splice",
+			pipe: func(src, dst Conn) (int64, error) {
+				return pipe(src, dst, DefaultPipeBufferSize, nil, nil)
+			},
+		},
+	}
+
+	chunk := make([]byte, 64<<10)
+	for _, tc := range tt {
+		b.Run(tc.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				client, srcNetConn := tcpPair(b)
+				dstNetConn, server := tcpPair(b)
+				go func() {
+					for sent := 0; sent < size; sent += len(chunk) {
+						if _, err := client.Write(chunk); err != nil {
+							return
+						}
+					}
+					client.Close()
+				}()
+				done := make(chan struct{})
+				go func() {
+					io.Copy(io.Discard, server)
+					close(done)
+				}()
+				b.StartTimer()
+
+				if n, err := tc.pipe(wrapConn(srcNetConn), wrapConn(dstNetConn)); err != io.EOF || n != size {
+					b.Fatalf("got: %d bytes, %v; want: %d bytes, %v", n, err, size, io.EOF)
+				}
+				dstNetConn.Close()
+				<-done
+			}
+		})
+	}
+}
+
+func TestPipeContextWithTap_TCP(t *testing.T) {
+	client, c1 := tcpPair(t)
+	c2, server := tcpPair(t)
+
+	serverBound := bytes.Repeat([]byte("infrared"), 100)
+	clientBound := bytes.Repeat([]byte("derarfni"), 100)
+
+	// Spliced data never reaches user space, so tapped connections have to be copied
+	recorder := &tapRecorder{}
+	pipeWithTap(t, client, c1, c2, server, recorder.tap, serverBound, clientBound)
+
+	if data := recorder.waitFor(DirectionServerBound, len(serverBound)); !bytes.Equal(data, serverBound) {
+		t.Errorf("server bound: got: %d bytes; want: %d", len(data), len(serverBound))
+	}
+	if data := recorder.waitFor(DirectionClientBound, len(clientBound)); !bytes.Equal(data, clientBound) {
+		t.Errorf("client bound: got: %d bytes; want: %d", len(data), len(clientBound))
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package infrared
+
+// splicePipe reports false since splice(2) only exists on Linux
+func splicePipe(src, dst Conn, activity *pipeActivity) (int64, bool, error) {
+	return 0, false, nil
+}
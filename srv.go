@@ -0,0 +1,120 @@
+package infrared
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minecraftSRVService = "minecraft"
+	minecraftSRVProto   = "tcp"
+	minecraftPort       = "25565"
+)
+
+// SRVResolver looks up SRV records. It is implemented by *net.Resolver.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// SRVCache resolves addresses without a port like the Minecraft client does.
+// The address of the _minecraft._tcp SRV record of the host is used if it exists,
+// otherwise the host with the default port 25565.
+// Results are cached for TTL since the Go resolver does not expose record TTLs.
+// If the SRV record has several targets, every call picks one of them by priority
+// and weight as described in RFC 2782.
+type SRVCache struct {
+	Resolver SRVResolver
+	TTL      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]srvEntry
+}
+
+type srvEntry struct {
+	// records is empty if the host has no SRV record
+	records []*net.SRV
+	expires time.Time
+}
+
+var defaultSRVCache = &SRVCache{
+	Resolver: net.DefaultResolver,
+	TTL:      time.Minute,
+}
+
+// Resolve returns addr unchanged if it has a port and resolves it otherwise
+func (cache *SRVCache) Resolve(ctx context.Context, addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+
+	cache.mu.Lock()
+	entry, ok := cache.entries[addr]
+	cache.mu.Unlock()
+	if !ok || !time.Now().Before(entry.expires) {
+		entry = srvEntry{
+			records: cache.lookup(ctx, addr),
+			expires: time.Now().Add(cache.TTL),
+		}
+
+		cache.mu.Lock()
+		if cache.entries == nil {
+			cache.entries = map[string]srvEntry{}
+		}
+		cache.entries[addr] = entry
+		cache.mu.Unlock()
+	}
+
+	record := selectSRV(entry.records)
+	if record == nil {
+		return net.JoinHostPort(addr, minecraftPort)
+	}
+	target := strings.TrimSuffix(record.Target, ".")
+	return net.JoinHostPort(target, strconv.Itoa(int(record.Port)))
+}
+
+func (cache *SRVCache) lookup(ctx context.Context, host string) []*net.SRV {
+	_, records, err := cache.Resolver.LookupSRV(ctx, minecraftSRVService, minecraftSRVProto, host)
+	if err != nil {
+		return nil
+	}
+	return records
+}
+
+// selectSRV picks a record of the lowest priority at random, weighted by the weights
+// of the records like RFC 2782 describes. Records with a weight of zero are only
+// picked if all records of the priority have a weight of zero.
+func selectSRV(records []*net.SRV) *net.SRV {
+	var candidates []*net.SRV
+	total := 0
+	for _, record := range records {
+		if len(candidates) > 0 && record.Priority > candidates[0].Priority {
+			continue
+		}
+		if len(candidates) > 0 && record.Priority < candidates[0].Priority {
+			candidates, total = nil, 0
+		}
+		candidates = append(candidates, record)
+		total += int(record.Weight)
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+	if total == 0 {
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	n := rand.Intn(total)
+	for _, record := range candidates {
+		n -= int(record.Weight)
+		if n < 0 {
+			return record
+		}
+	}
+	return candidates[len(candidates)-1]
+}
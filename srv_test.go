@@ -0,0 +1,211 @@
+package infrared
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockSRVResolver struct {
+	mu      sync.Mutex
+	records map[string][]*net.SRV
+	lookups int
+}
+
+func (r *mockSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+
+	cname := "_" + service + "._" + proto + "." + name
+	records, ok := r.records[cname]
+	if !ok {
+		return "", nil, errors.New("no such host")
+	}
+	return cname, records, nil
+}
+
+func TestSRVCache_Resolve(t *testing.T) {
+	resolver := &mockSRVResolver{
+		records: map[string][]*net.SRV{
+			"_minecraft._tcp.mc.example.com": {
+				{Target: "node1.example.com.", Port: 25577},
+			},
+		},
+	}
+
+	tt := []struct {
+		name     string
+		addr     string
+		expected string
+	}{
+		{
+			name:     "SRVRecord",
+			addr:     "mc.example.com",
+			expected: "node1.example.com:25577",
+		},
+		{
+			name:     "NoSRVRecord",
+			addr:     "example.com",
+			expected: "example.com:25565",
+		},
+		{
+			name:     "WithPort",
+			addr:     "mc.example.com:25566",
+			expected: "mc.example.com:25566",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cache := SRVCache{Resolver: resolver, TTL: time.Minute}
+			if got := cache.Resolve(context.Background(), tc.addr); got != tc.expected {
+				t.Errorf("got: %v; want: %v", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSRVCache_TTL(t *testing.T) {
+	resolver := &mockSRVResolver{}
+	cache := SRVCache{Resolver: resolver, TTL: 20 * time.Millisecond}
+
+	cache.Resolve(context.Background(), "mc.example.com")
+	cache.Resolve(context.Background(), "mc.example.com")
+	if resolver.lookups != 1 {
+		t.Errorf("got: %d lookups; want: %d", resolver.lookups, 1)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	cache.Resolve(context.Background(), "mc.example.com")
+	if resolver.lookups != 2 {
+		t.Errorf("got: %d lookups; want: %d", resolver.lookups, 2)
+	}
+}
+
+func TestDialer_DialSRV(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	dialer := Dialer{
+		SRV: &SRVCache{
+			Resolver: &mockSRVResolver{
+				records: map[string][]*net.SRV{
+					"_minecraft._tcp.mc.example.com": {
+						{Target: "127.0.0.1.", Port: uint16(port)},
+					},
+				},
+			},
+			TTL: time.Minute,
+		},
+	}
+
+	conn, err := dialer.Dial("mc.example.com")
+	if err != nil {
+		t.Fatalf("Can't dial resolved address: %v", err)
+	}
+	defer conn.Close()
+
+	if got := conn.RemoteAddr().String(); got != "127.0.0.1:"+strconv.Itoa(port) {
+		t.Errorf("got: %v; want: %v", got, listener.Addr())
+	}
+}
+
+func TestSelectSRV(t *testing.T) {
+	tt := []struct {
+		name     string
+		records  []*net.SRV
+		expected map[string]float64
+	}{
+		{
+			name:     "NoRecords",
+			expected: map[string]float64{},
+		},
+		{
+			name: "LowestPriority",
+			records: []*net.SRV{
+				{Target: "backup", Priority: 20, Weight: 100},
+				{Target: "primary", Priority: 10, Weight: 1},
+			},
+			expected: map[string]float64{"primary": 1},
+		},
+		{
+			name: "Weighted",
+			records: []*net.SRV{
+				{Target: "big", Priority: 10, Weight: 3},
+				{Target: "small", Priority: 10, Weight: 1},
+				{Target: "unused", Priority: 10, Weight: 0},
+			},
+			expected: map[string]float64{"big": 0.75, "small": 0.25},
+		},
+		{
+			name: "ZeroWeights",
+			records: []*net.SRV{
+				{Target: "a", Priority: 10},
+				{Target: "b", Priority: 10},
+			},
+			expected: map[string]float64{"a": 0.5, "b": 0.5},
+		},
+	}
+
+	const picks = 4000
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			counts := map[string]int{}
+			for i := 0; i < picks; i++ {
+				if record := selectSRV(tc.records); record != nil {
+					counts[record.Target]++
+				}
+			}
+
+			if len(counts) != len(tc.expected) {
+				t.Fatalf("got: %v; want: %v", counts, tc.expected)
+			}
+			for target, share := range tc.expected {
+				got := float64(counts[target]) / picks
+				if got < share-0.05 || got > share+0.05 {
+					t.Errorf("%s: got: %.2f; want: %.2f", target, got, share)
+				}
+			}
+		})
+	}
+}
+
+func TestSRVCache_ResolveWeighted(t *testing.T) {
+	resolver := &mockSRVResolver{
+		records: map[string][]*net.SRV{
+			"_minecraft._tcp.mc.example.com": {
+				{Target: "node1.example.com.", Port: 25577, Priority: 10, Weight: 1},
+				{Target: "node2.example.com.", Port: 25578, Priority: 10, Weight: 1},
+			},
+		},
+	}
+	cache := SRVCache{Resolver: resolver, TTL: time.Minute}
+
+	// The cached record is picked from again on every call
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		seen[cache.Resolve(context.Background(), "mc.example.com")] = true
+	}
+
+	expected := map[string]bool{"node1.example.com:25577": true, "node2.example.com:25578": true}
+	if len(seen) != len(expected) {
+		t.Errorf("got: %v; want: %v", seen, expected)
+	}
+	for addr := range expected {
+		if !seen[addr] {
+			t.Errorf("got: %v; want: %v", seen, expected)
+		}
+	}
+	if resolver.lookups != 1 {
+		t.Errorf("got: %d lookups; want: %d", resolver.lookups, 1)
+	}
+}
@@ -0,0 +1,65 @@
+package infrared
+
+import (
+	"sync"
+	"time"
+
+	"github.com/haveachin/infrared/protocol"
+)
+
+// statusCache caches a status response packet for a limited time.
+// Concurrent calls on a cache miss share a single fetch.
+type statusCache struct {
+	mu       sync.Mutex
+	packet   protocol.Packet
+	expires  time.Time
+	inflight *statusFetch
+}
+
+type statusFetch struct {
+	done   chan struct{}
+	packet protocol.Packet
+	err    error
+}
+
+// get returns the cached packet if it is younger than ttl and
+// calls fetch to refresh the cache otherwise
+func (cache *statusCache) get(ttl time.Duration, fetch func() (protocol.Packet, error)) (protocol.Packet, error) {
+	cache.mu.Lock()
+	if time.Now().Before(cache.expires) {
+		pk := cache.packet
+		cache.mu.Unlock()
+		return pk, nil
+	}
+
+	if f := cache.inflight; f != nil {
+		cache.mu.Unlock()
+		<-f.done
+		return f.packet, f.err
+	}
+
+	f := &statusFetch{done: make(chan struct{})}
+	cache.inflight = f
+	cache.mu.Unlock()
+
+	f.packet, f.err = fetch()
+
+	cache.mu.Lock()
+	if f.err == nil {
+		cache.packet = f.packet
+		cache.expires = time.Now().Add(ttl)
+	}
+	cache.inflight = nil
+	cache.mu.Unlock()
+	close(f.done)
+
+	return f.packet, f.err
+}
+
+// invalidate drops the cached packet so that the next get fetches a new one
+func (cache *statusCache) invalidate() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.packet = protocol.Packet{}
+	cache.expires = time.Time{}
+}
@@ -0,0 +1,108 @@
+package infrared
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haveachin/infrared/protocol"
+)
+
+func TestStatusCache_Get(t *testing.T) {
+	tt := []struct {
+		name      string
+		ttl       time.Duration
+		calls     int
+		sleep     time.Duration
+		err       error
+		wantFetch int32
+	}{
+		{
+			name:      "ConcurrentMissCoalesces",
+			ttl:       time.Minute,
+			calls:     50,
+			wantFetch: 1,
+		},
+		{
+			name:      "ExpiredEntryRefetches",
+			ttl:       time.Millisecond,
+			calls:     2,
+			sleep:     10 * time.Millisecond,
+			wantFetch: 2,
+		},
+		{
+			name:      "ErrorIsNotCached",
+			ttl:       time.Minute,
+			calls:     2,
+			sleep:     10 * time.Millisecond,
+			err:       errors.New("offline"),
+			wantFetch: 2,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var cache statusCache
+			var fetches int32
+			wantPk := protocol.Packet{ID: 0x00, Data: []byte("status")}
+			fetch := func() (protocol.Packet, error) {
+				atomic.AddInt32(&fetches, 1)
+				time.Sleep(5 * time.Millisecond)
+				return wantPk, tc.err
+			}
+
+			if tc.sleep > 0 {
+				for i := 0; i < tc.calls; i++ {
+					if _, err := cache.get(tc.ttl, fetch); err != tc.err {
+						t.Errorf("got: %v; want: %v", err, tc.err)
+					}
+					time.Sleep(tc.sleep)
+				}
+			} else {
+				var wg sync.WaitGroup
+				for i := 0; i < tc.calls; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						pk, err := cache.get(tc.ttl, fetch)
+						if err != tc.err {
+							t.Errorf("got: %v; want: %v", err, tc.err)
+						}
+						if string(pk.Data) != string(wantPk.Data) {
+							t.Errorf("got: %v; want: %v", pk, wantPk)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+
+			if got := atomic.LoadInt32(&fetches); got != tc.wantFetch {
+				t.Errorf("got: %d fetches; want: %d", got, tc.wantFetch)
+			}
+		})
+	}
+}
+
+func TestStatusCache_Invalidate(t *testing.T) {
+	var cache statusCache
+	fetches := 0
+	fetch := func() (protocol.Packet, error) {
+		fetches++
+		return protocol.Packet{ID: 0x00, Data: []byte{byte(fetches)}}, nil
+	}
+
+	cache.get(time.Minute, fetch)
+	cache.get(time.Minute, fetch)
+	cache.invalidate()
+	pk, _ := cache.get(time.Minute, fetch)
+
+	if fetches != 2 {
+		t.Errorf("got: %d fetches; want: %d", fetches, 2)
+	}
+
+	if pk.Data[0] != 2 {
+		t.Errorf("got: %v; want: %v", pk.Data[0], 2)
+	}
+}
@@ -0,0 +1,86 @@
+package infrared
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// StickySessionStore remembers the server of every player for TTL,
+// so that players who reconnect are routed back to the server their session is on.
+// Every assignment renews the TTL of the player. The zero value keeps assignments forever.
+type StickySessionStore struct {
+	TTL time.Duration
+
+	mu         sync.Mutex
+	sessions   map[uuid.UUID]stickySession
+	lastPruned time.Time
+}
+
+type stickySession struct {
+	addr      string
+	expiresAt time.Time
+}
+
+func (s stickySession) expired(now time.Time) bool {
+	return !s.expiresAt.IsZero() && now.After(s.expiresAt)
+}
+
+// Server returns the address of the server that id was assigned to within the TTL
+func (store *StickySessionStore) Server(id uuid.UUID) (string, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	session, ok := store.sessions[id]
+	if !ok {
+		return "", false
+	}
+	if session.expired(time.Now()) {
+		delete(store.sessions, id)
+		return "", false
+	}
+	return session.addr, true
+}
+
+// Assign routes id to the server addr until the TTL expires.
+// Expired sessions are pruned at most once per TTL.
+func (store *StickySessionStore) Assign(id uuid.UUID, addr string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	if store.sessions == nil {
+		store.sessions = map[uuid.UUID]stickySession{}
+	}
+	if store.TTL > 0 && now.Sub(store.lastPruned) >= store.TTL {
+		for sessionID, session := range store.sessions {
+			if session.expired(now) {
+				delete(store.sessions, sessionID)
+			}
+		}
+		store.lastPruned = now
+	}
+
+	session := stickySession{addr: addr}
+	if store.TTL > 0 {
+		session.expiresAt = now.Add(store.TTL)
+	}
+	store.sessions[id] = session
+}
+
+// ClearSession removes the server assignment of id
+func (store *StickySessionStore) ClearSession(id uuid.UUID) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.sessions, id)
+}
+
+// loginUUID peeks the login start of conn and returns the offline UUID of the player
+func loginUUID(conn Conn) (uuid.UUID, error) {
+	loginStart, err := peekLoginStart(conn)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.FromString(loginStart.OfflineUUID())
+}
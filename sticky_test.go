@@ -0,0 +1,84 @@
+package infrared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+func TestStickySessionStore(t *testing.T) {
+	ttl := 50 * time.Millisecond
+	steve := uuid.Must(uuid.NewV4())
+	alex := uuid.Must(uuid.NewV4())
+
+	tt := []struct {
+		name         string
+		action       func(store *StickySessionStore)
+		id           uuid.UUID
+		expectedAddr string
+	}{
+		{
+			name:   "Unknown",
+			action: func(store *StickySessionStore) {},
+			id:     steve,
+		},
+		{
+			name: "WithinTTL",
+			action: func(store *StickySessionStore) {
+				store.Assign(steve, "server-1")
+				store.Assign(alex, "server-2")
+			},
+			id:           steve,
+			expectedAddr: "server-1",
+		},
+		{
+			name: "Reassigned",
+			action: func(store *StickySessionStore) {
+				store.Assign(steve, "server-1")
+				store.Assign(steve, "server-2")
+			},
+			id:           steve,
+			expectedAddr: "server-2",
+		},
+		{
+			name: "Expired",
+			action: func(store *StickySessionStore) {
+				store.Assign(steve, "server-1")
+				time.Sleep(ttl * 2)
+			},
+			id: steve,
+		},
+		{
+			name: "Cleared",
+			action: func(store *StickySessionStore) {
+				store.Assign(steve, "server-1")
+				store.ClearSession(steve)
+			},
+			id: steve,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &StickySessionStore{TTL: ttl}
+			tc.action(store)
+
+			addr, ok := store.Server(tc.id)
+			if ok != (tc.expectedAddr != "") || addr != tc.expectedAddr {
+				t.Errorf("got: %q, %v; want: %q", addr, ok, tc.expectedAddr)
+			}
+		})
+	}
+}
+
+func TestStickySessionStore_PrunesExpired(t *testing.T) {
+	store := &StickySessionStore{TTL: 20 * time.Millisecond}
+	store.Assign(uuid.Must(uuid.NewV4()), "server-1")
+	time.Sleep(40 * time.Millisecond)
+	store.Assign(uuid.Must(uuid.NewV4()), "server-2")
+
+	if len(store.sessions) != 1 {
+		t.Errorf("got: %d sessions; want: 1", len(store.sessions))
+	}
+}
@@ -0,0 +1,86 @@
+package infrared
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// tapQueueLength is the number of chunks a tap can fall behind before chunks are dropped
+const tapQueueLength = 256
+
+// Tap receives a copy of every chunk a pipe relays and the direction it was relayed in.
+// Like for middleware, c1 is the client, so data from c1 to c2 is DirectionServerBound.
+// Chunks are raw bytes as they are sent over the connection, so they may be compressed or
+// split in the middle of a packet. Taps are called one chunk at a time on a goroutine of their own,
+// so they can't stall the pipe; chunks are dropped instead while a tap falls behind.
+// Taps only observe the data and must not mutate it. They get a copy that they may keep,
+// so what is relayed is never affected.
+type Tap func(direction Direction, data []byte)
+
+type tapChunk struct {
+	direction Direction
+	data      []byte
+}
+
+// pipeTap hands the chunks of a pipe to its Tap in the background
+type pipeTap struct {
+	tap     Tap
+	chunks  chan tapChunk
+	dropped int64
+}
+
+func newPipeTap(tap Tap) *pipeTap {
+	t := &pipeTap{
+		tap:    tap,
+		chunks: make(chan tapChunk, tapQueueLength),
+	}
+	go t.run()
+	return t
+}
+
+func (t *pipeTap) run() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[w] Tap panicked and stops receiving data; error: %v", r)
+			for range t.chunks {
+			}
+		}
+	}()
+
+	for chunk := range t.chunks {
+		t.tap(chunk.direction, chunk.data)
+	}
+}
+
+// send queues a copy of data for the tap or drops it if the queue is full
+func (t *pipeTap) send(direction Direction, data []byte) {
+	chunk := tapChunk{
+		direction: direction,
+		data:      append([]byte(nil), data...),
+	}
+
+	select {
+	case t.chunks <- chunk:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+// close lets the tap finish the queued chunks without waiting for it.
+// No chunks may be sent after close.
+func (t *pipeTap) close() {
+	close(t.chunks)
+	if dropped := atomic.LoadInt64(&t.dropped); dropped > 0 {
+		log.Printf("[w] Tap fell behind and missed %d chunks", dropped)
+	}
+}
+
+// tapFunc returns a func that sends chunks of direction to t or nil if t is nil
+func (t *pipeTap) tapFunc(direction Direction) func([]byte) {
+	if t == nil {
+		return nil
+	}
+	return func(data []byte) {
+		t.send(direction, data)
+	}
+}
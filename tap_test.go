@@ -0,0 +1,168 @@
+package infrared
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tapRecorder records the data a Tap receives by direction
+type tapRecorder struct {
+	mu   sync.Mutex
+	data map[Direction][]byte
+}
+
+func (r *tapRecorder) tap(direction Direction, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.data == nil {
+		r.data = map[Direction][]byte{}
+	}
+	r.data[direction] = append(r.data[direction], data...)
+}
+
+// waitFor waits until the tap received n bytes in direction and returns them
+func (r *tapRecorder) waitFor(direction Direction, n int) []byte {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		data := append([]byte(nil), r.data[direction]...)
+		r.mu.Unlock()
+		if len(data) >= n || time.Now().After(deadline) {
+			return data
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// pipeWithTap pipes between client and server through c1 and c2 with tap and sends
+// serverBound from the client and clientBound from the server before closing the client
+func pipeWithTap(t *testing.T, client, c1, c2, server net.Conn, tap Tap, serverBound, clientBound []byte) PipeResult {
+	resultCh := make(chan PipeResult, 1)
+	go func() {
+		resultCh <- PipeContextWithTap(context.Background(), wrapConn(c1), wrapConn(c2), 16, 0, tap)
+	}()
+
+	go server.Write(clientBound)
+	received := make([]byte, len(clientBound))
+	if _, err := io.ReadFull(client, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, clientBound) {
+		t.Errorf("client received: got: %q; want: %q", received, clientBound)
+	}
+
+	go func() {
+		client.Write(serverBound)
+		client.Close()
+	}()
+	received = make([]byte, len(serverBound))
+	if _, err := io.ReadFull(server, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, serverBound) {
+		t.Errorf("server received: got: %q; want: %q", received, serverBound)
+	}
+
+	select {
+	case result := <-resultCh:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipe did not return")
+		return PipeResult{}
+	}
+}
+
+func TestPipeContextWithTap(t *testing.T) {
+	client, c1 := net.Pipe()
+	c2, server := net.Pipe()
+	defer server.Close()
+
+	serverBound := bytes.Repeat([]byte("to the server;"), 10)
+	clientBound := bytes.Repeat([]byte("to the client;"), 5)
+
+	recorder := &tapRecorder{}
+	result := pipeWithTap(t, client, c1, c2, server, recorder.tap, serverBound, clientBound)
+	if result.Err != nil {
+		t.Errorf("got: %v; want: nil", result.Err)
+	}
+
+	if data := recorder.waitFor(DirectionServerBound, len(serverBound)); !bytes.Equal(data, serverBound) {
+		t.Errorf("server bound: got: %q; want: %q", data, serverBound)
+	}
+	if data := recorder.waitFor(DirectionClientBound, len(clientBound)); !bytes.Equal(data, clientBound) {
+		t.Errorf("client bound: got: %q; want: %q", data, clientBound)
+	}
+}
+
+func TestPipeContextWithTap_KeptData(t *testing.T) {
+	client, c1 := net.Pipe()
+	c2, server := net.Pipe()
+	defer server.Close()
+
+	var mu sync.Mutex
+	var chunks [][]byte
+	tap := func(direction Direction, data []byte) {
+		if direction != DirectionServerBound {
+			return
+		}
+		mu.Lock()
+		chunks = append(chunks, data)
+		mu.Unlock()
+	}
+
+	serverBound := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	pipeWithTap(t, client, c1, c2, server, tap, serverBound, []byte("clientbound"))
+
+	// The chunks must not share the buffer of the pipe that is reused for the next read
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		data := bytes.Join(chunks, nil)
+		mu.Unlock()
+		if bytes.Equal(data, serverBound) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got: %q; want: %q", data, serverBound)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPipeContextWithTap_BlockedTap(t *testing.T) {
+	client, c1 := net.Pipe()
+	c2, server := net.Pipe()
+	defer server.Close()
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	tap := func(direction Direction, data []byte) {
+		<-unblock
+	}
+
+	// Far more chunks of 16 bytes than the tap can queue
+	data := make([]byte, 16*tapQueueLength*4)
+	result := pipeWithTap(t, client, c1, c2, server, tap, data, data)
+	if result.BytesC1ToC2 != int64(len(data)) || result.BytesC2ToC1 != int64(len(data)) {
+		t.Errorf("got: %d and %d bytes; want: %d", result.BytesC1ToC2, result.BytesC2ToC1, len(data))
+	}
+}
+
+func TestPipeContextWithTap_PanickingTap(t *testing.T) {
+	client, c1 := net.Pipe()
+	c2, server := net.Pipe()
+	defer server.Close()
+
+	tap := func(direction Direction, data []byte) {
+		panic("tap failed")
+	}
+	result := pipeWithTap(t, client, c1, c2, server, tap, []byte("serverbound"), []byte("clientbound"))
+	if result.Err != nil {
+		t.Errorf("got: %v; want: nil", result.Err)
+	}
+}
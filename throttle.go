@@ -0,0 +1,100 @@
+package infrared
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// ThrottledConn limits the bytes per second that are read from and written to a Conn
+// with a token bucket for each direction. The buckets hold the bytes of one second,
+// so reads and writes are split into chunks of at most that size.
+// Closing the connection ends every wait for the buckets.
+type ThrottledConn struct {
+	Conn
+
+	readLimiter  *rate.Limiter
+	writeLimiter *rate.Limiter
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewThrottledConn throttles reads from c to readBytesPerSec and writes to c to writeBytesPerSec.
+// A rate of zero or less leaves its direction unlimited.
+func NewThrottledConn(c Conn, readBytesPerSec, writeBytesPerSec int) *ThrottledConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ThrottledConn{
+		Conn:         c,
+		readLimiter:  newByteLimiter(readBytesPerSec),
+		writeLimiter: newByteLimiter(writeBytesPerSec),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+func newByteLimiter(bytesPerSec int) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), bytesPerSec)
+}
+
+func (c *ThrottledConn) Read(b []byte) (int, error) {
+	if c.readLimiter == nil {
+		return c.Conn.Read(b)
+	}
+
+	if len(b) > c.readLimiter.Burst() {
+		b = b[:c.readLimiter.Burst()]
+	}
+	n, err := c.Conn.Read(b)
+	if throttleErr := c.throttle(c.readLimiter, n); err == nil {
+		err = throttleErr
+	}
+	return n, err
+}
+
+func (c *ThrottledConn) Write(b []byte) (int, error) {
+	if c.writeLimiter == nil {
+		return c.Conn.Write(b)
+	}
+
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > c.writeLimiter.Burst() {
+			chunk = chunk[:c.writeLimiter.Burst()]
+		}
+		if err := c.throttle(c.writeLimiter, len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close closes the connection and ends its waits for the buckets
+func (c *ThrottledConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// throttle takes n bytes from limiter and waits until they are available or the connection is closed.
+// n must not exceed the burst of limiter.
+func (c *ThrottledConn) throttle(limiter *rate.Limiter, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if err := limiter.WaitN(c.ctx, n); err != nil {
+		return net.ErrClosed
+	}
+	return nil
+}
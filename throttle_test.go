@@ -0,0 +1,157 @@
+package infrared
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestThrottledConn(t *testing.T) {
+	bytesPerSec := 1000
+
+	tt := []struct {
+		name       string
+		throttle   func(c Conn) Conn
+		throttleC1 bool
+	}{
+		{
+			name: "Read",
+			throttle: func(c Conn) Conn {
+				return NewThrottledConn(c, bytesPerSec, 0)
+			},
+			throttleC1: false,
+		},
+		{
+			name: "Write",
+			throttle: func(c Conn) Conn {
+				return NewThrottledConn(c, 0, bytesPerSec)
+			},
+			throttleC1: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+
+			writer, reader := wrapConn(c1), wrapConn(c2)
+			var w io.Writer = writer
+			var r io.Reader = reader
+			if tc.throttleC1 {
+				w = tc.throttle(writer)
+			} else {
+				r = tc.throttle(reader)
+			}
+
+			// The first second worth of bytes passes as burst, the rest takes half a second
+			payload := make([]byte, bytesPerSec*3/2)
+			go func() {
+				_, _ = w.Write(payload)
+			}()
+
+			start := time.Now()
+			if _, err := io.ReadFull(r, make([]byte, len(payload))); err != nil {
+				t.Fatal(err)
+			}
+			elapsed := time.Since(start)
+
+			minElapsed, maxElapsed := 400*time.Millisecond, time.Second
+			if elapsed < minElapsed || elapsed > maxElapsed {
+				t.Errorf("got: %v; want: between %v and %v", elapsed, minElapsed, maxElapsed)
+			}
+		})
+	}
+}
+
+func TestThrottledConn_Close(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2)
+
+	bytesPerSec := 1000
+	w := NewThrottledConn(wrapConn(c1), 0, bytesPerSec)
+
+	// The burst passes right away, every further chunk waits a second
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := w.Write(make([]byte, bytesPerSec*11))
+		errCh <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	w.Close()
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("got: nil; want: error")
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Write kept waiting after the connection was closed")
+	}
+}
+
+func TestThrottledConn_Unlimited(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	w := NewThrottledConn(wrapConn(c1), 0, 0)
+	payload := make([]byte, 1<<20)
+	go func() {
+		_, _ = w.Write(payload)
+	}()
+
+	start := time.Now()
+	if _, err := io.ReadFull(NewThrottledConn(wrapConn(c2), 0, 0), make([]byte, len(payload))); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("got: %v; want: less than %v", elapsed, 100*time.Millisecond)
+	}
+}
+
+func BenchmarkThrottledConn(b *testing.B) {
+	payload := make([]byte, 1<<20)
+
+	tt := []struct {
+		name     string
+		throttle func(c Conn) Conn
+	}{
+		{
+			name:     "Unthrottled",
+			throttle: func(c Conn) Conn { return c },
+		},
+		{
+			name: "Throttled",
+			throttle: func(c Conn) Conn {
+				// High enough to never wait so that only the overhead is measured
+				return NewThrottledConn(c, 1<<30, 1<<30)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		b.Run(tc.name, func(b *testing.B) {
+			client, c1 := net.Pipe()
+			c2, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go PipeContext(context.Background(), tc.throttle(wrapConn(c1)), wrapConn(c2))
+			go io.Copy(io.Discard, server)
+
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if _, err := client.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
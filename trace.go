@@ -0,0 +1,50 @@
+package infrared
+
+import (
+	"context"
+)
+
+// Names of the spans the gateway creates for every connection
+const (
+	SpanConnection = "infrared.connection"
+	SpanHandshake  = "infrared.handshake"
+	SpanDial       = "infrared.dial"
+)
+
+// Attributes of the connection span
+const (
+	AttributeServerAddress   = "server.address"
+	AttributePlayerName      = "player.name"
+	AttributeProtocolVersion = "protocol.version"
+	AttributeRequestType     = "mc.request_type"
+)
+
+// Tracer creates the spans of the connections a gateway handles.
+// The otel module of this repository implements it with OpenTelemetry.
+type Tracer interface {
+	// Start starts a span as child of the span in ctx and returns a context that holds the new span
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced operation of a connection
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// startSpan starts a span with tracer or returns a span that records nothing if tracer is nil
+func startSpan(ctx context.Context, tracer Tracer, name string) (context.Context, Span) {
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return tracer.Start(ctx, name)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+
+func (noopSpan) RecordError(err error) {}
+
+func (noopSpan) End() {}